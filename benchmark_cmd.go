@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/client"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type benchResult struct {
+	ops       int
+	elapsed   time.Duration
+	latencies []time.Duration // of the ops that succeeded
+	errors    map[string]int
+}
+
+func (r *benchResult) failures() int {
+	failures := 0
+	for _, count := range r.errors {
+		failures += count
+	}
+	return failures
+}
+
+// benchClient sends the requests of the benchmark: a write asks the
+// master for a fid, as upload does, then is one POST to /write, and a
+// read is one GET of /read from a node holding the volume.
+type benchClient struct {
+	client *client.Client
+	nodes  []string
+	scheme string
+	http   *http.Client
+	key    string
+	next   uint64
+}
+
+func (b *benchClient) node() string {
+	return b.nodes[atomic.AddUint64(&b.next, 1)%uint64(len(b.nodes))]
+}
+
+func (b *benchClient) do(req *http.Request, handle func(io.Reader) error) error {
+	if b.key != "" {
+		req.Header.Set(util.ClientKeyHeader, b.key)
+	}
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s %s: %d %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return handle(resp.Body)
+}
+
+func (b *benchClient) write(body []byte, contentType string, collection string) (*storage.FileId, error) {
+	a, err := b.client.Assign(background, collection, "")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", b.scheme+"://"+a.Url+"/write/"+a.Fid, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if a.Auth != "" {
+		req.Header.Set("Authorization", "Bearer "+a.Auth)
+	}
+	var fid *storage.FileId
+	err = b.do(req, func(r io.Reader) (err error) {
+		fid, err = client.ParseWriteResponse(r)
+		return
+	})
+	return fid, err
+}
+
+// leaders returns the leader, or else any node, of each volume of fids.
+func (b *benchClient) leaders(fids []*storage.FileId) map[storage.VolumeId]string {
+	nodes := make(map[storage.VolumeId]string)
+	for _, fid := range fids {
+		if fid == nil {
+			continue
+		}
+		if _, ok := nodes[fid.VolumeId]; ok {
+			continue
+		}
+		req, err := http.NewRequest("GET", b.scheme+"://"+b.node()+"/dir/lookup?volumeId="+fid.VolumeId.String(), nil)
+		if err != nil {
+			fatal(err)
+		}
+		var res struct {
+			Locations []struct {
+				Url    string
+				Leader bool
+			} `json:"locations"`
+		}
+		if err = b.do(req, func(r io.Reader) error { return json.NewDecoder(r).Decode(&res) }); err != nil {
+			fatal(err)
+		}
+		for _, l := range res.Locations {
+			if l.Leader || nodes[fid.VolumeId] == "" {
+				nodes[fid.VolumeId] = l.Url
+			}
+		}
+	}
+	return nodes
+}
+
+func (b *benchClient) read(node string, fid *storage.FileId) error {
+	u := fmt.Sprintf("%s://%s/read/%s/%d/%d/%d", b.scheme, node, fid.VolumeId.String(), fid.Offset, fid.Size, fid.Cookie)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	return b.do(req, func(r io.Reader) error {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	})
+}
+
+func runBenchmark(args []string) {
+	fs, nodes := clientFlags("benchmark", "[arguments]")
+	n := fs.Int("n", 10000, "number of files to write and read")
+	concurrency := fs.Int("c", 16, "number of concurrent writers and readers")
+	size := fs.Int("size", 10*1024, "payload size in bytes")
+	collection := fs.String("collection", "", "collection to write to")
+	read := fs.Bool("read", true, "read the files back after writing them")
+	fs.Parse(args)
+
+	b := &benchClient{
+		client: newClient(*nodes),
+		nodes:  strings.Split(*nodes, ","),
+		scheme: "http",
+		http:   &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}},
+		key:    os.Getenv("MCDFS_CLIENT_KEY"),
+	}
+	if config := clientTLS(); config != nil {
+		b.scheme = "https"
+		b.http.Transport.(*http.Transport).TLSClientConfig = config
+	}
+	payload := make([]byte, *size)
+	rand.Read(payload)
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, err := mw.CreateFormFile("file", "bench")
+	if err == nil {
+		part.Write(payload)
+		err = mw.Close()
+	}
+	if err != nil {
+		fatal(err)
+	}
+	body, contentType := buf.Bytes(), mw.FormDataContentType()
+	fids := make([]*storage.FileId, *n)
+
+	fmt.Printf("payload: %d bytes, concurrency: %d\n\n", *size, *concurrency)
+	res := bench(*n, *concurrency, func(i int) (err error) {
+		fids[i], err = b.write(body, contentType, *collection)
+		return
+	})
+	report("write", res, *size)
+	if !*read {
+		return
+	}
+	leaders := b.leaders(fids)
+	res = bench(*n, *concurrency, func(i int) error {
+		if fids[i] == nil {
+			return fmt.Errorf("not written")
+		}
+		return b.read(leaders[fids[i].VolumeId], fids[i])
+	})
+	report("read", res, *size)
+}
+
+// bench runs op for 0..n-1 on concurrency goroutines.
+func bench(n int, concurrency int, op func(i int) error) *benchResult {
+	res := &benchResult{ops: n, errors: make(map[string]int)}
+	latencies := make([]time.Duration, n)
+	failed := make([]bool, n)
+	var mutex sync.Mutex
+	var next int64 = -1
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				t := time.Now()
+				err := op(i)
+				latencies[i] = time.Since(t)
+				if err != nil {
+					failed[i] = true
+					mutex.Lock()
+					res.errors[err.Error()]++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	for i, latency := range latencies {
+		if !failed[i] {
+			res.latencies = append(res.latencies, latency)
+		}
+	}
+	return res
+}
+
+// report prints the throughput and latencies of the ops that succeeded,
+// then the errors of the others, most frequent first.
+func report(name string, res *benchResult, size int) {
+	sort.Slice(res.latencies, func(i, j int) bool { return res.latencies[i] < res.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(res.latencies) == 0 {
+			return 0
+		}
+		return res.latencies[int(float64(len(res.latencies)-1)*p)]
+	}
+	seconds := res.elapsed.Seconds()
+	ok := len(res.latencies)
+	fmt.Printf("%s via http\n", name)
+	fmt.Printf("%d ops in %.3fs, %d succeeded, %d failed\n", res.ops, seconds, ok, res.failures())
+	fmt.Printf("qps:%.2f, %.2f MB/s\n", float64(ok)/seconds, float64(ok*size)/seconds/(1<<20))
+	fmt.Printf("latency p50:%v p90:%v p99:%v max:%v\n",
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+	var errors []string
+	for msg := range res.errors {
+		errors = append(errors, msg)
+	}
+	sort.Slice(errors, func(i, j int) bool { return res.errors[errors[i]] > res.errors[errors[j]] })
+	for i, msg := range errors {
+		if i == 5 {
+			fmt.Printf("  and %d other errors\n", len(errors)-i)
+			break
+		}
+		fmt.Printf("  %d x %s\n", res.errors[msg], msg)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,232 @@
+// Package client talks to an MCDFS cluster: it asks the master where to
+// write, uploads, downloads and deletes needles, and fails over between
+// the nodes it knows about.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/Masterlvng/MCDFS/util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// StatusError is returned when a node answers with an unexpected status.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+}
+
+type Client struct {
+	nodes   []string
+	scheme  string
+	http    *http.Client
+	key     string
+	retries int
+	backoff time.Duration
+	mutex   sync.Mutex
+	leader  string
+}
+
+type Option func(*Client)
+
+func WithHTTPClient(c *http.Client) Option {
+	return func(cl *Client) { cl.http = c }
+}
+
+// WithTLS talks to the nodes over HTTPS with config.
+func WithTLS(config *tls.Config) Option {
+	return func(cl *Client) {
+		cl.scheme = "https"
+		cl.http = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+}
+
+// WithClientKey presents key to the nodes, which hand tokens to delete
+// and to read private collections to the clients with a key.
+func WithClientKey(key string) Option {
+	return func(cl *Client) { cl.key = key }
+}
+
+// WithRetries sets how many times a request is retried, on another node
+// when there is one, and how long to wait before the first retry; the wait
+// doubles with every retry.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(cl *Client) { cl.retries, cl.backoff = retries, backoff }
+}
+
+// New returns a client for the cluster made of nodes ("host:port").
+func New(nodes []string, options ...Option) *Client {
+	c := &Client{
+		nodes:   nodes,
+		scheme:  "http",
+		http:    http.DefaultClient,
+		retries: 3,
+		backoff: 100 * time.Millisecond,
+	}
+	for _, o := range options {
+		o(c)
+	}
+	return c
+}
+
+func (c *Client) url(node string, path string) string {
+	return c.scheme + "://" + node + path
+}
+
+// candidates returns the nodes to try for a metadata request, the known
+// leader first.
+func (c *Client) candidates() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.leader == "" {
+		return c.nodes
+	}
+	nodes := []string{c.leader}
+	for _, n := range c.nodes {
+		if n != c.leader {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func (c *Client) setLeader(leader string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.leader = leader
+}
+
+// Leader asks the nodes in turn which one leads the cluster.
+func (c *Client) Leader(ctx context.Context) (string, error) {
+	var res struct {
+		Leader string `json:"leader"`
+	}
+	err := c.do(ctx, c.nodes, func(node string) (*http.Request, error) {
+		return http.NewRequest("GET", c.url(node, "/leader"), nil)
+	}, func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&res)
+	})
+	if err != nil {
+		return "", err
+	}
+	c.setLeader(res.Leader)
+	return res.Leader, nil
+}
+
+// master sends a request to the metadata leader. Followers forward it, so
+// any node will do when the leader is unknown or down.
+func (c *Client) master(ctx context.Context, path string, v interface{}) error {
+	c.mutex.Lock()
+	known := c.leader != ""
+	c.mutex.Unlock()
+	if !known {
+		c.Leader(ctx)
+	}
+	err := c.do(ctx, c.candidates(), func(node string) (*http.Request, error) {
+		return http.NewRequest("GET", c.url(node, path), nil)
+	}, func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(v)
+	})
+	if err != nil {
+		c.setLeader("")
+	}
+	return err
+}
+
+// do tries the request on nodes in turn, going round them again until the
+// retries are spent. Client errors are not retried.
+func (c *Client) do(ctx context.Context, nodes []string, newRequest func(node string) (*http.Request, error), handle func(*http.Response) error) error {
+	if len(nodes) == 0 {
+		return errors.New("no nodes")
+	}
+	var err error
+	backoff := c.backoff
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		var req *http.Request
+		if req, err = newRequest(nodes[attempt%len(nodes)]); err != nil {
+			return err
+		}
+		if id := util.RequestId(ctx); id != "" {
+			req.Header.Set(util.RequestIdHeader, id)
+		}
+		if c.key != "" {
+			req.Header.Set(util.ClientKeyHeader, c.key)
+		}
+		var resp *http.Response
+		if resp, err = c.http.Do(req.WithContext(ctx)); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		err = checkResponse(resp)
+		if err == nil {
+			err = handle(resp)
+		}
+		resp.Body.Close()
+		if wait := retryAfter(resp); wait > backoff {
+			backoff = wait
+		}
+		if se, ok := err.(*StatusError); ok && se.StatusCode < 500 && se.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+		if err == nil || err == ErrNotFound {
+			return err
+		}
+	}
+	return err
+}
+
+// retryAfter returns how long an overloaded node asked to wait.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{resp.StatusCode, strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+// Status returns the nodes the master has heard from lately.
+func (c *Client) Status(ctx context.Context) ([]*cluster.DataNode, error) {
+	var nodes []*cluster.DataNode
+	err := c.master(ctx, "/dir/status", &nodes)
+	return nodes, err
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode answers with its statuses in turn, the last one from then on,
+// and counts the requests it gets. A node without statuses is down.
+type fakeNode struct {
+	statuses []int
+	mutex    sync.Mutex
+	hits     int
+	addr     string
+}
+
+func startFakeNode(t *testing.T, statuses ...int) *fakeNode {
+	f := &fakeNode{statuses: statuses}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		f.mutex.Lock()
+		status := f.statuses[len(f.statuses)-1]
+		if f.hits < len(f.statuses) {
+			status = f.statuses[f.hits]
+		}
+		f.hits++
+		f.mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	f.addr = strings.TrimPrefix(srv.URL, "http://")
+	if len(statuses) == 0 {
+		srv.Close()
+	} else {
+		t.Cleanup(srv.Close)
+	}
+	return f
+}
+
+func TestDoRetriesAndFailsOver(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodes    [][]int
+		retries  int
+		wantHits []int
+		wantErr  string
+	}{
+		{"first node answers", [][]int{{200}, {200}}, 3, []int{1, 0}, ""},
+		{"first node down", [][]int{nil, {200}}, 3, []int{0, 1}, ""},
+		{"server error on another node", [][]int{{500}, {200}}, 3, []int{1, 1}, ""},
+		{"server error retried on the only node", [][]int{{503, 502, 200}}, 3, []int{3}, ""},
+		{"overloaded node retried", [][]int{{429, 200}}, 3, []int{2}, ""},
+		{"client error not retried", [][]int{{400}, {200}}, 3, []int{1, 0}, "400"},
+		{"not found not retried", [][]int{{404}, {200}}, 3, []int{1, 0}, ErrNotFound.Error()},
+		{"retries spent", [][]int{{500}, {500}}, 2, []int{2, 1}, "500"},
+		{"every node down", [][]int{nil, nil}, 2, []int{0, 0}, "connection refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nodes []*fakeNode
+			var addrs []string
+			for _, statuses := range tt.nodes {
+				f := startFakeNode(t, statuses...)
+				nodes = append(nodes, f)
+				addrs = append(addrs, f.addr)
+			}
+			c := New(addrs, WithRetries(tt.retries, time.Millisecond))
+			err := c.do(context.Background(), addrs, func(node string) (*http.Request, error) {
+				return http.NewRequest("GET", c.url(node, "/status"), nil)
+			}, func(resp *http.Response) error {
+				return nil
+			})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("do() = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("do() = %v, want %q", err, tt.wantErr)
+			}
+			for i, f := range nodes {
+				if f.hits != tt.wantHits[i] {
+					t.Errorf("node %d got %d requests, want %d", i, f.hits, tt.wantHits[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDoStopsWhenTheContextIsDone(t *testing.T) {
+	f := startFakeNode(t, 500)
+	c := New([]string{f.addr}, WithRetries(10, time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := c.do(ctx, c.nodes, func(node string) (*http.Request, error) {
+		return http.NewRequest("GET", c.url(node, "/status"), nil)
+	}, func(resp *http.Response) error {
+		return nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("do() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if f.hits != 1 {
+		t.Errorf("%d requests, want 1", f.hits)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		status int
+		header string
+		want   time.Duration
+	}{
+		{http.StatusTooManyRequests, "2", 2 * time.Second},
+		{http.StatusServiceUnavailable, "1", time.Second},
+		{http.StatusTooManyRequests, "", 0},
+		{http.StatusTooManyRequests, "Wed, 21 Oct 2015 07:28:00 GMT", 0},
+		{http.StatusInternalServerError, "2", 0},
+		{http.StatusOK, "2", 0},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		if got := retryAfter(resp); got != tt.want {
+			t.Errorf("retryAfter(%d, %q) = %v, want %v", tt.status, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	tests := []struct {
+		leader string
+		want   []string
+	}{
+		{"", []string{"a", "b", "c"}},
+		{"b", []string{"b", "a", "c"}},
+		{"d", []string{"d", "a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		c := New([]string{"a", "b", "c"})
+		c.setLeader(tt.leader)
+		if got := c.candidates(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("candidates() with leader %q = %v, want %v", tt.leader, got, tt.want)
+		}
+	}
+}
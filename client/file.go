@@ -0,0 +1,323 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type UploadOptions struct {
+	FileName   string
+	MimeType   string
+	Collection string
+	Ttl        string
+}
+
+type FileInfo struct {
+	Size         int64
+	Name         string
+	MimeType     string
+	LastModified time.Time
+}
+
+// Assignment is a fid handed out by the master ("vid,cookie"), the node
+// to write it to and, when writes need one, the token to write it with.
+type Assignment struct {
+	Fid  string `json:"fid"`
+	Url  string `json:"url"`
+	Auth string `json:"auth"`
+}
+
+// Assign asks the master for a fid of a writable volume of collection and
+// ttl, both optional.
+func (c *Client) Assign(ctx context.Context, collection string, ttl string) (*Assignment, error) {
+	q := url.Values{}
+	if collection != "" {
+		q.Set("collection", collection)
+	}
+	if ttl != "" {
+		q.Set("ttl", ttl)
+	}
+	a := &Assignment{}
+	if err := c.master(ctx, "/dir/assign?"+q.Encode(), a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Upload asks the master for a fid and writes r to the node holding the
+// volume; the returned fid is what Download, Stat and Delete take.
+func (c *Client) Upload(ctx context.Context, r io.Reader, opts UploadOptions) (*storage.FileId, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	a, err := c.Assign(ctx, opts.Collection, opts.Ttl)
+	if err != nil {
+		return nil, err
+	}
+	vid, _, err := storage.ParseAssignedId(a.Fid)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := c.lookup(ctx, vid, a.Url)
+	if err != nil {
+		return nil, err
+	}
+	body, contentType, err := multipartBody(data, opts)
+	if err != nil {
+		return nil, err
+	}
+	var fid *storage.FileId
+	err = c.do(ctx, loc.nodes, func(node string) (*http.Request, error) {
+		u := c.url(node, "/write/"+a.Fid)
+		if opts.Ttl != "" {
+			u += "?ttl=" + url.QueryEscape(opts.Ttl)
+		}
+		req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", contentType)
+			bearer(req, a.Auth)
+		}
+		return req, err
+	}, func(resp *http.Response) (err error) {
+		fid, err = ParseWriteResponse(resp.Body)
+		return
+	})
+	return fid, err
+}
+
+func multipartBody(data []byte, opts UploadOptions) ([]byte, string, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, opts.FileName))
+	if opts.MimeType != "" {
+		h.Set("Content-Type", opts.MimeType)
+	}
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err = part.Write(data); err != nil {
+		return nil, "", err
+	}
+	if err = mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mw.FormDataContentType(), nil
+}
+
+// ParseWriteResponse reads the answer of /write: the volume id followed by
+// the JSON of the write result.
+func ParseWriteResponse(r io.Reader) (*storage.FileId, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.IndexByte(content, '{')
+	if i < 0 {
+		return nil, fmt.Errorf("unexpected write response %q", content)
+	}
+	var res struct {
+		Vid    uint64
+		Cookie uint32
+		Offset uint64
+		Size   uint32
+	}
+	if err = json.Unmarshal(content[i:], &res); err != nil {
+		return nil, err
+	}
+	vid, err := storage.NewVolumeId(string(content[:i]))
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewFileId(vid, res.Offset, res.Size, res.Cookie), nil
+}
+
+// location is where a volume lives.
+type location struct {
+	nodes []string
+}
+
+// lookup returns the nodes holding vid, the group leader first, and
+// prefer ahead of the others when it holds the volume too.
+func (c *Client) lookup(ctx context.Context, vid storage.VolumeId, prefer string) (*location, error) {
+	var res struct {
+		Locations []struct {
+			Url    string
+			Leader bool
+		} `json:"locations"`
+	}
+	if err := c.master(ctx, "/dir/lookup?volumeId="+vid.String(), &res); err != nil {
+		if prefer != "" && err == ErrNotFound {
+			return &location{nodes: []string{prefer}}, nil
+		}
+		return nil, err
+	}
+	var nodes []string
+	if prefer != "" {
+		nodes = append(nodes, prefer)
+	}
+	for _, l := range res.Locations {
+		if l.Leader && l.Url != prefer {
+			nodes = append(nodes, l.Url)
+		}
+	}
+	for _, l := range res.Locations {
+		if !l.Leader && l.Url != prefer {
+			nodes = append(nodes, l.Url)
+		}
+	}
+	return &location{nodes: nodes}, nil
+}
+
+// token asks for a token to "delete" or "read" fid. It is empty when the
+// cluster needs none.
+func (c *Client) token(ctx context.Context, fid *storage.FileId, op string) (string, error) {
+	var res struct {
+		Auth string `json:"auth"`
+	}
+	path := fmt.Sprintf("/dir/token?fid=%s&op=%s", url.QueryEscape(fid.String()), op)
+	if err := c.master(ctx, path, &res); err != nil {
+		return "", err
+	}
+	return res.Auth, nil
+}
+
+// withReadToken runs read without a token, and again with one when the
+// node asks for it, as private collections do.
+func (c *Client) withReadToken(ctx context.Context, fid *storage.FileId, read func(token string) error) error {
+	err := read("")
+	if se, ok := err.(*StatusError); !ok || se.StatusCode != http.StatusUnauthorized {
+		return err
+	}
+	token, terr := c.token(ctx, fid, "read")
+	if terr != nil || token == "" {
+		return err
+	}
+	return read(token)
+}
+
+// bearer authorizes req with token, when there is one.
+func bearer(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func readPath(fid *storage.FileId) string {
+	return fid.VolumeId.String() + "/" + strconv.FormatUint(fid.Offset, 10) + "/" +
+		strconv.FormatUint(uint64(fid.Size), 10) + "/" + strconv.FormatUint(uint64(fid.Cookie), 10)
+}
+
+// Download writes the content of fid to w, reading from any replica.
+func (c *Client) Download(ctx context.Context, fid *storage.FileId, w io.Writer) error {
+	return c.Read(ctx, fid, "", w)
+}
+
+// Read is Download at a read consistency level: "local", "leader" or
+// "linearizable", see the server package.
+func (c *Client) Read(ctx context.Context, fid *storage.FileId, consistency string, w io.Writer) error {
+	loc, err := c.lookup(ctx, fid.VolumeId, "")
+	if err != nil {
+		return err
+	}
+	u := "/read/" + readPath(fid)
+	if consistency != "" {
+		u += "?consistency=" + url.QueryEscape(consistency)
+	}
+	var buf bytes.Buffer
+	err = c.withReadToken(ctx, fid, func(token string) error {
+		return c.do(ctx, loc.nodes, func(node string) (*http.Request, error) {
+			req, err := http.NewRequest("GET", c.url(node, u), nil)
+			if err == nil {
+				bearer(req, token)
+			}
+			return req, err
+		}, func(resp *http.Response) error {
+			buf.Reset()
+			_, err := io.Copy(&buf, resp.Body)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// Stat returns what is known about fid without downloading it.
+func (c *Client) Stat(ctx context.Context, fid *storage.FileId) (*FileInfo, error) {
+	loc, err := c.lookup(ctx, fid.VolumeId, "")
+	if err != nil {
+		return nil, err
+	}
+	info := &FileInfo{}
+	err = c.withReadToken(ctx, fid, func(token string) error {
+		return c.do(ctx, loc.nodes, func(node string) (*http.Request, error) {
+			req, err := http.NewRequest("HEAD", c.url(node, "/read/"+readPath(fid)), nil)
+			if err == nil {
+				bearer(req, token)
+			}
+			return req, err
+		}, func(resp *http.Response) error {
+			info.Size = resp.ContentLength
+			info.MimeType = resp.Header.Get("Content-Type")
+			if d := resp.Header.Get("Content-Disposition"); d != "" {
+				if i := strings.Index(d, "filename="); i >= 0 {
+					info.Name, _ = strconv.Unquote(d[i+len("filename="):])
+				}
+			}
+			info.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+			return nil
+		})
+	})
+	return info, err
+}
+
+// Presign returns a URL that reads fid without a token until expires has
+// passed. The cluster must have URL keys.
+func (c *Client) Presign(ctx context.Context, fid *storage.FileId, expires time.Duration) (string, error) {
+	var res struct {
+		Url string `json:"url"`
+	}
+	path := fmt.Sprintf("/dir/presign?fid=%s&expires=%d", url.QueryEscape(fid.String()), int64(expires/time.Second))
+	if err := c.master(ctx, path, &res); err != nil {
+		return "", err
+	}
+	return res.Url, nil
+}
+
+// Delete deletes fid through the leader of its volume group.
+func (c *Client) Delete(ctx context.Context, fid *storage.FileId) error {
+	loc, err := c.lookup(ctx, fid.VolumeId, "")
+	if err != nil {
+		return err
+	}
+	token, err := c.token(ctx, fid, "delete")
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, loc.nodes, func(node string) (*http.Request, error) {
+		req, err := http.NewRequest("DELETE", c.url(node, "/delete/"+readPath(fid)), nil)
+		if err == nil {
+			bearer(req, token)
+		}
+		return req, err
+	}, func(resp *http.Response) error {
+		return nil
+	})
+}
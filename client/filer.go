@@ -0,0 +1,131 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/Masterlvng/MCDFS/filer"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+// Filer requests can go to any node: the node applies changes through the
+// leader and serves reads from its own copy of the namespace.
+
+func (c *Client) filerUrl(node string, p string, q url.Values) string {
+	u := c.url(node, "/filer"+(&url.URL{Path: filer.Clean(p)}).EscapedPath())
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
+
+func (c *Client) filer(ctx context.Context, method string, p string, q url.Values, body []byte, contentType string, handle func(*http.Response) error) error {
+	return c.do(ctx, c.candidates(), func(node string) (*http.Request, error) {
+		req, err := http.NewRequest(method, c.filerUrl(node, p, q), bytes.NewReader(body))
+		if err == nil && contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return req, err
+	}, handle)
+}
+
+func decodeJson(v interface{}) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+}
+
+func discard(resp *http.Response) error {
+	_, err := io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// FilerEntry returns the entry at p.
+func (c *Client) FilerEntry(ctx context.Context, p string) (*filer.Entry, error) {
+	e := &filer.Entry{}
+	err := c.filer(ctx, "GET", p, url.Values{"meta": {"true"}}, nil, "", decodeJson(e))
+	return e, err
+}
+
+// FilerList returns all the entries of the directory dir.
+func (c *Client) FilerList(ctx context.Context, dir string) ([]*filer.Entry, error) {
+	var entries []*filer.Entry
+	after := ""
+	for {
+		var listing struct {
+			Entries []*filer.Entry
+		}
+		err := c.filer(ctx, "GET", dir, url.Values{"after": {after}}, nil, "", decodeJson(&listing))
+		if err != nil {
+			return nil, err
+		}
+		if len(listing.Entries) == 0 {
+			return entries, nil
+		}
+		entries = append(entries, listing.Entries...)
+		after = listing.Entries[len(listing.Entries)-1].Name()
+	}
+}
+
+// FilerRead writes the content of the file at p to w.
+func (c *Client) FilerRead(ctx context.Context, p string, w io.Writer) error {
+	var buf bytes.Buffer
+	err := c.filer(ctx, "GET", p, nil, nil, "", func(resp *http.Response) error {
+		buf.Reset()
+		_, err := io.Copy(&buf, resp.Body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// FilerWrite stores r as the file at p, replacing what was there.
+func (c *Client) FilerWrite(ctx context.Context, p string, r io.Reader, opts UploadOptions) (*filer.Entry, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", opts.FileName)
+	if err != nil {
+		return nil, err
+	}
+	part.Write(data)
+	mw.Close()
+	q := url.Values{}
+	if opts.Collection != "" {
+		q.Set("collection", opts.Collection)
+	}
+	if opts.Ttl != "" {
+		q.Set("ttl", opts.Ttl)
+	}
+	e := &filer.Entry{}
+	err = c.filer(ctx, "POST", p, q, body.Bytes(), mw.FormDataContentType(), decodeJson(e))
+	return e, err
+}
+
+// FilerDelete removes the file or directory at p; a directory that is not
+// empty needs recursive.
+func (c *Client) FilerDelete(ctx context.Context, p string, recursive bool) error {
+	q := url.Values{}
+	if recursive {
+		q.Set("recursive", "true")
+	}
+	return c.filer(ctx, "DELETE", p, q, nil, "", discard)
+}
+
+func (c *Client) FilerMkdir(ctx context.Context, p string) error {
+	return c.filer(ctx, "POST", p, url.Values{"mkdir": {"true"}}, nil, "", discard)
+}
+
+func (c *Client) FilerRename(ctx context.Context, from string, to string) error {
+	return c.filer(ctx, "POST", from, url.Values{"rename": {filer.Clean(to)}}, nil, "", discard)
+}
@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"github.com/Masterlvng/MCDFS/storage"
+	"sort"
+	"sync"
+)
+
+// GroupTable is the state of the metadata raft group: for every volume
+// group it records the nodes hosting a replica, by name and connection
+// string. It also keeps the largest volume id ever hosted, so that the id
+// of a group that was dropped, e.g. once its volume was erasure coded, is
+// not handed out again.
+type GroupTable struct {
+	mutex sync.RWMutex
+	hosts map[storage.VolumeId]map[string]string
+	max   storage.VolumeId
+}
+
+func NewGroupTable() *GroupTable {
+	return &GroupTable{hosts: make(map[storage.VolumeId]map[string]string)}
+}
+
+func (t *GroupTable) Host(vid storage.VolumeId, name string, connectionString string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.hosts[vid] == nil {
+		t.hosts[vid] = make(map[string]string)
+	}
+	t.hosts[vid][name] = connectionString
+	if vid > t.max {
+		t.max = vid
+	}
+}
+
+func (t *GroupTable) Unhost(vid storage.VolumeId, name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.hosts[vid], name)
+	if len(t.hosts[vid]) == 0 {
+		delete(t.hosts, vid)
+	}
+}
+
+// Hosts returns a copy of name -> connection string for the group.
+func (t *GroupTable) Hosts(vid storage.VolumeId) map[string]string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	hosts := make(map[string]string, len(t.hosts[vid]))
+	for name, cs := range t.hosts[vid] {
+		hosts[name] = cs
+	}
+	return hosts
+}
+
+// MaxVolumeId returns the largest volume id a group was ever hosted
+// under.
+func (t *GroupTable) MaxVolumeId() storage.VolumeId {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.max
+}
+
+func (t *GroupTable) Groups() []storage.VolumeId {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	vids := make([]storage.VolumeId, 0, len(t.hosts))
+	for vid := range t.hosts {
+		vids = append(vids, vid)
+	}
+	sort.Sort(storage.VolumeIds(vids))
+	return vids
+}
+
+// Snapshot returns the whole table keyed by volume id string, ready to be
+// encoded as JSON.
+func (t *GroupTable) Snapshot() map[string]map[string]string {
+	snapshot := make(map[string]map[string]string)
+	for _, vid := range t.Groups() {
+		snapshot[vid.String()] = t.Hosts(vid)
+	}
+	return snapshot
+}
+
+// Restore replaces the table with a snapshot taken by Snapshot and the
+// MaxVolumeId of the table it was taken from.
+func (t *GroupTable) Restore(snapshot map[string]map[string]string, max storage.VolumeId) error {
+	hosts := make(map[storage.VolumeId]map[string]string, len(snapshot))
+	for id, names := range snapshot {
+		vid, err := storage.NewVolumeId(id)
+		if err != nil {
+			return err
+		}
+		if vid > max {
+			max = vid
+		}
+		hosts[vid] = make(map[string]string, len(names))
+		for name, cs := range names {
+			hosts[vid][name] = cs
+		}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.hosts, t.max = hosts, max
+	return nil
+}
@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	"github.com/Masterlvng/MCDFS/storage"
+	"testing"
+	"time"
+)
+
+func TestGroupTableMaxVolumeId(t *testing.T) {
+	table := NewGroupTable()
+	table.Host(3, "a", "http://a")
+	table.Host(7, "a", "http://a")
+	table.Host(7, "b", "http://b")
+	// Dropping the group of the largest id, as erasure coding does,
+	// keeps the id from being handed out again.
+	table.Unhost(7, "a")
+	table.Unhost(7, "b")
+	if got := table.MaxVolumeId(); got != 7 {
+		t.Errorf("MaxVolumeId() = %d, want 7", got)
+	}
+
+	restored := NewGroupTable()
+	if err := restored.Restore(table.Snapshot(), table.MaxVolumeId()); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.MaxVolumeId(); got != 7 {
+		t.Errorf("restored MaxVolumeId() = %d, want 7", got)
+	}
+	// Snapshots taken before the id was kept have none.
+	if err := restored.Restore(table.Snapshot(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.MaxVolumeId(); got != 3 {
+		t.Errorf("MaxVolumeId() of an older snapshot = %d, want 3", got)
+	}
+}
+
+func TestTopologyMaxVolumeId(t *testing.T) {
+	topo := NewTopology(time.Minute)
+	topo.Register(&DataNode{Name: "a", Volumes: []storage.VolumeInfo{{Id: 2}, {Id: 4}}})
+	topo.Register(&DataNode{Name: "b", EcShards: map[storage.VolumeId][]int{9: {0, 1}}})
+	if got := topo.MaxVolumeId(); got != 9 {
+		t.Errorf("MaxVolumeId() = %d, want 9", got)
+	}
+}
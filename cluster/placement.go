@@ -0,0 +1,170 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ReplicaPlacement says where the copies of a volume live relative to the
+// first one, e.g. "same rack 1, different rack 1, different dc 0" keeps
+// three copies: two on one rack and one on another rack of the same data
+// center.
+type ReplicaPlacement struct {
+	SameRack       int
+	DiffRack       int
+	DiffDataCenter int
+}
+
+func NewReplicaPlacement(policy string) (*ReplicaPlacement, error) {
+	rp := &ReplicaPlacement{}
+	if strings.TrimSpace(policy) == "" {
+		return rp, nil
+	}
+	for _, item := range strings.Split(policy, ",") {
+		words := strings.Fields(strings.ToLower(item))
+		if len(words) != 3 {
+			return nil, fmt.Errorf("invalid placement %q", item)
+		}
+		count, err := strconv.Atoi(words[2])
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid count in %q", item)
+		}
+		switch words[0] + " " + words[1] {
+		case "same rack":
+			rp.SameRack = count
+		case "different rack", "diff rack":
+			rp.DiffRack = count
+		case "different dc", "diff dc":
+			rp.DiffDataCenter = count
+		default:
+			return nil, fmt.Errorf("invalid placement %q", item)
+		}
+	}
+	return rp, nil
+}
+
+func (rp *ReplicaPlacement) String() string {
+	return fmt.Sprintf("same rack %d, different rack %d, different dc %d", rp.SameRack, rp.DiffRack, rp.DiffDataCenter)
+}
+
+func (rp *ReplicaPlacement) Copies() int {
+	return 1 + rp.SameRack + rp.DiffRack + rp.DiffDataCenter
+}
+
+// Place picks the nodes for a new volume, least loaded first. The first
+// node returned is the one the others are placed relative to.
+func (rp *ReplicaPlacement) Place(nodes []*DataNode) ([]*DataNode, error) {
+	candidates := make([]*DataNode, len(nodes))
+	copy(candidates, nodes)
+	sort.Stable(byLoad(candidates))
+	for _, main := range candidates {
+		var sameRack, diffRack, diffDataCenter []*DataNode
+		racks, dataCenters := make(map[string]bool), make(map[string]bool)
+		for _, n := range candidates {
+			switch {
+			case n == main:
+			case n.DataCenter != main.DataCenter:
+				if !dataCenters[n.DataCenter] {
+					dataCenters[n.DataCenter] = true
+					diffDataCenter = append(diffDataCenter, n)
+				}
+			case n.Rack != main.Rack:
+				if !racks[n.Rack] {
+					racks[n.Rack] = true
+					diffRack = append(diffRack, n)
+				}
+			default:
+				sameRack = append(sameRack, n)
+			}
+		}
+		if len(sameRack) < rp.SameRack || len(diffRack) < rp.DiffRack || len(diffDataCenter) < rp.DiffDataCenter {
+			continue
+		}
+		placed := []*DataNode{main}
+		placed = append(placed, sameRack[:rp.SameRack]...)
+		placed = append(placed, diffRack[:rp.DiffRack]...)
+		placed = append(placed, diffDataCenter[:rp.DiffDataCenter]...)
+		return placed, nil
+	}
+	return nil, fmt.Errorf("not enough nodes for %s", rp.String())
+}
+
+// Satisfied reports whether the nodes holding a volume match the placement.
+func (rp *ReplicaPlacement) Satisfied(nodes []*DataNode) bool {
+	if len(nodes) != rp.Copies() {
+		return false
+	}
+	for _, main := range nodes {
+		sameRack := 0
+		racks, dataCenters := make(map[string]bool), make(map[string]bool)
+		for _, n := range nodes {
+			switch {
+			case n == main:
+			case n.DataCenter != main.DataCenter:
+				dataCenters[n.DataCenter] = true
+			case n.Rack != main.Rack:
+				racks[n.Rack] = true
+			default:
+				sameRack++
+			}
+		}
+		if sameRack == rp.SameRack && len(racks) == rp.DiffRack && len(dataCenters) == rp.DiffDataCenter {
+			return true
+		}
+	}
+	return false
+}
+
+type byLoad []*DataNode
+
+func (s byLoad) Len() int           { return len(s) }
+func (s byLoad) Less(i, j int) bool { return len(s[i].Volumes) < len(s[j].Volumes) }
+func (s byLoad) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// PolicyTable holds the replication policy of every collection. It is part
+// of the metadata group state.
+type PolicyTable struct {
+	mutex    sync.RWMutex
+	policies map[string]string
+}
+
+func NewPolicyTable() *PolicyTable {
+	return &PolicyTable{policies: make(map[string]string)}
+}
+
+func (t *PolicyTable) Set(collection string, policy string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.policies[collection] = policy
+}
+
+// Get returns the collection's policy and whether one was set.
+func (t *PolicyTable) Get(collection string) (string, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	policy, ok := t.policies[collection]
+	return policy, ok
+}
+
+func (t *PolicyTable) Snapshot() map[string]string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	snapshot := make(map[string]string, len(t.policies))
+	for collection, policy := range t.policies {
+		snapshot[collection] = policy
+	}
+	return snapshot
+}
+
+// Restore replaces the table with a snapshot.
+func (t *PolicyTable) Restore(snapshot map[string]string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.policies = make(map[string]string, len(snapshot))
+	for collection, policy := range snapshot {
+		t.policies[collection] = policy
+	}
+}
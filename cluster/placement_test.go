@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"strings"
+	"testing"
+)
+
+// testNodes makes a node per "dc/rack/volumes" spec, named after its
+// index.
+func testNodes(specs ...string) []*DataNode {
+	var nodes []*DataNode
+	for i, spec := range specs {
+		parts := strings.Split(spec, "/")
+		n := &DataNode{Name: fmt.Sprint(i), DataCenter: parts[0], Rack: parts[1]}
+		var volumes int
+		fmt.Sscan(parts[2], &volumes)
+		for v := 0; v < volumes; v++ {
+			n.Volumes = append(n.Volumes, storage.VolumeInfo{Id: storage.VolumeId(v + 1)})
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func names(nodes []*DataNode) string {
+	var s []string
+	for _, n := range nodes {
+		s = append(s, n.Name)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestNewReplicaPlacement(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    ReplicaPlacement
+		wantErr bool
+	}{
+		{"", ReplicaPlacement{}, false},
+		{"same rack 1", ReplicaPlacement{SameRack: 1}, false},
+		{"Same Rack 1, diff rack 2, different dc 1", ReplicaPlacement{1, 2, 1}, false},
+		{"different rack 1,diff dc 0", ReplicaPlacement{DiffRack: 1}, false},
+		{"same rack", ReplicaPlacement{}, true},
+		{"same rack -1", ReplicaPlacement{}, true},
+		{"same rack one", ReplicaPlacement{}, true},
+		{"same node 1", ReplicaPlacement{}, true},
+		{"same rack 1,", ReplicaPlacement{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			rp, err := NewReplicaPlacement(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewReplicaPlacement() = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && *rp != tt.want {
+				t.Errorf("NewReplicaPlacement() = %+v, want %+v", *rp, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlace(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		nodes   []string
+		want    string
+		wantErr bool
+	}{
+		{"one copy on the least loaded node", "", []string{"dc1/r1/3", "dc1/r1/1", "dc1/r2/2"}, "1", false},
+		{"same rack", "same rack 1", []string{"dc1/r1/0", "dc1/r2/0", "dc1/r1/5"}, "0,2", false},
+		{"different rack", "diff rack 1", []string{"dc1/r1/0", "dc1/r1/1", "dc1/r2/2"}, "0,2", false},
+		{"different data center", "diff dc 1", []string{"dc1/r1/0", "dc1/r2/0", "dc2/r1/4"}, "0,2", false},
+		{"one rack per copy", "diff rack 2", []string{"dc1/r1/0", "dc1/r2/0", "dc1/r2/1", "dc1/r3/1"}, "0,1,3", false},
+		{"the least loaded node cannot lead", "same rack 1", []string{"dc1/r1/0", "dc1/r2/1", "dc1/r2/2"}, "1,2", false},
+		{"every level", "same rack 1, diff rack 1, diff dc 1", []string{"dc1/r1/0", "dc1/r1/0", "dc1/r2/0", "dc2/r1/0"}, "0,1,2,3", false},
+		{"not enough racks", "diff rack 1", []string{"dc1/r1/0", "dc1/r1/0"}, "", true},
+		{"not enough data centers", "diff dc 1", []string{"dc1/r1/0", "dc1/r2/0"}, "", true},
+		{"no nodes", "", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp, err := NewReplicaPlacement(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			placed, err := rp.Place(testNodes(tt.nodes...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Place() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := names(placed); got != tt.want {
+				t.Errorf("Place() = %s, want %s", got, tt.want)
+			}
+			if !rp.Satisfied(placed) {
+				t.Errorf("Satisfied(Place()) = false")
+			}
+		})
+	}
+}
+
+func TestSatisfied(t *testing.T) {
+	tests := []struct {
+		policy string
+		nodes  []string
+		want   bool
+	}{
+		{"", []string{"dc1/r1/0"}, true},
+		{"", []string{"dc1/r1/0", "dc1/r1/0"}, false},
+		{"same rack 1", []string{"dc1/r1/0", "dc1/r1/0"}, true},
+		{"same rack 1", []string{"dc1/r1/0", "dc1/r2/0"}, false},
+		{"diff rack 1", []string{"dc1/r1/0", "dc1/r2/0"}, true},
+		{"diff rack 2", []string{"dc1/r1/0", "dc1/r2/0", "dc1/r2/0"}, false},
+		{"diff dc 1", []string{"dc1/r1/0", "dc2/r1/0"}, true},
+		{"diff dc 1", []string{"dc1/r1/0", "dc1/r2/0"}, false},
+		{"same rack 1, diff dc 1", []string{"dc2/r1/0", "dc1/r1/0", "dc1/r1/0"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s on %v", tt.policy, tt.nodes), func(t *testing.T) {
+			rp, err := NewReplicaPlacement(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rp.Satisfied(testNodes(tt.nodes...)); got != tt.want {
+				t.Errorf("Satisfied() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
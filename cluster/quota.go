@@ -0,0 +1,123 @@
+package cluster
+
+import (
+	"github.com/Masterlvng/MCDFS/storage"
+	"sort"
+	"sync"
+)
+
+// Quota limits what a collection stores; a zero field means no limit.
+type Quota struct {
+	MaxBytes uint64 `json:"maxBytes,omitempty"`
+	MaxFiles uint64 `json:"maxFiles,omitempty"`
+}
+
+// QuotaTable holds the quota of every collection. It is part of the
+// metadata group state.
+type QuotaTable struct {
+	mutex  sync.RWMutex
+	quotas map[string]Quota
+}
+
+func NewQuotaTable() *QuotaTable {
+	return &QuotaTable{quotas: make(map[string]Quota)}
+}
+
+// Set sets the quota of collection; a zero quota removes it.
+func (t *QuotaTable) Set(collection string, q Quota) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if q == (Quota{}) {
+		delete(t.quotas, collection)
+		return
+	}
+	t.quotas[collection] = q
+}
+
+func (t *QuotaTable) Get(collection string) (Quota, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	q, ok := t.quotas[collection]
+	return q, ok
+}
+
+func (t *QuotaTable) Snapshot() map[string]Quota {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	snapshot := make(map[string]Quota, len(t.quotas))
+	for collection, q := range t.quotas {
+		snapshot[collection] = q
+	}
+	return snapshot
+}
+
+// Restore replaces the table with a snapshot.
+func (t *QuotaTable) Restore(snapshot map[string]Quota) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.quotas = make(map[string]Quota, len(snapshot))
+	for collection, q := range snapshot {
+		t.quotas[collection] = q
+	}
+}
+
+// Usage is what a collection stores: the live bytes and files of its
+// volumes, counted once however many replicas they have.
+type Usage struct {
+	Collection string `json:"collection"`
+	Bytes      uint64 `json:"bytes"`
+	Files      uint64 `json:"files"`
+	Volumes    int    `json:"volumes"`
+	Quota      *Quota `json:"quota,omitempty"`
+}
+
+// Allows reports whether the collection has room for one more file of
+// size bytes under q.
+func (u *Usage) Allows(q Quota, size uint64) bool {
+	if q.MaxBytes > 0 && u.Bytes+size > q.MaxBytes {
+		return false
+	}
+	return q.MaxFiles == 0 || u.Files < q.MaxFiles
+}
+
+// Usage returns the usage of every collection, sorted by name. Replicas
+// of a volume report at different times, so the largest report counts.
+// An erasure coded volume counts once, however many nodes hold shards of
+// it, and a tiered volume counts what it stores on its tier.
+func (t *Topology) Usage() []*Usage {
+	volumes := make(map[storage.VolumeId]storage.VolumeInfo)
+	add := func(v storage.VolumeInfo) {
+		if seen, ok := volumes[v.Id]; !ok || v.Size > seen.Size {
+			volumes[v.Id] = v
+		}
+	}
+	for _, n := range t.Nodes() {
+		for _, v := range n.Volumes {
+			add(v)
+		}
+		for _, v := range n.EcVolumes {
+			add(v)
+		}
+	}
+	usage := make(map[string]*Usage)
+	for _, v := range volumes {
+		u := usage[v.Collection]
+		if u == nil {
+			u = &Usage{Collection: v.Collection}
+			usage[v.Collection] = u
+		}
+		u.Volumes++
+		if v.Size > v.DeletedByteCount {
+			u.Bytes += v.Size - v.DeletedByteCount
+		}
+		if v.FileCount > v.DeleteCount {
+			u.Files += uint64(v.FileCount - v.DeleteCount)
+		}
+	}
+	var res []*Usage
+	for _, u := range usage {
+		res = append(res, u)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Collection < res[j].Collection })
+	return res
+}
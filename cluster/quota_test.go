@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"testing"
+	"time"
+)
+
+func TestUsageAllows(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage Usage
+		quota Quota
+		size  uint64
+		want  bool
+	}{
+		{"no quota", Usage{Bytes: 1 << 40, Files: 1 << 20}, Quota{}, 1 << 30, true},
+		{"room for the bytes", Usage{Bytes: 60}, Quota{MaxBytes: 100}, 40, true},
+		{"one byte over", Usage{Bytes: 60}, Quota{MaxBytes: 100}, 41, false},
+		{"already over", Usage{Bytes: 120}, Quota{MaxBytes: 100}, 0, false},
+		{"room for a file", Usage{Files: 9}, Quota{MaxFiles: 10}, 1, true},
+		{"no room for a file", Usage{Files: 10}, Quota{MaxFiles: 10}, 1, false},
+		{"both limits, files full", Usage{Bytes: 10, Files: 2}, Quota{MaxBytes: 100, MaxFiles: 2}, 1, false},
+		{"both limits, room", Usage{Bytes: 10, Files: 1}, Quota{MaxBytes: 100, MaxFiles: 2}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.usage.Allows(tt.quota, tt.size); got != tt.want {
+				t.Errorf("Allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaTable(t *testing.T) {
+	table := NewQuotaTable()
+	table.Set("photos", Quota{MaxBytes: 10})
+	table.Set("docs", Quota{MaxFiles: 3})
+	table.Set("docs", Quota{})
+	if _, ok := table.Get("docs"); ok {
+		t.Error("a zero quota did not remove the quota")
+	}
+	restored := NewQuotaTable()
+	restored.Restore(table.Snapshot())
+	if q, ok := restored.Get("photos"); !ok || q.MaxBytes != 10 {
+		t.Errorf("restored quota = %+v, %v", q, ok)
+	}
+}
+
+func TestTopologyUsage(t *testing.T) {
+	volume := func(id int, collection string, size uint64, files int, deleted int, deletedBytes uint64) storage.VolumeInfo {
+		return storage.VolumeInfo{Id: storage.VolumeId(id), Collection: collection, Size: size,
+			FileCount: files, DeleteCount: deleted, DeletedByteCount: deletedBytes}
+	}
+	tests := []struct {
+		name  string
+		nodes [][]storage.VolumeInfo
+		ec    [][]storage.VolumeInfo
+		want  string
+	}{
+		{"one volume", [][]storage.VolumeInfo{{volume(1, "a", 100, 4, 0, 0)}},
+			nil, "a:100/4/1"},
+		{"replicas count once", [][]storage.VolumeInfo{{volume(1, "a", 100, 4, 0, 0)}, {volume(1, "a", 100, 4, 0, 0)}},
+			nil, "a:100/4/1"},
+		{"the largest report counts", [][]storage.VolumeInfo{{volume(1, "a", 80, 3, 0, 0)}, {volume(1, "a", 100, 4, 0, 0)}},
+			nil, "a:100/4/1"},
+		{"deletes are not counted", [][]storage.VolumeInfo{{volume(1, "a", 100, 4, 1, 30)}},
+			nil, "a:70/3/1"},
+		{"collections apart, sorted", [][]storage.VolumeInfo{{volume(2, "b", 10, 1, 0, 0), volume(1, "a", 20, 2, 0, 0)}, {volume(3, "a", 5, 1, 0, 0)}},
+			nil, "a:25/3/2 b:10/1/1"},
+		{"more deleted than reported", [][]storage.VolumeInfo{{volume(1, "", 10, 1, 2, 20)}},
+			nil, ":0/0/1"},
+		{"erasure coded volumes count once", nil, [][]storage.VolumeInfo{{volume(1, "a", 100, 4, 1, 10)}, {volume(1, "a", 100, 4, 1, 10)}},
+			"a:90/3/1"},
+		{"a volume being encoded counts once", [][]storage.VolumeInfo{{volume(1, "a", 100, 4, 0, 0)}}, [][]storage.VolumeInfo{{volume(1, "a", 100, 4, 0, 0)}},
+			"a:100/4/1"},
+		{"volumes and erasure coded volumes", [][]storage.VolumeInfo{{volume(1, "a", 100, 4, 0, 0)}}, [][]storage.VolumeInfo{nil, {volume(2, "a", 50, 2, 0, 0)}},
+			"a:150/6/2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topo := NewTopology(time.Minute)
+			for i := 0; i < len(tt.nodes) || i < len(tt.ec); i++ {
+				n := &DataNode{Name: fmt.Sprint(i)}
+				if i < len(tt.nodes) {
+					n.Volumes = tt.nodes[i]
+				}
+				if i < len(tt.ec) {
+					n.EcVolumes = tt.ec[i]
+				}
+				topo.Register(n)
+			}
+			got := ""
+			for i, u := range topo.Usage() {
+				if i > 0 {
+					got += " "
+				}
+				got += fmt.Sprintf("%s:%d/%d/%d", u.Collection, u.Bytes, u.Files, u.Volumes)
+			}
+			if got != tt.want {
+				t.Errorf("Usage() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
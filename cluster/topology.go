@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DataNode is what a volume server reports in its heartbeat.
+type DataNode struct {
+	Name       string
+	Url        string
+	DataCenter string
+	Rack       string
+	Volumes    []storage.VolumeInfo
+	Leads      []storage.VolumeId // volume groups this node is the leader of
+	EcShards   map[storage.VolumeId][]int
+	EcVolumes  []storage.VolumeInfo // of the shards, as encoded
+
+	lastSeen time.Time
+}
+
+func (n *DataNode) leads(vid storage.VolumeId) bool {
+	for _, id := range n.Leads {
+		if id == vid {
+			return true
+		}
+	}
+	return false
+}
+
+type Location struct {
+	Url      string
+	Leader   bool
+	EcShards []int `json:",omitempty"`
+}
+
+// Topology is kept by the master (the metadata group leader) from the
+// heartbeats of every volume server. It is not replicated: a new master
+// rebuilds it within one heartbeat pulse.
+type Topology struct {
+	mutex     sync.RWMutex
+	nodes     map[string]*DataNode
+	timeout   time.Duration
+	counter   uint32
+	sizeLimit uint64
+}
+
+func NewTopology(timeout time.Duration) *Topology {
+	return &Topology{
+		nodes:   make(map[string]*DataNode),
+		timeout: timeout,
+	}
+}
+
+// SetVolumeSizeLimit stops PickForWrite from picking volumes of limit
+// bytes or more; 0 means no limit.
+func (t *Topology) SetVolumeSizeLimit(limit uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sizeLimit = limit
+}
+
+func (t *Topology) Register(n *DataNode) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	n.lastSeen = time.Now()
+	t.nodes[n.Name] = n
+}
+
+// Nodes returns the nodes heard from within the timeout, sorted by name.
+func (t *Topology) Nodes() []*DataNode {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	var nodes []*DataNode
+	for _, n := range t.nodes {
+		if time.Since(n.lastSeen) <= t.timeout {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Sort(byName(nodes))
+	return nodes
+}
+
+func (t *Topology) Node(name string) *DataNode {
+	for _, n := range t.Nodes() {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// Collection returns the collection of a volume as reported by its nodes.
+func (t *Topology) Collection(vid storage.VolumeId) string {
+	for _, n := range t.Nodes() {
+		for _, v := range n.Volumes {
+			if v.Id == vid {
+				return v.Collection
+			}
+		}
+	}
+	return ""
+}
+
+// MaxVolumeId returns the largest volume id any node reported, of a
+// volume or of erasure coded shards.
+func (t *Topology) MaxVolumeId() storage.VolumeId {
+	var max storage.VolumeId
+	for _, n := range t.Nodes() {
+		for _, v := range n.Volumes {
+			if v.Id > max {
+				max = v.Id
+			}
+		}
+		for vid := range n.EcShards {
+			if vid > max {
+				max = vid
+			}
+		}
+	}
+	return max
+}
+
+// Lookup returns the nodes holding the volume or shards of it.
+func (t *Topology) Lookup(vid storage.VolumeId) []Location {
+	var locations []Location
+	for _, n := range t.Nodes() {
+		for _, v := range n.Volumes {
+			if v.Id == vid {
+				locations = append(locations, Location{Url: n.Url, Leader: n.leads(vid)})
+			}
+		}
+		if shards := n.EcShards[vid]; len(shards) > 0 {
+			locations = append(locations, Location{Url: n.Url, EcShards: shards})
+		}
+	}
+	return locations
+}
+
+// PickForWrite returns a writable volume of the collection (any collection
+// when empty) and TTL together with the url of its group leader.
+func (t *Topology) PickForWrite(collection string, ttl string) (storage.VolumeId, string, error) {
+	type candidate struct {
+		vid storage.VolumeId
+		url string
+	}
+	var candidates []candidate
+	t.mutex.RLock()
+	limit := t.sizeLimit
+	t.mutex.RUnlock()
+	for _, n := range t.Nodes() {
+		for _, v := range n.Volumes {
+			if v.ReadOnly || v.Ttl != ttl || !n.leads(v.Id) {
+				continue
+			}
+			if limit > 0 && v.Size >= limit {
+				continue
+			}
+			if collection != "" && v.Collection != collection {
+				continue
+			}
+			candidates = append(candidates, candidate{v.Id, n.Url})
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, "", fmt.Errorf("no writable volume for collection %q with ttl %q", collection, ttl)
+	}
+	c := candidates[(atomic.AddUint32(&t.counter, 1)-1)%uint32(len(candidates))]
+	return c.vid, c.url, nil
+}
+
+type byName []*DataNode
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
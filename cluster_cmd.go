@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+func runCluster(args []string) {
+	fs, nodes := clientFlags("cluster", "[arguments] status")
+	fs.Parse(args)
+	if fs.NArg() != 1 || fs.Arg(0) != "status" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c := newClient(*nodes)
+	leader, err := c.Leader(background)
+	if err != nil {
+		fatal(err)
+	}
+	status, err := c.Status(background)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("leader: %s\n\n", leader)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tURL\tDC\tRACK\tVOLUMES\tLEADS\tEC SHARDS")
+	for _, n := range status {
+		shards := 0
+		for _, s := range n.EcShards {
+			shards += len(s)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\n",
+			n.Name, n.Url, n.DataCenter, n.Rack, len(n.Volumes), len(n.Leads), shards)
+	}
+	w.Flush()
+}
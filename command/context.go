@@ -0,0 +1,39 @@
+package command
+
+import (
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/Masterlvng/MCDFS/filer"
+	"github.com/Masterlvng/MCDFS/storage"
+	"math/rand"
+)
+
+// Context is handed to every raft group of a node. Volume groups apply
+// writes to Store, the metadata group maintains Groups, Policies, Quotas
+// and the Filer namespace.
+type Context struct {
+	Store    *storage.Store
+	Groups   *cluster.GroupTable
+	Policies *cluster.PolicyTable
+	Quotas   *cluster.QuotaTable
+	Filer    *filer.Filer
+}
+
+func NewContext(store *storage.Store) *Context {
+	return &Context{
+		Store:    store,
+		Groups:   cluster.NewGroupTable(),
+		Policies: cluster.NewPolicyTable(),
+		Quotas:   cluster.NewQuotaTable(),
+		Filer:    filer.New(filer.NewMemoryStore()),
+	}
+}
+
+// NewNonce picks the nonce of a write or delete command, which is never
+// zero.
+func NewNonce() uint64 {
+	for {
+		if n := rand.Uint64(); n != 0 {
+			return n
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package command
+
+import (
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"github.com/goraft/raft"
+)
+
+// DeleteCommand drops a reference to a needle; the needle is deleted once
+// no deduplicated upload refers to it any more. Like WriteCommand, it
+// carries a nonce picked by the leader.
+type DeleteCommand struct {
+	Vid       string
+	Offset    uint64
+	Size      uint32
+	Cookie    uint32
+	Nonce     uint64 `json:",omitempty"`
+	RequestId string `json:",omitempty"`
+}
+
+type DeleteRes struct {
+	Refs int
+}
+
+func (c *DeleteCommand) CommandName() string {
+	return "delete"
+}
+
+func (c *DeleteCommand) Apply(server raft.Server) (interface{}, error) {
+	s := server.Context().(*Context).Store
+	vid, _ := storage.NewVolumeId(c.Vid)
+	n := &storage.Needle{Offset: c.Offset, Size: c.Size, Cookie: c.Cookie}
+	refs, err := s.Delete(vid, n, c.Nonce)
+	log := util.RequestLogger(c.RequestId)
+	if err != nil {
+		log.Warn("delete failed", "volume", c.Vid, "offset", c.Offset, "err", err)
+		return nil, err
+	}
+	log.Debug("deleted needle", "volume", c.Vid, "offset", c.Offset, "refs", refs)
+	return DeleteRes{refs}, nil
+}
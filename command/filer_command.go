@@ -0,0 +1,52 @@
+package command
+
+import (
+	"github.com/Masterlvng/MCDFS/filer"
+	"github.com/goraft/raft"
+	"time"
+)
+
+// The filer namespace is kept by the metadata group, so every node can
+// resolve paths from its own copy.
+
+// FilerCreateCommand returns the file it replaced, if any.
+type FilerCreateCommand struct {
+	Entry filer.Entry
+}
+
+func (c *FilerCreateCommand) CommandName() string {
+	return "filer:create"
+}
+
+func (c *FilerCreateCommand) Apply(server raft.Server) (interface{}, error) {
+	e := c.Entry
+	return server.Context().(*Context).Filer.Create(&e)
+}
+
+// FilerDeleteCommand returns the files it removed.
+type FilerDeleteCommand struct {
+	Path      string
+	Recursive bool
+}
+
+func (c *FilerDeleteCommand) CommandName() string {
+	return "filer:delete"
+}
+
+func (c *FilerDeleteCommand) Apply(server raft.Server) (interface{}, error) {
+	return server.Context().(*Context).Filer.Delete(c.Path, c.Recursive)
+}
+
+type FilerRenameCommand struct {
+	From  string
+	To    string
+	Mtime time.Time
+}
+
+func (c *FilerRenameCommand) CommandName() string {
+	return "filer:rename"
+}
+
+func (c *FilerRenameCommand) Apply(server raft.Server) (interface{}, error) {
+	return nil, server.Context().(*Context).Filer.Rename(c.From, c.To, c.Mtime)
+}
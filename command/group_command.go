@@ -0,0 +1,50 @@
+package command
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/goraft/raft"
+)
+
+// HostGroupCommand records in the metadata group that a node hosts a
+// replica of a volume group.
+type HostGroupCommand struct {
+	Vid              string
+	Name             string
+	ConnectionString string
+}
+
+func (c *HostGroupCommand) CommandName() string {
+	return "group:host"
+}
+
+func (c *HostGroupCommand) Apply(server raft.Server) (interface{}, error) {
+	ctx := server.Context().(*Context)
+	vid, err := storage.NewVolumeId(c.Vid)
+	if err != nil {
+		return nil, fmt.Errorf("bad volume id %s", c.Vid)
+	}
+	ctx.Groups.Host(vid, c.Name, c.ConnectionString)
+	return nil, nil
+}
+
+// UnhostGroupCommand removes a node from a volume group in the metadata
+// group.
+type UnhostGroupCommand struct {
+	Vid  string
+	Name string
+}
+
+func (c *UnhostGroupCommand) CommandName() string {
+	return "group:unhost"
+}
+
+func (c *UnhostGroupCommand) Apply(server raft.Server) (interface{}, error) {
+	ctx := server.Context().(*Context)
+	vid, err := storage.NewVolumeId(c.Vid)
+	if err != nil {
+		return nil, fmt.Errorf("bad volume id %s", c.Vid)
+	}
+	ctx.Groups.Unhost(vid, c.Name)
+	return nil, nil
+}
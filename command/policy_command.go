@@ -0,0 +1,26 @@
+package command
+
+import (
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/goraft/raft"
+)
+
+// SetPolicyCommand sets the replication policy of a collection.
+type SetPolicyCommand struct {
+	Collection string
+	Policy     string
+}
+
+func (c *SetPolicyCommand) CommandName() string {
+	return "policy:set"
+}
+
+func (c *SetPolicyCommand) Apply(server raft.Server) (interface{}, error) {
+	ctx := server.Context().(*Context)
+	rp, err := cluster.NewReplicaPlacement(c.Policy)
+	if err != nil {
+		return nil, err
+	}
+	ctx.Policies.Set(c.Collection, rp.String())
+	return nil, nil
+}
@@ -0,0 +1,23 @@
+package command
+
+import (
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/goraft/raft"
+)
+
+// SetQuotaCommand sets the quota of a collection; zero limits remove it.
+type SetQuotaCommand struct {
+	Collection string
+	MaxBytes   uint64
+	MaxFiles   uint64
+}
+
+func (c *SetQuotaCommand) CommandName() string {
+	return "quota:set"
+}
+
+func (c *SetQuotaCommand) Apply(server raft.Server) (interface{}, error) {
+	ctx := server.Context().(*Context)
+	ctx.Quotas.Set(c.Collection, cluster.Quota{MaxBytes: c.MaxBytes, MaxFiles: c.MaxFiles})
+	return nil, nil
+}
@@ -0,0 +1,25 @@
+package command
+
+import (
+	"github.com/goraft/raft"
+	"sync"
+)
+
+var registerOnce sync.Once
+
+// Register makes the commands of this package known to raft, which
+// decodes log entries by command name. It may be called more than once.
+func Register() {
+	registerOnce.Do(func() {
+		raft.RegisterCommand(&WriteCommand{})
+		raft.RegisterCommand(&HostGroupCommand{})
+		raft.RegisterCommand(&UnhostGroupCommand{})
+		raft.RegisterCommand(&SetPolicyCommand{})
+		raft.RegisterCommand(&SetQuotaCommand{})
+		raft.RegisterCommand(&SealCommand{})
+		raft.RegisterCommand(&DeleteCommand{})
+		raft.RegisterCommand(&FilerCreateCommand{})
+		raft.RegisterCommand(&FilerDeleteCommand{})
+		raft.RegisterCommand(&FilerRenameCommand{})
+	})
+}
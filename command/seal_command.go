@@ -0,0 +1,30 @@
+package command
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/goraft/raft"
+)
+
+// SealCommand makes a volume read-only. Going through the volume group
+// seals every replica at the same position of the log.
+type SealCommand struct {
+	Vid string
+}
+
+func (c *SealCommand) CommandName() string {
+	return "seal"
+}
+
+func (c *SealCommand) Apply(server raft.Server) (interface{}, error) {
+	s := server.Context().(*Context).Store
+	vid, _ := storage.NewVolumeId(c.Vid)
+	v := s.GetVolume(vid)
+	if v == nil {
+		return nil, fmt.Errorf("no volume")
+	}
+	if v.ReadOnly() {
+		return nil, nil
+	}
+	return nil, v.Seal()
+}
@@ -0,0 +1,49 @@
+package command
+
+import (
+	"encoding/json"
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/Masterlvng/MCDFS/filer"
+	"github.com/Masterlvng/MCDFS/storage"
+)
+
+type metadataSnapshot struct {
+	Groups      map[string]map[string]string
+	MaxVolumeId storage.VolumeId
+	Policies    map[string]string
+	Quotas      map[string]cluster.Quota
+	Filer       []*filer.Entry
+}
+
+// Save and Recovery make Context the state machine of the metadata group,
+// so that the group can take snapshots and compact its log. Volume groups
+// have their own, which checkpoints the volume.
+func (c *Context) Save() ([]byte, error) {
+	snapshot := &metadataSnapshot{
+		Groups:      c.Groups.Snapshot(),
+		MaxVolumeId: c.Groups.MaxVolumeId(),
+		Policies:    c.Policies.Snapshot(),
+		Quotas:      c.Quotas.Snapshot(),
+	}
+	err := c.Filer.Walk(func(e *filer.Entry) error {
+		snapshot.Filer = append(snapshot.Filer, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(snapshot)
+}
+
+func (c *Context) Recovery(b []byte) error {
+	snapshot := &metadataSnapshot{}
+	if err := json.Unmarshal(b, snapshot); err != nil {
+		return err
+	}
+	if err := c.Groups.Restore(snapshot.Groups, snapshot.MaxVolumeId); err != nil {
+		return err
+	}
+	c.Policies.Restore(snapshot.Policies)
+	c.Quotas.Restore(snapshot.Quotas)
+	return c.Filer.Restore(snapshot.Filer)
+}
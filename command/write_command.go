@@ -3,13 +3,21 @@ package command
 import (
 	"fmt"
 	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
 	"github.com/goraft/raft"
 	"strconv"
 )
 
+// WriteCommand appends a needle to a volume. With Dedup set, a needle whose
+// bytes the volume already holds is not written again. The leader picks
+// the Nonce, which the volume keeps so that the command does nothing more
+// when the log is replayed.
 type WriteCommand struct {
-	Vid string
-	N   []byte
+	Vid       string
+	N         []byte
+	Dedup     bool
+	Nonce     uint64 `json:",omitempty"`
+	RequestId string `json:",omitempty"`
 }
 
 type WriteRes struct {
@@ -21,8 +29,9 @@ type WriteRes struct {
 
 func NewWriteCommand(id string, nbytes []byte) *WriteCommand {
 	return &WriteCommand{
-		Vid: id,
-		N:   nbytes,
+		Vid:   id,
+		N:     nbytes,
+		Nonce: NewNonce(),
 	}
 }
 
@@ -31,19 +40,29 @@ func (c *WriteCommand) CommandName() string {
 }
 
 func (c *WriteCommand) Apply(server raft.Server) (interface{}, error) {
-	s := server.Context().(*storage.Store)
+	s := server.Context().(*Context).Store
 	vid, _ := storage.NewVolumeId(c.Vid)
+	log := util.RequestLogger(c.RequestId)
 	v := s.GetVolume(vid)
 	if v == nil {
-		fmt.Printf("no volume %s\n", c.Vid)
+		log.Error("write to a missing volume", "volume", c.Vid)
 		return nil, fmt.Errorf("no volume")
 	}
 	n := &storage.Needle{}
 	err := n.GobDecode(c.N)
 	if err != nil {
-		fmt.Println(err.Error())
+		log.Error("cannot decode needle", "volume", c.Vid, "err", err)
 	}
-	v.Write(n)
+	if c.Dedup {
+		_, err = v.WriteDedup(n, c.Nonce)
+	} else {
+		_, err = v.WriteOnce(n, c.Nonce)
+	}
+	if err != nil {
+		log.Error("write failed", "volume", c.Vid, "err", err)
+		return nil, err
+	}
+	log.Debug("wrote needle", "volume", c.Vid, "offset", n.Offset, "size", n.Size)
 	uint64_vid, _ := strconv.ParseUint(v.Id.String(), 10, 10)
 	return WriteRes{uint64_vid, n.Cookie, n.Offset, n.Size}, nil
 }
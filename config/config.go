@@ -0,0 +1,217 @@
+// Package config holds the settings of a node, read from a YAML file and
+// overridden by the flags of "MCDFS server".
+package config
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Host       string `yaml:"host"`
+	Port       int    `yaml:"port"`
+	Join       string `yaml:"join"`
+	Leave      bool   `yaml:"leave"`
+	DataCenter string `yaml:"dataCenter"`
+	Rack       string `yaml:"rack"`
+	// ShutdownTimeout bounds the wait for the requests in flight on
+	// SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+
+	// Dir keeps the raft logs, the filer store and the name of the node;
+	// VolumeDir keeps the volumes.
+	Dir        string `yaml:"dir"`
+	VolumeDir  string `yaml:"volumeDir"`
+	Volumes    string `yaml:"volumes"`    // volumes created on start, e.g. "1,2,3"
+	Collection string `yaml:"collection"` // collection of Volumes
+	// VolumeSizeLimitMB stops assigning writes to volumes of this size,
+	// so that new ones are grown; 0 for no limit.
+	VolumeSizeLimitMB int64                 `yaml:"volumeSizeLimitMB"`
+	Collections       map[string]Collection `yaml:"collections"`
+	Private           []string              `yaml:"private"`
+	Dedup             bool                  `yaml:"dedup"`
+	FilerStore        string                `yaml:"filerStore"`
+
+	Listen Listen `yaml:"listen"`
+	TLS    TLS    `yaml:"tls"`
+	Raft   Raft   `yaml:"raft"`
+	Tier   Tier   `yaml:"tier"`
+	Limits Limits `yaml:"limits"`
+	Log    Log    `yaml:"log"`
+}
+
+// Collection is applied by the leader of the metadata group.
+type Collection struct {
+	Replication string `yaml:"replication"`
+}
+
+// Listen holds the addresses of the APIs served next to the node port.
+type Listen struct {
+	S3   string `yaml:"s3"`
+	GRPC string `yaml:"grpc"`
+}
+
+type TLS struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	CA   string `yaml:"ca"`
+}
+
+// Raft holds the timings of the metadata group and the volume groups.
+type Raft struct {
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval"`
+	ElectionTimeout   time.Duration `yaml:"electionTimeout"`
+	TransportTimeout  time.Duration `yaml:"transportTimeout"`
+}
+
+type Tier struct {
+	Dir        string `yaml:"dir"`
+	S3Endpoint string `yaml:"s3Endpoint"`
+	S3Bucket   string `yaml:"s3Bucket"`
+	S3Region   string `yaml:"s3Region"`
+}
+
+type Log struct {
+	Level string `yaml:"level"` // debug, info, warn or error
+	JSON  bool   `yaml:"json"`
+}
+
+type Limits struct {
+	Rate          float64 `yaml:"rate"`
+	Burst         int     `yaml:"burst"`
+	ClientRate    float64 `yaml:"clientRate"`
+	ClientBurst   int     `yaml:"clientBurst"`
+	MaxUploads    int     `yaml:"maxUploads"`
+	MaxUploadMB   int64   `yaml:"maxUploadMB"`
+	MaxInFlightMB int64   `yaml:"maxInFlightMB"`
+}
+
+// Default returns the settings a node has always started with.
+func Default() *Config {
+	return &Config{
+		Host:            "localhost",
+		Port:            4001,
+		ShutdownTimeout: 30 * time.Second,
+		Volumes:         "1,2,3",
+		Collection:      "photo",
+		FilerStore:      "bolt",
+		Raft: Raft{
+			HeartbeatInterval: 1 * time.Millisecond,
+			ElectionTimeout:   150 * time.Millisecond,
+			TransportTimeout:  200 * time.Millisecond,
+		},
+		Tier: Tier{S3Bucket: "mcdfs"},
+		Log:  Log{Level: "info"},
+	}
+}
+
+// Load reads the file at path over c. Keys the file does not set keep
+// their value; unknown keys are an error.
+func (c *Config) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d := yaml.NewDecoder(f)
+	d.KnownFields(true)
+	if err = d.Decode(c); err != nil {
+		return fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// ValidationError lists what is wrong with a Config.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks c as a whole, reporting every problem it finds.
+func (c *Config) Validate() error {
+	var e ValidationError
+	add := func(format string, args ...interface{}) {
+		e = append(e, fmt.Sprintf(format, args...))
+	}
+	if c.Host == "" {
+		add("host: required")
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		add("port: %d is not a port", c.Port)
+	}
+	if c.ShutdownTimeout <= 0 {
+		add("shutdownTimeout: must be positive")
+	}
+	if c.Dir == "" {
+		add("dir: required")
+	}
+	if c.VolumeDir != "" {
+		if fi, err := os.Stat(c.VolumeDir); err != nil || !fi.IsDir() {
+			add("volumeDir: %s is not a directory", c.VolumeDir)
+		}
+	}
+	if c.Volumes != "" {
+		for _, id := range strings.Split(c.Volumes, ",") {
+			if _, err := storage.NewVolumeId(id); err != nil {
+				add("volumes: %q is not a volume id", id)
+			}
+		}
+	}
+	checkCollection := func(key string, name string) {
+		if strings.Contains(name, "_") {
+			add("%s: collection %q contains \"_\"", key, name)
+		}
+	}
+	checkCollection("collection", c.Collection)
+	for name, col := range c.Collections {
+		checkCollection("collections", name)
+		if _, err := cluster.NewReplicaPlacement(col.Replication); err != nil {
+			add("collections.%s.replication: %s", name, err.Error())
+		}
+	}
+	for _, name := range c.Private {
+		checkCollection("private", name)
+	}
+	if c.VolumeSizeLimitMB < 0 {
+		add("volumeSizeLimitMB: must not be negative")
+	}
+	if c.FilerStore != "bolt" && c.FilerStore != "memory" {
+		add("filerStore: %q is not bolt or memory", c.FilerStore)
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		add("tls: cert and key go together")
+	}
+	if c.TLS.CA != "" && c.TLS.Cert == "" {
+		add("tls.ca: requires tls.cert")
+	}
+	if c.Raft.HeartbeatInterval <= 0 {
+		add("raft.heartbeatInterval: must be positive")
+	}
+	if c.Raft.TransportTimeout <= 0 {
+		add("raft.transportTimeout: must be positive")
+	}
+	if c.Raft.ElectionTimeout <= c.Raft.HeartbeatInterval {
+		add("raft.electionTimeout: must be longer than raft.heartbeatInterval")
+	}
+	if c.Tier.S3Endpoint != "" && c.Tier.S3Bucket == "" {
+		add("tier.s3Bucket: required with tier.s3Endpoint")
+	}
+	l := c.Limits
+	if l.Rate < 0 || l.Burst < 0 || l.ClientRate < 0 || l.ClientBurst < 0 || l.MaxUploads < 0 || l.MaxUploadMB < 0 || l.MaxInFlightMB < 0 {
+		add("limits: must not be negative")
+	}
+	if !util.ValidLogLevel(c.Log.Level) {
+		add("log.level: %q is not debug, info, warn or error", c.Log.Level)
+	}
+	if len(e) > 0 {
+		return e
+	}
+	return nil
+}
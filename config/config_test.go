@@ -0,0 +1,122 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// valid is the default configuration with the settings it lacks.
+func valid() *Config {
+	c := Default()
+	c.Dir = "/var/lib/mcdfs"
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   []string // the problems reported, by key
+	}{
+		{"defaults with a dir", func(c *Config) {}, nil},
+		{"no dir", func(c *Config) { c.Dir = "" }, []string{"dir:"}},
+		{"no host", func(c *Config) { c.Host = "" }, []string{"host:"}},
+		{"port out of range", func(c *Config) { c.Port = 70000 }, []string{"port:"}},
+		{"port zero", func(c *Config) { c.Port = 0 }, []string{"port:"}},
+		{"shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }, []string{"shutdownTimeout:"}},
+		{"missing volume dir", func(c *Config) { c.VolumeDir = "/does/not/exist" }, []string{"volumeDir:"}},
+		{"volume ids", func(c *Config) { c.Volumes = "1,x,3" }, []string{"volumes:"}},
+		{"no volumes", func(c *Config) { c.Volumes = "" }, nil},
+		{"collection with an underscore", func(c *Config) { c.Collection = "my_photos" }, []string{"collection:"}},
+		{"private collection with an underscore", func(c *Config) { c.Private = []string{"ok", "a_b"} }, []string{"private:"}},
+		{"replication policy", func(c *Config) {
+			c.Collections = map[string]Collection{"photos": {Replication: "same rack 1"}, "docs": {Replication: "same shelf 1"}}
+		}, []string{"collections.docs.replication:"}},
+		{"negative volume size limit", func(c *Config) { c.VolumeSizeLimitMB = -1 }, []string{"volumeSizeLimitMB:"}},
+		{"filer store", func(c *Config) { c.FilerStore = "redis" }, []string{"filerStore:"}},
+		{"memory filer store", func(c *Config) { c.FilerStore = "memory" }, nil},
+		{"tls cert without key", func(c *Config) { c.TLS.Cert = "node.crt" }, []string{"tls:"}},
+		{"tls ca without cert", func(c *Config) { c.TLS.CA = "ca.crt" }, []string{"tls.ca:"}},
+		{"tls", func(c *Config) { c.TLS = TLS{Cert: "node.crt", Key: "node.key", CA: "ca.crt"} }, nil},
+		{"heartbeat", func(c *Config) { c.Raft.HeartbeatInterval = 0 }, []string{"raft.heartbeatInterval:"}},
+		{"election shorter than heartbeat", func(c *Config) { c.Raft.ElectionTimeout = time.Millisecond }, []string{"raft.electionTimeout:"}},
+		{"transport timeout", func(c *Config) { c.Raft.TransportTimeout = -time.Second }, []string{"raft.transportTimeout:"}},
+		{"s3 tier without bucket", func(c *Config) { c.Tier = Tier{S3Endpoint: "http://s3"} }, []string{"tier.s3Bucket:"}},
+		{"negative limits", func(c *Config) { c.Limits.ClientBurst = -1 }, []string{"limits:"}},
+		{"log level", func(c *Config) { c.Log.Level = "verbose" }, []string{"log.level:"}},
+		{"every problem is reported", func(c *Config) {
+			c.Port, c.Dir, c.Log.Level = -1, "", "loud"
+		}, []string{"port:", "dir:", "log.level:"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.change(c)
+			err := c.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			ve, ok := err.(ValidationError)
+			if !ok {
+				t.Fatalf("Validate() = %v, want a ValidationError", err)
+			}
+			if len(ve) != len(tt.want) {
+				t.Fatalf("Validate() reported %q, want %q", []string(ve), tt.want)
+			}
+			for i, key := range tt.want {
+				if !strings.HasPrefix(ve[i], key) {
+					t.Errorf("problem %d = %q, want it about %s", i, ve[i], key)
+				}
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		check   func(c *Config) bool
+		wantErr bool
+	}{
+		{"overrides the defaults it sets", "port: 5001\ndir: /data\nraft:\n  electionTimeout: 1s\n", func(c *Config) bool {
+			return c.Port == 5001 && c.Dir == "/data" && c.Raft.ElectionTimeout == time.Second &&
+				c.Host == "localhost" && c.Raft.HeartbeatInterval == time.Millisecond
+		}, false},
+		{"collections", "collections:\n  photos:\n    replication: same rack 1\n", func(c *Config) bool {
+			return c.Collections["photos"].Replication == "same rack 1"
+		}, false},
+		{"unknown key", "prot: 5001\n", nil, true},
+		{"unknown nested key", "tls:\n  certificate: x\n", nil, true},
+		{"wrong type", "port: many\n", nil, true},
+		{"bad duration", "shutdownTimeout: soon\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mcdfs.yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			c := Default()
+			err := c.Load(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !tt.check(c) {
+				t.Errorf("Load() = %+v", c)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if err := Default().Load(filepath.Join(t.TempDir(), "none.yaml")); err == nil {
+		t.Error("Load() of a missing file succeeded")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/client"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+func runUpload(args []string) {
+	fs, nodes := clientFlags("upload", "[arguments] <files...>")
+	collection := fs.String("collection", "", "collection to upload to")
+	ttl := fs.String("ttl", "", "time to live, e.g. 3d")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c := newClient(*nodes)
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fatal(err)
+		}
+		fid, err := c.Upload(background, f, client.UploadOptions{
+			FileName:   filepath.Base(name),
+			Collection: *collection,
+			Ttl:        *ttl,
+		})
+		f.Close()
+		if err != nil {
+			fatal(fmt.Errorf("%s: %s", name, err.Error()))
+		}
+		fmt.Printf("%s\t%s\n", fid.String(), name)
+	}
+}
+
+func runDownload(args []string) {
+	fs, nodes := clientFlags("download", "[arguments] <fid>")
+	output := fs.String("o", "", "file to write to instead of stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fid, err := parseFid(fs.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err = newClient(*nodes).Download(background, fid, w); err != nil {
+		fatal(err)
+	}
+}
+
+func runDelete(args []string) {
+	fs, nodes := clientFlags("delete", "[arguments] <fids...>")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c := newClient(*nodes)
+	for _, s := range fs.Args() {
+		fid, err := parseFid(s)
+		if err != nil {
+			fatal(err)
+		}
+		if err = c.Delete(background, fid); err != nil {
+			fatal(fmt.Errorf("%s: %s", s, err.Error()))
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package filer
+
+import (
+	"bytes"
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var entriesBucket = []byte("entries")
+
+// BoltStore keeps the entries in a bolt database file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(fileName string) (*BoltStore, error) {
+	db, err := bolt.Open(fileName, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(entriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(path string) (*Entry, error) {
+	var e *Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(entriesBucket).Get(key(path))
+		if value == nil {
+			return ErrNotFound
+		}
+		e = &Entry{}
+		return json.Unmarshal(value, e)
+	})
+	return e, err
+}
+
+func (s *BoltStore) Put(e *Entry) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Put(key(e.Path), value)
+	})
+}
+
+func (s *BoltStore) Delete(path string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Delete(key(path))
+	})
+}
+
+func (s *BoltStore) List(dir string, after string, limit int) ([]*Entry, error) {
+	var entries []*Entry
+	prefix := dirPrefix(dir)
+	start := append(append([]byte{}, prefix...), after...)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(entriesBucket).Cursor()
+		for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if bytes.Equal(k, start) {
+				continue
+			}
+			if limit > 0 && len(entries) == limit {
+				break
+			}
+			e := &Entry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,81 @@
+package filer
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("no such file or directory")
+	ErrExists   = errors.New("file exists")
+	ErrNotDir   = errors.New("not a directory")
+	ErrIsDir    = errors.New("is a directory")
+	ErrNotEmpty = errors.New("directory not empty")
+)
+
+// Errors maps the messages of the errors above back to them, for errors
+// that went over the wire.
+var Errors = map[string]error{}
+
+func init() {
+	for _, err := range []error{ErrNotFound, ErrExists, ErrNotDir, ErrIsDir, ErrNotEmpty} {
+		Errors[err.Error()] = err
+	}
+}
+
+// Entry is a file or a directory of the namespace. Files point at the fid
+// ("vid,offset/size/cookie") holding their content, or at the chunks it
+// was uploaded in.
+type Entry struct {
+	Path   string
+	IsDir  bool    `json:",omitempty"`
+	Fid    string  `json:",omitempty"`
+	Chunks []Chunk `json:",omitempty"`
+	Size   int64   `json:",omitempty"`
+	Mime   string  `json:",omitempty"`
+	ETag   string  `json:",omitempty"`
+	Mtime  time.Time
+}
+
+type Chunk struct {
+	Fid  string
+	Size int64
+}
+
+func (e *Entry) Name() string {
+	return path.Base(e.Path)
+}
+
+// Fids returns the fids holding the content of e.
+func (e *Entry) Fids() []string {
+	if e.Fid != "" {
+		return []string{e.Fid}
+	}
+	var fids []string
+	for _, c := range e.Chunks {
+		fids = append(fids, c.Fid)
+	}
+	return fids
+}
+
+// Clean turns p into an absolute path without trailing slash.
+func Clean(p string) string {
+	return path.Clean("/" + p)
+}
+
+// splitPath returns the directory and the name of an absolute path.
+func splitPath(p string) (dir string, name string) {
+	i := strings.LastIndex(p, "/")
+	dir, name = p[:i], p[i+1:]
+	if dir == "" {
+		dir = "/"
+	}
+	return
+}
+
+// isUnder reports whether p is dir or inside it.
+func isUnder(p string, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
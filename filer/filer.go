@@ -0,0 +1,244 @@
+// Package filer maps POSIX-like paths to fids. Directories are entries of
+// their own and are created on demand for the files put under them.
+package filer
+
+import (
+	"sync"
+	"time"
+)
+
+const listPage = 1024
+
+type Filer struct {
+	store Store
+	mutex sync.Mutex
+}
+
+func New(store Store) *Filer {
+	return &Filer{store: store}
+}
+
+func (f *Filer) Close() error {
+	return f.store.Close()
+}
+
+func (f *Filer) Find(p string) (*Entry, error) {
+	p = Clean(p)
+	if p == "/" {
+		return &Entry{Path: "/", IsDir: true}, nil
+	}
+	return f.store.Get(p)
+}
+
+// List returns up to limit entries of dir after the given name; limit 0
+// means all of them.
+func (f *Filer) List(dir string, after string, limit int) ([]*Entry, error) {
+	dir = Clean(dir)
+	d, err := f.Find(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !d.IsDir {
+		return nil, ErrNotDir
+	}
+	return f.store.List(dir, after, limit)
+}
+
+// Create adds or replaces the entry at e.Path, creating the missing
+// parent directories with e.Mtime. A file never replaces a directory.
+// It returns the file it replaced, if any.
+func (f *Filer) Create(e *Entry) (*Entry, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	e.Path = Clean(e.Path)
+	if e.Path == "/" {
+		return nil, ErrExists
+	}
+	if err := f.mkdirAll(splitDir(e.Path), e.Mtime); err != nil {
+		return nil, err
+	}
+	old, err := f.store.Get(e.Path)
+	if err == nil && old.IsDir != e.IsDir {
+		if old.IsDir {
+			return nil, ErrIsDir
+		}
+		return nil, ErrNotDir
+	}
+	if err = f.store.Put(e); err != nil {
+		return nil, err
+	}
+	if old != nil && old.IsDir {
+		old = nil
+	}
+	return old, nil
+}
+
+func splitDir(p string) string {
+	dir, _ := splitPath(p)
+	return dir
+}
+
+func (f *Filer) mkdirAll(dir string, mtime time.Time) error {
+	if dir == "/" {
+		return nil
+	}
+	e, err := f.store.Get(dir)
+	if err == nil {
+		if !e.IsDir {
+			return ErrNotDir
+		}
+		return nil
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	if err = f.mkdirAll(splitDir(dir), mtime); err != nil {
+		return err
+	}
+	return f.store.Put(&Entry{Path: dir, IsDir: true, Mtime: mtime})
+}
+
+// Delete removes the entry at p, and everything under it when recursive
+// is set. It returns the files removed so their content can be deleted.
+func (f *Filer) Delete(p string, recursive bool) ([]*Entry, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	p = Clean(p)
+	e, err := f.store.Get(p)
+	if err != nil {
+		return nil, err
+	}
+	var files []*Entry
+	if e.IsDir {
+		children, err := f.store.List(p, "", 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(children) > 0 && !recursive {
+			return nil, ErrNotEmpty
+		}
+		if files, err = f.deleteChildren(p); err != nil {
+			return nil, err
+		}
+	} else {
+		files = append(files, e)
+	}
+	return files, f.store.Delete(p)
+}
+
+func (f *Filer) deleteChildren(dir string) ([]*Entry, error) {
+	var files []*Entry
+	for {
+		children, err := f.store.List(dir, "", listPage)
+		if err != nil || len(children) == 0 {
+			return files, err
+		}
+		for _, c := range children {
+			if c.IsDir {
+				sub, err := f.deleteChildren(c.Path)
+				files = append(files, sub...)
+				if err != nil {
+					return files, err
+				}
+			} else {
+				files = append(files, c)
+			}
+			if err = f.store.Delete(c.Path); err != nil {
+				return files, err
+			}
+		}
+	}
+}
+
+// Rename moves the entry at from, and everything under it, to to. A file
+// may replace a file; nothing else is replaced.
+func (f *Filer) Rename(from string, to string, mtime time.Time) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	from, to = Clean(from), Clean(to)
+	if from == "/" || to == "/" || (from != to && isUnder(to, from)) {
+		return ErrExists
+	}
+	e, err := f.store.Get(from)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	if old, err := f.store.Get(to); err == nil && (old.IsDir || e.IsDir) {
+		return ErrExists
+	}
+	if err = f.mkdirAll(splitDir(to), mtime); err != nil {
+		return err
+	}
+	return f.move(e, to)
+}
+
+func (f *Filer) move(e *Entry, to string) error {
+	from := e.Path
+	if e.IsDir {
+		for {
+			children, err := f.store.List(from, "", listPage)
+			if err != nil {
+				return err
+			}
+			if len(children) == 0 {
+				break
+			}
+			for _, c := range children {
+				if err = f.move(c, to+"/"+c.Name()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	e.Path = to
+	if err := f.store.Put(e); err != nil {
+		return err
+	}
+	return f.store.Delete(from)
+}
+
+// Walk calls fn for every entry, each directory before its children.
+func (f *Filer) Walk(fn func(*Entry) error) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.walk("/", fn)
+}
+
+func (f *Filer) walk(dir string, fn func(*Entry) error) error {
+	after := ""
+	for {
+		children, err := f.store.List(dir, after, listPage)
+		if err != nil || len(children) == 0 {
+			return err
+		}
+		for _, c := range children {
+			if err = fn(c); err != nil {
+				return err
+			}
+			if c.IsDir {
+				if err = f.walk(c.Path, fn); err != nil {
+					return err
+				}
+			}
+		}
+		after = children[len(children)-1].Name()
+	}
+}
+
+// Restore replaces every entry with entries, as listed by Walk.
+func (f *Filer) Restore(entries []*Entry) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, err := f.deleteChildren("/"); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := f.store.Put(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package filer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// forEachStore runs fn on a filer over each store.
+func forEachStore(t *testing.T, fn func(t *testing.T, f *Filer)) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) Store
+	}{
+		{"memory", func(t *testing.T) Store { return NewMemoryStore() }},
+		{"bolt", func(t *testing.T) Store {
+			s, err := NewBoltStore(filepath.Join(t.TempDir(), "filer.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}},
+	}
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			f := New(s.open(t))
+			defer f.Close()
+			fn(t, f)
+		})
+	}
+}
+
+// create adds the files, and the directories written with a trailing
+// slash.
+func create(t *testing.T, f *Filer, paths ...string) {
+	for _, p := range paths {
+		e := &Entry{Path: p, Fid: "1,0/1/" + p, Mtime: time.Now()}
+		if strings.HasSuffix(p, "/") {
+			e = &Entry{Path: p, IsDir: true, Mtime: time.Now()}
+		}
+		if _, err := f.Create(e); err != nil {
+			t.Fatalf("Create(%s) = %v", p, err)
+		}
+	}
+}
+
+// tree lists every entry, directories with a trailing slash.
+func tree(t *testing.T, f *Filer) string {
+	var paths []string
+	err := f.Walk(func(e *Entry) error {
+		if e.IsDir {
+			paths = append(paths, e.Path+"/")
+		} else {
+			paths = append(paths, e.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(paths, " ")
+}
+
+func names(entries []*Entry) string {
+	var s []string
+	for _, e := range entries {
+		s = append(s, e.Name())
+	}
+	return strings.Join(s, " ")
+}
+
+func TestListPagination(t *testing.T) {
+	tests := []struct {
+		dir     string
+		after   string
+		limit   int
+		want    string
+		wantErr error
+	}{
+		{"/d", "", 0, "a b c sub", nil},
+		{"/d", "", 2, "a b", nil},
+		{"/d", "b", 2, "c sub", nil},
+		{"/d", "sub", 2, "", nil},
+		{"/d", "bb", 0, "c sub", nil},
+		{"/d/", "", 1, "a", nil},
+		{"/", "", 0, "d da", nil},
+		{"/d/sub", "", 0, "x", nil},
+		{"/d/a", "", 0, "", ErrNotDir},
+		{"/missing", "", 0, "", ErrNotFound},
+	}
+	forEachStore(t, func(t *testing.T, f *Filer) {
+		// The children of "/da" share a prefix with those of "/d".
+		create(t, f, "/d/b", "/d/a", "/d/c", "/d/sub/x", "/da/y")
+		for _, tt := range tests {
+			entries, err := f.List(tt.dir, tt.after, tt.limit)
+			if err != tt.wantErr {
+				t.Errorf("List(%s, %q, %d) = %v, want %v", tt.dir, tt.after, tt.limit, err, tt.wantErr)
+				continue
+			}
+			if got := names(entries); got != tt.want {
+				t.Errorf("List(%s, %q, %d) = %q, want %q", tt.dir, tt.after, tt.limit, got, tt.want)
+			}
+		}
+	})
+}
+
+func TestListEveryPage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, f *Filer) {
+		var want []string
+		for i := 0; i < 25; i++ {
+			name := fmt.Sprintf("f%02d", i)
+			create(t, f, "/d/"+name)
+			want = append(want, name)
+		}
+		for _, limit := range []int{1, 4, 25, 30} {
+			var got []string
+			after := ""
+			for {
+				entries, err := f.List("/d", after, limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) > limit {
+					t.Fatalf("page of %d entries, limit %d", len(entries), limit)
+				}
+				if len(entries) == 0 {
+					break
+				}
+				for _, e := range entries {
+					got = append(got, e.Name())
+				}
+				after = entries[len(entries)-1].Name()
+			}
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("pages of %d = %v, want %v", limit, got, want)
+			}
+		}
+	})
+}
+
+func TestRename(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     string
+		wantErr  error
+	}{
+		{"file", "/a/f", "/a/g", "/a/ /a/g /a/sub/ /a/sub/h /b/ /b/f", nil},
+		{"file to a new directory", "/a/f", "/c/d/f", "/a/ /a/sub/ /a/sub/h /b/ /b/f /c/ /c/d/ /c/d/f", nil},
+		{"file over a file", "/a/f", "/b/f", "/a/ /a/sub/ /a/sub/h /b/ /b/f", nil},
+		{"directory and its children", "/a", "/z", "/b/ /b/f /z/ /z/f /z/sub/ /z/sub/h", nil},
+		{"directory into another", "/a/sub", "/b/sub", "/a/ /a/f /b/ /b/f /b/sub/ /b/sub/h", nil},
+		{"same path", "/a/f", "/a/f", "/a/ /a/f /a/sub/ /a/sub/h /b/ /b/f", nil},
+		{"file over a directory", "/b/f", "/a/sub", "", ErrExists},
+		{"directory over a file", "/a/sub", "/b/f", "", ErrExists},
+		{"directory into itself", "/a", "/a/sub/a", "", ErrExists},
+		{"root", "/", "/r", "", ErrExists},
+		{"missing", "/nothing", "/x", "", ErrNotFound},
+		{"under a file", "/a/f", "/b/f/g", "", ErrNotDir},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, f *Filer) {
+				create(t, f, "/a/f", "/a/sub/h", "/b/f")
+				before := tree(t, f)
+				err := f.Rename(tt.from, tt.to, time.Now())
+				if err != tt.wantErr {
+					t.Fatalf("Rename() = %v, want %v", err, tt.wantErr)
+				}
+				want := tt.want
+				if err != nil {
+					want = before
+				}
+				if got := tree(t, f); got != want {
+					t.Errorf("tree = %s, want %s", got, want)
+				}
+			})
+		})
+	}
+}
+
+func TestRenameKeepsTheEntry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, f *Filer) {
+		create(t, f, "/a/f")
+		if err := f.Rename("/a/f", "/b/g", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		e, err := f.Find("/b/g")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Fid != "1,0/1//a/f" {
+			t.Errorf("renamed file points at %s", e.Fid)
+		}
+	})
+}
+
+func TestCreateAndDelete(t *testing.T) {
+	tests := []struct {
+		name      string
+		create    string
+		delete    string
+		recursive bool
+		removed   string // files returned by Delete
+		want      string
+		wantErr   error
+	}{
+		{"file under a file", "/a/f/g", "", false, "", "", ErrNotDir},
+		{"file over a directory", "/a", "", false, "", "", ErrIsDir},
+		{"directory over a file", "/a/f/", "", false, "", "", ErrNotDir},
+		{"root", "/", "", false, "", "", ErrExists},
+		{"file", "", "/a/f", false, "/a/f", "/a/ /a/sub/ /a/sub/h", nil},
+		{"empty directory", "/e/", "/e", false, "", "/a/ /a/f /a/sub/ /a/sub/h", nil},
+		{"directory not empty", "", "/a", false, "", "", ErrNotEmpty},
+		{"directory and its children", "", "/a", true, "/a/f /a/sub/h", "", nil},
+		{"missing", "", "/nothing", true, "", "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, f *Filer) {
+				create(t, f, "/a/f", "/a/sub/h")
+				before := tree(t, f)
+				var err error
+				if tt.create != "" {
+					e := &Entry{Path: tt.create, Fid: "1,0/1/1", IsDir: strings.HasSuffix(tt.create, "/")}
+					_, err = f.Create(e)
+				}
+				var removed []*Entry
+				if err == nil && tt.delete != "" {
+					removed, err = f.Delete(tt.delete, tt.recursive)
+				}
+				if err != tt.wantErr {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				if err != nil {
+					if got := tree(t, f); got != before {
+						t.Errorf("a failed change left %s, want %s", got, before)
+					}
+					return
+				}
+				var paths []string
+				for _, e := range removed {
+					paths = append(paths, e.Path)
+				}
+				if got := strings.Join(paths, " "); got != tt.removed {
+					t.Errorf("Delete() removed %q, want %q", got, tt.removed)
+				}
+				if got := tree(t, f); got != tt.want {
+					t.Errorf("tree = %s, want %s", got, tt.want)
+				}
+			})
+		})
+	}
+}
+
+func TestCreateReturnsTheReplacedFile(t *testing.T) {
+	forEachStore(t, func(t *testing.T, f *Filer) {
+		create(t, f, "/a/f", "/d/")
+		tests := []struct {
+			entry *Entry
+			want  string // fid of the entry replaced
+		}{
+			{&Entry{Path: "/a/g", Fid: "1,0/1/2"}, ""},
+			{&Entry{Path: "/a/f", Fid: "1,0/1/3"}, "1,0/1//a/f"},
+			// The same fid again, as a deduplicated upload has it.
+			{&Entry{Path: "/a/f", Fid: "1,0/1/3"}, "1,0/1/3"},
+			{&Entry{Path: "/d", IsDir: true}, ""},
+		}
+		for _, tt := range tests {
+			old, err := f.Create(tt.entry)
+			if err != nil {
+				t.Fatalf("Create(%s) = %v", tt.entry.Path, err)
+			}
+			got := ""
+			if old != nil {
+				got = old.Fid
+			}
+			if got != tt.want {
+				t.Errorf("Create(%s) replaced %q, want %q", tt.entry.Path, got, tt.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package filer
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStore keeps the entries in a map. It is rebuilt from the raft log
+// when the node restarts.
+type MemoryStore struct {
+	entries map[string]*Entry
+	mutex   sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*Entry)}
+}
+
+func (s *MemoryStore) Get(path string) (*Entry, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	e, ok := s.entries[string(key(path))]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copy := *e
+	return &copy, nil
+}
+
+func (s *MemoryStore) Put(e *Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	copy := *e
+	s.entries[string(key(e.Path))] = &copy
+	return nil
+}
+
+func (s *MemoryStore) Delete(path string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entries, string(key(path)))
+	return nil
+}
+
+func (s *MemoryStore) List(dir string, after string, limit int) ([]*Entry, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	prefix := string(dirPrefix(dir))
+	start := prefix + after
+	var keys []string
+	for k := range s.entries {
+		if strings.HasPrefix(k, prefix) && k > start {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	entries := make([]*Entry, 0, len(keys))
+	for _, k := range keys {
+		copy := *s.entries[k]
+		entries = append(entries, &copy)
+	}
+	return entries, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,24 @@
+package filer
+
+// Store keeps the entries of a filer. Entries are keyed by full path;
+// List returns the children of a directory ordered by name.
+type Store interface {
+	Get(path string) (*Entry, error)
+	Put(e *Entry) error
+	Delete(path string) error
+	// List returns up to limit children of dir whose names sort after
+	// the given name.
+	List(dir string, after string, limit int) ([]*Entry, error)
+	Close() error
+}
+
+// key orders entries by directory, then name, so the children of a
+// directory are next to each other and their grandchildren are not.
+func key(p string) []byte {
+	dir, name := splitPath(p)
+	return []byte(dir + "\x00" + name)
+}
+
+func dirPrefix(dir string) []byte {
+	return []byte(dir + "\x00")
+}
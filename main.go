@@ -1,44 +1,139 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
-	"github.com/Masterlvng/MCDFS/command"
-	"github.com/Masterlvng/MCDFS/server"
-	"github.com/goraft/raft"
-	"math/rand"
+	"github.com/Masterlvng/MCDFS/client"
+	"github.com/Masterlvng/MCDFS/storage"
+	"io/ioutil"
 	"os"
-	"time"
+	"strings"
 )
 
-var host string
-var port int
-var join string
+type subcommand struct {
+	run   func(args []string)
+	usage string
+}
 
-var vlocation string
+var subcommands = map[string]subcommand{
+	"server":    {runServer, "start a node"},
+	"upload":    {runUpload, "upload files and print their fids"},
+	"download":  {runDownload, "download a fid"},
+	"delete":    {runDelete, "delete fids"},
+	"cluster":   {runCluster, "show the nodes of the cluster (cluster status)"},
+	"mount":     {runMount, "mount the filer as a local filesystem"},
+	"benchmark": {runBenchmark, "measure write and read throughput"},
+}
 
-func init() {
-	flag.StringVar(&host, "h", "localhost", "hostname")
-	flag.IntVar(&port, "p", 4001, "port")
-	flag.StringVar(&join, "join", "", "host:port of leader to join")
-	flag.StringVar(&vlocation, "vl", "", "where to store volume")
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [arguments] <data-path> \n", os.Args[0])
-		flag.PrintDefaults()
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands:\n", os.Args[0])
+	for _, name := range []string{"server", "upload", "download", "delete", "cluster", "mount", "benchmark"} {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, subcommands[name].usage)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun \"%s <command> -help\" for the arguments of a command.\n", os.Args[0])
 }
 
 func main() {
-	flag.Parse()
-	rand.Seed(time.Now().UnixNano())
-	raft.RegisterCommand(&command.WriteCommand{})
-	if flag.NArg() == 0 {
-		flag.Usage()
-	}
-	path := flag.Arg(0)
-	os.MkdirAll(path, 0744)
-	var dirname []string
-	dirname = append(dirname, vlocation)
-	s := server.New(path, host, port, dirname)
-	s.ListenAndServe(join)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	if c, ok := subcommands[os.Args[1]]; ok {
+		c.run(os.Args[2:])
+		return
+	}
+	switch os.Args[1] {
+	case "-help", "-h", "--help", "help":
+		usage()
+		os.Exit(2)
+	}
+	// "MCDFS [arguments] <data-path>" starts a node as it always has; a
+	// word that is neither a command nor a data path is a typo.
+	if strings.HasPrefix(os.Args[1], "-") || isDir(os.Args[1]) {
+		runServer(os.Args[1:])
+		return
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+var useTLS bool
+var caFile string
+var certFile string
+var keyFile string
+
+// clientFlags adds the flags shared by the commands that talk to a
+// cluster.
+func clientFlags(name string, usage string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	nodes := fs.String("server", "localhost:4001", "comma separated host:port of cluster nodes")
+	fs.BoolVar(&useTLS, "tls", false, "connect over HTTPS")
+	fs.StringVar(&caFile, "cacert", "", "CA of the cluster certificates, implies -tls")
+	fs.StringVar(&certFile, "cert", "", "client certificate signed by the CA of the cluster, implies -tls")
+	fs.StringVar(&keyFile, "key", "", "key of -cert")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], name, usage)
+		fs.PrintDefaults()
+	}
+	return fs, nodes
+}
+
+// newClient connects to nodes, presenting the client key of
+// MCDFS_CLIENT_KEY and the -cert, if any.
+func newClient(nodes string) *client.Client {
+	options := []client.Option{client.WithClientKey(os.Getenv("MCDFS_CLIENT_KEY"))}
+	if config := clientTLS(); config != nil {
+		options = append(options, client.WithTLS(config))
+	}
+	return client.New(strings.Split(nodes, ","), options...)
+}
+
+// clientTLS is the TLS configuration of the -tls, -cacert and -cert
+// flags, nil without them.
+func clientTLS() *tls.Config {
+	if !useTLS && caFile == "" && certFile == "" {
+		return nil
+	}
+	config := &tls.Config{}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			fatal(err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			fatal(fmt.Errorf("no certificate in %s", caFile))
+		}
+	}
+	return config
 }
+
+func parseFid(s string) (*storage.FileId, error) {
+	if strings.Count(s, ",") != 1 || strings.Count(s, "/") != 2 {
+		return nil, fmt.Errorf("invalid fid %q, want vid,offset/size/cookie", s)
+	}
+	return storage.ParseFileId(s)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
+
+var background = context.Background()
@@ -0,0 +1,131 @@
+package mount
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/Masterlvng/MCDFS/filer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache keeps file contents on local disk, keyed by the fids holding them.
+// A fid never changes content, so entries never go stale; the least
+// recently used ones are evicted past the size limit. The sizes and uses
+// of the files are kept in memory, read from the directory once.
+type Cache struct {
+	dir   string
+	max   int64
+	mutex sync.Mutex
+	files map[string]*cachedFile // by name in dir
+	size  int64
+}
+
+type cachedFile struct {
+	size int64
+	used time.Time
+}
+
+// NewCache returns a cache of up to max bytes in dir; max 0 disables it.
+// The files a previous cache left in dir count as used when they were
+// last modified.
+func NewCache(dir string, max int64) (*Cache, error) {
+	c := &Cache{dir: dir, max: max, files: make(map[string]*cachedFile)}
+	if max == 0 {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		c.files[f.Name()] = &cachedFile{size: f.Size(), used: f.ModTime()}
+		c.size += f.Size()
+	}
+	c.mutex.Lock()
+	c.evict()
+	c.mutex.Unlock()
+	return c, nil
+}
+
+func (c *Cache) fileName(e *filer.Entry) string {
+	sum := sha1.Sum([]byte(strings.Join(e.Fids(), ";")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) Get(e *filer.Entry) ([]byte, bool) {
+	if c.max == 0 || len(e.Fids()) == 0 {
+		return nil, false
+	}
+	name := c.fileName(e)
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, name))
+	if err != nil || int64(len(data)) != e.Size {
+		return nil, false
+	}
+	now := time.Now()
+	c.mutex.Lock()
+	if f := c.files[name]; f != nil {
+		f.used = now
+	}
+	c.mutex.Unlock()
+	// The modification time keeps the order of use for the next cache.
+	os.Chtimes(filepath.Join(c.dir, name), now, now)
+	return data, true
+}
+
+func (c *Cache) Put(e *filer.Entry, data []byte) {
+	if c.max == 0 || len(e.Fids()) == 0 || int64(len(data)) > c.max {
+		return
+	}
+	name := c.fileName(e)
+	path := filepath.Join(c.dir, name)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return
+	}
+	if os.Rename(path+".tmp", path) != nil {
+		os.Remove(path + ".tmp")
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if f := c.files[name]; f != nil {
+		c.size -= f.size
+	}
+	c.files[name] = &cachedFile{size: int64(len(data)), used: time.Now()}
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// evict removes the least recently used files until the cache fits in
+// max. The mutex is held.
+func (c *Cache) evict() {
+	if c.size <= c.max {
+		return
+	}
+	names := make([]string, 0, len(c.files))
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return c.files[names[i]].used.Before(c.files[names[j]].used) })
+	for _, name := range names {
+		if c.size <= c.max {
+			return
+		}
+		err := os.Remove(filepath.Join(c.dir, name))
+		if err == nil || os.IsNotExist(err) {
+			c.size -= c.files[name].size
+			delete(c.files, name)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package mount
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/filer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// entry returns a file of size bytes stored at the fid named n.
+func entry(n int, size int64) *filer.Entry {
+	return &filer.Entry{Path: fmt.Sprintf("/f%d", n), Fid: fmt.Sprintf("1,%d/%d/1", n, size), Size: size}
+}
+
+func TestCache(t *testing.T) {
+	c, err := NewCache(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, d := entry(1, 4), entry(2, 4), entry(3, 4)
+	if _, ok := c.Get(a); ok {
+		t.Error("Get() of an empty cache hit")
+	}
+	c.Put(a, []byte("aaaa"))
+	c.Put(b, []byte("bbbb"))
+	if data, ok := c.Get(a); !ok || string(data) != "aaaa" {
+		t.Errorf("Get() = %q, %v", data, ok)
+	}
+	// b is the least recently used and goes first.
+	c.Put(d, []byte("dddd"))
+	if _, ok := c.Get(b); ok {
+		t.Error("the least recently used file was not evicted")
+	}
+	for _, e := range []*filer.Entry{a, d} {
+		if _, ok := c.Get(e); !ok {
+			t.Errorf("%s was evicted", e.Path)
+		}
+	}
+	if c.size != 8 {
+		t.Errorf("size = %d, want 8", c.size)
+	}
+
+	// A file larger than the cache is never kept, and neither is one of
+	// the wrong size.
+	c.Put(entry(4, 11), make([]byte, 11))
+	if _, ok := c.Get(entry(4, 11)); ok {
+		t.Error("a file larger than the cache was kept")
+	}
+	c.Put(entry(5, 2), []byte("e"))
+	if _, ok := c.Get(entry(5, 2)); ok {
+		t.Error("Get() returned a file of the wrong size")
+	}
+}
+
+func TestCacheReopens(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for i, name := range []string{"old", "new"} {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte("12345"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, old.Add(time.Duration(i)*time.Minute), old.Add(time.Duration(i)*time.Minute))
+	}
+	ioutil.WriteFile(filepath.Join(dir, "partial.tmp"), []byte("1"), 0600)
+
+	c, err := NewCache(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != "new" {
+		t.Errorf("the cache kept %v, want only the most recently used file", files)
+	}
+	if c.size != 5 {
+		t.Errorf("size = %d, want 5", c.size)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	c, err := NewCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put(entry(1, 1), []byte("a"))
+	if _, ok := c.Get(entry(1, 1)); ok {
+		t.Error("a disabled cache hit")
+	}
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("a disabled cache created its directory: %v", err)
+	}
+}
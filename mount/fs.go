@@ -0,0 +1,309 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+// Package mount presents the filer namespace of a cluster as a FUSE
+// filesystem. Files are read whole into memory and written back when
+// they are closed.
+package mount
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bytes"
+	"context"
+	"github.com/Masterlvng/MCDFS/client"
+	"github.com/Masterlvng/MCDFS/filer"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+type FS struct {
+	client     *client.Client
+	root       string
+	collection string
+	cache      *Cache
+}
+
+// New serves the filer directory root; new files go to collection.
+func New(c *client.Client, root string, collection string, cache *Cache) *FS {
+	return &FS{client: c, root: filer.Clean(root), collection: collection, cache: cache}
+}
+
+func (f *FS) Root() (fs.Node, error) {
+	return &Dir{fs: f, path: f.root}, nil
+}
+
+func fuseError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case client.ErrNotFound:
+		return fuse.ENOENT
+	}
+	if se, ok := err.(*client.StatusError); ok && se.StatusCode == 409 {
+		return fuse.EEXIST
+	}
+	return fuse.EIO
+}
+
+func (f *FS) node(e *filer.Entry) fs.Node {
+	if e.IsDir {
+		return &Dir{fs: f, path: e.Path, mtime: e}
+	}
+	return &File{fs: f, path: e.Path, entry: e}
+}
+
+type Dir struct {
+	fs    *FS
+	path  string
+	mtime *filer.Entry
+}
+
+func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0755
+	if d.mtime != nil {
+		a.Mtime = d.mtime.Mtime
+	}
+	return nil
+}
+
+func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	e, err := d.fs.client.FilerEntry(ctx, path.Join(d.path, name))
+	if err != nil {
+		return nil, fuseError(err)
+	}
+	return d.fs.node(e), nil
+}
+
+func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	entries, err := d.fs.client.FilerList(ctx, d.path)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+	dirents := make([]fuse.Dirent, 0, len(entries))
+	for _, e := range entries {
+		t := fuse.DT_File
+		if e.IsDir {
+			t = fuse.DT_Dir
+		}
+		dirents = append(dirents, fuse.Dirent{Name: e.Name(), Type: t})
+	}
+	return dirents, nil
+}
+
+// Create hands out a handle on an empty file; the file appears in the
+// namespace when the handle is closed.
+func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	f := &File{fs: d.fs, path: path.Join(d.path, req.Name), entry: &filer.Entry{}}
+	h := &handle{file: f, writable: true, dirty: true}
+	f.open(h)
+	return f, h, nil
+}
+
+func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	p := path.Join(d.path, req.Name)
+	if err := d.fs.client.FilerMkdir(ctx, p); err != nil {
+		return nil, fuseError(err)
+	}
+	return &Dir{fs: d.fs, path: p}, nil
+}
+
+func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	err := d.fs.client.FilerDelete(ctx, path.Join(d.path, req.Name), false)
+	if se, ok := err.(*client.StatusError); ok && se.StatusCode == 409 && req.Dir {
+		return fuse.Errno(syscall.ENOTEMPTY)
+	}
+	return fuseError(err)
+}
+
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	to, ok := newDir.(*Dir)
+	if !ok {
+		return fuse.EIO
+	}
+	return fuseError(d.fs.client.FilerRename(ctx, path.Join(d.path, req.OldName), path.Join(to.path, req.NewName)))
+}
+
+type File struct {
+	fs      *FS
+	path    string
+	mutex   sync.Mutex
+	entry   *filer.Entry
+	handles map[*handle]bool
+}
+
+func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	a.Mode = 0644
+	a.Size = uint64(f.entry.Size)
+	a.Mtime = f.entry.Mtime
+	for h := range f.handles {
+		if h.dirty {
+			a.Size = uint64(len(h.data))
+		}
+	}
+	return nil
+}
+
+func (f *File) open(h *handle) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.handles == nil {
+		f.handles = make(map[*handle]bool)
+	}
+	f.handles[h] = true
+}
+
+func (f *File) close(h *handle) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.handles, h)
+}
+
+// content reads the whole file, from the cache when it can.
+func (f *File) content(ctx context.Context) ([]byte, error) {
+	f.mutex.Lock()
+	e := f.entry
+	f.mutex.Unlock()
+	if data, ok := f.fs.cache.Get(e); ok {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	if err := f.fs.client.FilerRead(ctx, f.path, &buf); err != nil {
+		return nil, fuseError(err)
+	}
+	f.fs.cache.Put(e, buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	h := &handle{file: f, writable: !req.Flags.IsReadOnly()}
+	if req.Flags&fuse.OpenTruncate != 0 {
+		h.dirty = true
+	} else {
+		data, err := f.content(ctx)
+		if err != nil {
+			return nil, err
+		}
+		h.data = data
+	}
+	f.open(h)
+	return h, nil
+}
+
+// Setattr only supports changing the size, which open handles apply and
+// which is written at once otherwise.
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if !req.Valid.Size() {
+		return nil
+	}
+	f.mutex.Lock()
+	var open []*handle
+	for h := range f.handles {
+		if h.writable {
+			open = append(open, h)
+		}
+	}
+	f.mutex.Unlock()
+	if len(open) == 0 {
+		data, err := f.content(ctx)
+		if err != nil {
+			return err
+		}
+		h := &handle{file: f, data: resize(data, req.Size), dirty: true}
+		return h.flush(ctx)
+	}
+	for _, h := range open {
+		h.mutex.Lock()
+		h.data, h.dirty = resize(h.data, req.Size), true
+		h.mutex.Unlock()
+	}
+	resp.Attr.Size = req.Size
+	return nil
+}
+
+func resize(data []byte, size uint64) []byte {
+	if uint64(len(data)) >= size {
+		return data[:size]
+	}
+	return append(data, make([]byte, size-uint64(len(data)))...)
+}
+
+func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	return nil
+}
+
+type handle struct {
+	file     *File
+	mutex    sync.Mutex
+	data     []byte
+	writable bool
+	dirty    bool
+}
+
+func (h *handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if req.Offset >= int64(len(h.data)) {
+		return nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(h.data)) {
+		end = int64(len(h.data))
+	}
+	resp.Data = h.data[req.Offset:end]
+	return nil
+}
+
+func (h *handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.writable {
+		return fuse.EPERM
+	}
+	end := uint64(req.Offset) + uint64(len(req.Data))
+	if end > uint64(len(h.data)) {
+		h.data = resize(h.data, end)
+	}
+	copy(h.data[req.Offset:], req.Data)
+	h.dirty = true
+	resp.Size = len(req.Data)
+	return nil
+}
+
+// Flush is called on every close of the file: that is when what was
+// written is stored.
+func (h *handle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return h.flush(ctx)
+}
+
+func (h *handle) flush(ctx context.Context) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.dirty {
+		return nil
+	}
+	f := h.file
+	e, err := f.fs.client.FilerWrite(ctx, f.path, bytes.NewReader(h.data), client.UploadOptions{
+		FileName:   path.Base(f.path),
+		Collection: f.fs.collection,
+	})
+	if err != nil {
+		return fuseError(err)
+	}
+	f.fs.cache.Put(e, h.data)
+	f.mutex.Lock()
+	f.entry = e
+	f.mutex.Unlock()
+	h.dirty = false
+	return nil
+}
+
+func (h *handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	err := h.flush(ctx)
+	h.file.close(h)
+	return err
+}
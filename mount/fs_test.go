@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package mount
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		data string
+		size uint64
+		want []byte
+	}{
+		{"abcd", 2, []byte("ab")},
+		{"abcd", 4, []byte("abcd")},
+		{"ab", 4, []byte{'a', 'b', 0, 0}},
+		{"", 3, []byte{0, 0, 0}},
+		{"abcd", 0, []byte{}},
+	}
+	for _, tt := range tests {
+		if got := resize([]byte(tt.data), tt.size); !bytes.Equal(got, tt.want) {
+			t.Errorf("resize(%q, %d) = %q, want %q", tt.data, tt.size, got, tt.want)
+		}
+	}
+}
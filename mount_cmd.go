@@ -0,0 +1,49 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/mount"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+func runMount(args []string) {
+	flags, nodes := clientFlags("mount", "[arguments] <dir>")
+	root := flags.String("root", "/", "filer directory to mount")
+	collection := flags.String("collection", "", "collection of the files written")
+	cacheDir := flags.String("cachedir", filepath.Join(os.TempDir(), "mcdfs-cache"), "directory of the read cache")
+	cacheSize := flags.Int64("cachesize", 1024, "size of the read cache in MB, 0 to disable it")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	dir := flags.Arg(0)
+	cache, err := mount.NewCache(*cacheDir, *cacheSize<<20)
+	if err != nil {
+		fatal(err)
+	}
+	c, err := fuse.Mount(dir, fuse.FSName("mcdfs"), fuse.Subtype("mcdfs"))
+	if err != nil {
+		fatal(err)
+	}
+	defer c.Close()
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := fuse.Unmount(dir); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+	}()
+	if err = fs.Serve(c, mount.New(newClient(*nodes), *root, *collection, cache)); err != nil {
+		fatal(err)
+	}
+}
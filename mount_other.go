@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func runMount(args []string) {
+	fatal(fmt.Errorf("mount is not supported on %s", runtime.GOOS))
+}
@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"context"
+	"google.golang.org/grpc"
+)
+
+type MCDFSClient interface {
+	Write(ctx context.Context, opts ...grpc.CallOption) (MCDFS_WriteClient, error)
+	Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (MCDFS_ReadClient, error)
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error)
+	VolumeStatus(ctx context.Context, in *VolumeStatusRequest, opts ...grpc.CallOption) (*VolumeStatusResponse, error)
+	ClusterStatus(ctx context.Context, in *ClusterStatusRequest, opts ...grpc.CallOption) (*ClusterStatusResponse, error)
+}
+
+type mcdfsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewMCDFSClient returns a client of the service on cc; its calls use the
+// JSON codec.
+func NewMCDFSClient(cc grpc.ClientConnInterface) MCDFSClient {
+	return &mcdfsClient{cc}
+}
+
+func (c *mcdfsClient) invoke(ctx context.Context, method string, in interface{}, out interface{}, opts []grpc.CallOption) error {
+	return c.cc.Invoke(ctx, "/"+ServiceName+"/"+method, in, out, append([]grpc.CallOption{CallOption()}, opts...)...)
+}
+
+func (c *mcdfsClient) stream(ctx context.Context, desc *grpc.StreamDesc, opts []grpc.CallOption) (grpc.ClientStream, error) {
+	return c.cc.NewStream(ctx, desc, "/"+ServiceName+"/"+desc.StreamName, append([]grpc.CallOption{CallOption()}, opts...)...)
+}
+
+type MCDFS_WriteClient interface {
+	Send(*WriteRequest) error
+	CloseAndRecv() (*WriteResponse, error)
+	grpc.ClientStream
+}
+
+type writeClient struct {
+	grpc.ClientStream
+}
+
+func (c *mcdfsClient) Write(ctx context.Context, opts ...grpc.CallOption) (MCDFS_WriteClient, error) {
+	stream, err := c.stream(ctx, &ServiceDesc.Streams[0], opts)
+	if err != nil {
+		return nil, err
+	}
+	return &writeClient{stream}, nil
+}
+
+func (x *writeClient) Send(m *WriteRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *writeClient) CloseAndRecv() (*WriteResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(WriteResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type MCDFS_ReadClient interface {
+	Recv() (*ReadResponse, error)
+	grpc.ClientStream
+}
+
+type readClient struct {
+	grpc.ClientStream
+}
+
+func (c *mcdfsClient) Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (MCDFS_ReadClient, error) {
+	stream, err := c.stream(ctx, &ServiceDesc.Streams[1], opts)
+	if err != nil {
+		return nil, err
+	}
+	x := &readClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *readClient) Recv() (*ReadResponse, error) {
+	m := new(ReadResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *mcdfsClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	if err := c.invoke(ctx, "Delete", in, out, opts); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mcdfsClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error) {
+	out := new(FileInfo)
+	if err := c.invoke(ctx, "Stat", in, out, opts); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mcdfsClient) VolumeStatus(ctx context.Context, in *VolumeStatusRequest, opts ...grpc.CallOption) (*VolumeStatusResponse, error) {
+	out := new(VolumeStatusResponse)
+	if err := c.invoke(ctx, "VolumeStatus", in, out, opts); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mcdfsClient) ClusterStatus(ctx context.Context, in *ClusterStatusRequest, opts ...grpc.CallOption) (*ClusterStatusResponse, error) {
+	out := new(ClusterStatusResponse)
+	if err := c.invoke(ctx, "ClusterStatus", in, out, opts); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
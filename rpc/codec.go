@@ -0,0 +1,36 @@
+package rpc
+
+import (
+	"encoding/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// The messages of the service are plain Go structs carried as JSON: gRPC
+// clients select the codec with the "json" content subtype, i.e. the
+// content type application/grpc+json.
+const CodecName = "json"
+
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (codec) Name() string {
+	return CodecName
+}
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// CallOption makes a call use the codec; the client of this package
+// passes it on every call.
+func CallOption() grpc.CallOption {
+	return grpc.CallContentSubtype(CodecName)
+}
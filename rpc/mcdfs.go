@@ -0,0 +1,188 @@
+// Package rpc defines the gRPC service of MCDFS. It mirrors the HTTP API:
+// Write and Read stream the content of a file in chunks, the other
+// methods are unary.
+package rpc
+
+import (
+	"context"
+	"github.com/Masterlvng/MCDFS/cluster"
+	"google.golang.org/grpc"
+)
+
+const ServiceName = "mcdfs.MCDFS"
+
+// ChunkSize is the size of the chunks Read sends and Write should send.
+const ChunkSize = 64 * 1024
+
+// WriteRequest is a chunk of the file to write. Collection, Ttl, Name and
+// Mime are only read from the first one.
+type WriteRequest struct {
+	Collection string `json:"collection,omitempty"`
+	Ttl        string `json:"ttl,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Mime       string `json:"mime,omitempty"`
+	Data       []byte `json:"data,omitempty"`
+}
+
+type WriteResponse struct {
+	Fid  string `json:"fid"`
+	Size int64  `json:"size"`
+	Name string `json:"name,omitempty"`
+	ETag string `json:"etag"`
+}
+
+// ReadRequest names a fid ("vid,offset/size/cookie") and the consistency
+// level to read it at, "local" by default.
+type ReadRequest struct {
+	Fid         string `json:"fid"`
+	Consistency string `json:"consistency,omitempty"`
+}
+
+// ReadResponse is a chunk of the file read; the first one carries Info.
+type ReadResponse struct {
+	Info *FileInfo `json:"info,omitempty"`
+	Data []byte    `json:"data,omitempty"`
+}
+
+type DeleteRequest struct {
+	Fid string `json:"fid"`
+}
+
+type DeleteResponse struct{}
+
+type StatRequest struct {
+	Fid string `json:"fid"`
+}
+
+type FileInfo struct {
+	Fid          string `json:"fid"`
+	Size         int64  `json:"size"`
+	Name         string `json:"name,omitempty"`
+	Mime         string `json:"mime,omitempty"`
+	LastModified int64  `json:"lastModified,omitempty"`
+}
+
+type VolumeStatusRequest struct{}
+
+// VolumeStatusResponse describes the node answering and its volumes.
+type VolumeStatusResponse struct {
+	Node *cluster.DataNode `json:"node"`
+}
+
+type ClusterStatusRequest struct{}
+
+type ClusterStatusResponse struct {
+	Nodes []*cluster.DataNode `json:"nodes"`
+}
+
+type MCDFSServer interface {
+	Write(MCDFS_WriteServer) error
+	Read(*ReadRequest, MCDFS_ReadServer) error
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	Stat(context.Context, *StatRequest) (*FileInfo, error)
+	VolumeStatus(context.Context, *VolumeStatusRequest) (*VolumeStatusResponse, error)
+	ClusterStatus(context.Context, *ClusterStatusRequest) (*ClusterStatusResponse, error)
+}
+
+func RegisterMCDFSServer(s *grpc.Server, srv MCDFSServer) {
+	s.RegisterService(&ServiceDesc, srv)
+}
+
+type MCDFS_WriteServer interface {
+	SendAndClose(*WriteResponse) error
+	Recv() (*WriteRequest, error)
+	grpc.ServerStream
+}
+
+type writeServer struct {
+	grpc.ServerStream
+}
+
+func (x *writeServer) SendAndClose(m *WriteResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *writeServer) Recv() (*WriteRequest, error) {
+	m := new(WriteRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type MCDFS_ReadServer interface {
+	Send(*ReadResponse) error
+	grpc.ServerStream
+}
+
+type readServer struct {
+	grpc.ServerStream
+}
+
+func (x *readServer) Send(m *ReadResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// unary builds the handler of a unary method from its request type and
+// the call to make.
+func unary(method string, newReq func() interface{}, call func(MCDFSServer, context.Context, interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := newReq()
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(MCDFSServer), ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/" + method}
+			return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(MCDFSServer), ctx, req)
+			})
+		},
+	}
+}
+
+var ServiceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*MCDFSServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("Delete", func() interface{} { return new(DeleteRequest) },
+			func(s MCDFSServer, ctx context.Context, in interface{}) (interface{}, error) {
+				return s.Delete(ctx, in.(*DeleteRequest))
+			}),
+		unary("Stat", func() interface{} { return new(StatRequest) },
+			func(s MCDFSServer, ctx context.Context, in interface{}) (interface{}, error) {
+				return s.Stat(ctx, in.(*StatRequest))
+			}),
+		unary("VolumeStatus", func() interface{} { return new(VolumeStatusRequest) },
+			func(s MCDFSServer, ctx context.Context, in interface{}) (interface{}, error) {
+				return s.VolumeStatus(ctx, in.(*VolumeStatusRequest))
+			}),
+		unary("ClusterStatus", func() interface{} { return new(ClusterStatusRequest) },
+			func(s MCDFSServer, ctx context.Context, in interface{}) (interface{}, error) {
+				return s.ClusterStatus(ctx, in.(*ClusterStatusRequest))
+			}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Write",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(MCDFSServer).Write(&writeServer{stream})
+			},
+			ClientStreams: true,
+		},
+		{
+			StreamName: "Read",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				m := new(ReadRequest)
+				if err := stream.RecvMsg(m); err != nil {
+					return err
+				}
+				return srv.(MCDFSServer).Read(m, &readServer{stream})
+			},
+			ServerStreams: true,
+		},
+	},
+}
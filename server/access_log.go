@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"github.com/Masterlvng/MCDFS/util"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// accessEntry collects what a handler knows of a request for its line in
+// the access log.
+type accessEntry struct {
+	fid  string
+	size int
+}
+
+type accessKey struct{}
+
+// noteFid records the fid a request read, wrote or deleted, and its size.
+func noteFid(req *http.Request, fid string, size int) {
+	if e, ok := req.Context().Value(accessKey{}).(*accessEntry); ok {
+		e.fid, e.size = fid, size
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessLog gives every request an id, kept from the node that forwarded
+// it, and logs the request once answered. Raft and the other requests
+// between nodes are logged at debug level.
+func accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(util.RequestIdHeader)
+		if id == "" {
+			id = util.NewRequestId()
+			req.Header.Set(util.RequestIdHeader, id)
+		}
+		w.Header().Set(util.RequestIdHeader, id)
+		entry := &accessEntry{}
+		ctx := context.WithValue(util.WithRequestId(req.Context(), id), accessKey{}, entry)
+		sw := &statusWriter{ResponseWriter: w}
+		start := time.Now()
+		h.ServeHTTP(sw, req.WithContext(ctx))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if isInternal(req) {
+			level = slog.LevelDebug
+		}
+		attrs := []slog.Attr{
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", sw.status),
+			slog.Int64("bytes", sw.bytes),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("remote", req.RemoteAddr),
+		}
+		if entry.fid != "" {
+			attrs = append(attrs, slog.String("fid", entry.fid), slog.Int("size", entry.size))
+		}
+		util.Logger(ctx).LogAttrs(ctx, level, "request", attrs...)
+	})
+}
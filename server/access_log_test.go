@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Masterlvng/MCDFS/util"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// captureLogs sends the records of the default logger, from debug up, to
+// the returned buffer as JSON until the end of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+func TestAccessLog(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		id     string
+		level  string
+		fid    string
+		status int
+	}{
+		{"write", "/v1/write", "", "INFO", "3,0/9/42", http.StatusCreated},
+		{"forwarded read", "/read/3/0/9/42", "0123456789abcdef", "INFO", "3,0/9/42", http.StatusOK},
+		{"missing read", "/read/3/0/9/43", "", "INFO", "", http.StatusNotFound},
+		{"raft", "/raft/appendEntries", "fedcba9876543210", "DEBUG", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			var seen string
+			h := accessLog(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				seen = util.RequestId(req.Context())
+				if got := req.Header.Get(util.RequestIdHeader); got != seen {
+					t.Errorf("the request carries id %q to forward, want %q", got, seen)
+				}
+				if tt.fid != "" {
+					noteFid(req, tt.fid, 9)
+				}
+				util.Logger(req.Context()).Info("handled")
+				w.WriteHeader(tt.status)
+				w.Write([]byte("response"))
+			}))
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.id != "" {
+				req.Header.Set(util.RequestIdHeader, tt.id)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if seen == "" || (tt.id != "" && seen != tt.id) {
+				t.Errorf("the handler saw request id %q, want %q", seen, tt.id)
+			}
+			if got := w.Header().Get(util.RequestIdHeader); got != seen {
+				t.Errorf("the response has request id %q, want %q", got, seen)
+			}
+			var records []map[string]interface{}
+			for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+				var r map[string]interface{}
+				if err := json.Unmarshal(line, &r); err != nil {
+					t.Fatalf("%v: %s", err, line)
+				}
+				records = append(records, r)
+			}
+			if len(records) != 2 {
+				t.Fatalf("logged %d records, want 2: %s", len(records), logs)
+			}
+			if records[0]["msg"] != "handled" || records[0]["request"] != seen {
+				t.Errorf("the handler logged %v, want request %s", records[0], seen)
+			}
+			r := records[1]
+			if r["msg"] != "request" || r["level"] != tt.level || r["request"] != seen {
+				t.Errorf("access log = %v, want a request at %s with id %s", r, tt.level, seen)
+			}
+			if r["path"] != tt.path || r["status"] != float64(tt.status) || r["bytes"] != float64(len("response")) {
+				t.Errorf("access log = %v, want path %s, status %d and %d bytes", r, tt.path, tt.status, len("response"))
+			}
+			if tt.fid == "" {
+				if _, ok := r["fid"]; ok {
+					t.Errorf("access log = %v, want no fid", r)
+				}
+			} else if r["fid"] != tt.fid || r["size"] != float64(9) {
+				t.Errorf("access log = %v, want fid %s of 9 bytes", r, tt.fid)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"net/http"
+)
+
+// The /v1 API answers with a single JSON document, and failures with an
+// error status and {"error": {"code": ..., "message": ...}}.
+
+type V1WriteResult struct {
+	Fid  string `json:"fid"`
+	Url  string `json:"url"`
+	Size int    `json:"size"`
+	Name string `json:"name,omitempty"`
+	ETag string `json:"etag"`
+}
+
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newApiError(status int, code string, err error) *apiError {
+	return &apiError{Status: status, Code: code, Message: err.Error()}
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func writeApiError(w http.ResponseWriter, e *apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(map[string]*apiError{"error": e})
+}
+
+func (s *Server) v1WriteHandler(w http.ResponseWriter, req *http.Request) {
+	vid, n, res, e := s.write(w, req)
+	if e != nil {
+		writeApiError(w, e)
+		return
+	}
+	if n == nil {
+		return
+	}
+	// The needle may hold the upload compressed; the result describes the
+	// file as it was uploaded and is read back.
+	data := n.Data
+	if n.IsGzipped() {
+		if d, err := storage.UnGzipData(n.Data); err == nil {
+			data = d
+		}
+	}
+	fid := storage.NewFileId(vid, res.Offset, res.Size, res.Cookie)
+	noteFid(req, fid.String(), len(data))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&V1WriteResult{
+		Fid:  fid.String(),
+		Url:  fmt.Sprintf("%s://%s/read/%s/%d/%d/%d", scheme(), s.publicUrl(), vid.String(), res.Offset, res.Size, res.Cookie),
+		Size: len(data),
+		Name: string(n.Name),
+		ETag: fmt.Sprintf("%08x", storage.NewCRC(data).Value()),
+	})
+}
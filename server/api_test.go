@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v1Upload returns a multipart body holding data as the file name.
+func v1Upload(name string, data []byte) (string, *bytes.Buffer) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", name)
+	fw.Write(data)
+	mw.Close()
+	return mw.FormDataContentType(), &body
+}
+
+// apiErrorOf decodes the error document of a /v1 response.
+func apiErrorOf(t *testing.T, header http.Header, body []byte) *apiError {
+	if ct := header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var doc struct{ Error *apiError }
+	if err := json.Unmarshal(body, &doc); err != nil || doc.Error == nil {
+		t.Fatalf("the body is not an error document: %v: %s", err, body)
+	}
+	return doc.Error
+}
+
+func TestV1WriteErrors(t *testing.T) {
+	s := newTestServer(t)
+	s.installRoutes()
+	tests := []struct {
+		name     string
+		path     string
+		writeKey string
+		token    string
+		status   int
+		code     string
+	}{
+		{"bad fid", "/v1/write/bogus", "", "", http.StatusBadRequest, "invalid_fid"},
+		{"bad ttl", "/v1/write?ttl=forever", "", "", http.StatusBadRequest, "invalid_ttl"},
+		{"no fid", "/v1/write", "write-key", "", http.StatusUnauthorized, "token_required"},
+		{"no token", "/v1/write/3,42", "write-key", "", http.StatusUnauthorized, "token_required"},
+		{"bad token", "/v1/write/3,42", "write-key", "guess", http.StatusUnauthorized, "invalid_token"},
+		{"token of another fid", "/v1/write/3,42", "write-key", util.SignToken([]byte("write-key"), "3,43", time.Minute), http.StatusForbidden, "token_mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.writeKey = nil
+			if tt.writeKey != "" {
+				s.writeKey = []byte(tt.writeKey)
+			}
+			ct, body := v1Upload("a.txt", []byte("a"))
+			req := httptest.NewRequest("POST", tt.path, body)
+			req.Header.Set("Content-Type", ct)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if e := apiErrorOf(t, w.Header(), w.Body.Bytes()); e.Code != tt.code || e.Message == "" {
+				t.Errorf("error = %+v, want code %s and a message", e, tt.code)
+			}
+		})
+	}
+}
+
+func TestV1Write(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a node")
+	}
+	s := startTestNode(t)
+	vid := storage.VolumeId(7)
+	allocate(t, s, vid, "")
+	waitForGroup(t, s, vid, 0)
+	// Text is stored compressed, and the result still describes it as
+	// uploaded.
+	data := []byte(strings.Repeat("compressible text ", 100))
+	ct, body := v1Upload("notes.txt", data)
+	resp, err := http.Post(fmt.Sprintf("http://%s/v1/write?vid=%s", s.publicUrl(), vid.String()), ct, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("status = %d, Content-Type = %q: %s", resp.StatusCode, resp.Header.Get("Content-Type"), b)
+	}
+	var res V1WriteResult
+	if err = json.Unmarshal(b, &res); err != nil {
+		t.Fatalf("%v: %s", err, b)
+	}
+	if _, err = storage.ParseFileId(res.Fid); err != nil {
+		t.Errorf("fid %q: %v", res.Fid, err)
+	}
+	if res.Size != len(data) || res.Name != "notes.txt" {
+		t.Errorf("result = %+v, want %d bytes named notes.txt", res, len(data))
+	}
+	if want := fmt.Sprintf("%08x", storage.NewCRC(data).Value()); res.ETag != want {
+		t.Errorf("ETag = %s, want %s", res.ETag, want)
+	}
+	if !strings.HasSuffix(res.Url, "/read/"+strings.Replace(res.Fid, ",", "/", 1)) {
+		t.Errorf("url %s does not read fid %s", res.Url, res.Fid)
+	}
+	resp, err = http.Get(res.Url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(read, data) {
+		t.Errorf("reading the url returned %d bytes, want the %d written", len(read), len(data))
+	}
+
+	// An upload that is not multipart is refused once it reaches the
+	// volume.
+	resp, err = http.Post(fmt.Sprintf("http://%s/v1/write?vid=%s", s.publicUrl(), vid.String()), "text/plain", strings.NewReader("raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d: %s", resp.StatusCode, http.StatusBadRequest, b)
+	}
+	if e := apiErrorOf(t, resp.Header, b); e.Code != "invalid_upload" {
+		t.Errorf("error = %+v, want invalid_upload", e)
+	}
+}
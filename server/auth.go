@@ -0,0 +1,221 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"github.com/goraft/raft"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The nodes of a cluster share a secret, and with TLS a CA, that guard
+// membership changes and raft traffic. Writes and deletes need a token the master signs for
+// the fid with the write key, and reads of private collections one signed
+// with the read key. Tokens name fids as "vid,cookie", so the token of an
+// assignment also allows deleting what was written with it. The master
+// only hands tokens to the nodes and to the clients with a client key or
+// a certificate the CA signed.
+
+const tokenExpiry = time.Minute
+
+var clusterSecret string
+var clusterTLS *util.CertReloader
+var clientKeys []string
+var peerClient = &http.Client{}
+
+// SetClusterSecret sets the secret shared by the nodes of the cluster. It
+// applies to every server of the process and to RemoveNode.
+func SetClusterSecret(secret string) {
+	clusterSecret = secret
+	peerClient = &http.Client{Transport: peerTransport(0)}
+}
+
+// SetClientKeys sets the keys that clients present in X-Mcdfs-Key to be
+// handed tokens. It applies to every server of the process.
+func SetClientKeys(keys []string) {
+	clientKeys = keys
+}
+
+// SetTLS makes the servers of the process serve HTTPS with the
+// certificate of certs and talk to the other nodes over TLS, presenting
+// it as their client certificate. With a CA, nodes must present a
+// certificate it signed to reach the peer endpoints.
+func SetTLS(certs *util.CertReloader) {
+	clusterTLS = certs
+	peerClient = &http.Client{Transport: peerTransport(0)}
+}
+
+// scheme is the scheme of the URLs clients reach the nodes at.
+func scheme() string {
+	if clusterTLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// peerTransport carries the requests between nodes. Nodes address each
+// other as http://host:port, as the raft logs keep them, so with TLS the
+// transport dials TLS itself rather than relying on the scheme.
+func peerTransport(timeout time.Duration) http.RoundTripper {
+	t := &http.Transport{ResponseHeaderTimeout: timeout}
+	if clusterTLS != nil {
+		d := &tls.Dialer{Config: clusterTLS.ClientConfig()}
+		t.DialContext = d.DialContext
+	}
+	return &util.SecretTransport{Secret: clusterSecret, Base: t}
+}
+
+// peerOnly lets through the requests of the other nodes: those presenting
+// the cluster secret and, with a CA, a certificate it signed.
+func peerOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !util.HasSecret(req, clusterSecret) {
+			http.Error(w, "cluster secret required", http.StatusForbidden)
+			return
+		}
+		if clusterTLS != nil && clusterTLS.HasCA() && (req.TLS == nil || len(req.TLS.VerifiedChains) == 0) {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// authenticated reports whether req comes from a node or from a client
+// the cluster knows: one presenting the cluster secret, a client key or a
+// certificate the CA signed.
+func authenticated(req *http.Request) bool {
+	if clusterSecret != "" && util.HasSecret(req, clusterSecret) {
+		return true
+	}
+	if util.HasClientKey(req, clientKeys) {
+		return true
+	}
+	return clusterTLS != nil && clusterTLS.HasCA() && req.TLS != nil && len(req.TLS.VerifiedChains) > 0
+}
+
+// guardsClients reports whether the cluster tells its clients apart: once
+// it has a write, read or client key, or private collections, the filer,
+// WebDAV and gRPC APIs, which act with the tokens of the master, only
+// answer authenticated callers.
+func (s *Server) guardsClients() bool {
+	return s.writeKey != nil || s.readKey != nil || len(clientKeys) > 0 || len(s.private) > 0
+}
+
+// clientsOnly lets through the requests of authenticated callers when the
+// cluster guards its clients.
+func (s *Server) clientsOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.guardsClients() && !authenticated(req) {
+			http.Error(w, "a client key or certificate is required", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// secureTransporter makes t send raft traffic like the other requests
+// between nodes.
+func secureTransporter(t *raft.HTTPTransporter, timeout time.Duration) {
+	if clusterSecret == "" && clusterTLS == nil {
+		return
+	}
+	t.Transport.RegisterProtocol("http", peerTransport(timeout))
+}
+
+// SetWriteKey makes writes and deletes require a token signed with key.
+// Every node of a cluster should use the same key.
+func (s *Server) SetWriteKey(key string) {
+	if key != "" {
+		s.writeKey = []byte(key)
+	}
+}
+
+// SetReadKey makes reads of the private collections require a token
+// signed with key or a presigned URL. Without a key, only presigned URLs
+// open them.
+func (s *Server) SetReadKey(key string, private []string) {
+	if key != "" {
+		s.readKey = []byte(key)
+	}
+	s.private = make(map[string]bool)
+	for _, c := range private {
+		s.private[c] = true
+	}
+}
+
+func (s *Server) isPrivate(vid storage.VolumeId) bool {
+	if len(s.private) == 0 {
+		return false
+	}
+	if v := s.store.GetVolume(vid); v != nil {
+		return s.private[v.Collection]
+	}
+	if ev := s.store.GetEcVolume(vid); ev != nil {
+		return s.private[ev.Collection]
+	}
+	return false
+}
+
+// authorizeRead checks the presigned URL of a read, or, for the private
+// collections, its token.
+func (s *Server) authorizeRead(req *http.Request, fid *storage.FileId) *apiError {
+	if req.URL.Query().Get("sig") != "" {
+		if s.urlKeys == nil {
+			return newApiError(http.StatusForbidden, "invalid_signature", fmt.Errorf("URLs are not signed here"))
+		}
+		if err := s.urlKeys.Verify(fid.String(), req.URL.Query()); err != nil {
+			return newApiError(http.StatusForbidden, "invalid_signature", err)
+		}
+		return nil
+	}
+	if !s.isPrivate(fid.VolumeId) {
+		return nil
+	}
+	if s.readKey == nil {
+		return newApiError(http.StatusUnauthorized, "signature_required", fmt.Errorf("a presigned URL is required"))
+	}
+	return checkToken(s.readKey, req, fid.VolumeId, fid.Cookie)
+}
+
+// checkToken verifies that req carries a token signed with key for the
+// fid of vid and cookie.
+func checkToken(key []byte, req *http.Request, vid storage.VolumeId, cookie uint32) *apiError {
+	token := util.RequestToken(req)
+	if token == "" {
+		return newApiError(http.StatusUnauthorized, "token_required", fmt.Errorf("token required"))
+	}
+	c, err := util.VerifyToken(key, token)
+	if err != nil {
+		return newApiError(http.StatusUnauthorized, "invalid_token", err)
+	}
+	if c.Fid != storage.AssignedId(vid, cookie) {
+		return newApiError(http.StatusForbidden, "token_mismatch", fmt.Errorf("token is for fid %s", c.Fid))
+	}
+	return nil
+}
+
+// parseTokenFid takes a fid either as assigned ("vid,cookie") or as
+// written ("vid,offset/size/cookie").
+func parseTokenFid(fid string) (storage.VolumeId, uint32, error) {
+	if !strings.Contains(fid, "/") {
+		return storage.ParseAssignedId(fid)
+	}
+	id, err := parseFid(fid)
+	if err != nil {
+		return 0, 0, err
+	}
+	return id.VolumeId, id.Cookie, nil
+}
+
+// parseFid parses "vid,offset/size/cookie", which storage.ParseFileId
+// takes for granted.
+func parseFid(fid string) (*storage.FileId, error) {
+	if strings.Count(fid, ",") != 1 || strings.Count(fid, "/") != 2 {
+		return nil, fmt.Errorf("Invalid fid %s", fid)
+	}
+	return storage.ParseFileId(fid)
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withCredentials sets the cluster secret and the client keys for the
+// length of a test.
+func withCredentials(t *testing.T, secret string, keys ...string) {
+	oldSecret, oldKeys := clusterSecret, clientKeys
+	clusterSecret, clientKeys = secret, keys
+	t.Cleanup(func() { clusterSecret, clientKeys = oldSecret, oldKeys })
+}
+
+func TestAuthenticated(t *testing.T) {
+	withCredentials(t, "s3cret", "k1", "k2")
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   bool
+	}{
+		{"nothing", "", "", false},
+		{"cluster secret", util.SecretHeader, "s3cret", true},
+		{"wrong secret", util.SecretHeader, "guess", false},
+		{"client key", util.ClientKeyHeader, "k2", true},
+		{"wrong client key", util.ClientKeyHeader, "k3", false},
+		{"empty client key", util.ClientKeyHeader, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/dir/token", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			if got := authenticated(req); got != tt.want {
+				t.Errorf("authenticated() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticatedWithoutCredentials(t *testing.T) {
+	withCredentials(t, "")
+	req := httptest.NewRequest("GET", "/dir/token", nil)
+	req.Header.Set(util.SecretHeader, "")
+	if authenticated(req) {
+		t.Error("a cluster without credentials authenticated a caller")
+	}
+}
+
+func TestCheckToken(t *testing.T) {
+	key := []byte("write-key")
+	vid := storage.VolumeId(3)
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"valid", util.SignToken(key, storage.AssignedId(vid, 42), time.Minute), 0},
+		{"missing", "", http.StatusUnauthorized},
+		{"other key", util.SignToken([]byte("other"), storage.AssignedId(vid, 42), time.Minute), http.StatusUnauthorized},
+		{"expired", util.SignToken(key, storage.AssignedId(vid, 42), -time.Minute), http.StatusUnauthorized},
+		{"other cookie", util.SignToken(key, storage.AssignedId(vid, 43), time.Minute), http.StatusForbidden},
+		{"other volume", util.SignToken(key, storage.AssignedId(vid+1, 42), time.Minute), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("DELETE", "/delete/3/0/10/42", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			e := checkToken(key, req, vid, 42)
+			switch {
+			case tt.status == 0 && e != nil:
+				t.Errorf("checkToken() = %d %s, want success", e.Status, e.Message)
+			case tt.status != 0 && e == nil:
+				t.Errorf("checkToken() succeeded, want %d", tt.status)
+			case tt.status != 0 && e.Status != tt.status:
+				t.Errorf("checkToken() = %d, want %d", e.Status, tt.status)
+			}
+		})
+	}
+}
+
+func TestTokenHandler(t *testing.T) {
+	withCredentials(t, "", "client-key")
+	s := &Server{writeKey: []byte("write-key"), readKey: []byte("read-key")}
+	tests := []struct {
+		name   string
+		query  string
+		key    string
+		status int
+		signer []byte
+	}{
+		{"delete", "fid=3,0/10/42&op=delete", "client-key", http.StatusOK, s.writeKey},
+		{"read", "fid=3,42&op=read", "client-key", http.StatusOK, s.readKey},
+		{"anonymous", "fid=3,42&op=delete", "", http.StatusUnauthorized, nil},
+		{"wrong key", "fid=3,42&op=read", "guess", http.StatusUnauthorized, nil},
+		{"unknown op", "fid=3,42&op=write", "client-key", http.StatusBadRequest, nil},
+		{"bad fid", "fid=x&op=read", "client-key", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/dir/token?"+tt.query, nil)
+			if tt.key != "" {
+				req.Header.Set(util.ClientKeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+			s.tokenHandler(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.signer == nil {
+				return
+			}
+			var res TokenResult
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			c, err := util.VerifyToken(tt.signer, res.Auth)
+			if err != nil {
+				t.Fatalf("VerifyToken() = %v", err)
+			}
+			if c.Fid != "3,42" {
+				t.Errorf("token is for %s, want 3,42", c.Fid)
+			}
+		})
+	}
+}
+
+func TestTokenHandlerWithoutKeys(t *testing.T) {
+	withCredentials(t, "")
+	s := &Server{}
+	w := httptest.NewRecorder()
+	s.tokenHandler(w, httptest.NewRequest("GET", "/dir/token?fid=3,42&op=delete", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	var res TokenResult
+	json.NewDecoder(w.Body).Decode(&res)
+	if res.Auth != "" {
+		t.Errorf("auth = %q, want none", res.Auth)
+	}
+}
+
+func TestAssignNeedsCredentialsForTokens(t *testing.T) {
+	withCredentials(t, "", "client-key")
+	s := &Server{writeKey: []byte("write-key")}
+	w := httptest.NewRecorder()
+	s.assignHandler(w, httptest.NewRequest("GET", "/dir/assign", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", w.Code)
+	}
+}
+
+func TestClientRoutesNeedCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		keys   []string
+		set    func(s *Server)
+		header string
+		value  string
+		want   bool // let through
+	}{
+		{"open cluster", nil, func(s *Server) {}, "", "", true},
+		{"client keys", []string{"k1"}, func(s *Server) {}, "", "", false},
+		{"write key", nil, func(s *Server) { s.SetWriteKey("w") }, "", "", false},
+		{"read key", nil, func(s *Server) { s.SetReadKey("r", nil) }, "", "", false},
+		{"private collections", nil, func(s *Server) { s.SetReadKey("", []string{"secret"}) }, "", "", false},
+		{"wrong client key", []string{"k1"}, func(s *Server) {}, util.ClientKeyHeader, "k2", false},
+		{"client key", []string{"k1"}, func(s *Server) { s.SetWriteKey("w") }, util.ClientKeyHeader, "k1", true},
+		{"cluster secret", []string{"k1"}, func(s *Server) {}, util.SecretHeader, "s3cret", true},
+	}
+	requests := []struct{ method, path string }{
+		{"GET", "/filer/"},
+		{"PUT", "/filer/a.txt"},
+		{"DELETE", "/filer/a.txt"},
+		{"PROPFIND", "/dav/"},
+		{"PUT", "/dav/photos/a.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCredentials(t, "s3cret", tt.keys...)
+			s := newTestServer(t)
+			tt.set(s)
+			s.installRoutes()
+			for _, r := range requests {
+				req := httptest.NewRequest(r.method, r.path, strings.NewReader("data"))
+				if tt.header != "" {
+					req.Header.Set(tt.header, tt.value)
+				}
+				w := httptest.NewRecorder()
+				s.router.ServeHTTP(w, req)
+				if refused := w.Code == http.StatusUnauthorized; refused == tt.want {
+					t.Errorf("%s %s: status = %d", r.method, r.path, w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCNeedsCredentials(t *testing.T) {
+	withCredentials(t, "s3cret", "k1")
+	s := &Server{}
+	tests := []struct {
+		name string
+		md   metadata.MD
+		want codes.Code
+	}{
+		{"anonymous", nil, codes.Unauthenticated},
+		{"wrong client key", metadata.Pairs(util.ClientKeyHeader, "k2"), codes.Unauthenticated},
+		{"client key", metadata.Pairs(util.ClientKeyHeader, "k1"), codes.OK},
+		{"cluster secret", metadata.Pairs(util.SecretHeader, "s3cret"), codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+			_, err := s.grpcUnaryAdmit(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/mcdfs.MCDFS/Delete"}, handler)
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("unary call: code = %v, want %v", got, tt.want)
+			}
+			stream := &fakeServerStream{ctx: ctx}
+			err = s.grpcStreamAdmit(nil, stream, &grpc.StreamServerInfo{FullMethod: "/mcdfs.MCDFS/Write"}, func(interface{}, grpc.ServerStream) error { return nil })
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("stream: code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (f *fakeServerStream) Context() context.Context { return f.ctx }
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/util"
+	"github.com/goraft/raft"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Read consistency levels accepted by the "consistency" query parameter.
+const (
+	ConsistencyLocal        = "local"        // serve from the local store as is
+	ConsistencyLeader       = "leader"       // serve from the raft leader
+	ConsistencyLinearizable = "linearizable" // confirm the read index with the leader first
+)
+
+const readIndexTimeout = 2 * time.Second
+
+func (s *Server) leaderConnectionString(rs raft.Server) (string, error) {
+	leader := rs.Leader()
+	if leader == rs.Name() {
+		return s.connectionString(), nil
+	}
+	if peer, ok := rs.Peers()[leader]; ok {
+		return peer.ConnectionString, nil
+	}
+	return "", fmt.Errorf("no leader elected")
+}
+
+func isLeader(rs raft.Server) bool {
+	return rs.State() == raft.Leader
+}
+
+// 把请求原样转发给leader，并把结果写回给客户端
+func (s *Server) forwardToLeader(rs raft.Server, w http.ResponseWriter, req *http.Request) {
+	if status, err := s.proxyToLeader(rs, w, req); err != nil {
+		http.Error(w, err.Error(), status)
+	}
+}
+
+// proxyToLeader is forwardToLeader for handlers that report errors their
+// own way: nothing is written to w when it fails.
+func (s *Server) proxyToLeader(rs raft.Server, w http.ResponseWriter, req *http.Request) (int, error) {
+	leader, err := s.leaderConnectionString(rs)
+	if err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+	r, err := http.NewRequest(req.Method, leader+req.URL.RequestURI(), req.Body)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	r.ContentLength = req.ContentLength
+	copyEndToEnd(r.Header, req.Header)
+	// The secret is for peerClient to add, not for a client to pass on.
+	r.Header.Del(util.SecretHeader)
+	r.Header.Set(util.RequestIdHeader, util.RequestId(req.Context()))
+	resp, err := peerClient.Do(r)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	defer resp.Body.Close()
+	copyEndToEnd(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// hopByHop are the headers of one connection, which a proxy does not
+// pass on (RFC 7230, section 6.1).
+var hopByHop = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// copyEndToEnd copies the headers of from to to, but the hop-by-hop ones
+// and those the Connection header of from names.
+func copyEndToEnd(to http.Header, from http.Header) {
+	skip := make(map[string]bool)
+	for _, h := range hopByHop {
+		skip[h] = true
+	}
+	for _, v := range from["Connection"] {
+		for _, h := range strings.Split(v, ",") {
+			skip[http.CanonicalHeaderKey(strings.TrimSpace(h))] = true
+		}
+	}
+	for k, v := range from {
+		if !skip[k] {
+			to[k] = append([]string(nil), v...)
+		}
+	}
+}
+
+// readState batches the read index requests of a raft group and wakes
+// the reads waiting for the group to apply its log up to an index.
+type readState struct {
+	mutex   sync.Mutex
+	running bool
+	waiting []chan readIndexResult
+	applied chan struct{} // closed on the next commit
+}
+
+type readIndexResult struct {
+	index uint64
+	err   error
+}
+
+// reads returns the readState of rs, which it creates and has notified of
+// the commits of rs on first use.
+func (s *Server) reads(rs raft.Server) *readState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r := s.readStates[rs]; r != nil {
+		return r
+	}
+	if s.readStates == nil {
+		s.readStates = make(map[raft.Server]*readState)
+	}
+	r := &readState{}
+	rs.AddEventListener(raft.CommitEventType, r.committed)
+	s.readStates[rs] = r
+	return r
+}
+
+// readIndex commits a no-op through the log, which proves that this node
+// is still the leader and that every earlier write has been applied. The
+// requests arriving while a no-op is in flight share the next one: it is
+// committed after all of them arrived, so its index is one they can use.
+func (r *readState) readIndex(rs raft.Server) (uint64, error) {
+	c := make(chan readIndexResult, 1)
+	r.mutex.Lock()
+	r.waiting = append(r.waiting, c)
+	if !r.running {
+		r.running = true
+		go r.commitNOPs(rs)
+	}
+	r.mutex.Unlock()
+	res := <-c
+	return res.index, res.err
+}
+
+func (r *readState) commitNOPs(rs raft.Server) {
+	for {
+		r.mutex.Lock()
+		batch := r.waiting
+		r.waiting = nil
+		if len(batch) == 0 {
+			r.running = false
+			r.mutex.Unlock()
+			return
+		}
+		r.mutex.Unlock()
+		var res readIndexResult
+		if _, res.err = rs.Do(raft.NOPCommand{}); res.err == nil {
+			res.index = rs.CommitIndex()
+		}
+		for _, c := range batch {
+			c <- res
+		}
+	}
+}
+
+// committed is called by raft before it applies an entry, with the log
+// locked: it only wakes the waiting reads, which check the commit index
+// once raft has applied the entries it is committing.
+func (r *readState) committed(raft.Event) {
+	r.mutex.Lock()
+	if r.applied != nil {
+		close(r.applied)
+		r.applied = nil
+	}
+	r.mutex.Unlock()
+}
+
+// waitApplied blocks until rs has applied its log up to index.
+func (r *readState) waitApplied(rs raft.Server, index uint64) error {
+	timeout := time.NewTimer(readIndexTimeout)
+	defer timeout.Stop()
+	for {
+		r.mutex.Lock()
+		if r.applied == nil {
+			r.applied = make(chan struct{})
+		}
+		applied := r.applied
+		r.mutex.Unlock()
+		if rs.CommitIndex() >= index {
+			return nil
+		}
+		select {
+		case <-applied:
+		case <-timeout.C:
+			return fmt.Errorf("timeout waiting for index %d", index)
+		}
+	}
+}
+
+// waitReadIndex asks the leader of the volume group (or of the metadata
+// group when vid is empty) for its read index and blocks until the local
+// replica has applied the log up to it.
+func (s *Server) waitReadIndex(vid string) error {
+	rs, err := s.raftGroup(vid)
+	if err != nil {
+		return err
+	}
+	reads := s.reads(rs)
+	var index uint64
+	if isLeader(rs) {
+		if index, err = reads.readIndex(rs); err != nil {
+			return err
+		}
+	} else {
+		leader, err := s.leaderConnectionString(rs)
+		if err != nil {
+			return err
+		}
+		resp, err := peerClient.Get(leader + groupPrefix(vid) + "/readindex")
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("read index: %s", b)
+		}
+		if index, err = strconv.ParseUint(string(b), 10, 64); err != nil {
+			return err
+		}
+	}
+	return reads.waitApplied(rs, index)
+}
+
+func (s *Server) readIndexHandler(w http.ResponseWriter, req *http.Request) {
+	rs, err := s.raftGroup(mux.Vars(req)["vid"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !isLeader(rs) {
+		http.Error(w, raft.NotLeaderError.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	index, err := s.reads(rs).readIndex(rs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte(strconv.FormatUint(index, 10)))
+}
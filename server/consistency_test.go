@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/client"
+	"github.com/Masterlvng/MCDFS/util"
+	"github.com/goraft/raft"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadConsistency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a node")
+	}
+	s := startTestNode(t)
+	fid, err := s.client().Upload(context.Background(), bytes.NewReader([]byte("hello")), client.UploadOptions{FileName: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		consistency string
+		status      int
+	}{
+		{"", http.StatusOK},
+		{ConsistencyLocal, http.StatusOK},
+		{ConsistencyLeader, http.StatusOK},
+		{ConsistencyLinearizable, http.StatusOK},
+		{"eventual", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.consistency, func(t *testing.T) {
+			u := fmt.Sprintf("http://%s/read/%s/%d/%d/%d?consistency=%s", s.publicUrl(), fid.VolumeId.String(), fid.Offset, fid.Size, fid.Cookie, tt.consistency)
+			resp, err := http.Get(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if tt.status == http.StatusOK && string(body) != "hello" {
+				t.Errorf("body = %q, want %q", body, "hello")
+			}
+		})
+	}
+}
+
+func TestWaitReadIndex(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a node")
+	}
+	s := startTestNode(t)
+	if _, err := s.client().Upload(context.Background(), bytes.NewReader([]byte("hello")), client.UploadOptions{FileName: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	vids := s.store.VolumeIds()
+	if len(vids) == 0 {
+		t.Fatal("the upload grew no volume")
+	}
+	tests := []struct {
+		name string
+		vid  string
+		ok   bool
+	}{
+		{"metadata group", "", true},
+		{"volume group", vids[0].String(), true},
+		{"unknown volume", "999", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := uint64(0)
+			if rs, err := s.raftGroup(tt.vid); err == nil {
+				before = rs.CommitIndex()
+			}
+			err := s.waitReadIndex(tt.vid)
+			if (err == nil) != tt.ok {
+				t.Fatalf("waitReadIndex(%q) = %v", tt.vid, err)
+			}
+			if !tt.ok {
+				return
+			}
+			// The read index is a no-op committed after everything before it.
+			if rs, _ := s.raftGroup(tt.vid); rs.CommitIndex() <= before {
+				t.Errorf("commit index %d did not move past %d", rs.CommitIndex(), before)
+			}
+		})
+	}
+}
+
+// slowLeader commits the no-ops it is given once release is closed.
+type slowLeader struct {
+	raft.Server
+	release chan struct{}
+	mutex   sync.Mutex
+	nops    uint64
+}
+
+func (l *slowLeader) Do(raft.Command) (interface{}, error) {
+	<-l.release
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.nops++
+	return nil, nil
+}
+
+func (l *slowLeader) CommitIndex() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.nops
+}
+
+func TestReadIndexesShareNOPs(t *testing.T) {
+	rs := &slowLeader{release: make(chan struct{})}
+	r := &readState{}
+	const reads = 10
+	indexes := make(chan uint64, reads+1)
+	read := func() {
+		index, err := r.readIndex(rs)
+		if err != nil {
+			t.Error(err)
+		}
+		indexes <- index
+	}
+	waitFor := func(done func() bool) {
+		for {
+			r.mutex.Lock()
+			ok := done()
+			r.mutex.Unlock()
+			if ok {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	go read()
+	waitFor(func() bool { return r.running && len(r.waiting) == 0 })
+	// The reads arriving while the first no-op is in flight wait for the
+	// next one together.
+	for i := 0; i < reads; i++ {
+		go read()
+	}
+	waitFor(func() bool { return len(r.waiting) == reads })
+	close(rs.release)
+	got := make(map[uint64]int)
+	for i := 0; i <= reads; i++ {
+		got[<-indexes]++
+	}
+	if got[1] != 1 || got[2] != reads {
+		t.Errorf("the reads got indexes %v, want one 1 and %d 2s", got, reads)
+	}
+	if rs.nops != 2 {
+		t.Errorf("%d reads committed %d no-ops, want 2", reads+1, rs.nops)
+	}
+}
+
+// followerOf is a raft server that is not the leader of its group.
+type followerOf struct {
+	raft.Server
+	leader string
+}
+
+func (f *followerOf) Name() string   { return "follower" }
+func (f *followerOf) Leader() string { return "leader" }
+func (f *followerOf) Peers() map[string]*raft.Peer {
+	return map[string]*raft.Peer{"leader": {Name: "leader", ConnectionString: f.leader}}
+}
+
+func TestProxyToLeaderCopiesEndToEndHeaders(t *testing.T) {
+	var got http.Header
+	var body string
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Content-Range", "bytes 0-1/5")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("he"))
+	}))
+	defer leader.Close()
+	s := &Server{}
+	req := httptest.NewRequest("POST", "/write?vid=1", strings.NewReader("hello"))
+	for k, v := range map[string]string{
+		"Range":           "bytes=0-1",
+		"If-None-Match":   `"xyz"`,
+		"Accept-Encoding": "gzip",
+		"Content-Type":    "text/plain",
+		"Connection":      "X-Hop",
+		"X-Hop":           "1",
+		"Te":              "trailers",
+		util.SecretHeader: "forged",
+	} {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	status, err := s.proxyToLeader(&followerOf{leader: leader.URL}, w, req)
+	if err != nil || status != http.StatusPartialContent {
+		t.Fatalf("proxyToLeader() = %d, %v", status, err)
+	}
+	for _, h := range []string{"Range", "If-None-Match", "Accept-Encoding", "Content-Type"} {
+		if got.Get(h) != req.Header.Get(h) {
+			t.Errorf("the leader got %s: %q, want %q", h, got.Get(h), req.Header.Get(h))
+		}
+	}
+	for _, h := range []string{"X-Hop", "Te", util.SecretHeader} {
+		if got.Get(h) != "" {
+			t.Errorf("the leader got %s: %q", h, got.Get(h))
+		}
+	}
+	if body != "hello" {
+		t.Errorf("the leader got body %q", body)
+	}
+	if w.Header().Get("ETag") != `"abc"` || w.Header().Get("Content-Range") != "bytes 0-1/5" {
+		t.Errorf("the client got headers %v", w.Header())
+	}
+	if w.Header().Get("Keep-Alive") != "" {
+		t.Errorf("the client got Keep-Alive: %q", w.Header().Get("Keep-Alive"))
+	}
+	if w.Code != http.StatusPartialContent || w.Body.String() != "he" {
+		t.Errorf("the client got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"github.com/Masterlvng/MCDFS/command"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+)
+
+// SetDedup turns on content-addressed deduplication: uploading bytes a
+// volume already holds returns the fid of the stored needle. Every node
+// of a cluster should use the same setting.
+func (s *Server) SetDedup(on bool) {
+	s.dedup = on
+}
+
+func (s *Server) deleteHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if s.writeKey != nil {
+		vid, _ := storage.NewVolumeId(vars["vid"])
+		cookie, _ := strconv.ParseUint(vars["cookie"], 10, 32)
+		if e := checkToken(s.writeKey, req, vid, uint32(cookie)); e != nil {
+			http.Error(w, e.Message, e.Status)
+			return
+		}
+	}
+	rs, err := s.raftGroup(vars["vid"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !isLeader(rs) {
+		s.forwardToLeader(rs, w, req)
+		return
+	}
+	c := &command.DeleteCommand{Vid: vars["vid"], Nonce: command.NewNonce()}
+	c.Offset, _ = strconv.ParseUint(vars["offset"], 10, 64)
+	size, _ := strconv.ParseUint(vars["size"], 10, 32)
+	cookie, _ := strconv.ParseUint(vars["cookie"], 10, 32)
+	c.Size, c.Cookie = uint32(size), uint32(cookie)
+	c.RequestId = util.RequestId(req.Context())
+	vid, _ := storage.NewVolumeId(vars["vid"])
+	noteFid(req, storage.NewFileId(vid, c.Offset, c.Size, c.Cookie).String(), int(c.Size))
+	rv, err := rs.Do(c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJson(w, rv)
+}
@@ -0,0 +1,484 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/Masterlvng/MCDFS/command"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Sealed volumes can be converted into Reed-Solomon shards spread over the
+// cluster. The master drives the conversion through the /admin/ec
+// endpoints of the volume servers; reads of a missing shard are served by
+// fetching it, or rebuilding it, from the shards held by other nodes.
+
+type EcLayout struct {
+	VolumeId string           `json:"volumeId"`
+	Shards   map[int][]string `json:"shards"`
+}
+
+func volumeIdVar(req *http.Request) (storage.VolumeId, error) {
+	return storage.NewVolumeId(mux.Vars(req)["vid"])
+}
+
+func parseShards(list string) ([]int, error) {
+	var shards []int
+	for _, item := range strings.Split(list, ",") {
+		if item == "" {
+			continue
+		}
+		shard, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, shard)
+	}
+	return shards, nil
+}
+
+func (s *Server) lookup(vid storage.VolumeId) ([]cluster.Location, error) {
+	if isLeader(s.raftServer) {
+		return s.topology.Lookup(vid), nil
+	}
+	leader, err := s.leaderConnectionString(s.raftServer)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := peerClient.Get(fmt.Sprintf("%s/dir/lookup?volumeId=%s", leader, vid.String()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lookup volume %s: %s", vid.String(), resp.Status)
+	}
+	res := &LookupResult{}
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	return res.Locations, nil
+}
+
+// fetchEcShard is the storage.ShardFetcher of this node.
+func (s *Server) fetchEcShard(vid storage.VolumeId, shard int, offset int64, size int) ([]byte, error) {
+	locations, err := s.lookup(vid)
+	if err != nil {
+		return nil, err
+	}
+	err = fmt.Errorf("shard %d of volume %s not found", shard, vid.String())
+	for _, l := range locations {
+		if l.Url == s.publicUrl() || !hasShard(l.EcShards, shard) {
+			continue
+		}
+		u := fmt.Sprintf("http://%s/admin/ec/shard/%s/%d?offset=%d&size=%d", l.Url, vid.String(), shard, offset, size)
+		resp, e := peerClient.Get(u)
+		if e != nil {
+			err = e
+			continue
+		}
+		data, e := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if e == nil && resp.StatusCode == http.StatusOK && len(data) == size {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func hasShard(shards []int, shard int) bool {
+	for _, k := range shards {
+		if k == shard {
+			return true
+		}
+	}
+	return false
+}
+
+// sealHandler seals a volume through its group.
+func (s *Server) sealHandler(w http.ResponseWriter, req *http.Request) {
+	vid := mux.Vars(req)["vid"]
+	rs, err := s.raftGroup(vid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !isLeader(rs) {
+		s.forwardToLeader(rs, w, req)
+		return
+	}
+	if _, err := rs.Do(&command.SealCommand{Vid: vid}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(s.publicUrl()))
+}
+
+// deleteVolumeHandler drops the volume and its group from this node.
+func (s *Server) deleteVolumeHandler(w http.ResponseWriter, req *http.Request) {
+	vid, err := volumeIdVar(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.dropGroup(vid); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.store.DeleteVolume(vid); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+}
+
+func (s *Server) ecEncodeHandler(w http.ResponseWriter, req *http.Request) {
+	vid, err := volumeIdVar(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.EncodeVolume(vid); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) ecDecodeHandler(w http.ResponseWriter, req *http.Request) {
+	vid, err := volumeIdVar(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.DecodeEcVolume(vid); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// EcVolumeInfo describes an erasure coded volume and the shards a node
+// holds of it.
+type EcVolumeInfo struct {
+	storage.EcInfo
+	Shards []int
+}
+
+func (s *Server) ecInfoHandler(w http.ResponseWriter, req *http.Request) {
+	vid, err := volumeIdVar(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ev := s.store.GetEcVolume(vid)
+	if ev == nil {
+		http.Error(w, "volume not found", http.StatusNotFound)
+		return
+	}
+	writeJson(w, &EcVolumeInfo{EcInfo: ev.Info(), Shards: ev.ShardIds()})
+}
+
+// ecShardHandler serves a range of a local shard, or the whole shard when
+// no size is given.
+func (s *Server) ecShardHandler(w http.ResponseWriter, req *http.Request) {
+	vid, err := volumeIdVar(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	shard, err := strconv.Atoi(mux.Vars(req)["shard"])
+	if err != nil || shard < 0 || shard >= storage.TotalShardsCount {
+		http.Error(w, "invalid shard", http.StatusBadRequest)
+		return
+	}
+	ev := s.store.GetEcVolume(vid)
+	if ev == nil {
+		http.Error(w, "volume not found", http.StatusNotFound)
+		return
+	}
+	if req.FormValue("size") == "" {
+		f, err := ev.OpenLocalShard(shard)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		io.Copy(w, f)
+		return
+	}
+	offset, _ := strconv.ParseInt(req.FormValue("offset"), 10, 64)
+	size, _ := strconv.Atoi(req.FormValue("size"))
+	data, err := ev.ReadLocalShard(shard, offset, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Write(data)
+}
+
+// ecPullHandler copies a shard from the node given by "from", which must
+// be a node of the cluster.
+func (s *Server) ecPullHandler(w http.ResponseWriter, req *http.Request) {
+	vid, err := volumeIdVar(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	shard, err := strconv.Atoi(mux.Vars(req)["shard"])
+	if err != nil || shard < 0 || shard >= storage.TotalShardsCount {
+		http.Error(w, "invalid shard", http.StatusBadRequest)
+		return
+	}
+	from := req.FormValue("from")
+	if !s.isMember(from) {
+		http.Error(w, fmt.Sprintf("%s is not a node of the cluster", from), http.StatusBadRequest)
+		return
+	}
+	resp, err := peerClient.Get(fmt.Sprintf("http://%s/admin/ec/info/%s", from, vid.String()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	info := storage.EcInfo{}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp, err = peerClient.Get(fmt.Sprintf("http://%s/admin/ec/shard/%s/%d", from, vid.String(), shard))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, resp.Status, http.StatusBadGateway)
+		return
+	}
+	if err := s.store.ReceiveEcShard(vid, info, shard, resp.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// ecDeleteHandler removes the listed local shards, or all of them.
+func (s *Server) ecDeleteHandler(w http.ResponseWriter, req *http.Request) {
+	vid, err := volumeIdVar(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	shards, err := parseShards(req.FormValue("shards"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(shards) == 0 {
+		err = s.store.DeleteEcVolume(vid)
+	} else {
+		err = s.store.DeleteEcShards(vid, shards)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// ecTargets spreads the shards of a volume over nodes, shard k going to
+// targets[k]. A node holding more than ParityShardsCount shards would
+// take the volume down with it, so that needs enough nodes.
+func ecTargets(nodes []*cluster.DataNode) ([]string, error) {
+	need := (storage.TotalShardsCount + storage.ParityShardsCount - 1) / storage.ParityShardsCount
+	if len(nodes) < need {
+		return nil, fmt.Errorf("erasure coding needs %d nodes so that none holds more than %d shards, %d are live",
+			need, storage.ParityShardsCount, len(nodes))
+	}
+	targets := make([]string, storage.TotalShardsCount)
+	for shard := range targets {
+		targets[shard] = nodes[shard%len(nodes)].Url
+	}
+	return targets, nil
+}
+
+// dirEcEncodeHandler converts a volume into shards: the volume is sealed
+// through its group, encoded on the group leader and the shards are
+// spread over the live nodes. The replicas of the volume are only dropped
+// once every node has confirmed its shards; until then a failure leaves
+// the volume sealed but whole.
+func (s *Server) dirEcEncodeHandler(w http.ResponseWriter, req *http.Request) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	vid, err := storage.NewVolumeId(req.FormValue("volumeId"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hosts := s.volumeHosts(vid)
+	if len(hosts) == 0 {
+		http.Error(w, "volume not found", http.StatusNotFound)
+		return
+	}
+	targets, err := ecTargets(s.topology.Nodes())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	source, err := postForString(fmt.Sprintf("http://%s/admin/volume/%s/seal", hosts[0], vid.String()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := postMembership(fmt.Sprintf("http://%s/admin/ec/encode/%s", source, vid.String()), nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	layout := &EcLayout{VolumeId: vid.String(), Shards: make(map[int][]string)}
+	var moved []string
+	for shard, target := range targets {
+		if target != source {
+			u := fmt.Sprintf("http://%s/admin/ec/pull/%s/%d?from=%s", target, vid.String(), shard, source)
+			if err := postMembership(u, nil); err != nil {
+				abortEcEncode(vid, source, targets)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			moved = append(moved, strconv.Itoa(shard))
+		}
+		layout.Shards[shard] = []string{target}
+	}
+	if err := confirmEcShards(vid, targets); err != nil {
+		abortEcEncode(vid, source, targets)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(moved) > 0 {
+		u := fmt.Sprintf("http://%s/admin/ec/delete/%s?shards=%s", source, vid.String(), strings.Join(moved, ","))
+		if err := postMembership(u, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, host := range hosts {
+		if err := postMembership(fmt.Sprintf("http://%s/admin/volume/%s/delete", host, vid.String()), nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJson(w, layout)
+}
+
+// confirmEcShards checks that every target holds the shards it was given.
+func confirmEcShards(vid storage.VolumeId, targets []string) error {
+	held := make(map[string][]int)
+	for shard, target := range targets {
+		if _, ok := held[target]; !ok {
+			info, err := getEcVolumeInfo(target, vid)
+			if err != nil {
+				return fmt.Errorf("confirm shards on %s: %s", target, err.Error())
+			}
+			held[target] = info.Shards
+		}
+		if !hasShard(held[target], shard) {
+			return fmt.Errorf("%s does not hold shard %d", target, shard)
+		}
+	}
+	return nil
+}
+
+func getEcVolumeInfo(node string, vid storage.VolumeId) (*EcVolumeInfo, error) {
+	resp, err := peerClient.Get(fmt.Sprintf("http://%s/admin/ec/info/%s", node, vid.String()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	info := &EcVolumeInfo{}
+	if err = json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// abortEcEncode drops the shards of a failed conversion. The replicas of
+// the volume are left as they are.
+func abortEcEncode(vid storage.VolumeId, source string, targets []string) {
+	done := map[string]bool{}
+	for _, node := range append([]string{source}, targets...) {
+		if done[node] {
+			continue
+		}
+		done[node] = true
+		if err := postMembership(fmt.Sprintf("http://%s/admin/ec/delete/%s", node, vid.String()), nil); err != nil {
+			slog.Warn("cannot drop the shards of a failed conversion", "volume", vid.String(), "node", node, "err", err)
+		}
+	}
+}
+
+// dirEcDecodeHandler turns the shards back into a sealed volume on the
+// node holding most of them.
+func (s *Server) dirEcDecodeHandler(w http.ResponseWriter, req *http.Request) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	vid, err := storage.NewVolumeId(req.FormValue("volumeId"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var holders []cluster.Location
+	target := -1
+	for _, l := range s.topology.Lookup(vid) {
+		if len(l.EcShards) == 0 {
+			continue
+		}
+		holders = append(holders, l)
+		if target < 0 || len(l.EcShards) > len(holders[target].EcShards) {
+			target = len(holders) - 1
+		}
+	}
+	if target < 0 {
+		http.Error(w, "volume not found", http.StatusNotFound)
+		return
+	}
+	if err := postMembership(fmt.Sprintf("http://%s/admin/ec/decode/%s", holders[target].Url, vid.String()), nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, l := range holders {
+		if i == target {
+			continue
+		}
+		if err := postMembership(fmt.Sprintf("http://%s/admin/ec/delete/%s", l.Url, vid.String()), nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJson(w, &LookupResult{VolumeId: vid.String(), Locations: []cluster.Location{{Url: holders[target].Url}}})
+}
+
+func postForString(url string) (string, error) {
+	resp, err := peerClient.Post(url, "application/json", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return string(b), nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEcPullRejectsUnknownNodes(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		name  string
+		shard string
+		from  string
+	}{
+		{"outside the cluster", "0", "169.254.169.254:80"},
+		{"empty", "0", ""},
+		{"negative shard", "-1", "localhost:4001"},
+		{"shard out of range", "14", "localhost:4001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/admin/ec/pull/1/"+tt.shard+"?from="+tt.from, nil)
+			req = mux.SetURLVars(req, map[string]string{"vid": "1", "shard": tt.shard})
+			w := httptest.NewRecorder()
+			s.ecPullHandler(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+		})
+	}
+}
+
+func TestIsMember(t *testing.T) {
+	s := newTestServer(t)
+	if !s.isMember("localhost:4001") {
+		t.Error("the node itself is not a member")
+	}
+	if !s.isMember("http://LocalHost:4001/") {
+		t.Error("the connection string of the node itself is not a member")
+	}
+	if s.isMember("localhost:4002") {
+		t.Error("an unknown node is a member")
+	}
+}
+
+func TestEcTargets(t *testing.T) {
+	tests := []struct {
+		nodes   int
+		wantErr bool
+	}{
+		{1, true},
+		{2, true},
+		{3, true},
+		{4, false},
+		{5, false},
+		{7, false},
+		{14, false},
+		{20, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d nodes", tt.nodes), func(t *testing.T) {
+			var nodes []*cluster.DataNode
+			for i := 0; i < tt.nodes; i++ {
+				nodes = append(nodes, &cluster.DataNode{Name: fmt.Sprint(i), Url: fmt.Sprintf("node%d:4001", i)})
+			}
+			targets, err := ecTargets(nodes)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ecTargets() = %v, want an error", targets)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(targets) != storage.TotalShardsCount {
+				t.Fatalf("got %d targets, want %d", len(targets), storage.TotalShardsCount)
+			}
+			held := make(map[string]int)
+			for _, target := range targets {
+				held[target]++
+			}
+			for node, n := range held {
+				if n > storage.ParityShardsCount {
+					t.Errorf("%s holds %d shards, more than %d", node, n, storage.ParityShardsCount)
+				}
+			}
+		})
+	}
+}
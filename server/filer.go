@@ -0,0 +1,339 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/client"
+	"github.com/Masterlvng/MCDFS/command"
+	"github.com/Masterlvng/MCDFS/filer"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/goraft/raft"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const filerListLimit = 1000
+
+type FilerListing struct {
+	Path    string
+	Entries []*filer.Entry
+}
+
+// SetFilerStore replaces the store of the filer namespace. It has to be
+// called before ListenAndServe.
+func (s *Server) SetFilerStore(st filer.Store) {
+	s.context.Filer = filer.New(st)
+}
+
+// client talks to the cluster through this node.
+func (s *Server) client() *client.Client {
+	return client.New([]string{s.publicUrl()}, client.WithHTTPClient(peerClient))
+}
+
+func filerPath(req *http.Request) string {
+	return filer.Clean(strings.TrimPrefix(req.URL.Path, "/filer"))
+}
+
+func filerStatus(err error) int {
+	switch err {
+	case filer.ErrNotFound, client.ErrNotFound:
+		return http.StatusNotFound
+	case filer.ErrExists, filer.ErrIsDir, filer.ErrNotDir, filer.ErrNotEmpty:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// doFiler applies a filer command through the metadata leader and decodes
+// its result into v.
+func (s *Server) doFiler(endpoint string, c raft.Command, v interface{}) error {
+	var body io.Reader
+	if isLeader(s.raftServer) {
+		rv, err := s.raftServer.Do(c)
+		if err != nil || v == nil {
+			return err
+		}
+		content, err := json.Marshal(rv)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+	} else {
+		leader, err := s.leaderConnectionString(s.raftServer)
+		if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		json.NewEncoder(&b).Encode(c)
+		resp, err := peerClient.Post(leader+"/dir/filer/"+endpoint, "application/json", &b)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			if err, ok := filer.Errors[strings.TrimSpace(string(msg))]; ok {
+				return err
+			}
+			return fmt.Errorf("%s: %s", resp.Status, msg)
+		}
+		if v == nil {
+			return nil
+		}
+		body = resp.Body
+	}
+	return json.NewDecoder(body).Decode(v)
+}
+
+func (s *Server) filerMetaHandler(w http.ResponseWriter, req *http.Request) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	var c raft.Command
+	switch strings.TrimPrefix(req.URL.Path, "/dir/filer/") {
+	case "create":
+		c = &command.FilerCreateCommand{}
+	case "delete":
+		c = &command.FilerDeleteCommand{}
+	case "rename":
+		c = &command.FilerRenameCommand{}
+	default:
+		http.Error(w, "unknown filer command", http.StatusNotFound)
+		return
+	}
+	if err := json.NewDecoder(req.Body).Decode(c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rv, err := s.raftServer.Do(c)
+	if err != nil {
+		http.Error(w, err.Error(), filerStatus(err))
+		return
+	}
+	writeJson(w, rv)
+}
+
+// putEntry creates or replaces a file; the content of the file it
+// replaces is deleted. Every entry put holds its own reference to its
+// fids, even those a deduplicated upload shares with the file it
+// replaces, so all of them are freed.
+func (s *Server) putEntry(e *filer.Entry) error {
+	var old *filer.Entry
+	if err := s.doFiler("create", &command.FilerCreateCommand{Entry: *e}, &old); err != nil {
+		return err
+	}
+	if old != nil {
+		s.deleteFids([]*filer.Entry{old})
+	}
+	return nil
+}
+
+// removeEntry removes a file or a directory and the content of the files
+// that go with it.
+func (s *Server) removeEntry(p string, recursive bool) error {
+	var files []*filer.Entry
+	err := s.doFiler("delete", &command.FilerDeleteCommand{Path: p, Recursive: recursive}, &files)
+	if err != nil {
+		return err
+	}
+	s.deleteFids(files)
+	return nil
+}
+
+func (s *Server) renameEntry(from string, to string) error {
+	return s.doFiler("rename", &command.FilerRenameCommand{From: from, To: to, Mtime: time.Now()}, nil)
+}
+
+// uploadEntry stores data and returns the file entry pointing at it.
+func (s *Server) uploadEntry(ctx context.Context, p string, data []byte, mimeType string, collection string, ttl string) (*filer.Entry, error) {
+	fid, err := s.client().Upload(ctx, bytes.NewReader(data), client.UploadOptions{
+		FileName:   path.Base(p),
+		MimeType:   mimeType,
+		Collection: collection,
+		Ttl:        ttl,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(data)
+	return &filer.Entry{
+		Path:  p,
+		Fid:   fid.String(),
+		Size:  int64(len(data)),
+		Mime:  mimeType,
+		ETag:  hex.EncodeToString(sum[:]),
+		Mtime: time.Now(),
+	}, nil
+}
+
+// readEntry writes length bytes of the content of e from offset to w.
+func (s *Server) readEntry(ctx context.Context, e *filer.Entry, offset int64, length int64, w io.Writer) error {
+	chunks := e.Chunks
+	if e.Fid != "" {
+		chunks = []filer.Chunk{{Fid: e.Fid, Size: e.Size}}
+	}
+	c := s.client()
+	var start int64
+	for _, chunk := range chunks {
+		end := start + chunk.Size
+		if length > 0 && end > offset && start < offset+length {
+			fid, err := storage.ParseFileId(chunk.Fid)
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err = c.Download(ctx, fid, &buf); err != nil {
+				return err
+			}
+			data := buf.Bytes()
+			from, to := int64(0), int64(len(data))
+			if offset > start {
+				from = offset - start
+			}
+			if offset+length < end {
+				to = offset + length - start
+			}
+			if from > to || to > int64(len(data)) {
+				return fmt.Errorf("chunk %s is shorter than recorded", chunk.Fid)
+			}
+			if _, err = w.Write(data[from:to]); err != nil {
+				return err
+			}
+		}
+		start = end
+	}
+	return nil
+}
+
+// deleteFids deletes the content of removed files. Failures only leave
+// garbage behind, so they are logged and skipped.
+func (s *Server) deleteFids(files []*filer.Entry) {
+	c := s.client()
+	for _, e := range files {
+		for _, f := range e.Fids() {
+			fid, err := storage.ParseFileId(f)
+			if err == nil {
+				err = c.Delete(context.Background(), fid)
+			}
+			if err != nil {
+				slog.Warn("cannot delete the content of a removed file", "fid", f, "path", e.Path, "err", err)
+			}
+		}
+	}
+}
+
+// filerHandler serves /filer/<path>:
+//
+//	GET     reads a file or lists a directory; ?meta=true returns the entry
+//	POST    uploads a file; ?rename=<path> renames, ?mkdir=true creates a directory
+//	DELETE  removes a file, or a directory with ?recursive=true
+func (s *Server) filerHandler(w http.ResponseWriter, req *http.Request) {
+	var err error
+	switch {
+	case req.Method == "GET" || req.Method == "HEAD":
+		s.filerReadHandler(w, req)
+		return
+	case req.Method == "DELETE":
+		err = s.removeEntry(filerPath(req), req.FormValue("recursive") == "true")
+	case req.URL.Query().Get("mkdir") == "true":
+		err = s.putEntry(&filer.Entry{Path: filerPath(req), IsDir: true, Mtime: time.Now()})
+	case req.URL.Query().Get("rename") != "":
+		err = s.renameEntry(filerPath(req), filer.Clean(req.URL.Query().Get("rename")))
+	default:
+		var e *filer.Entry
+		if e, err = s.filerUpload(req); err == nil {
+			writeJson(w, e)
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), filerStatus(err))
+	}
+}
+
+func (s *Server) filerReadHandler(w http.ResponseWriter, req *http.Request) {
+	e, err := s.context.Filer.Find(filerPath(req))
+	if err != nil {
+		http.Error(w, err.Error(), filerStatus(err))
+		return
+	}
+	if req.FormValue("meta") == "true" {
+		writeJson(w, e)
+		return
+	}
+	if e.IsDir {
+		limit, _ := strconv.Atoi(req.FormValue("limit"))
+		if limit <= 0 || limit > filerListLimit {
+			limit = filerListLimit
+		}
+		entries, err := s.context.Filer.List(e.Path, req.FormValue("after"), limit)
+		if err != nil {
+			http.Error(w, err.Error(), filerStatus(err))
+			return
+		}
+		writeJson(w, &FilerListing{Path: e.Path, Entries: entries})
+		return
+	}
+	var buf bytes.Buffer
+	if err = s.readEntry(req.Context(), e, 0, e.Size, &buf); err != nil {
+		http.Error(w, err.Error(), filerStatus(err))
+		return
+	}
+	if e.Mime != "" {
+		w.Header().Set("Content-Type", e.Mime)
+	}
+	if e.ETag != "" {
+		w.Header().Set("ETag", `"`+e.ETag+`"`)
+	}
+	w.Header().Set("Last-Modified", e.Mtime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	buf.WriteTo(w)
+}
+
+// filerUpload stores the first part of a multipart upload and points the
+// path at it.
+func (s *Server) filerUpload(req *http.Request) (*filer.Entry, error) {
+	p := filerPath(req)
+	if p == "/" {
+		return nil, filer.ErrIsDir
+	}
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(part)
+	if err != nil {
+		return nil, err
+	}
+	mimeType := part.Header.Get("Content-Type")
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		if t := mime.TypeByExtension(path.Ext(p)); t != "" {
+			mimeType = t
+		}
+	}
+	e, err := s.uploadEntry(req.Context(), p, data, mimeType, req.FormValue("collection"), req.FormValue("ttl"))
+	if err != nil {
+		return nil, err
+	}
+	if err = s.putEntry(e); err != nil {
+		s.deleteFids([]*filer.Entry{e})
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/command"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/goraft/raft"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Every volume is replicated by its own raft group so that writes to
+// different volumes are ordered by different leaders. The group's raft
+// endpoints live under groupPrefix(vid); the metadata group keeps the
+// original paths and an empty prefix.
+func groupPrefix(vid string) string {
+	if vid == "" {
+		return ""
+	}
+	return "/group/" + vid
+}
+
+func (s *Server) group(vid storage.VolumeId) raft.Server {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.groups[vid]
+}
+
+// raftGroup returns the volume group named by vid, or the metadata group
+// when vid is empty.
+func (s *Server) raftGroup(vid string) (raft.Server, error) {
+	if vid == "" {
+		return s.raftServer, nil
+	}
+	id, err := storage.NewVolumeId(vid)
+	if err != nil {
+		return nil, err
+	}
+	if rs := s.group(id); rs != nil {
+		return rs, nil
+	}
+	return nil, fmt.Errorf("no raft group for volume %s", vid)
+}
+
+func (s *Server) startGroup(vid storage.VolumeId, leader string) error {
+	prefix := groupPrefix(vid.String())
+	path := filepath.Join(s.path, "group", vid.String())
+	if err := os.MkdirAll(path, 0744); err != nil {
+		return err
+	}
+	t := raft.NewHTTPTransporter(prefix+"/raft", s.timings.TransportTimeout)
+	secureTransporter(t, s.timings.TransportTimeout)
+	rs, err := raft.NewServer(s.name, path, t, &groupState{s: s, vid: vid}, s.context, "")
+	if err != nil {
+		return err
+	}
+	if snapshots, _ := ioutil.ReadDir(filepath.Join(path, "snapshot")); len(snapshots) > 0 {
+		if err = rs.LoadSnapshot(); err != nil {
+			slog.Error("cannot load snapshot", "volume", vid.String(), "err", err)
+		}
+	}
+	t.Install(rs, s)
+	rs.SetHeartbeatInterval(s.timings.HeartbeatInterval)
+	rs.SetElectionTimeout(s.timings.ElectionTimeout)
+	if err = rs.Start(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.groups[vid] = rs
+	s.mutex.Unlock()
+	go s.snapshotGroup(vid, rs)
+
+	join := &raft.DefaultJoinCommand{
+		Name:             s.name,
+		ConnectionString: s.connectionString(),
+	}
+	if leader != "" {
+		return postJSON(fmt.Sprintf("http://%s%s/join", leader, prefix), join)
+	}
+	if rs.IsLogEmpty() {
+		if _, err = rs.Do(join); err != nil {
+			return err
+		}
+		return s.hostGroup(vid.String(), s.name, s.connectionString())
+	}
+	return nil
+}
+
+// groupSnapshotEntries is how many entries a volume group commits between
+// two snapshots, and so about how many it keeps in its log.
+const groupSnapshotEntries = 1000
+
+const groupSnapshotPulse = 10 * time.Second
+
+// snapshotGroup snapshots the group of vid every groupSnapshotEntries
+// entries, until the group stops.
+func (s *Server) snapshotGroup(vid storage.VolumeId, rs raft.Server) {
+	ticker := time.NewTicker(groupSnapshotPulse)
+	defer ticker.Stop()
+	last := rs.CommitIndex()
+	for range ticker.C {
+		if !rs.Running() {
+			return
+		}
+		if index := rs.CommitIndex(); index-last >= groupSnapshotEntries {
+			if err := rs.TakeSnapshot(); err != nil {
+				slog.Error("cannot snapshot volume group", "volume", vid.String(), "err", err)
+				continue
+			}
+			last = index
+		}
+	}
+}
+
+// volumeCheckpoint is the snapshot of a volume group: the size of the
+// data file at a checkpoint of the volume, and the node that took it.
+type volumeCheckpoint struct {
+	Size int64
+	Node string
+}
+
+// groupState is the state machine of a volume group. The volume holds
+// every command the group applied, so a snapshot only checkpoints it, and
+// the group compacts its log instead of keeping every needle forever. A
+// replica too far behind for the log left catches up on the data file of
+// the node that took the snapshot.
+type groupState struct {
+	s   *Server
+	vid storage.VolumeId
+}
+
+func (g *groupState) Save() ([]byte, error) {
+	v := g.s.store.GetVolume(g.vid)
+	if v == nil {
+		return nil, fmt.Errorf("no volume %s", g.vid.String())
+	}
+	size, err := v.Checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&volumeCheckpoint{Size: size, Node: g.s.publicUrl()})
+}
+
+// groupRecoveryAttempts bounds how often a replica tries to catch up on a
+// snapshot: raft gives up on the node when Recovery fails.
+const groupRecoveryAttempts = 5
+
+func (g *groupState) Recovery(b []byte) error {
+	var c volumeCheckpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+	v := g.s.store.GetVolume(g.vid)
+	if v == nil {
+		return fmt.Errorf("no volume %s", g.vid.String())
+	}
+	var err error
+	for i := 0; i < groupRecoveryAttempts; i++ {
+		from := v.Size()
+		if from >= c.Size {
+			return nil
+		}
+		if err = g.fetch(v, c, from); err == nil {
+			return nil
+		}
+		slog.Warn("cannot catch up on a volume snapshot", "volume", g.vid.String(), "from", c.Node, "err", err)
+		time.Sleep(time.Second)
+	}
+	return err
+}
+
+// fetch appends the data file of the node that took the snapshot c from
+// from on.
+func (g *groupState) fetch(v *storage.Volume, c volumeCheckpoint, from int64) error {
+	resp, err := peerClient.Get(fmt.Sprintf("http://%s/admin/volume/%s/data?from=%d&to=%d", c.Node, g.vid.String(), from, c.Size))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", c.Node, resp.Status)
+	}
+	return v.AppendData(io.LimitReader(resp.Body, c.Size-from), from)
+}
+
+// volumeDataHandler serves a section of the data file of a volume to a
+// replica catching up on a snapshot.
+func (s *Server) volumeDataHandler(w http.ResponseWriter, req *http.Request) {
+	vid, err := volumeIdVar(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v := s.store.GetVolume(vid)
+	if v == nil {
+		http.Error(w, "volume not found", http.StatusNotFound)
+		return
+	}
+	from, err := strconv.ParseInt(req.FormValue("from"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := strconv.ParseInt(req.FormValue("to"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r, err := v.DataSection(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(to-from, 10))
+	io.Copy(w, r)
+}
+
+// writableVolume picks the volume for a new needle with the given TTL. A
+// pinned vid is used as is; otherwise volumes whose group is led by this
+// node are preferred so that the write does not need to be forwarded.
+func (s *Server) writableVolume(vid string, ttl storage.TTL) (*storage.Volume, raft.Server, error) {
+	if vid != "" {
+		id, err := storage.NewVolumeId(vid)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := s.store.GetVolume(id)
+		rs := s.group(id)
+		if v == nil || rs == nil {
+			return nil, nil, fmt.Errorf("volume %s not found", vid)
+		}
+		return v, rs, nil
+	}
+	var fallback *storage.Volume
+	for range s.store.VolumeIds() {
+		v := s.store.FreeVolume()
+		if v == nil || v.ReadOnly() || v.Ttl != ttl {
+			continue
+		}
+		if s.sizeLimit > 0 && uint64(v.Size()) >= s.sizeLimit {
+			continue
+		}
+		rs := s.group(v.Id)
+		if rs == nil {
+			continue
+		}
+		if isLeader(rs) {
+			return v, rs, nil
+		}
+		if fallback == nil {
+			fallback = v
+		}
+	}
+	if fallback == nil {
+		return nil, nil, fmt.Errorf("no writable volume")
+	}
+	return fallback, s.group(fallback.Id), nil
+}
+
+// hostGroup and unhostGroup update the group table through the metadata
+// group, forwarding to its leader when needed.
+func (s *Server) hostGroup(vid string, name string, connectionString string) error {
+	return s.doMeta(vid, "/host", &command.HostGroupCommand{
+		Vid:              vid,
+		Name:             name,
+		ConnectionString: connectionString,
+	})
+}
+
+func (s *Server) unhostGroup(vid string, name string) error {
+	return s.doMeta(vid, "/unhost", &command.UnhostGroupCommand{
+		Vid:  vid,
+		Name: name,
+	})
+}
+
+func (s *Server) doMeta(vid string, endpoint string, c raft.Command) error {
+	if isLeader(s.raftServer) {
+		_, err := s.raftServer.Do(c)
+		return err
+	}
+	leader, err := s.leaderConnectionString(s.raftServer)
+	if err != nil {
+		return err
+	}
+	return postJSON(leader+groupPrefix(vid)+endpoint, c)
+}
+
+func postJSON(url string, v interface{}) error {
+	var b bytes.Buffer
+	json.NewEncoder(&b).Encode(v)
+	return postMembership(url, &b)
+}
+
+func (s *Server) hostHandler(w http.ResponseWriter, req *http.Request) {
+	s.metaHandler(w, req, &command.HostGroupCommand{})
+}
+
+func (s *Server) unhostHandler(w http.ResponseWriter, req *http.Request) {
+	s.metaHandler(w, req, &command.UnhostGroupCommand{})
+}
+
+func (s *Server) metaHandler(w http.ResponseWriter, req *http.Request, c raft.Command) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	if err := json.NewDecoder(req.Body).Decode(c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.raftServer.Do(c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) groupsHandler(w http.ResponseWriter, req *http.Request) {
+	content, _ := json.Marshal(s.context.Groups.Snapshot())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+// dropGroup stops the volume group on this node and forgets its log.
+func (s *Server) dropGroup(vid storage.VolumeId) error {
+	s.mutex.Lock()
+	rs := s.groups[vid]
+	delete(s.groups, vid)
+	delete(s.readStates, rs)
+	s.mutex.Unlock()
+	if rs == nil {
+		return nil
+	}
+	rs.Stop()
+	if err := os.RemoveAll(filepath.Join(s.path, "group", vid.String())); err != nil {
+		return err
+	}
+	return s.unhostGroup(vid.String(), s.name)
+}
+
+const expirePulse = time.Minute
+
+// expireVolumes drops the TTL volumes whose needles have all expired.
+func (s *Server) expireVolumes() {
+	for range time.Tick(expirePulse) {
+		if !s.raftServer.Running() {
+			return
+		}
+		for _, vid := range s.store.ExpiredVolumes() {
+			if err := s.dropGroup(vid); err != nil {
+				slog.Error("cannot drop the group of an expired volume", "volume", vid.String(), "err", err)
+			}
+			if err := s.store.DeleteVolume(vid); err != nil {
+				slog.Error("cannot delete expired volume", "volume", vid.String(), "err", err)
+			} else {
+				slog.Info("deleted expired volume", "volume", vid.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/command"
+	"github.com/Masterlvng/MCDFS/storage"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// allocate creates volume vid on s, which bootstraps its group, or joins
+// the group led by leader.
+func allocate(t *testing.T, s *Server, vid storage.VolumeId, leader string) {
+	u := fmt.Sprintf("http://%s/admin/volume/%s", s.publicUrl(), vid.String())
+	if leader != "" {
+		u += "?join=" + leader
+	}
+	if err := postMembership(u, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForGroup waits until the group of vid on s has want peers besides s.
+func waitForGroup(t *testing.T, s *Server, vid storage.VolumeId, want int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if rs := s.group(vid); rs != nil && len(rs.Peers()) == want && rs.Leader() != "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the group of volume %s on %s does not have %d peers", vid.String(), s.name, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// writeNeedle uploads data to volume vid through s and returns where it
+// was stored.
+func writeNeedle(t *testing.T, s *Server, vid storage.VolumeId, data string) *storage.FileId {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "a.txt")
+	fw.Write([]byte(data))
+	mw.Close()
+	resp, err := http.Post(fmt.Sprintf("http://%s/write?vid=%s", s.publicUrl(), vid.String()), mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("write: %s: %s", resp.Status, content)
+	}
+	var res command.WriteRes
+	if err = json.Unmarshal(bytes.TrimPrefix(content, []byte(vid.String())), &res); err != nil {
+		t.Fatalf("write: %v: %s", err, content)
+	}
+	return storage.NewFileId(vid, res.Offset, res.Size, res.Cookie)
+}
+
+// waitForNeedle waits until the replica of s holds data at fid.
+func waitForNeedle(t *testing.T, s *Server, fid *storage.FileId, data string) {
+	deadline := time.Now().Add(10 * time.Second)
+	u := fmt.Sprintf("http://%s/read/%s/%d/%d/%d?consistency=%s", s.publicUrl(), fid.VolumeId.String(), fid.Offset, fid.Size, fid.Cookie, ConsistencyLocal)
+	for {
+		var body []byte
+		resp, err := http.Get(u)
+		if err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err == nil && resp.StatusCode == http.StatusOK && string(body) == data {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s does not hold %s: %v %s", s.name, fid.String(), err, body)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestGrow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	leader := startTestNode(t)
+	node := startNode(t, leader.publicUrl())
+	if _, err := leader.raftServer.Do(&command.SetPolicyCommand{Collection: "photo", Policy: "same rack 1"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(leader.topology.Nodes()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the master does not know the second node")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	res, err := leader.grow("photo", storage.EmptyTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Urls) != 2 {
+		t.Fatalf("grow() placed the volume on %v, want both nodes", res.Urls)
+	}
+	vid, _ := storage.NewVolumeId(res.VolumeId)
+	for _, s := range []*Server{leader, node} {
+		if v := s.store.GetVolume(vid); v == nil || v.Collection != "photo" {
+			t.Errorf("%s does not hold volume %s of photo", s.name, res.VolumeId)
+		}
+		waitForGroup(t, s, vid, 1)
+	}
+	deadline = time.Now().Add(10 * time.Second)
+	for len(leader.context.Groups.Snapshot()[res.VolumeId]) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the group table has %v for volume %s", leader.context.Groups.Snapshot()[res.VolumeId], res.VolumeId)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestWriteThroughAGroupLeader(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	leader := startTestNode(t)
+	node := startNode(t, leader.publicUrl())
+	// The second node leads the group of the volume, not the metadata
+	// group, and a write reaching the first is forwarded to it.
+	vid := storage.VolumeId(7)
+	allocate(t, node, vid, "")
+	allocate(t, leader, vid, node.publicUrl())
+	waitForGroup(t, leader, vid, 1)
+	if name := leader.group(vid).Leader(); name != node.name {
+		t.Fatalf("the group is led by %s, want %s", name, node.name)
+	}
+	fid := writeNeedle(t, leader, vid, "forwarded")
+	waitForNeedle(t, node, fid, "forwarded")
+	waitForNeedle(t, leader, fid, "forwarded")
+}
+
+func TestJoinCatchesUpOnASnapshot(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	leader := startTestNode(t)
+	vid := storage.VolumeId(7)
+	allocate(t, leader, vid, "")
+	waitForGroup(t, leader, vid, 0)
+	// Past the entries a snapshot keeps, the log no longer starts at the
+	// beginning and a new replica gets the snapshot.
+	var fids []*storage.FileId
+	for i := 0; i < 250; i++ {
+		fids = append(fids, writeNeedle(t, leader, vid, fmt.Sprintf("needle %d", i)))
+	}
+	if err := leader.group(vid).TakeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	fids = append(fids, writeNeedle(t, leader, vid, "after the snapshot"))
+
+	node := startNode(t, leader.publicUrl())
+	allocate(t, node, vid, leader.publicUrl())
+	waitForGroup(t, node, vid, 1)
+	waitForNeedle(t, node, fids[0], "needle 0")
+	waitForNeedle(t, node, fids[len(fids)-1], "after the snapshot")
+	// The entries after the snapshot were replayed without writing twice.
+	if got, want := node.store.GetVolume(vid).Size(), leader.store.GetVolume(vid).Size(); got != want {
+		t.Errorf("the replica has %d bytes, want %d", got, want)
+	}
+	snapshots, err := ioutil.ReadDir(filepath.Join(node.path, "group", vid.String(), "snapshot"))
+	if err != nil || len(snapshots) != 1 {
+		t.Errorf("the replica saved %d snapshots: %v", len(snapshots), err)
+	}
+}
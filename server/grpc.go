@@ -0,0 +1,356 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/client"
+	"github.com/Masterlvng/MCDFS/command"
+	"github.com/Masterlvng/MCDFS/rpc"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ServeGRPC serves the rpc.MCDFS service on addr. Files of the volumes
+// this node holds are read from its store and deleted through its raft
+// groups; the others, and every write, take the same way through the
+// cluster as the filer does.
+func (s *Server) ServeGRPC(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	g := s.newGRPCServer()
+	s.mutex.Lock()
+	s.grpcServer = g
+	s.mutex.Unlock()
+	return g.Serve(l)
+}
+
+func (s *Server) newGRPCServer() *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.grpcUnaryAdmit),
+		grpc.StreamInterceptor(s.grpcStreamAdmit),
+	}
+	if clusterTLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(clusterTLS.ServerConfig())))
+	}
+	g := grpc.NewServer(opts...)
+	rpc.RegisterMCDFSServer(g, &grpcServer{s: s})
+	return g
+}
+
+// grpcRequest is the HTTP request the calls of ctx amount to: the
+// cluster secret or a client key in their metadata, under the names of
+// the HTTP headers, the certificate of their TLS connection and the
+// address of their client.
+func grpcRequest(ctx context.Context) *http.Request {
+	req := &http.Request{Header: http.Header{}}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, h := range []string{util.SecretHeader, util.ClientKeyHeader} {
+		if v := md.Get(h); len(v) > 0 {
+			req.Header.Set(h, v[0])
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			req.TLS = &info.State
+		}
+	}
+	return req
+}
+
+// grpcAdmit holds the calls of the service to what clientsOnly and the
+// rate limits hold the filer to.
+func (s *Server) grpcAdmit(ctx context.Context) error {
+	req := grpcRequest(ctx)
+	if s.guardsClients() && !authenticated(req) {
+		return status.Error(codes.Unauthenticated, "a client key or certificate is required")
+	}
+	if s.admission != nil && !fromPeer(req) {
+		if wait := s.admission.take(clientAddr(req)); wait > 0 {
+			return status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry in %v", wait)
+		}
+	}
+	return nil
+}
+
+func (s *Server) grpcUnaryAdmit(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.grpcAdmit(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) grpcStreamAdmit(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.grpcAdmit(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+type grpcServer struct {
+	s *Server
+}
+
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusServiceUnavailable, http.StatusBadGateway:
+		return codes.Unavailable
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	}
+	return codes.Internal
+}
+
+func grpcError(err error) error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *client.StatusError:
+		return status.Error(grpcCode(e.StatusCode), e.Message)
+	case *apiError:
+		return status.Error(grpcCode(e.Status), e.Message)
+	}
+	if err == client.ErrNotFound {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func parseGrpcFid(fid string) (*storage.FileId, error) {
+	id, err := parseFid(fid)
+	if err != nil || id.Size == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid fid %q", fid)
+	}
+	return id, nil
+}
+
+// localNeedle reads fid from the store when this node holds its volume;
+// it returns a nil needle when it does not.
+func (g *grpcServer) localNeedle(fid *storage.FileId, consistency string) (*storage.Needle, error) {
+	s := g.s
+	if !s.store.HasVolume(fid.VolumeId) && s.store.GetEcVolume(fid.VolumeId) == nil {
+		return nil, nil
+	}
+	switch consistency {
+	case "", ConsistencyLocal:
+	case ConsistencyLeader, ConsistencyLinearizable:
+		// Once the local replica has applied the read index of the
+		// leader, it is as fresh as the leader itself.
+		if s.group(fid.VolumeId) != nil {
+			if err := s.waitReadIndex(fid.VolumeId.String()); err != nil {
+				return nil, status.Error(codes.Unavailable, err.Error())
+			}
+		}
+	default:
+		return nil, status.Error(codes.InvalidArgument, "unknown consistency")
+	}
+	n := &storage.Needle{Offset: fid.Offset, Size: fid.Size, Cookie: fid.Cookie}
+	if _, err := s.store.Read(fid.VolumeId, n); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return n, nil
+}
+
+func needleInfo(fid *storage.FileId, n *storage.Needle) *rpc.FileInfo {
+	info := &rpc.FileInfo{Fid: fid.String(), Size: int64(len(n.Data))}
+	if n.HasName() {
+		info.Name = string(n.Name)
+	}
+	if n.HasMime() {
+		info.Mime = string(n.Mime)
+	}
+	if n.HasLastModifiedDate() {
+		info.LastModified = int64(n.LastModified)
+	}
+	return info
+}
+
+func (g *grpcServer) Write(stream rpc.MCDFS_WriteServer) error {
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "empty write")
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := storage.ReadTTL(first.Ttl); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The size of a stream is only known at its end, so the room it takes
+	// for an upload grows with every chunk.
+	var u *upload
+	if a := g.s.admission; a != nil {
+		var code int
+		if u, code, err = a.admitUpload(0); err != nil {
+			return status.Error(grpcCode(code), err.Error())
+		}
+		defer u.release()
+	}
+	var data bytes.Buffer
+	for m := first; ; {
+		if u != nil {
+			if code, err := u.grow(int64(len(m.Data))); err != nil {
+				return status.Error(grpcCode(code), err.Error())
+			}
+		}
+		data.Write(m.Data)
+		if m, err = stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	fid, err := g.s.client().Upload(stream.Context(), bytes.NewReader(data.Bytes()), client.UploadOptions{
+		FileName:   first.Name,
+		MimeType:   first.Mime,
+		Collection: first.Collection,
+		Ttl:        first.Ttl,
+	})
+	if err != nil {
+		return grpcError(err)
+	}
+	return stream.SendAndClose(&rpc.WriteResponse{
+		Fid:  fid.String(),
+		Size: int64(data.Len()),
+		Name: first.Name,
+		ETag: fmt.Sprintf("%08x", storage.NewCRC(data.Bytes()).Value()),
+	})
+}
+
+// chunkSender sends what is written to it as ReadResponses of at most
+// rpc.ChunkSize bytes, the first one carrying info.
+type chunkSender struct {
+	stream rpc.MCDFS_ReadServer
+	info   *rpc.FileInfo
+}
+
+func (c *chunkSender) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		size := len(p)
+		if size > rpc.ChunkSize {
+			size = rpc.ChunkSize
+		}
+		if err := c.stream.Send(&rpc.ReadResponse{Info: c.info, Data: p[:size]}); err != nil {
+			return written, err
+		}
+		c.info = nil
+		p, written = p[size:], written+size
+	}
+	return written, nil
+}
+
+func (g *grpcServer) Read(req *rpc.ReadRequest, stream rpc.MCDFS_ReadServer) error {
+	fid, err := parseGrpcFid(req.Fid)
+	if err != nil {
+		return err
+	}
+	n, err := g.localNeedle(fid, req.Consistency)
+	if err != nil {
+		return err
+	}
+	if n != nil {
+		w := &chunkSender{stream: stream, info: needleInfo(fid, n)}
+		if len(n.Data) == 0 {
+			return stream.Send(&rpc.ReadResponse{Info: w.info})
+		}
+		_, err = w.Write(n.Data)
+		return err
+	}
+	info, err := g.stat(stream.Context(), fid)
+	if err != nil {
+		return err
+	}
+	w := &chunkSender{stream: stream, info: info}
+	if err = g.s.client().Read(stream.Context(), fid, req.Consistency, w); err != nil {
+		return grpcError(err)
+	}
+	if w.info != nil {
+		return stream.Send(&rpc.ReadResponse{Info: w.info})
+	}
+	return nil
+}
+
+func (g *grpcServer) stat(ctx context.Context, fid *storage.FileId) (*rpc.FileInfo, error) {
+	n, err := g.localNeedle(fid, ConsistencyLocal)
+	if err != nil {
+		return nil, err
+	}
+	if n != nil {
+		return needleInfo(fid, n), nil
+	}
+	fi, err := g.s.client().Stat(ctx, fid)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	info := &rpc.FileInfo{Fid: fid.String(), Size: fi.Size, Name: fi.Name, Mime: fi.MimeType}
+	if !fi.LastModified.IsZero() {
+		info.LastModified = fi.LastModified.Unix()
+	}
+	return info, nil
+}
+
+func (g *grpcServer) Stat(ctx context.Context, req *rpc.StatRequest) (*rpc.FileInfo, error) {
+	fid, err := parseGrpcFid(req.Fid)
+	if err != nil {
+		return nil, err
+	}
+	return g.stat(ctx, fid)
+}
+
+func (g *grpcServer) Delete(ctx context.Context, req *rpc.DeleteRequest) (*rpc.DeleteResponse, error) {
+	fid, err := parseGrpcFid(req.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if rs := g.s.group(fid.VolumeId); rs != nil && isLeader(rs) {
+		_, err = rs.Do(&command.DeleteCommand{
+			Vid:    fid.VolumeId.String(),
+			Offset: fid.Offset,
+			Size:   fid.Size,
+			Cookie: fid.Cookie,
+			Nonce:  command.NewNonce(),
+		})
+		if err != nil {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return &rpc.DeleteResponse{}, nil
+	}
+	if err = g.s.client().Delete(ctx, fid); err != nil {
+		return nil, grpcError(err)
+	}
+	return &rpc.DeleteResponse{}, nil
+}
+
+func (g *grpcServer) VolumeStatus(ctx context.Context, req *rpc.VolumeStatusRequest) (*rpc.VolumeStatusResponse, error) {
+	return &rpc.VolumeStatusResponse{Node: g.s.dataNode()}, nil
+}
+
+func (g *grpcServer) ClusterStatus(ctx context.Context, req *rpc.ClusterStatusRequest) (*rpc.ClusterStatusResponse, error) {
+	if isLeader(g.s.raftServer) {
+		return &rpc.ClusterStatusResponse{Nodes: g.s.topology.Nodes()}, nil
+	}
+	nodes, err := g.s.client().Status(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &rpc.ClusterStatusResponse{Nodes: nodes}, nil
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/rpc"
+	"github.com/Masterlvng/MCDFS/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// dialGRPC serves the gRPC API of s over an in-memory listener and
+// returns a client of it.
+func dialGRPC(t *testing.T, s *Server) rpc.MCDFSClient {
+	l := bufconn.Listen(1 << 20)
+	g := s.newGRPCServer()
+	go g.Serve(l)
+	t.Cleanup(g.Stop)
+	dial := func(ctx context.Context, addr string) (net.Conn, error) { return l.DialContext(ctx) }
+	conn, err := grpc.NewClient("passthrough:///bufconn", grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return rpc.NewMCDFSClient(conn)
+}
+
+// grpcRead reads fid and returns the messages it was sent in.
+func grpcRead(c rpc.MCDFSClient, fid string) ([]*rpc.ReadResponse, error) {
+	stream, err := c.Read(context.Background(), &rpc.ReadRequest{Fid: fid})
+	if err != nil {
+		return nil, err
+	}
+	var messages []*rpc.ReadResponse
+	for {
+		m, err := stream.Recv()
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, m)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a node")
+	}
+	s := startTestNode(t)
+	c := dialGRPC(t, s)
+	ctx := context.Background()
+
+	data := make([]byte, 2*rpc.ChunkSize+rpc.ChunkSize/2)
+	rand.New(rand.NewSource(1)).Read(data)
+	w, err := c.Write(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i += rpc.ChunkSize / 2 {
+		m := &rpc.WriteRequest{Data: data[i:min(i+rpc.ChunkSize/2, len(data))]}
+		if i == 0 {
+			m.Name, m.Mime = "photo", "image/png"
+		}
+		if err = w.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := w.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Size != int64(len(data)) || res.Name != "photo" {
+		t.Errorf("Write() = %+v, want %d bytes named photo", res, len(data))
+	}
+	if want := fmt.Sprintf("%08x", storage.NewCRC(data).Value()); res.ETag != want {
+		t.Errorf("Write() ETag = %s, want %s", res.ETag, want)
+	}
+
+	messages, err := grpcRead(c, res.Fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 {
+		t.Errorf("Read() sent %d messages, want 3", len(messages))
+	}
+	var read bytes.Buffer
+	for i, m := range messages {
+		if (m.Info != nil) != (i == 0) {
+			t.Errorf("message %d carries info: %v", i, m.Info != nil)
+		}
+		if len(m.Data) > rpc.ChunkSize {
+			t.Errorf("message %d carries %d bytes, more than a chunk", i, len(m.Data))
+		}
+		read.Write(m.Data)
+	}
+	if !bytes.Equal(read.Bytes(), data) {
+		t.Errorf("Read() returned %d bytes that differ from the %d written", read.Len(), len(data))
+	}
+	if info := messages[0].Info; info.Fid != res.Fid || info.Size != int64(len(data)) || info.Name != "photo" || info.Mime != "image/png" {
+		t.Errorf("Read() info = %+v", info)
+	}
+
+	info, err := c.Stat(ctx, &rpc.StatRequest{Fid: res.Fid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) || info.Name != "photo" {
+		t.Errorf("Stat() = %+v", info)
+	}
+
+	if _, err = c.Delete(ctx, &rpc.DeleteRequest{Fid: res.Fid}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = grpcRead(c, res.Fid); status.Code(err) != codes.NotFound {
+		t.Errorf("Read() after Delete = %v, want NotFound", err)
+	}
+	if _, err = c.Stat(ctx, &rpc.StatRequest{Fid: res.Fid}); status.Code(err) != codes.NotFound {
+		t.Errorf("Stat() after Delete = %v, want NotFound", err)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a node")
+	}
+	s := startTestNode(t)
+	c := dialGRPC(t, s)
+	ctx := context.Background()
+	write := func(messages ...*rpc.WriteRequest) error {
+		w, err := c.Write(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			if err = w.Send(m); err != nil {
+				return err
+			}
+		}
+		_, err = w.CloseAndRecv()
+		return err
+	}
+	tests := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{"read of a bad fid", func() error { _, err := grpcRead(c, "bogus"); return err }, codes.InvalidArgument},
+		{"stat of a bad fid", func() error { _, err := c.Stat(ctx, &rpc.StatRequest{Fid: "1,2"}); return err }, codes.InvalidArgument},
+		{"delete of a bad fid", func() error { _, err := c.Delete(ctx, &rpc.DeleteRequest{Fid: ""}); return err }, codes.InvalidArgument},
+		{"empty write", func() error { return write() }, codes.InvalidArgument},
+		{"write with a bad ttl", func() error { return write(&rpc.WriteRequest{Ttl: "forever", Data: []byte("a")}) }, codes.InvalidArgument},
+		{"read of a missing volume", func() error { _, err := grpcRead(c, "999,0/5/1"); return err }, codes.NotFound},
+		{"stat of a missing volume", func() error { _, err := c.Stat(ctx, &rpc.StatRequest{Fid: "999,0/5/1"}); return err }, codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); status.Code(err) != tt.want {
+				t.Errorf("code = %v, want %v: %v", status.Code(err), tt.want, err)
+			}
+		})
+	}
+}
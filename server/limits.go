@@ -0,0 +1,249 @@
+package server
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/util"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits bounds the load a node takes. Rates are in requests per second;
+// zero fields mean no limit. Requests over a rate get 429, uploads over
+// the in-flight caps get 503, both with a Retry-After, and a single
+// upload over MaxUploadBytes gets 413.
+type Limits struct {
+	Rate             float64 // all clients together
+	Burst            int
+	ClientRate       float64 // each client address
+	ClientBurst      int
+	MaxUploads       int   // uploads in flight
+	MaxUploadBytes   int64 // bytes of one upload
+	MaxInFlightBytes int64 // bytes of the uploads in flight
+}
+
+// SetLimits applies l to the HTTP API, the S3 gateway and the gRPC API.
+func (s *Server) SetLimits(l Limits) {
+	s.admission = newAdmission(l)
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// take takes a token, or returns how long until there is one.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full reports whether b has refilled, when it is no different from a
+// new bucket.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+type admission struct {
+	limits  Limits
+	mutex   sync.Mutex
+	global  *tokenBucket
+	clients map[string]*tokenBucket
+	swept   time.Time
+	uploads int
+	bytes   int64
+}
+
+func newAdmission(l Limits) *admission {
+	a := &admission{limits: l, clients: make(map[string]*tokenBucket), swept: time.Now()}
+	if l.Rate > 0 {
+		a.global = newTokenBucket(l.Rate, l.Burst, time.Now())
+	}
+	return a
+}
+
+// internalPaths are the requests nodes make to each other. They are
+// logged at debug level, but their path alone exempts nothing from the
+// limits: anyone can ask for it, see fromPeer.
+var internalPaths = []string{"/raft/", "/group/", "/join", "/leave", "/remove/", "/readindex", "/dir/heartbeat", "/dir/filer/", "/admin/"}
+
+func isInternal(req *http.Request) bool {
+	for _, p := range internalPaths {
+		if strings.HasPrefix(req.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromPeer reports whether req proves it comes from another node: it
+// carries the cluster secret and, with a CA, a certificate the CA signed.
+// Without a secret or a CA, no request does.
+func fromPeer(req *http.Request) bool {
+	hasCA := clusterTLS != nil && clusterTLS.HasCA()
+	if clusterSecret == "" && !hasCA {
+		return false
+	}
+	if !util.HasSecret(req, clusterSecret) {
+		return false
+	}
+	return !hasCA || (req.TLS != nil && len(req.TLS.VerifiedChains) > 0)
+}
+
+func isUpload(req *http.Request) bool {
+	if req.Method != "POST" && req.Method != "PUT" {
+		return false
+	}
+	for _, p := range []string{"/write", "/v1/write", "/filer/", davPrefix + "/"} {
+		if strings.HasPrefix(req.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isS3Upload reports whether req puts an object or a part of one to the
+// S3 gateway; a PUT without a key creates a bucket.
+func isS3Upload(req *http.Request) bool {
+	return req.Method == "PUT" && strings.Contains(strings.Trim(req.URL.Path, "/"), "/")
+}
+
+func clientAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// take takes a token from the global bucket and the bucket of client.
+func (a *admission) take(client string) time.Duration {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := time.Now()
+	if a.global != nil {
+		if wait := a.global.take(now); wait > 0 {
+			return wait
+		}
+	}
+	if a.limits.ClientRate <= 0 {
+		return 0
+	}
+	if now.Sub(a.swept) > time.Minute {
+		for c, b := range a.clients {
+			if b.full(now) {
+				delete(a.clients, c)
+			}
+		}
+		a.swept = now
+	}
+	b := a.clients[client]
+	if b == nil {
+		b = newTokenBucket(a.limits.ClientRate, a.limits.ClientBurst, now)
+		a.clients[client] = b
+	}
+	return b.take(now)
+}
+
+// upload is the room admitted for one upload.
+type upload struct {
+	a    *admission
+	size int64
+}
+
+// admitUpload admits an upload of size bytes, -1 when it is unknown, or
+// returns the status to reject it with.
+func (a *admission) admitUpload(size int64) (*upload, int, error) {
+	if size < 0 && (a.limits.MaxUploadBytes > 0 || a.limits.MaxInFlightBytes > 0) {
+		return nil, http.StatusLengthRequired, fmt.Errorf("uploads need a Content-Length")
+	}
+	a.mutex.Lock()
+	if a.limits.MaxUploads > 0 && a.uploads >= a.limits.MaxUploads {
+		a.mutex.Unlock()
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("too many uploads in flight")
+	}
+	a.uploads++
+	a.mutex.Unlock()
+	u := &upload{a: a}
+	if size > 0 {
+		if status, err := u.grow(size); err != nil {
+			u.release()
+			return nil, status, err
+		}
+	}
+	return u, 0, nil
+}
+
+// grow reserves n more bytes for u, which is rejected when it outgrows
+// MaxUploadBytes or the bytes in flight would outgrow MaxInFlightBytes.
+func (u *upload) grow(n int64) (int, error) {
+	a := u.a
+	if a.limits.MaxUploadBytes > 0 && u.size+n > a.limits.MaxUploadBytes {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("upload larger than %d bytes", a.limits.MaxUploadBytes)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.limits.MaxInFlightBytes > 0 && a.bytes+n > a.limits.MaxInFlightBytes {
+		return http.StatusServiceUnavailable, fmt.Errorf("too many bytes in flight")
+	}
+	a.bytes += n
+	u.size += n
+	return 0, nil
+}
+
+// release gives back the room of u.
+func (u *upload) release() {
+	a := u.a
+	a.mutex.Lock()
+	a.uploads--
+	a.bytes -= u.size
+	a.mutex.Unlock()
+	u.size = 0
+}
+
+func reject(w http.ResponseWriter, status int, wait time.Duration, err error) {
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(math.Max(1, wait.Seconds())))))
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// wrap rejects the requests over the limits before they reach h; the
+// requests isUpload reports also take room for an upload.
+func (a *admission) wrap(h http.Handler, isUpload func(*http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !fromPeer(req) {
+			if wait := a.take(clientAddr(req)); wait > 0 {
+				reject(w, http.StatusTooManyRequests, wait, fmt.Errorf("rate limit exceeded"))
+				return
+			}
+		}
+		if isUpload(req) {
+			u, status, err := a.admitUpload(req.ContentLength)
+			if err != nil {
+				reject(w, status, time.Second, err)
+				return
+			}
+			defer u.release()
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"github.com/Masterlvng/MCDFS/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		takes []time.Duration // since start
+		waits []time.Duration
+	}{
+		{"within the burst", 1, 2, []time.Duration{0, 0}, []time.Duration{0, 0}},
+		{"over the burst", 1, 2, []time.Duration{0, 0, 0}, []time.Duration{0, 0, time.Second}},
+		{"refills with time", 2, 1, []time.Duration{0, 0, 500 * time.Millisecond}, []time.Duration{0, 500 * time.Millisecond, 0}},
+		{"refills up to the burst", 10, 2, []time.Duration{0, 0, time.Hour, time.Hour, time.Hour}, []time.Duration{0, 0, 0, 0, 100 * time.Millisecond}},
+		{"burst defaults to the rate", 3, 0, []time.Duration{0, 0, 0, 0}, []time.Duration{0, 0, 0, time.Second / 3}},
+		{"burst of at least one", 0.5, 0, []time.Duration{0, 0}, []time.Duration{0, 2 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate, tt.burst, start)
+			for i, at := range tt.takes {
+				wait := b.take(start.Add(at))
+				if d := wait - tt.waits[i]; d > time.Millisecond || d < -time.Millisecond {
+					t.Errorf("take %d = %v, want %v", i, wait, tt.waits[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketFull(t *testing.T) {
+	start := time.Unix(1000, 0)
+	b := newTokenBucket(1, 2, start)
+	if !b.full(start) {
+		t.Error("a new bucket is not full")
+	}
+	b.take(start)
+	if b.full(start.Add(500 * time.Millisecond)) {
+		t.Error("the bucket is full before it refilled")
+	}
+	if !b.full(start.Add(time.Second)) {
+		t.Error("the bucket is not full once it refilled")
+	}
+}
+
+func TestFromPeer(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		path   string
+		sent   string
+		want   bool
+	}{
+		{"no secret configured", "", "/dir/heartbeat", "", false},
+		{"internal path without the secret", "s3cret", "/raft/appendEntries", "", false},
+		{"internal path with a wrong secret", "s3cret", "/admin/volume/1", "guess", false},
+		{"internal path with the secret", "s3cret", "/raft/appendEntries", "s3cret", true},
+		{"client path with the secret", "s3cret", "/write/1,2", "s3cret", true},
+		{"client path without the secret", "s3cret", "/write/1,2", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCredentials(t, tt.secret)
+			req := httptest.NewRequest("POST", tt.path, nil)
+			if tt.sent != "" {
+				req.Header.Set(util.SecretHeader, tt.sent)
+			}
+			if got := fromPeer(req); got != tt.want {
+				t.Errorf("fromPeer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdmissionLimitsInternalPathsWithoutProof(t *testing.T) {
+	withCredentials(t, "s3cret")
+	a := newAdmission(Limits{ClientRate: 1, ClientBurst: 1})
+	h := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), isUpload)
+	tests := []struct {
+		name   string
+		secret string
+		status int
+	}{
+		{"first request", "", http.StatusOK},
+		{"over the rate", "", http.StatusTooManyRequests},
+		{"peer over the rate", "s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/dir/heartbeat", nil)
+		if tt.secret != "" {
+			req.Header.Set(util.SecretHeader, tt.secret)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After", tt.name)
+		}
+	}
+}
+
+func TestAdmitUpload(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		sizes  []int64
+		status []int
+	}{
+		{"no limits", Limits{}, []int64{-1, 1 << 30}, []int{0, 0}},
+		{"uploads in flight", Limits{MaxUploads: 2}, []int64{1, 1, 1}, []int{0, 0, http.StatusServiceUnavailable}},
+		{"bytes in flight", Limits{MaxInFlightBytes: 10}, []int64{6, 4, 1}, []int{0, 0, http.StatusServiceUnavailable}},
+		{"upload over the cap", Limits{MaxUploadBytes: 10}, []int64{11}, []int{http.StatusRequestEntityTooLarge}},
+		{"uploads under the cap", Limits{MaxUploadBytes: 10}, []int64{10, 10, 10}, []int{0, 0, 0}},
+		{"unknown length", Limits{MaxUploadBytes: 10}, []int64{-1}, []int{http.StatusLengthRequired}},
+		{"unknown length in flight", Limits{MaxInFlightBytes: 10}, []int64{-1}, []int{http.StatusLengthRequired}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdmission(tt.limits)
+			var uploads []*upload
+			for i, size := range tt.sizes {
+				u, status, _ := a.admitUpload(size)
+				if status != tt.status[i] {
+					t.Errorf("upload %d: status = %d, want %d", i, status, tt.status[i])
+				}
+				if u != nil {
+					uploads = append(uploads, u)
+				}
+			}
+			for _, u := range uploads {
+				u.release()
+			}
+			if a.uploads != 0 || a.bytes != 0 {
+				t.Errorf("%d uploads and %d bytes left in flight after release", a.uploads, a.bytes)
+			}
+		})
+	}
+}
+
+func TestUploadGrows(t *testing.T) {
+	a := newAdmission(Limits{MaxUploadBytes: 8, MaxInFlightBytes: 10})
+	u, _, _ := a.admitUpload(0)
+	v, _, _ := a.admitUpload(0)
+	if status, err := u.grow(6); err != nil {
+		t.Fatalf("grow(6) = %d %v", status, err)
+	}
+	if status, _ := v.grow(6); status != http.StatusServiceUnavailable {
+		t.Errorf("growing over the bytes in flight: status = %d, want 503", status)
+	}
+	if status, _ := u.grow(3); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("growing over the upload cap: status = %d, want 413", status)
+	}
+	u.release()
+	if status, err := v.grow(6); err != nil {
+		t.Errorf("grow(6) once the other upload is released = %d %v", status, err)
+	}
+	v.release()
+	if a.uploads != 0 || a.bytes != 0 {
+		t.Errorf("%d uploads and %d bytes left in flight after release", a.uploads, a.bytes)
+	}
+}
+
+func TestIsUpload(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		upload bool
+		s3     bool
+	}{
+		{"POST", "/write", true, false},
+		{"PUT", "/filer/a/b", true, true},
+		{"GET", "/filer/a/b", false, false},
+		{"PUT", "/bucket", false, false},
+		{"PUT", "/bucket/", false, false},
+		{"PUT", "/bucket/key", false, true},
+		{"PUT", "/bucket/dir/key?partNumber=1&uploadId=u", false, true},
+		{"POST", "/bucket/key?uploadId=u", false, false},
+		{"POST", "/bucket?delete", false, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		if got := isUpload(req); got != tt.upload {
+			t.Errorf("isUpload(%s %s) = %v, want %v", tt.method, tt.url, got, tt.upload)
+		}
+		if got := isS3Upload(req); got != tt.s3 {
+			t.Errorf("isS3Upload(%s %s) = %v, want %v", tt.method, tt.url, got, tt.s3)
+		}
+	}
+}
+
+func TestGRPCCallsAreRateLimited(t *testing.T) {
+	withCredentials(t, "s3cret")
+	s := &Server{admission: newAdmission(Limits{ClientRate: 1, ClientBurst: 1})}
+	from := func(ip string, md metadata.MD) context.Context {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 5000}})
+		return metadata.NewIncomingContext(ctx, md)
+	}
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want codes.Code
+	}{
+		{"first call", from("10.0.0.1", nil), codes.OK},
+		{"over the rate", from("10.0.0.1", nil), codes.ResourceExhausted},
+		{"another client", from("10.0.0.2", nil), codes.OK},
+		{"peer over the rate", from("10.0.0.1", metadata.Pairs(util.SecretHeader, "s3cret")), codes.OK},
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	for _, tt := range tests {
+		_, err := s.grpcUnaryAdmit(tt.ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/mcdfs.MCDFS/Stat"}, handler)
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: code = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The leader of the metadata group acts as the master: volume servers
+// report their volumes to it and clients ask it where to write and read.
+const (
+	heartbeatPulse   = 1 * time.Second
+	heartbeatTimeout = 5 * heartbeatPulse
+)
+
+// Assignment carries the token to write the fid with when the cluster
+// has a write key.
+type Assignment struct {
+	Fid  string `json:"fid"`
+	Url  string `json:"url"`
+	Auth string `json:"auth,omitempty"`
+}
+
+type LookupResult struct {
+	VolumeId  string             `json:"volumeId"`
+	Locations []cluster.Location `json:"locations"`
+}
+
+// TokenResult carries the token to delete a fid or to read it from a
+// private collection, empty when the cluster has no key for that.
+type TokenResult struct {
+	Auth string `json:"auth"`
+}
+
+func (s *Server) publicUrl() string {
+	return fmt.Sprintf("%s:%d", s.host, s.port)
+}
+
+func (s *Server) dataNode() *cluster.DataNode {
+	n := &cluster.DataNode{
+		Name:       s.name,
+		Url:        s.publicUrl(),
+		DataCenter: s.dataCenter,
+		Rack:       s.rack,
+		Volumes:    s.store.VolumeInfos(),
+		EcShards:   s.store.EcShards(),
+		EcVolumes:  s.store.EcVolumeInfos(),
+	}
+	for _, vid := range s.store.VolumeIds() {
+		if rs := s.group(vid); rs != nil && isLeader(rs) {
+			n.Leads = append(n.Leads, vid)
+		}
+	}
+	return n
+}
+
+// heartbeat reports this node to the master every pulse until the raft
+// server stops.
+func (s *Server) heartbeat() {
+	for range time.Tick(heartbeatPulse) {
+		if !s.raftServer.Running() {
+			return
+		}
+		if isLeader(s.raftServer) {
+			s.applyPolicies()
+			s.topology.Register(s.dataNode())
+			s.setUsage(s.topology.Usage())
+			continue
+		}
+		leader, err := s.leaderConnectionString(s.raftServer)
+		if err != nil {
+			continue
+		}
+		var b bytes.Buffer
+		json.NewEncoder(&b).Encode(s.dataNode())
+		resp, err := peerClient.Post(leader+"/dir/heartbeat", "application/json", &b)
+		if err != nil {
+			slog.Warn("heartbeat failed", "leader", leader, "err", err)
+			continue
+		}
+		var usage []*cluster.Usage
+		if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&usage) == nil {
+			s.setUsage(usage)
+		} else if resp.StatusCode != http.StatusOK {
+			slog.Warn("heartbeat failed", "leader", leader, "status", resp.Status)
+		}
+		resp.Body.Close()
+	}
+}
+
+func (s *Server) heartbeatHandler(w http.ResponseWriter, req *http.Request) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	n := &cluster.DataNode{}
+	if err := json.NewDecoder(req.Body).Decode(n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.topology.Register(n)
+	// The usage goes back to the node, which checks quotas on write.
+	writeJson(w, s.topology.Usage())
+}
+
+func (s *Server) assignHandler(w http.ResponseWriter, req *http.Request) {
+	if s.writeKey != nil && !authenticated(req) {
+		http.Error(w, "a client key or certificate is required", http.StatusUnauthorized)
+		return
+	}
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	collection := req.FormValue("collection")
+	ttl, err := storage.ReadTTL(req.FormValue("ttl"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if e := s.checkQuota(collection, 0); e != nil {
+		http.Error(w, e.Message, e.Status)
+		return
+	}
+	vid, url, err := s.topology.PickForWrite(collection, ttl.String())
+	if err != nil {
+		// Volumes of new collections and TTLs are created on demand.
+		var res *GrowResult
+		if res, err = s.grow(collection, ttl); err == nil {
+			vid, _ = storage.NewVolumeId(res.VolumeId)
+			url = res.Urls[0]
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	a := &Assignment{
+		Fid: storage.AssignedId(vid, rand.Uint32()),
+		Url: url,
+	}
+	if s.writeKey != nil {
+		a.Auth = util.SignToken(s.writeKey, a.Fid, tokenExpiry)
+	}
+	writeJson(w, a)
+}
+
+func (s *Server) lookupHandler(w http.ResponseWriter, req *http.Request) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	vid, err := storage.NewVolumeId(req.FormValue("volumeId"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	locations := s.topology.Lookup(vid)
+	if len(locations) == 0 {
+		http.Error(w, "volume not found", http.StatusNotFound)
+		return
+	}
+	writeJson(w, &LookupResult{VolumeId: vid.String(), Locations: locations})
+}
+
+// tokenHandler signs a token for the fid, to "delete" it or to "read" it
+// from a private collection. Every node has the keys, so it answers
+// without the leader.
+func (s *Server) tokenHandler(w http.ResponseWriter, req *http.Request) {
+	vid, cookie, err := parseTokenFid(req.FormValue("fid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var key []byte
+	switch req.FormValue("op") {
+	case "delete":
+		key = s.writeKey
+	case "read":
+		key = s.readKey
+	default:
+		http.Error(w, "op must be delete or read", http.StatusBadRequest)
+		return
+	}
+	if key == nil {
+		writeJson(w, &TokenResult{})
+		return
+	}
+	if !authenticated(req) {
+		http.Error(w, "a client key or certificate is required", http.StatusUnauthorized)
+		return
+	}
+	writeJson(w, &TokenResult{Auth: util.SignToken(key, storage.AssignedId(vid, cookie), tokenExpiry)})
+}
+
+func (s *Server) dirStatusHandler(w http.ResponseWriter, req *http.Request) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	writeJson(w, s.topology.Nodes())
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+// leaderHandler tells clients which node leads the metadata group, so they
+// can skip the hop through a follower.
+func (s *Server) leaderHandler(w http.ResponseWriter, req *http.Request) {
+	leader, err := s.leaderConnectionString(s.raftServer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, map[string]string{"leader": strings.TrimPrefix(leader, "http://")})
+}
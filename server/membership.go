@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/goraft/raft"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Leave removes this node from every volume group it hosts and then from
+// the metadata group.
+func (s *Server) Leave() error {
+	for _, vid := range s.store.VolumeIds() {
+		if s.group(vid) == nil {
+			continue
+		}
+		if err := s.leaveGroup(vid.String()); err != nil {
+			return fmt.Errorf("group %s: %s", vid.String(), err.Error())
+		}
+	}
+	return s.leaveGroup("")
+}
+
+func (s *Server) leaveGroup(vid string) error {
+	rs, err := s.raftGroup(vid)
+	if err != nil {
+		return err
+	}
+	command := &raft.DefaultLeaveCommand{Name: s.name}
+	if !isLeader(rs) {
+		leader, err := s.leaderConnectionString(rs)
+		if err != nil {
+			return err
+		}
+		return postJSON(leader+groupPrefix(vid)+"/leave", command)
+	}
+	if _, err := rs.Do(command); err != nil {
+		return err
+	}
+	if vid != "" {
+		return s.unhostGroup(vid, s.name)
+	}
+	return nil
+}
+
+// RemoveNode asks the cluster reachable at addr (host:port) to remove the
+// named node. It is used to drop dead nodes and before replacing one.
+func RemoveNode(addr string, name string) error {
+	return postMembership(fmt.Sprintf("http://%s/remove/%s", addr, name), nil)
+}
+
+// HostedGroups returns the volume groups the named node hosts in the
+// cluster reachable at addr (host:port), for the node replacing it to
+// take them over once it is removed.
+func HostedGroups(addr string, name string) ([]storage.VolumeId, error) {
+	resp, err := peerClient.Get(fmt.Sprintf("http://%s/groups", addr))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	var groups map[string]map[string]string
+	if err = json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return nil, err
+	}
+	var vids []storage.VolumeId
+	for id, hosts := range groups {
+		if _, ok := hosts[name]; !ok {
+			continue
+		}
+		vid, err := storage.NewVolumeId(id)
+		if err != nil {
+			return nil, err
+		}
+		vids = append(vids, vid)
+	}
+	sort.Slice(vids, func(i, j int) bool { return vids[i] < vids[j] })
+	return vids, nil
+}
+
+// TakeOver has the node, once it has joined the cluster, replicate the
+// volumes of the groups vids, which the node it replaces hosted.
+func (s *Server) TakeOver(vids []storage.VolumeId) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.takeOver = vids
+}
+
+const takeOverAttempts = 30
+
+// takeOverGroups creates a replica of the volumes given to TakeOver and
+// joins their groups, which bring the replicas up to date from a
+// snapshot and their log.
+func (s *Server) takeOverGroups() {
+	s.mutex.Lock()
+	vids := s.takeOver
+	s.takeOver = nil
+	s.mutex.Unlock()
+	if len(vids) == 0 {
+		return
+	}
+	// The group table and the volumes the master knows of are as fresh
+	// as the metadata group, which this node has just joined.
+	var nodes []*cluster.DataNode
+	var err error
+	for attempt := 0; attempt < takeOverAttempts; attempt++ {
+		if err = s.waitReadIndex(""); err == nil {
+			if nodes, err = s.client().Status(context.Background()); err == nil {
+				break
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		slog.Error("cannot take over volume groups", "err", err)
+		return
+	}
+	for _, vid := range vids {
+		if err = s.takeOverGroup(vid, nodes); err != nil {
+			slog.Error("cannot take over volume group", "volume", vid.String(), "err", err)
+			continue
+		}
+		slog.Info("took over volume group", "volume", vid.String())
+	}
+}
+
+func (s *Server) takeOverGroup(vid storage.VolumeId, nodes []*cluster.DataNode) error {
+	if s.store.HasVolume(vid) {
+		return nil
+	}
+	join := ""
+	for name, connectionString := range s.context.Groups.Hosts(vid) {
+		if name != s.name {
+			join = memberAddr(connectionString)
+			break
+		}
+	}
+	if join == "" {
+		return fmt.Errorf("no host left in the group")
+	}
+	var info *storage.VolumeInfo
+	for _, n := range nodes {
+		for i := range n.Volumes {
+			if n.Volumes[i].Id == vid {
+				info = &n.Volumes[i]
+			}
+		}
+	}
+	if info == nil {
+		return fmt.Errorf("no node reports the volume")
+	}
+	ttl, err := storage.ReadTTL(info.Ttl)
+	if err != nil {
+		return err
+	}
+	s.store.AddVolume(vid.String(), info.Collection, ttl)
+	if !s.store.HasVolume(vid) {
+		return fmt.Errorf("cannot create volume")
+	}
+	return s.startGroup(vid, join)
+}
+
+// memberAddr returns the host:port of addr, a host:port or a connection
+// string as connectionString() builds them, in lower case.
+func memberAddr(addr string) string {
+	if u, err := url.Parse(addr); err == nil && u.Host != "" {
+		addr = u.Host
+	}
+	return strings.ToLower(strings.TrimSuffix(addr, "/"))
+}
+
+// isMember reports whether addr, a host:port or a connection string, is
+// a node of the metadata group, which is what the nodes know of the
+// topology.
+func (s *Server) isMember(addr string) bool {
+	addr = memberAddr(addr)
+	if addr == memberAddr(s.connectionString()) {
+		return true
+	}
+	for _, peer := range s.raftServer.Peers() {
+		if memberAddr(peer.ConnectionString) == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func postMembership(url string, body *bytes.Buffer) error {
+	if body == nil {
+		body = &bytes.Buffer{}
+	}
+	resp, err := peerClient.Post(url, "application/json", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	return nil
+}
+
+// Stop shuts down the raft groups, then syncs and closes the volumes.
+func (s *Server) Stop() {
+	s.mutex.Lock()
+	for _, rs := range s.groups {
+		rs.Stop()
+	}
+	s.mutex.Unlock()
+	if s.raftServer != nil {
+		s.raftServer.Stop()
+	}
+	s.store.Close()
+	s.context.Filer.Close()
+}
+
+func (s *Server) leaveHandler(w http.ResponseWriter, req *http.Request) {
+	vid := mux.Vars(req)["vid"]
+	rs, err := s.raftGroup(vid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !isLeader(rs) {
+		s.forwardToLeader(rs, w, req)
+		return
+	}
+	command := &raft.DefaultLeaveCommand{}
+	if err := json.NewDecoder(req.Body).Decode(&command); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := rs.Do(command); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if vid != "" {
+		if err := s.unhostGroup(vid, command.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// removeHandler removes a node from one volume group, or, on the metadata
+// route, from every volume group it hosts and then from the cluster.
+func (s *Server) removeHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	vid, name := vars["vid"], vars["name"]
+	rs, err := s.raftGroup(vid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !isLeader(rs) {
+		s.forwardToLeader(rs, w, req)
+		return
+	}
+	if name != rs.Name() {
+		if _, ok := rs.Peers()[name]; !ok {
+			http.Error(w, "no such node", http.StatusNotFound)
+			return
+		}
+	}
+	if vid == "" {
+		for _, gid := range s.context.Groups.Groups() {
+			if err := s.removeFromGroup(gid, name); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	if _, err := rs.Do(&raft.DefaultLeaveCommand{Name: name}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if vid != "" {
+		if err := s.unhostGroup(vid, name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// removeFromGroup asks any other host of the volume group to remove name;
+// the request finds its way to the group leader.
+func (s *Server) removeFromGroup(vid storage.VolumeId, name string) error {
+	hosts := s.context.Groups.Hosts(vid)
+	if _, ok := hosts[name]; !ok {
+		return nil
+	}
+	err := fmt.Errorf("no other host for group %s", vid.String())
+	for host, connectionString := range hosts {
+		if host == name {
+			continue
+		}
+		url := fmt.Sprintf("%s%s/remove/%s", connectionString, groupPrefix(vid.String()), name)
+		if err = postMembership(url, nil); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForPeers waits until the metadata group of s has want peers besides
+// s itself.
+func waitForPeers(t *testing.T, s *Server, want int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for len(s.raftServer.Peers()) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d peers, want %d", len(s.raftServer.Peers()), want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	tests := []struct {
+		name   string
+		remove func(leader *Server, node *Server) error
+		peers  int
+	}{
+		{"leave", func(leader *Server, node *Server) error {
+			return node.Leave()
+		}, 0},
+		{"remove", func(leader *Server, node *Server) error {
+			return RemoveNode(leader.publicUrl(), node.name)
+		}, 0},
+		{"remove through a follower", func(leader *Server, node *Server) error {
+			return RemoveNode(node.publicUrl(), node.name)
+		}, 0},
+		{"remove an unknown node", func(leader *Server, node *Server) error {
+			err := RemoveNode(leader.publicUrl(), "nobody")
+			if err == nil || !strings.HasPrefix(err.Error(), "404") {
+				return fmt.Errorf("RemoveNode() = %v, want a 404", err)
+			}
+			return nil
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leader := startTestNode(t)
+			node := startNode(t, leader.publicUrl())
+			waitForPeers(t, leader, 1)
+			if err := tt.remove(leader, node); err != nil {
+				t.Fatal(err)
+			}
+			waitForPeers(t, leader, tt.peers)
+			if _, ok := leader.raftServer.Peers()[node.name]; ok != (tt.peers > 0) {
+				t.Errorf("the node is a peer: %v, want %v", ok, tt.peers > 0)
+			}
+			if leader.isMember(node.publicUrl()) != (tt.peers > 0) {
+				t.Errorf("isMember() = %v, want %v", !(tt.peers > 0), tt.peers > 0)
+			}
+		})
+	}
+}
+
+func TestReplace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	leader := startTestNode(t)
+	other := startNode(t, leader.publicUrl())
+	failed := startNode(t, leader.publicUrl())
+	vid := storage.VolumeId(7)
+	allocate(t, leader, vid, "")
+	allocate(t, other, vid, leader.publicUrl())
+	allocate(t, failed, vid, leader.publicUrl())
+	waitForGroup(t, leader, vid, 2)
+	waitForVolumes(t, leader)
+	fid := writeNeedle(t, leader, vid, "before the failure")
+	waitForNeedle(t, failed, fid, "before the failure")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	failed.Shutdown(ctx, false)
+	vids, err := HostedGroups(leader.publicUrl(), failed.name)
+	if err != nil || !reflect.DeepEqual(vids, []storage.VolumeId{vid}) {
+		t.Fatalf("HostedGroups() = %v, %v", vids, err)
+	}
+	if err = RemoveNode(leader.publicUrl(), failed.name); err != nil {
+		t.Fatal(err)
+	}
+	node := startNode(t, leader.publicUrl(), func(s *Server) { s.TakeOver(vids) })
+	waitForNeedle(t, node, fid, "before the failure")
+	waitForGroup(t, leader, vid, 2)
+	if _, ok := leader.group(vid).Peers()[node.name]; !ok {
+		t.Errorf("the group of volume %s has peers %v, not the new node", vid.String(), leader.group(vid).Peers())
+	}
+	if hosts := leader.context.Groups.Hosts(vid); len(hosts) != 3 || hosts[failed.name] != "" {
+		t.Errorf("the group table has hosts %v", hosts)
+	}
+}
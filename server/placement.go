@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/Masterlvng/MCDFS/command"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/gorilla/mux"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+type GrowResult struct {
+	VolumeId string   `json:"volumeId"`
+	Urls     []string `json:"urls"`
+}
+
+type Violation struct {
+	VolumeId   string   `json:"volumeId"`
+	Collection string   `json:"collection"`
+	Policy     string   `json:"policy"`
+	Nodes      []string `json:"nodes"`
+}
+
+// SetLocation labels the node with where it lives physically; the master
+// uses the labels to place the replicas of new volumes.
+func (s *Server) SetLocation(dataCenter string, rack string) {
+	s.dataCenter, s.rack = dataCenter, rack
+}
+
+func (s *Server) placement(collection string) (*cluster.ReplicaPlacement, error) {
+	policy, _ := s.context.Policies.Get(collection)
+	return cluster.NewReplicaPlacement(policy)
+}
+
+func (s *Server) policyHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		writeJson(w, s.context.Policies.Snapshot())
+		return
+	}
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	c := &command.SetPolicyCommand{
+		Collection: req.FormValue("collection"),
+		Policy:     req.FormValue("replication"),
+	}
+	if _, err := cluster.NewReplicaPlacement(c.Policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := s.raftServer.Do(c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) growHandler(w http.ResponseWriter, req *http.Request) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	ttl, err := storage.ReadTTL(req.FormValue("ttl"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := s.grow(req.FormValue("collection"), ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, res)
+}
+
+// grow creates a new volume of a collection on nodes chosen by the
+// collection's replication policy. The first node bootstraps the volume
+// group, and so becomes its leader, and the others join it.
+func (s *Server) grow(collection string, ttl storage.TTL) (*GrowResult, error) {
+	rp, err := s.placement(collection)
+	if err != nil {
+		return nil, err
+	}
+	s.growLock.Lock()
+	defer s.growLock.Unlock()
+	nodes, err := rp.Place(s.topology.Nodes())
+	if err != nil {
+		return nil, err
+	}
+	vid := s.nextVolumeId()
+	res := &GrowResult{VolumeId: vid.String()}
+	for i, n := range nodes {
+		params := url.Values{"collection": {collection}, "ttl": {ttl.String()}}
+		if i > 0 {
+			params.Set("join", nodes[0].Url)
+		}
+		u := fmt.Sprintf("http://%s/admin/volume/%s?%s", n.Url, vid.String(), params.Encode())
+		if err := postMembership(u, nil); err != nil {
+			return nil, fmt.Errorf("%s: %s", n.Url, err.Error())
+		}
+		res.Urls = append(res.Urls, n.Url)
+	}
+	return res, nil
+}
+
+// nextVolumeId is past every id the metadata group has hosted a group
+// under and every id a node reports, including those of erasure coded
+// volumes, which have no group.
+func (s *Server) nextVolumeId() storage.VolumeId {
+	max := s.topology.MaxVolumeId()
+	if vid := s.context.Groups.MaxVolumeId(); vid > max {
+		max = vid
+	}
+	return max.Next()
+}
+
+// allocateVolumeHandler creates a volume on this node and starts or joins
+// its raft group.
+func (s *Server) allocateVolumeHandler(w http.ResponseWriter, req *http.Request) {
+	vid, err := storage.NewVolumeId(mux.Vars(req)["vid"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.store.HasVolume(vid) {
+		http.Error(w, "volume exists", http.StatusConflict)
+		return
+	}
+	ttl, err := storage.ReadTTL(req.FormValue("ttl"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.store.AddVolume(vid.String(), req.FormValue("collection"), ttl)
+	if !s.store.HasVolume(vid) {
+		http.Error(w, "cannot create volume", http.StatusInternalServerError)
+		return
+	}
+	if err := s.startGroup(vid, req.FormValue("join")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// SetPolicies sets the replication policies of collections the first
+// time this node leads the metadata group, where they differ from those
+// in force.
+func (s *Server) SetPolicies(policies map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.policies = policies
+}
+
+// applyPolicies runs on every heartbeat pulse of the leader until the
+// policies are in force.
+func (s *Server) applyPolicies() {
+	s.mutex.Lock()
+	policies := s.policies
+	s.mutex.Unlock()
+	for collection, policy := range policies {
+		if p, ok := s.context.Policies.Get(collection); ok && p == policy {
+			continue
+		}
+		_, err := s.raftServer.Do(&command.SetPolicyCommand{Collection: collection, Policy: policy})
+		if err != nil {
+			slog.Error("cannot set replication policy", "collection", collection, "err", err)
+			return
+		}
+	}
+	s.mutex.Lock()
+	s.policies = nil
+	s.mutex.Unlock()
+}
+
+// violationsHandler reports the volume groups whose hosts do not match the
+// replication policy of their collection.
+func (s *Server) violationsHandler(w http.ResponseWriter, req *http.Request) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	violations := []Violation{}
+	for _, vid := range s.context.Groups.Groups() {
+		collection := s.topology.Collection(vid)
+		policy, ok := s.context.Policies.Get(collection)
+		if !ok {
+			continue
+		}
+		rp, err := cluster.NewReplicaPlacement(policy)
+		if err != nil {
+			continue
+		}
+		var nodes []*cluster.DataNode
+		var names []string
+		for name := range s.context.Groups.Hosts(vid) {
+			names = append(names, name)
+			if n := s.topology.Node(name); n != nil {
+				nodes = append(nodes, n)
+			}
+		}
+		if len(nodes) != len(names) || !rp.Satisfied(nodes) {
+			violations = append(violations, Violation{
+				VolumeId:   vid.String(),
+				Collection: collection,
+				Policy:     policy,
+				Nodes:      names,
+			})
+		}
+	}
+	writeJson(w, violations)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/util"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPresignExpiry = time.Hour
+	maxPresignExpiry     = 7 * 24 * time.Hour
+)
+
+// SetURLKeys lets the master presign read URLs with keys. Every node of
+// a cluster should use the same keys.
+func (s *Server) SetURLKeys(keys util.KeyRing) {
+	if len(keys) > 0 {
+		s.urlKeys = keys
+	}
+}
+
+type PresignResult struct {
+	Url     string `json:"url"`
+	Expires int64  `json:"expires"`
+}
+
+// presignHandler signs a read URL of fid, at a node holding its volume,
+// valid for "expires" seconds. A presigned URL opens private collections,
+// so the caller needs what a private read needs: a read token for the fid,
+// or a client key or certificate.
+func (s *Server) presignHandler(w http.ResponseWriter, req *http.Request) {
+	if s.urlKeys == nil {
+		http.Error(w, "URL signing is not configured", http.StatusNotImplemented)
+		return
+	}
+	fid, err := parseFid(req.FormValue("fid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authenticated(req) && (s.readKey == nil || checkToken(s.readKey, req, fid.VolumeId, fid.Cookie) != nil) {
+		http.Error(w, "a read token, client key or certificate is required", http.StatusUnauthorized)
+		return
+	}
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	expiry := defaultPresignExpiry
+	if e := req.FormValue("expires"); e != "" {
+		seconds, err := strconv.ParseUint(e, 10, 32)
+		if err != nil || seconds == 0 || time.Duration(seconds)*time.Second > maxPresignExpiry {
+			http.Error(w, fmt.Sprintf("expires must be between 1 and %d seconds", int(maxPresignExpiry.Seconds())), http.StatusBadRequest)
+			return
+		}
+		expiry = time.Duration(seconds) * time.Second
+	}
+	locations := s.topology.Lookup(fid.VolumeId)
+	if len(locations) == 0 {
+		http.Error(w, "volume not found", http.StatusNotFound)
+		return
+	}
+	expires := time.Now().Add(expiry)
+	writeJson(w, &PresignResult{
+		Url: fmt.Sprintf("%s://%s/read/%s/%d/%d/%d?%s", scheme(), locations[0].Url,
+			fid.VolumeId.String(), fid.Offset, fid.Size, fid.Cookie, s.urlKeys.Sign(fid.String(), expires).Encode()),
+		Expires: expires.Unix(),
+	})
+}
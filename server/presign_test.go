@@ -0,0 +1,54 @@
+package server
+
+import (
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPresignNeedsReadCredentials(t *testing.T) {
+	withCredentials(t, "", "client-key")
+	s := newTestServer(t)
+	s.urlKeys = util.KeyRing{{Id: "k1", Secret: []byte("one")}}
+	s.readKey = []byte("read-key")
+	fid := "3,1/2/42"
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		denied bool
+	}{
+		{"anonymous", "", "", true},
+		{"wrong client key", util.ClientKeyHeader, "guess", true},
+		{"read token of another fid", "Authorization", "Bearer " + util.SignToken(s.readKey, storage.AssignedId(3, 43), time.Minute), true},
+		{"write token", "Authorization", "Bearer " + util.SignToken([]byte("write-key"), storage.AssignedId(3, 42), time.Minute), true},
+		{"client key", util.ClientKeyHeader, "client-key", false},
+		{"read token", "Authorization", "Bearer " + util.SignToken(s.readKey, storage.AssignedId(3, 42), time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/dir/presign?fid="+fid, nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			s.presignHandler(w, req)
+			if denied := w.Code == http.StatusUnauthorized; denied != tt.denied {
+				t.Errorf("status = %d, want denied %v", w.Code, tt.denied)
+			}
+		})
+	}
+}
+
+func TestPresignWithoutURLKeys(t *testing.T) {
+	withCredentials(t, "", "client-key")
+	s := newTestServer(t)
+	w := httptest.NewRecorder()
+	s.presignHandler(w, httptest.NewRequest("GET", "/dir/presign?fid=3,1/2/42", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("status = %d, want 501", w.Code)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/cluster"
+	"github.com/Masterlvng/MCDFS/command"
+	"net/http"
+	"strconv"
+)
+
+// Quotas are part of the metadata group state, so every node knows them.
+// Usage is summed up by the master from the heartbeats and handed back in
+// the answer to each heartbeat: writes are checked against usage at most
+// a pulse old, and a burst of writes can overshoot a quota by that much.
+
+func (s *Server) setUsage(usage []*cluster.Usage) {
+	m := make(map[string]*cluster.Usage, len(usage))
+	for _, u := range usage {
+		m[u.Collection] = u
+	}
+	s.mutex.Lock()
+	s.usage = m
+	s.mutex.Unlock()
+}
+
+// checkQuota tells whether collection can take one more file of size
+// bytes.
+func (s *Server) checkQuota(collection string, size uint64) *apiError {
+	q, ok := s.context.Quotas.Get(collection)
+	if !ok {
+		return nil
+	}
+	if q.MaxBytes > 0 && size > q.MaxBytes {
+		return newApiError(http.StatusRequestEntityTooLarge, "file_too_large",
+			fmt.Errorf("file is larger than the quota of collection %q", collection))
+	}
+	s.mutex.Lock()
+	u := s.usage[collection]
+	s.mutex.Unlock()
+	if u == nil {
+		u = &cluster.Usage{}
+	}
+	if !u.Allows(q, size) {
+		return newApiError(http.StatusInsufficientStorage, "quota_exceeded",
+			fmt.Errorf("collection %q is over its quota", collection))
+	}
+	return nil
+}
+
+func (s *Server) quotaHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		writeJson(w, s.context.Quotas.Snapshot())
+		return
+	}
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	c := &command.SetQuotaCommand{Collection: req.FormValue("collection")}
+	var err error
+	if v := req.FormValue("maxBytes"); v != "" {
+		if c.MaxBytes, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid maxBytes", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := req.FormValue("maxFiles"); v != "" {
+		if c.MaxFiles, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid maxFiles", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, err := s.raftServer.Do(c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// usageHandler reports the usage and the quota of every collection.
+func (s *Server) usageHandler(w http.ResponseWriter, req *http.Request) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	quotas := s.context.Quotas.Snapshot()
+	usage := s.topology.Usage()
+	for _, u := range usage {
+		if q, ok := quotas[u.Collection]; ok {
+			u.Quota = &q
+			delete(quotas, u.Collection)
+		}
+	}
+	for collection, q := range quotas {
+		q := q
+		usage = append(usage, &cluster.Usage{Collection: collection, Quota: &q})
+	}
+	writeJson(w, usage)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"github.com/Masterlvng/MCDFS/cluster"
+	"net/http"
+	"testing"
+)
+
+func TestCheckQuota(t *testing.T) {
+	tests := []struct {
+		name       string
+		quota      cluster.Quota
+		usage      *cluster.Usage
+		size       uint64
+		wantStatus int
+	}{
+		{"no quota", cluster.Quota{}, &cluster.Usage{Bytes: 1 << 40}, 1 << 30, 0},
+		{"within the quota", cluster.Quota{MaxBytes: 100}, &cluster.Usage{Bytes: 50}, 50, 0},
+		{"no usage reported yet", cluster.Quota{MaxBytes: 100, MaxFiles: 1}, nil, 100, 0},
+		{"file larger than the quota", cluster.Quota{MaxBytes: 100}, nil, 101, http.StatusRequestEntityTooLarge},
+		{"bytes over the quota", cluster.Quota{MaxBytes: 100}, &cluster.Usage{Bytes: 90}, 20, http.StatusInsufficientStorage},
+		{"files over the quota", cluster.Quota{MaxFiles: 2}, &cluster.Usage{Files: 2}, 1, http.StatusInsufficientStorage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.context.Quotas.Set("photos", tt.quota)
+			var usage []*cluster.Usage
+			if tt.usage != nil {
+				tt.usage.Collection = "photos"
+				usage = append(usage, tt.usage)
+			}
+			s.setUsage(usage)
+			status := 0
+			if e := s.checkQuota("photos", tt.size); e != nil {
+				status = e.Status
+			}
+			if status != tt.wantStatus {
+				t.Errorf("checkQuota() status = %d, want %d", status, tt.wantStatus)
+			}
+			// Other collections are not limited.
+			if e := s.checkQuota("docs", tt.size); e != nil {
+				t.Errorf("checkQuota(docs) = %v", e.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,586 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/client"
+	"github.com/Masterlvng/MCDFS/filer"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The S3 gateway maps buckets to collections and keys to files of the
+// filer under /buckets/<bucket>/<key>, so objects can be read through the
+// filer too. Keys are paths: "a//b", "a/" and "a/./b" are refused.
+
+const (
+	s3BucketsDir = "/buckets"
+	s3UploadsDir = "/buckets/.uploads"
+	s3MaxKeys    = 1000
+	s3OwnerId    = "mcdfs"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+)
+
+var s3BucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+type S3Gateway struct {
+	s    *Server
+	keys map[string]string // access key -> secret key
+}
+
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func newS3Error(status int, code string, message string) *s3Error {
+	return &s3Error{Status: status, Code: code, Message: message}
+}
+
+var (
+	s3ErrAccessDenied          = newS3Error(http.StatusForbidden, "AccessDenied", "Access Denied")
+	s3ErrAuthorizationHeader   = newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed")
+	s3ErrAuthorizationQuery    = newS3Error(http.StatusBadRequest, "AuthorizationQueryParametersError", "The presigned query is malformed")
+	s3ErrInvalidAccessKeyId    = newS3Error(http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist")
+	s3ErrSignatureDoesNotMatch = newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match")
+	s3ErrRequestTimeTooSkewed  = newS3Error(http.StatusForbidden, "RequestTimeTooSkewed", "The request time is too far from the server time")
+	s3ErrExpired               = newS3Error(http.StatusForbidden, "AccessDenied", "Request has expired")
+	s3ErrContentSha256Mismatch = newS3Error(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The payload does not match its x-amz-content-sha256")
+	s3ErrIncompleteBody        = newS3Error(http.StatusBadRequest, "IncompleteBody", "The request body is incomplete")
+	s3ErrEntityTooLarge        = newS3Error(http.StatusBadRequest, "EntityTooLarge", "The body is larger than the maximum allowed")
+	s3ErrInvalidArgument       = newS3Error(http.StatusBadRequest, "InvalidArgument", "Invalid argument")
+	s3ErrInvalidBucketName     = newS3Error(http.StatusBadRequest, "InvalidBucketName", "The bucket name is not valid")
+	s3ErrInvalidKey            = newS3Error(http.StatusBadRequest, "InvalidArgument", "The key is not a clean path")
+	s3ErrNoSuchBucket          = newS3Error(http.StatusNotFound, "NoSuchBucket", "The bucket does not exist")
+	s3ErrNoSuchKey             = newS3Error(http.StatusNotFound, "NoSuchKey", "The key does not exist")
+	s3ErrNoSuchUpload          = newS3Error(http.StatusNotFound, "NoSuchUpload", "The upload does not exist")
+	s3ErrBucketExists          = newS3Error(http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket exists")
+	s3ErrBucketNotEmpty        = newS3Error(http.StatusConflict, "BucketNotEmpty", "The bucket is not empty")
+	s3ErrKeyConflict           = newS3Error(http.StatusConflict, "InvalidArgument", "The key is a prefix of other keys or has a key as prefix")
+	s3ErrInvalidRange          = newS3Error(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The range is not satisfiable")
+	s3ErrMalformedXML          = newS3Error(http.StatusBadRequest, "MalformedXML", "The XML is not well-formed")
+	s3ErrInvalidPart           = newS3Error(http.StatusBadRequest, "InvalidPart", "A part was not uploaded or its ETag does not match")
+	s3ErrInvalidPartOrder      = newS3Error(http.StatusBadRequest, "InvalidPartOrder", "The parts are not in ascending order")
+	s3ErrNotImplemented        = newS3Error(http.StatusNotImplemented, "NotImplemented", "Not implemented")
+	s3ErrMethodNotAllowed      = newS3Error(http.StatusMethodNotAllowed, "MethodNotAllowed", "The method is not allowed")
+)
+
+func s3InternalError(err error) *s3Error {
+	return newS3Error(http.StatusInternalServerError, "InternalError", err.Error())
+}
+
+// s3FilerError turns a filer error about a key into an S3 error.
+func s3FilerError(err error, notFound *s3Error) *s3Error {
+	switch err {
+	case filer.ErrNotFound, client.ErrNotFound:
+		return notFound
+	case filer.ErrIsDir, filer.ErrNotDir, filer.ErrExists:
+		return s3ErrKeyConflict
+	}
+	return s3InternalError(err)
+}
+
+// ServeS3 serves the S3 API on addr. keys maps access keys to secret
+// keys; without keys any request is accepted.
+func (s *Server) ServeS3(addr string, keys map[string]string) error {
+	var h http.Handler = &S3Gateway{s: s, keys: keys}
+	if s.admission != nil {
+		h = s.admission.wrap(h, isS3Upload)
+	}
+	srv := &http.Server{Addr: addr, Handler: accessLog(s.track(h))}
+	if clusterTLS != nil {
+		srv.TLSConfig = clusterTLS.ServerConfig()
+	}
+	s.mutex.Lock()
+	s.s3Server = srv
+	s.mutex.Unlock()
+	if clusterTLS != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	sig, e := g.authenticate(req)
+	if e == nil {
+		e = g.route(w, req, sig)
+	}
+	if e != nil {
+		writeS3Error(w, req, e)
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, req *http.Request, e *s3Error) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.Status)
+	if req.Method == "HEAD" {
+		return
+	}
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		*s3Error
+		Resource string `xml:"Resource"`
+	}{s3Error: e, Resource: req.URL.Path})
+}
+
+func writeS3Xml(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (g *S3Gateway) route(w http.ResponseWriter, req *http.Request, sig *s3Signature) *s3Error {
+	p := strings.TrimPrefix(req.URL.Path, "/")
+	bucket, key := p, ""
+	if i := strings.Index(p, "/"); i >= 0 {
+		bucket, key = p[:i], p[i+1:]
+	}
+	q := req.URL.Query()
+	if bucket == "" {
+		if req.Method != "GET" {
+			return s3ErrMethodNotAllowed
+		}
+		return g.listBuckets(w)
+	}
+	if !s3BucketName.MatchString(bucket) {
+		return s3ErrInvalidBucketName
+	}
+	if key == "" {
+		switch {
+		case req.Method == "PUT":
+			return g.createBucket(w, bucket)
+		case req.Method == "HEAD":
+			return g.headBucket(bucket)
+		case req.Method == "DELETE":
+			return g.deleteBucket(w, bucket)
+		case req.Method == "GET" && q["uploads"] != nil:
+			return s3ErrNotImplemented
+		case req.Method == "GET":
+			return g.listObjects(w, req, bucket)
+		case req.Method == "POST" && q["delete"] != nil:
+			return g.deleteObjects(w, req, sig, bucket)
+		}
+		return s3ErrMethodNotAllowed
+	}
+	if filer.Clean(key) != "/"+key {
+		return s3ErrInvalidKey
+	}
+	if _, err := g.s.context.Filer.Find(s3BucketsDir + "/" + bucket); err != nil {
+		return s3ErrNoSuchBucket
+	}
+	uploadId := q.Get("uploadId")
+	switch {
+	case req.Method == "POST" && q["uploads"] != nil:
+		return g.createMultipartUpload(w, req, bucket, key)
+	case req.Method == "POST" && uploadId != "":
+		return g.completeMultipartUpload(w, req, sig, bucket, key, uploadId)
+	case req.Method == "PUT" && uploadId != "":
+		return g.uploadPart(w, req, sig, bucket, uploadId)
+	case req.Method == "DELETE" && uploadId != "":
+		return g.abortMultipartUpload(w, uploadId)
+	case req.Method == "GET" && uploadId != "":
+		return g.listParts(w, bucket, key, uploadId)
+	case req.Method == "PUT":
+		return g.putObject(w, req, sig, bucket, key)
+	case req.Method == "GET" || req.Method == "HEAD":
+		return g.getObject(w, req, bucket, key)
+	case req.Method == "DELETE":
+		return g.deleteObject(w, bucket, key)
+	}
+	return s3ErrMethodNotAllowed
+}
+
+func objectPath(bucket string, key string) string {
+	return s3BucketsDir + "/" + bucket + "/" + key
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+func (g *S3Gateway) listBuckets(w http.ResponseWriter) *s3Error {
+	entries, err := g.s.context.Filer.List(s3BucketsDir, "", 0)
+	if err != nil && err != filer.ErrNotFound {
+		return s3InternalError(err)
+	}
+	var buckets []s3Bucket
+	for _, e := range entries {
+		if e.IsDir && !strings.HasPrefix(e.Name(), ".") {
+			buckets = append(buckets, s3Bucket{e.Name(), e.Mtime.UTC().Format(s3TimeFormat)})
+		}
+	}
+	writeS3Xml(w, struct {
+		XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+		Owner   s3Owner    `xml:"Owner"`
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{Owner: s3Owner{s3OwnerId, s3OwnerId}, Buckets: buckets})
+	return nil
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+func (g *S3Gateway) createBucket(w http.ResponseWriter, bucket string) *s3Error {
+	p := s3BucketsDir + "/" + bucket
+	if _, err := g.s.context.Filer.Find(p); err == nil {
+		return s3ErrBucketExists
+	}
+	e := &filer.Entry{Path: p, IsDir: true, Mtime: time.Now()}
+	if err := g.s.putEntry(e); err != nil {
+		return s3InternalError(err)
+	}
+	w.Header().Set("Location", "/"+bucket)
+	return nil
+}
+
+func (g *S3Gateway) headBucket(bucket string) *s3Error {
+	if _, err := g.s.context.Filer.Find(s3BucketsDir + "/" + bucket); err != nil {
+		return s3ErrNoSuchBucket
+	}
+	return nil
+}
+
+func (g *S3Gateway) deleteBucket(w http.ResponseWriter, bucket string) *s3Error {
+	switch err := g.s.removeEntry(s3BucketsDir+"/"+bucket, false); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case filer.ErrNotFound:
+		return s3ErrNoSuchBucket
+	case filer.ErrNotEmpty:
+		return s3ErrBucketNotEmpty
+	default:
+		return s3InternalError(err)
+	}
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+// walk calls fn with the files under dir, depth first, until fn returns
+// false.
+func (g *S3Gateway) walk(dir string, fn func(e *filer.Entry) bool) (bool, error) {
+	after := ""
+	for {
+		entries, err := g.s.context.Filer.List(dir, after, s3MaxKeys)
+		if err != nil || len(entries) == 0 {
+			return true, err
+		}
+		for _, e := range entries {
+			more := true
+			if e.IsDir {
+				more, err = g.walk(e.Path, fn)
+			} else {
+				more = fn(e)
+			}
+			if err != nil || !more {
+				return false, err
+			}
+		}
+		after = entries[len(entries)-1].Name()
+	}
+}
+
+func s3ETag(e *filer.Entry) string {
+	return `"` + e.ETag + `"`
+}
+
+// listObjects serves ListObjectsV2, and V1 requests as far as they look
+// the same. The continuation token is the last key of the previous page.
+func (g *S3Gateway) listObjects(w http.ResponseWriter, req *http.Request, bucket string) *s3Error {
+	q := req.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s3ErrInvalidArgument
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	startAfter := q.Get("start-after")
+	if m := q.Get("marker"); m != "" {
+		startAfter = m
+	}
+	var token string
+	if t := q.Get("continuation-token"); t != "" {
+		b, err := base64.URLEncoding.DecodeString(t)
+		if err != nil {
+			return s3ErrInvalidArgument
+		}
+		token = string(b)
+	}
+	root := s3BucketsDir + "/" + bucket
+	if _, err := g.s.context.Filer.Find(root); err != nil {
+		return s3ErrNoSuchBucket
+	}
+	commonPrefix := func(key string) string {
+		if delimiter == "" || !strings.HasPrefix(key, prefix) {
+			return ""
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+			return key[:len(prefix)+i+len(delimiter)]
+		}
+		return ""
+	}
+
+	var contents []s3Object
+	var prefixes []s3Prefix
+	seen := map[string]bool{commonPrefix(token): token != ""}
+	passed, truncated, lastKey := token == "", false, ""
+	start := root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		start = filer.Clean(root + "/" + prefix[:i])
+	}
+	_, err := g.walk(start, func(e *filer.Entry) bool {
+		key := strings.TrimPrefix(e.Path, root+"/")
+		if !passed {
+			passed = key == token
+			return true
+		}
+		if !strings.HasPrefix(key, prefix) || (startAfter != "" && key <= startAfter) {
+			return true
+		}
+		cp := commonPrefix(key)
+		if cp != "" && seen[cp] {
+			lastKey = key
+			return true
+		}
+		if len(contents)+len(prefixes) == maxKeys {
+			truncated = true
+			return false
+		}
+		if cp != "" {
+			seen[cp] = true
+			prefixes = append(prefixes, s3Prefix{cp})
+		} else {
+			contents = append(contents, s3Object{
+				Key:          key,
+				LastModified: e.Mtime.UTC().Format(s3TimeFormat),
+				ETag:         s3ETag(e),
+				Size:         e.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+		lastKey = key
+		return true
+	})
+	if err != nil && err != filer.ErrNotFound && err != filer.ErrNotDir {
+		return s3InternalError(err)
+	}
+	res := struct {
+		XMLName               xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name                  string     `xml:"Name"`
+		Prefix                string     `xml:"Prefix"`
+		Delimiter             string     `xml:"Delimiter,omitempty"`
+		MaxKeys               int        `xml:"MaxKeys"`
+		KeyCount              int        `xml:"KeyCount"`
+		IsTruncated           bool       `xml:"IsTruncated"`
+		ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+		NextMarker            string     `xml:"NextMarker,omitempty"`
+		StartAfter            string     `xml:"StartAfter,omitempty"`
+		Contents              []s3Object `xml:"Contents"`
+		CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+	}{
+		Name:              bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		KeyCount:          len(contents) + len(prefixes),
+		IsTruncated:       truncated,
+		ContinuationToken: q.Get("continuation-token"),
+		StartAfter:        q.Get("start-after"),
+		Contents:          contents,
+		CommonPrefixes:    prefixes,
+	}
+	if truncated {
+		if q.Get("list-type") == "2" {
+			res.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(lastKey))
+		} else {
+			res.NextMarker = lastKey
+		}
+	}
+	writeS3Xml(w, res)
+	return nil
+}
+
+func (g *S3Gateway) putObject(w http.ResponseWriter, req *http.Request, sig *s3Signature, bucket string, key string) *s3Error {
+	if req.Header.Get("X-Amz-Copy-Source") != "" {
+		return s3ErrNotImplemented
+	}
+	data, e := sig.readBody(req)
+	if e != nil {
+		return e
+	}
+	entry, err := g.s.uploadEntry(req.Context(), objectPath(bucket, key), data, req.Header.Get("Content-Type"), bucket, "")
+	if err != nil {
+		return s3InternalError(err)
+	}
+	if err = g.s.putEntry(entry); err != nil {
+		g.s.deleteFids([]*filer.Entry{entry})
+		return s3FilerError(err, s3ErrNoSuchBucket)
+	}
+	w.Header().Set("ETag", s3ETag(entry))
+	return nil
+}
+
+// parseRange parses a single "bytes=" range against an object of size
+// bytes.
+func parseRange(header string, size int64) (offset int64, length int64, ok bool) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	if parts[0] == "" {
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, size > 0
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if parts[1] != "" {
+		if end, err = strconv.ParseInt(parts[1], 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
+
+func (g *S3Gateway) getObject(w http.ResponseWriter, req *http.Request, bucket string, key string) *s3Error {
+	e, err := g.s.context.Filer.Find(objectPath(bucket, key))
+	if err != nil || e.IsDir {
+		return s3ErrNoSuchKey
+	}
+	offset, length, status := int64(0), e.Size, http.StatusOK
+	if r := req.Header.Get("Range"); r != "" {
+		var ok bool
+		if offset, length, ok = parseRange(r, e.Size); !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", e.Size))
+			return s3ErrInvalidRange
+		}
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, e.Size))
+	}
+	var buf bytes.Buffer
+	if req.Method == "GET" {
+		if err = g.s.readEntry(req.Context(), e, offset, length, &buf); err != nil {
+			return s3FilerError(err, s3ErrNoSuchKey)
+		}
+	}
+	if e.Mime != "" {
+		w.Header().Set("Content-Type", e.Mime)
+	}
+	w.Header().Set("ETag", s3ETag(e))
+	w.Header().Set("Last-Modified", e.Mtime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+	return nil
+}
+
+// deleteObject removes the key and the directories it leaves empty. S3
+// answers 204 whether or not the key existed.
+func (g *S3Gateway) deleteObject(w http.ResponseWriter, bucket string, key string) *s3Error {
+	if e := g.deleteKey(bucket, key); e != nil {
+		return e
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *S3Gateway) deleteKey(bucket string, key string) *s3Error {
+	p := objectPath(bucket, key)
+	if e, err := g.s.context.Filer.Find(p); err != nil || e.IsDir {
+		return nil
+	}
+	if err := g.s.removeEntry(p, false); err != nil && err != filer.ErrNotFound {
+		return s3InternalError(err)
+	}
+	root := s3BucketsDir + "/" + bucket
+	for dir := p[:strings.LastIndex(p, "/")]; dir != root; dir = dir[:strings.LastIndex(dir, "/")] {
+		if g.s.removeEntry(dir, false) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (g *S3Gateway) deleteObjects(w http.ResponseWriter, req *http.Request, sig *s3Signature, bucket string) *s3Error {
+	data, e := sig.readBody(req)
+	if e != nil {
+		return e
+	}
+	var in struct {
+		Quiet   bool
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.Unmarshal(data, &in); err != nil {
+		return s3ErrMalformedXML
+	}
+	type deleted struct {
+		Key string
+	}
+	type deleteError struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	var res struct {
+		XMLName xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+		Deleted []deleted     `xml:"Deleted"`
+		Errors  []deleteError `xml:"Error"`
+	}
+	for _, o := range in.Objects {
+		e := s3ErrInvalidKey
+		if filer.Clean(o.Key) == "/"+o.Key {
+			e = g.deleteKey(bucket, o.Key)
+		}
+		if e != nil {
+			res.Errors = append(res.Errors, deleteError{o.Key, e.Code, e.Message})
+		} else if !in.Quiet {
+			res.Deleted = append(res.Deleted, deleted{o.Key})
+		}
+	}
+	writeS3Xml(w, res)
+	return nil
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 clients sign their requests with AWS Signature Version 4, in the
+// Authorization header or in the query of a presigned URL.
+
+const (
+	s3MaxClockSkew   = 15 * time.Minute
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	s3MaxPayload     = 5 << 30 // the largest object or part S3 takes in one request
+)
+
+// s3Signature is what a request was signed with; chunked payloads are
+// checked against it.
+type s3Signature struct {
+	credentials util.Credentials
+	amzTime     string
+	seed        string
+	payloadHash string
+}
+
+// authenticate checks the signature of req. Without keys the gateway is
+// open to anyone.
+func (g *S3Gateway) authenticate(req *http.Request) (*s3Signature, *s3Error) {
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if len(g.keys) == 0 {
+		return &s3Signature{payloadHash: payloadHash}, nil
+	}
+	q := req.URL.Query()
+	var credential, signedHeaders, signature, amzTime string
+	var expires time.Duration
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, util.SigV4Algorithm+" ") {
+			return nil, s3ErrAccessDenied
+		}
+		for _, field := range strings.Split(auth[len(util.SigV4Algorithm)+1:], ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+		amzTime = req.Header.Get("X-Amz-Date")
+		if payloadHash == "" {
+			return nil, s3ErrInvalidArgument
+		}
+	} else if q.Get("X-Amz-Algorithm") == util.SigV4Algorithm {
+		credential = q.Get("X-Amz-Credential")
+		signedHeaders = q.Get("X-Amz-SignedHeaders")
+		signature = q.Get("X-Amz-Signature")
+		amzTime = q.Get("X-Amz-Date")
+		seconds, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || seconds < 1 || seconds > 7*24*3600 {
+			return nil, s3ErrAuthorizationQuery
+		}
+		expires = time.Duration(seconds) * time.Second
+		payloadHash = util.UnsignedPayload
+	} else {
+		return nil, s3ErrAccessDenied
+	}
+
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[4] != "aws4_request" {
+		return nil, s3ErrAuthorizationHeader
+	}
+	secret, ok := g.keys[scope[0]]
+	if !ok {
+		return nil, s3ErrInvalidAccessKeyId
+	}
+	t, err := time.Parse(util.SigV4TimeFormat, amzTime)
+	if err != nil || scope[1] != amzTime[:8] {
+		return nil, s3ErrAuthorizationHeader
+	}
+	now := time.Now()
+	if expires > 0 {
+		if now.After(t.Add(expires)) || t.After(now.Add(s3MaxClockSkew)) {
+			return nil, s3ErrExpired
+		}
+	} else if d := now.Sub(t); d > s3MaxClockSkew || d < -s3MaxClockSkew {
+		return nil, s3ErrRequestTimeTooSkewed
+	}
+
+	c := util.Credentials{AccessKey: scope[0], SecretKey: secret, Region: scope[2], Service: scope[3]}
+	expected := util.SignatureV4(req, strings.Split(signedHeaders, ";"), payloadHash, c, amzTime)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, s3ErrSignatureDoesNotMatch
+	}
+	return &s3Signature{credentials: c, amzTime: amzTime, seed: signature, payloadHash: payloadHash}, nil
+}
+
+// readBody reads the payload of req and checks it against what was
+// signed. Payloads are held in memory, so none is read past s3MaxPayload
+// or, for chunked ones, the decoded length the client announced.
+func (sig *s3Signature) readBody(req *http.Request) ([]byte, *s3Error) {
+	if req.ContentLength > s3MaxPayload {
+		return nil, s3ErrEntityTooLarge
+	}
+	if sig.payloadHash == streamingPayload {
+		v := req.Header.Get("X-Amz-Decoded-Content-Length")
+		if v == "" {
+			return sig.readChunked(req.Body, s3MaxPayload)
+		}
+		decoded, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || decoded < 0 {
+			return nil, s3ErrInvalidArgument
+		}
+		if decoded > s3MaxPayload {
+			return nil, s3ErrEntityTooLarge
+		}
+		data, e := sig.readChunked(req.Body, decoded)
+		if e == nil && int64(len(data)) != decoded {
+			return nil, s3ErrIncompleteBody
+		}
+		return data, e
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, s3MaxPayload+1))
+	if err != nil {
+		return nil, s3ErrIncompleteBody
+	}
+	if len(data) > s3MaxPayload {
+		return nil, s3ErrEntityTooLarge
+	}
+	switch sig.payloadHash {
+	case "", util.UnsignedPayload:
+	default:
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != sig.payloadHash {
+			return nil, s3ErrContentSha256Mismatch
+		}
+	}
+	return data, nil
+}
+
+// readChunked decodes an aws-chunked payload of at most limit bytes:
+//
+//	<hex size>;chunk-signature=<signature>\r\n<data>\r\n ... 0;chunk-signature=<signature>\r\n\r\n
+//
+// checking the chain of chunk signatures when the gateway has keys.
+func (sig *s3Signature) readChunked(body io.Reader, limit int64) ([]byte, *s3Error) {
+	r := bufio.NewReader(body)
+	previous := sig.seed
+	var data bytes.Buffer
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, s3ErrIncompleteBody
+		}
+		header := strings.SplitN(strings.TrimSpace(line), ";chunk-signature=", 2)
+		if len(header) != 2 {
+			return nil, s3ErrIncompleteBody
+		}
+		size, err := strconv.ParseInt(header[0], 16, 64)
+		if err != nil || size < 0 {
+			return nil, s3ErrIncompleteBody
+		}
+		if size > limit-int64(data.Len()) {
+			if limit == s3MaxPayload {
+				return nil, s3ErrEntityTooLarge
+			}
+			return nil, s3ErrIncompleteBody
+		}
+		start := data.Len()
+		if _, err = io.CopyN(&data, r, size); err != nil {
+			return nil, s3ErrIncompleteBody
+		}
+		if sig.seed != "" {
+			expected := util.ChunkSignatureV4(sig.credentials, sig.amzTime, previous, data.Bytes()[start:])
+			if !hmac.Equal([]byte(expected), []byte(header[1])) {
+				return nil, s3ErrSignatureDoesNotMatch
+			}
+			previous = header[1]
+		}
+		if crlf, err := r.ReadString('\n'); err != nil || crlf != "\r\n" {
+			return nil, s3ErrIncompleteBody
+		}
+		if size == 0 {
+			return data.Bytes(), nil
+		}
+	}
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/command"
+	"github.com/Masterlvng/MCDFS/filer"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Multipart uploads keep their parts as files of /buckets/.uploads/<id>.
+// Completing an upload makes an entry pointing at the parts in order.
+
+const s3MaxPartNumber = 10000
+
+func uploadPath(uploadId string) string {
+	return s3UploadsDir + "/" + uploadId
+}
+
+func partPath(uploadId string, partNumber int) string {
+	return fmt.Sprintf("%s/%05d", uploadPath(uploadId), partNumber)
+}
+
+func (g *S3Gateway) findUpload(uploadId string) (*filer.Entry, *s3Error) {
+	if len(uploadId) != 32 || strings.Trim(uploadId, "0123456789abcdef") != "" {
+		return nil, s3ErrNoSuchUpload
+	}
+	e, err := g.s.context.Filer.Find(uploadPath(uploadId))
+	if err != nil {
+		return nil, s3ErrNoSuchUpload
+	}
+	return e, nil
+}
+
+func (g *S3Gateway) createMultipartUpload(w http.ResponseWriter, req *http.Request, bucket string, key string) *s3Error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return s3InternalError(err)
+	}
+	uploadId := hex.EncodeToString(b)
+	e := &filer.Entry{
+		Path:  uploadPath(uploadId),
+		IsDir: true,
+		Mime:  req.Header.Get("Content-Type"),
+		Mtime: time.Now(),
+	}
+	if err := g.s.putEntry(e); err != nil {
+		return s3InternalError(err)
+	}
+	writeS3Xml(w, struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: bucket, Key: key, UploadId: uploadId})
+	return nil
+}
+
+func (g *S3Gateway) uploadPart(w http.ResponseWriter, req *http.Request, sig *s3Signature, bucket string, uploadId string) *s3Error {
+	partNumber, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		return s3ErrInvalidArgument
+	}
+	if _, e := g.findUpload(uploadId); e != nil {
+		return e
+	}
+	data, e := sig.readBody(req)
+	if e != nil {
+		return e
+	}
+	entry, err := g.s.uploadEntry(req.Context(), partPath(uploadId, partNumber), data, "", bucket, "")
+	if err != nil {
+		return s3InternalError(err)
+	}
+	if err = g.s.putEntry(entry); err != nil {
+		g.s.deleteFids([]*filer.Entry{entry})
+		return s3InternalError(err)
+	}
+	w.Header().Set("ETag", s3ETag(entry))
+	return nil
+}
+
+func (g *S3Gateway) completeMultipartUpload(w http.ResponseWriter, req *http.Request, sig *s3Signature, bucket string, key string, uploadId string) *s3Error {
+	upload, e := g.findUpload(uploadId)
+	if e != nil {
+		return e
+	}
+	data, e := sig.readBody(req)
+	if e != nil {
+		return e
+	}
+	var in struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(data, &in); err != nil || len(in.Parts) == 0 {
+		return s3ErrMalformedXML
+	}
+	entry := &filer.Entry{Path: objectPath(bucket, key), Mime: upload.Mime, Mtime: time.Now()}
+	used := make(map[string]bool)
+	sums := md5.New()
+	for i, p := range in.Parts {
+		if i > 0 && p.PartNumber <= in.Parts[i-1].PartNumber {
+			return s3ErrInvalidPartOrder
+		}
+		part, err := g.s.context.Filer.Find(partPath(uploadId, p.PartNumber))
+		if err != nil || part.ETag != strings.Trim(p.ETag, `"`) {
+			return s3ErrInvalidPart
+		}
+		sum, _ := hex.DecodeString(part.ETag)
+		sums.Write(sum)
+		entry.Chunks = append(entry.Chunks, filer.Chunk{Fid: part.Fid, Size: part.Size})
+		entry.Size += part.Size
+		used[part.Fid] = true
+	}
+	entry.ETag = fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), len(in.Parts))
+	if err := g.s.putEntry(entry); err != nil {
+		return s3FilerError(err, s3ErrNoSuchBucket)
+	}
+	g.dropUpload(uploadId, used)
+	writeS3Xml(w, struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{Location: "/" + bucket + "/" + key, Bucket: bucket, Key: key, ETag: s3ETag(entry)})
+	return nil
+}
+
+// dropUpload forgets an upload and deletes the parts that did not make it
+// into the object.
+func (g *S3Gateway) dropUpload(uploadId string, used map[string]bool) error {
+	var parts []*filer.Entry
+	if err := g.s.doFiler("delete", &command.FilerDeleteCommand{Path: uploadPath(uploadId), Recursive: true}, &parts); err != nil {
+		return err
+	}
+	var unused []*filer.Entry
+	for _, p := range parts {
+		if !used[p.Fid] {
+			unused = append(unused, p)
+		}
+	}
+	g.s.deleteFids(unused)
+	return nil
+}
+
+func (g *S3Gateway) abortMultipartUpload(w http.ResponseWriter, uploadId string) *s3Error {
+	if _, e := g.findUpload(uploadId); e != nil {
+		return e
+	}
+	if err := g.dropUpload(uploadId, nil); err != nil {
+		return s3InternalError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *S3Gateway) listParts(w http.ResponseWriter, bucket string, key string, uploadId string) *s3Error {
+	if _, e := g.findUpload(uploadId); e != nil {
+		return e
+	}
+	entries, err := g.s.context.Filer.List(uploadPath(uploadId), "", 0)
+	if err != nil {
+		return s3InternalError(err)
+	}
+	type part struct {
+		PartNumber   int
+		LastModified string
+		ETag         string
+		Size         int64
+	}
+	var parts []part
+	for _, e := range entries {
+		n, _ := strconv.Atoi(e.Name())
+		parts = append(parts, part{n, e.Mtime.UTC().Format(s3TimeFormat), s3ETag(e), e.Size})
+	}
+	writeS3Xml(w, struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+		Parts    []part `xml:"Part"`
+	}{Bucket: bucket, Key: key, UploadId: uploadId, Parts: parts})
+	return nil
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/util"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testS3Credentials = util.Credentials{AccessKey: "AKID", SecretKey: "secret", Region: "us-east-1", Service: "s3"}
+
+// s3Request signs a request to the gateway at base with c, unless c has
+// no access key.
+func s3Request(t *testing.T, base string, method string, path string, body []byte, c util.Credentials) *http.Request {
+	req, err := http.NewRequest(method, base+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.AccessKey != "" {
+		sum := sha256.Sum256(body)
+		util.SignV4(req, hex.EncodeToString(sum[:]), c, time.Now())
+	}
+	return req
+}
+
+type s3ErrorBody struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+}
+
+// s3Do sends req and checks the status and, for errors, the S3 error
+// code in the XML body.
+func s3Do(t *testing.T, req *http.Request, status int, code string) []byte {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: status = %d, want %d: %s", req.Method, req.URL.Path, resp.StatusCode, status, body)
+	}
+	if code != "" {
+		if ct := resp.Header.Get("Content-Type"); ct != "application/xml" {
+			t.Errorf("%s %s: error served as %q", req.Method, req.URL.Path, ct)
+		}
+		var e s3ErrorBody
+		if err := xml.Unmarshal(body, &e); err != nil {
+			t.Fatalf("%s %s: error is not S3 XML: %v: %s", req.Method, req.URL.Path, err, body)
+		}
+		if e.Code != code {
+			t.Errorf("%s %s: code = %s, want %s", req.Method, req.URL.Path, e.Code, code)
+		}
+	}
+	return body
+}
+
+func TestS3Authentication(t *testing.T) {
+	s := newTestServer(t)
+	gw := httptest.NewServer(&S3Gateway{s: s, keys: map[string]string{"AKID": "secret"}})
+	defer gw.Close()
+	wrongSecret := testS3Credentials
+	wrongSecret.SecretKey = "guess"
+	unknownKey := testS3Credentials
+	unknownKey.AccessKey = "NOPE"
+	tests := []struct {
+		name   string
+		req    func() *http.Request
+		status int
+		code   string
+	}{
+		{"signed", func() *http.Request {
+			return s3Request(t, gw.URL, "GET", "/", nil, testS3Credentials)
+		}, http.StatusOK, ""},
+		{"unsigned", func() *http.Request {
+			return s3Request(t, gw.URL, "GET", "/", nil, util.Credentials{})
+		}, http.StatusForbidden, "AccessDenied"},
+		{"wrong secret", func() *http.Request {
+			return s3Request(t, gw.URL, "GET", "/", nil, wrongSecret)
+		}, http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"unknown access key", func() *http.Request {
+			return s3Request(t, gw.URL, "GET", "/", nil, unknownKey)
+		}, http.StatusForbidden, "InvalidAccessKeyId"},
+		{"signed path changed", func() *http.Request {
+			req := s3Request(t, gw.URL, "GET", "/", nil, testS3Credentials)
+			req.URL.Path = "/other-bucket"
+			return req
+		}, http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"clock skew", func() *http.Request {
+			req, _ := http.NewRequest("GET", gw.URL+"/", nil)
+			util.SignV4(req, util.EmptyPayloadHash, testS3Credentials, time.Now().Add(-time.Hour))
+			return req
+		}, http.StatusForbidden, "RequestTimeTooSkewed"},
+		{"payload hash missing", func() *http.Request {
+			req := s3Request(t, gw.URL, "GET", "/", nil, testS3Credentials)
+			req.Header.Del("X-Amz-Content-Sha256")
+			return req
+		}, http.StatusBadRequest, "InvalidArgument"},
+		{"presigned expiry out of range", func() *http.Request {
+			req, _ := http.NewRequest("GET", gw.URL+"/?X-Amz-Algorithm="+util.SigV4Algorithm+"&X-Amz-Expires=0", nil)
+			return req
+		}, http.StatusBadRequest, "AuthorizationQueryParametersError"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3Do(t, tt.req(), tt.status, tt.code)
+		})
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	s := newTestServer(t)
+	gw := httptest.NewServer(&S3Gateway{s: s})
+	defer gw.Close()
+	tests := []struct {
+		method string
+		path   string
+		status int
+		code   string
+	}{
+		{"GET", "/Bad_Bucket", http.StatusBadRequest, "InvalidBucketName"},
+		{"GET", "/missing", http.StatusNotFound, "NoSuchBucket"},
+		{"HEAD", "/missing", http.StatusNotFound, ""},
+		{"GET", "/missing/key", http.StatusNotFound, "NoSuchBucket"},
+		{"GET", "/missing/a//b", http.StatusBadRequest, "InvalidArgument"},
+		{"POST", "/", http.StatusMethodNotAllowed, "MethodNotAllowed"},
+		{"GET", "/bucket?uploads", http.StatusNotImplemented, "NotImplemented"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			s3Do(t, s3Request(t, gw.URL, tt.method, tt.path, nil, util.Credentials{}), tt.status, tt.code)
+		})
+	}
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+		ETag string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func TestS3Objects(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a node")
+	}
+	s := startTestNode(t)
+	gw := httptest.NewServer(&S3Gateway{s: s, keys: map[string]string{"AKID": "secret"}})
+	defer gw.Close()
+	do := func(method string, path string, body []byte, status int, code string) []byte {
+		return s3Do(t, s3Request(t, gw.URL, method, path, body, testS3Credentials), status, code)
+	}
+
+	do("PUT", "/photos", nil, http.StatusOK, "")
+	do("PUT", "/photos", nil, http.StatusConflict, "BucketAlreadyOwnedByYou")
+	objects := map[string]string{
+		"a.txt":         "first",
+		"dir/b.txt":     "second object",
+		"dir/sub/c.txt": "third",
+	}
+	for key, data := range objects {
+		do("PUT", "/photos/"+key, []byte(data), http.StatusOK, "")
+	}
+	waitForVolumes(t, s)
+
+	for key, data := range objects {
+		if got := do("GET", "/photos/"+key, nil, http.StatusOK, ""); string(got) != data {
+			t.Errorf("GET %s = %q, want %q", key, got, data)
+		}
+	}
+	req := s3Request(t, gw.URL, "GET", "/photos/dir/b.txt", nil, testS3Credentials)
+	req.Header.Set("Range", "bytes=7-")
+	if got := s3Do(t, req, http.StatusPartialContent, ""); string(got) != "object" {
+		t.Errorf("ranged GET = %q, want %q", got, "object")
+	}
+	do("GET", "/photos/none.txt", nil, http.StatusNotFound, "NoSuchKey")
+
+	tests := []struct {
+		query    string
+		keys     []string
+		prefixes []string
+		more     bool
+	}{
+		{"list-type=2", []string{"a.txt", "dir/b.txt", "dir/sub/c.txt"}, nil, false},
+		{"list-type=2&delimiter=/", []string{"a.txt"}, []string{"dir/"}, false},
+		{"list-type=2&prefix=dir/&delimiter=/", []string{"dir/b.txt"}, []string{"dir/sub/"}, false},
+		{"list-type=2&max-keys=2", []string{"a.txt", "dir/b.txt"}, nil, true},
+		{"list-type=2&prefix=nothing", nil, nil, false},
+	}
+	for _, tt := range tests {
+		var res s3ListResult
+		if err := xml.Unmarshal(do("GET", "/photos?"+tt.query, nil, http.StatusOK, ""), &res); err != nil {
+			t.Fatal(err)
+		}
+		var keys, prefixes []string
+		for _, c := range res.Contents {
+			keys = append(keys, c.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if fmt.Sprint(keys) != fmt.Sprint(tt.keys) || fmt.Sprint(prefixes) != fmt.Sprint(tt.prefixes) || res.IsTruncated != tt.more {
+			t.Errorf("list %s = %v %v truncated %v, want %v %v %v", tt.query, keys, prefixes, res.IsTruncated, tt.keys, tt.prefixes, tt.more)
+		}
+		if tt.more {
+			var next s3ListResult
+			xml.Unmarshal(do("GET", "/photos?list-type=2&continuation-token="+res.NextContinuationToken, nil, http.StatusOK, ""), &next)
+			if len(next.Contents) != 1 || next.Contents[0].Key != "dir/sub/c.txt" {
+				t.Errorf("second page = %v, want dir/sub/c.txt", next.Contents)
+			}
+		}
+	}
+
+	do("DELETE", "/photos", nil, http.StatusConflict, "BucketNotEmpty")
+	for key := range objects {
+		do("DELETE", "/photos/"+key, nil, http.StatusNoContent, "")
+	}
+	do("DELETE", "/photos/a.txt", nil, http.StatusNoContent, "")
+	do("GET", "/photos/a.txt", nil, http.StatusNotFound, "NoSuchKey")
+	var res s3ListResult
+	xml.Unmarshal(do("GET", "/photos?list-type=2", nil, http.StatusOK, ""), &res)
+	if len(res.Contents) != 0 {
+		t.Errorf("%d objects left after deleting them all", len(res.Contents))
+	}
+	do("DELETE", "/photos", nil, http.StatusNoContent, "")
+	do("HEAD", "/photos", nil, http.StatusNotFound, "")
+}
+
+func TestS3BodyLimits(t *testing.T) {
+	chunked := func(decoded string, body string) *http.Request {
+		req, _ := http.NewRequest("PUT", "/bucket/key", strings.NewReader(body))
+		if decoded != "" {
+			req.Header.Set("X-Amz-Decoded-Content-Length", decoded)
+		}
+		return req
+	}
+	tests := []struct {
+		name string
+		req  *http.Request
+		want *s3Error
+	}{
+		{"chunks", chunked("5", "3;chunk-signature=a\r\nabc\r\n2;chunk-signature=b\r\nde\r\n0;chunk-signature=c\r\n\r\n"), nil},
+		{"chunk past the decoded length", chunked("5", "40000000;chunk-signature=a\r\nabc"), s3ErrIncompleteBody},
+		{"chunk past the maximum", chunked("", "7fffffffffffffff;chunk-signature=a\r\nabc"), s3ErrEntityTooLarge},
+		{"chunks short of the decoded length", chunked("9", "3;chunk-signature=a\r\nabc\r\n0;chunk-signature=c\r\n\r\n"), s3ErrIncompleteBody},
+		{"decoded length past the maximum", chunked("9999999999999", ""), s3ErrEntityTooLarge},
+		{"content length past the maximum", func() *http.Request {
+			req := chunked("", "")
+			req.ContentLength = s3MaxPayload + 1
+			return req
+		}(), s3ErrEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig := &s3Signature{payloadHash: streamingPayload}
+			data, err := sig.readBody(tt.req)
+			if err != tt.want {
+				t.Fatalf("readBody() = %v, want %v", err, tt.want)
+			}
+			if err == nil && string(data) != "abcde" {
+				t.Errorf("readBody() = %q, want %q", data, "abcde")
+			}
+		})
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/Masterlvng/MCDFS/cluster"
 	"github.com/Masterlvng/MCDFS/command"
 	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
 	"github.com/goraft/raft"
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
 	"io/ioutil"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"path/filepath"
@@ -22,13 +26,48 @@ type Server struct {
 	host       string
 	port       int
 	path       string
+	dataCenter string
+	rack       string
 	router     *mux.Router
-	raftServer raft.Server
+	raftServer raft.Server // metadata group
+	groups     map[storage.VolumeId]raft.Server
+	readStates map[raft.Server]*readState
 	httpServer *http.Server
 	store      *storage.Store
+	context    *command.Context
+	topology   *cluster.Topology
+	dedup      bool
+	writeKey   []byte
+	readKey    []byte
+	private    map[string]bool
+	urlKeys    util.KeyRing
+	usage      map[string]*cluster.Usage
+	admission  *admission
+	timings    RaftTimings
+	draining   bool
+	inflight   sync.WaitGroup
+	s3Server   *http.Server
+	grpcServer *grpc.Server
+	sizeLimit  uint64
+	policies   map[string]string
+	takeOver   []storage.VolumeId
+	growLock   sync.Mutex
 	mutex      sync.Mutex
 }
 
+// RaftTimings apply to the metadata group and every volume group.
+type RaftTimings struct {
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+	TransportTimeout  time.Duration
+}
+
+var DefaultRaftTimings = RaftTimings{
+	HeartbeatInterval: 1 * time.Millisecond,
+	ElectionTimeout:   150 * time.Millisecond,
+	TransportTimeout:  200 * time.Millisecond,
+}
+
 type WriteResult struct {
 	Vid    int
 	Offset uint64
@@ -38,13 +77,17 @@ type WriteResult struct {
 
 func New(path string, host string, port int, dirName []string) *Server {
 	s := &Server{
-		host:   host,
-		port:   port,
-		path:   path,
-		store:  storage.NewStore(dirName),
-		router: mux.NewRouter(),
+		host:     host,
+		port:     port,
+		path:     path,
+		store:    storage.NewStore(dirName),
+		router:   mux.NewRouter(),
+		groups:   make(map[storage.VolumeId]raft.Server),
+		topology: cluster.NewTopology(heartbeatTimeout),
+		timings:  DefaultRaftTimings,
 	}
-	s.store.AddVolume("1,2,3", "photo")
+	s.context = command.NewContext(s.store)
+	s.store.SetShardFetcher(s.fetchEcShard)
 	if b, err := ioutil.ReadFile(filepath.Join(path, "name")); err == nil {
 		s.name = string(b)
 	} else {
@@ -56,19 +99,43 @@ func New(path string, host string, port int, dirName []string) *Server {
 	return s
 }
 
+// AddVolumes creates the volumes of volumeList ("1,2,3") in collection,
+// unless they exist.
+func (s *Server) AddVolumes(volumeList string, collection string) error {
+	return s.store.AddVolume(volumeList, collection, storage.EmptyTTL)
+}
+
+func (s *Server) SetRaftTimings(t RaftTimings) {
+	s.timings = t
+}
+
+// SetVolumeSizeLimit stops writes from being assigned to volumes of limit
+// bytes or more, so that new volumes are grown instead.
+func (s *Server) SetVolumeSizeLimit(limit uint64) {
+	s.sizeLimit = limit
+	s.topology.SetVolumeSizeLimit(limit)
+}
+
 func (s *Server) connectionString() string {
 	return fmt.Sprintf("http://%s:%d", s.host, s.port)
 }
 
 func (s *Server) ListenAndServe(leader string) error {
 	var err error
-	t := raft.NewHTTPTransporter("/raft", 200*time.Millisecond)
-	s.raftServer, err = raft.NewServer(s.name, s.path, t, nil, s.store, "")
+	t := raft.NewHTTPTransporter("/raft", s.timings.TransportTimeout)
+	secureTransporter(t, s.timings.TransportTimeout)
+	s.raftServer, err = raft.NewServer(s.name, s.path, t, s.context, s.context, "")
 	if err != nil {
-		fmt.Println(err.Error())
+		slog.Error("cannot create the metadata group", "err", err)
+	}
+	if snapshots, _ := ioutil.ReadDir(filepath.Join(s.path, "snapshot")); len(snapshots) > 0 {
+		if err = s.raftServer.LoadSnapshot(); err != nil {
+			slog.Error("cannot load snapshot", "err", err)
+		}
 	}
 	t.Install(s.raftServer, s)
-	s.raftServer.SetHeartbeatInterval(1 * time.Millisecond)
+	s.raftServer.SetHeartbeatInterval(s.timings.HeartbeatInterval)
+	s.raftServer.SetElectionTimeout(s.timings.ElectionTimeout)
 	s.raftServer.Start()
 	if leader != "" {
 		s.Join(leader)
@@ -78,24 +145,102 @@ func (s *Server) ListenAndServe(leader string) error {
 			Name:             s.raftServer.Name(),
 			ConnectionString: s.connectionString(),
 		})
-		fmt.Println(r)
 		if err != nil {
-			fmt.Println("do error")
+			slog.Error("cannot bootstrap the metadata group", "err", err)
+		} else {
+			slog.Info("bootstrapped the metadata group", "name", s.name, "result", r)
+		}
+	}
+	for _, vid := range s.store.VolumeIds() {
+		if err := s.startGroup(vid, leader); err != nil {
+			slog.Error("cannot start volume group", "volume", vid.String(), "err", err)
 		}
 	}
 
-	s.httpServer = &http.Server{
+	s.installRoutes()
+	go s.expireVolumes()
+	go s.takeOverGroups()
+	go s.heartbeat()
+	var h http.Handler = s.router
+	if s.admission != nil {
+		h = s.admission.wrap(h, isUpload)
+	}
+	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", s.port),
-		Handler: s.router,
+		Handler: accessLog(s.track(h)),
+	}
+	if clusterTLS != nil {
+		srv.TLSConfig = clusterTLS.ServerConfig()
+	}
+	s.mutex.Lock()
+	s.httpServer = srv
+	s.mutex.Unlock()
+	slog.Info("serving", "name", s.name, "addr", srv.Addr, "tls", clusterTLS != nil)
+	if clusterTLS != nil {
+		return srv.ListenAndServeTLS("", "")
 	}
+	return srv.ListenAndServe()
+}
+
+// installRoutes sets up the router. The requests between nodes and the
+// administration of the cluster only answer the other nodes.
+func (s *Server) installRoutes() {
 	s.router.HandleFunc("/write", s.writeHandler).Methods("POST")
-	s.router.HandleFunc("/read/{vid}/{offset}/{size}/{cookie}", s.readHandler).Methods("GET")
-	s.router.HandleFunc("/join", s.joinHandler).Methods("POST")
-	return s.httpServer.ListenAndServe()
+	s.router.HandleFunc("/write/{fid}", s.writeHandler).Methods("POST")
+	s.router.HandleFunc("/v1/write", s.v1WriteHandler).Methods("POST")
+	s.router.HandleFunc("/v1/write/{fid}", s.v1WriteHandler).Methods("POST")
+	s.router.HandleFunc("/read/{vid}/{offset}/{size}/{cookie}", s.readHandler).Methods("GET", "HEAD")
+	s.router.HandleFunc("/delete/{vid}/{offset}/{size}/{cookie}", s.deleteHandler).Methods("POST", "DELETE")
+	s.router.HandleFunc("/join", peerOnly(s.joinHandler)).Methods("POST")
+	s.router.HandleFunc("/leave", peerOnly(s.leaveHandler)).Methods("POST")
+	s.router.HandleFunc("/remove/{name}", peerOnly(s.removeHandler)).Methods("POST")
+	s.router.HandleFunc("/readindex", peerOnly(s.readIndexHandler)).Methods("GET")
+	s.router.HandleFunc("/groups", s.groupsHandler).Methods("GET")
+	s.router.PathPrefix(davPrefix).Handler(s.clientsOnly(s.davHandler()))
+	s.router.PathPrefix("/filer/").Handler(s.clientsOnly(http.HandlerFunc(s.filerHandler))).Methods("GET", "HEAD", "POST", "PUT", "DELETE")
+	s.router.HandleFunc("/leader", s.leaderHandler).Methods("GET")
+	s.router.HandleFunc("/dir/filer/{op}", peerOnly(s.filerMetaHandler)).Methods("POST")
+	s.router.HandleFunc("/dir/heartbeat", peerOnly(s.heartbeatHandler)).Methods("POST")
+	s.router.HandleFunc("/dir/assign", s.assignHandler).Methods("GET", "POST")
+	s.router.HandleFunc("/dir/lookup", s.lookupHandler).Methods("GET")
+	s.router.HandleFunc("/dir/token", s.tokenHandler).Methods("GET", "POST")
+	s.router.HandleFunc("/dir/presign", s.presignHandler).Methods("GET", "POST")
+	s.router.HandleFunc("/dir/status", s.dirStatusHandler).Methods("GET")
+	s.router.HandleFunc("/dir/policy", s.policyHandler).Methods("GET")
+	s.router.HandleFunc("/dir/policy", peerOnly(s.policyHandler)).Methods("POST")
+	s.router.HandleFunc("/dir/quota", s.quotaHandler).Methods("GET")
+	s.router.HandleFunc("/dir/quota", peerOnly(s.quotaHandler)).Methods("POST")
+	s.router.HandleFunc("/dir/usage", s.usageHandler).Methods("GET")
+	s.router.HandleFunc("/dir/grow", peerOnly(s.growHandler)).Methods("POST")
+	s.router.HandleFunc("/dir/placement/violations", s.violationsHandler).Methods("GET")
+	s.router.HandleFunc("/admin/volume/{vid}", peerOnly(s.allocateVolumeHandler)).Methods("POST")
+	s.router.HandleFunc("/admin/volume/{vid}/seal", peerOnly(s.sealHandler)).Methods("POST")
+	s.router.HandleFunc("/admin/volume/{vid}/delete", peerOnly(s.deleteVolumeHandler)).Methods("POST")
+	s.router.HandleFunc("/admin/volume/{vid}/tier", peerOnly(s.tierHandler)).Methods("POST")
+	s.router.HandleFunc("/admin/volume/{vid}/untier", peerOnly(s.untierHandler)).Methods("POST")
+	s.router.HandleFunc("/admin/volume/{vid}/data", peerOnly(s.volumeDataHandler)).Methods("GET")
+	s.router.HandleFunc("/admin/ec/encode/{vid}", peerOnly(s.ecEncodeHandler)).Methods("POST")
+	s.router.HandleFunc("/admin/ec/decode/{vid}", peerOnly(s.ecDecodeHandler)).Methods("POST")
+	s.router.HandleFunc("/admin/ec/info/{vid}", peerOnly(s.ecInfoHandler)).Methods("GET")
+	s.router.HandleFunc("/admin/ec/shard/{vid}/{shard}", peerOnly(s.ecShardHandler)).Methods("GET")
+	s.router.HandleFunc("/admin/ec/pull/{vid}/{shard}", peerOnly(s.ecPullHandler)).Methods("POST")
+	s.router.HandleFunc("/admin/ec/delete/{vid}", peerOnly(s.ecDeleteHandler)).Methods("POST")
+	s.router.HandleFunc("/dir/ec/encode", peerOnly(s.dirEcEncodeHandler)).Methods("POST")
+	s.router.HandleFunc("/dir/ec/decode", peerOnly(s.dirEcDecodeHandler)).Methods("POST")
+	s.router.HandleFunc("/dir/tier", peerOnly(s.dirTierHandler)).Methods("POST")
+	s.router.HandleFunc("/dir/untier", peerOnly(s.dirUntierHandler)).Methods("POST")
+	s.router.HandleFunc("/group/{vid}/join", peerOnly(s.joinHandler)).Methods("POST")
+	s.router.HandleFunc("/group/{vid}/leave", peerOnly(s.leaveHandler)).Methods("POST")
+	s.router.HandleFunc("/group/{vid}/remove/{name}", peerOnly(s.removeHandler)).Methods("POST")
+	s.router.HandleFunc("/group/{vid}/readindex", peerOnly(s.readIndexHandler)).Methods("GET")
+	s.router.HandleFunc("/group/{vid}/host", peerOnly(s.hostHandler)).Methods("POST")
+	s.router.HandleFunc("/group/{vid}/unhost", peerOnly(s.unhostHandler)).Methods("POST")
 }
 
+// HandleFunc is how the raft transporters install their endpoints, which
+// only answer the other nodes.
 func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
-	s.router.HandleFunc(pattern, handler)
+	s.router.HandleFunc(pattern, peerOnly(handler))
 }
 
 func (s *Server) Join(leader string) error {
@@ -105,7 +250,7 @@ func (s *Server) Join(leader string) error {
 	}
 	var b bytes.Buffer
 	json.NewEncoder(&b).Encode(command)
-	resp, err := http.Post(fmt.Sprintf("http://%s/join", leader), "application/json", &b)
+	resp, err := peerClient.Post(fmt.Sprintf("http://%s/join", leader), "application/json", &b)
 	if err != nil {
 		return err
 	}
@@ -114,44 +259,167 @@ func (s *Server) Join(leader string) error {
 }
 
 func (s *Server) joinHandler(w http.ResponseWriter, req *http.Request) {
+	vid := mux.Vars(req)["vid"]
+	rs, err := s.raftGroup(vid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if vid != "" && !isLeader(rs) {
+		s.forwardToLeader(rs, w, req)
+		return
+	}
 	command := &raft.DefaultJoinCommand{}
 	if err := json.NewDecoder(req.Body).Decode(&command); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if _, err := s.raftServer.Do(command); err != nil {
+	if _, err := rs.Do(command); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if vid != "" {
+		if err := s.hostGroup(vid, command.Name, command.ConnectionString); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 }
 
 func (s *Server) readHandler(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	vid, _ := storage.NewVolumeId(vars["vid"])
-	v := s.store.GetVolume(vid)
-	if v != nil {
-		n := &storage.Needle{}
-		n.Offset, _ = strconv.ParseUint(vars["offset"], 10, 64)
-		size, _ := strconv.ParseUint(vars["size"], 10, 32)
-		cookie, _ := strconv.ParseUint(vars["cookie"], 10, 32)
-		n.Size = uint32(size)
-		n.Cookie = uint32(cookie)
-		v.Read(n)
+	if e := s.authorizeRead(req, readFid(vid, vars)); e != nil {
+		http.Error(w, e.Message, e.Status)
+		return
+	}
+	switch req.FormValue("consistency") {
+	case "", ConsistencyLocal:
+	case ConsistencyLeader:
+		if s.group(vid) == nil {
+			break // sealed and erasure coded volumes never change
+		}
+		rs, err := s.raftGroup(mux.Vars(req)["vid"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !isLeader(rs) {
+			s.forwardToLeader(rs, w, req)
+			return
+		}
+	case ConsistencyLinearizable:
+		if s.group(vid) == nil {
+			break
+		}
+		if err := s.waitReadIndex(mux.Vars(req)["vid"]); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	default:
+		http.Error(w, "unknown consistency", http.StatusBadRequest)
+		return
+	}
+	if s.store.HasVolume(vid) || s.store.GetEcVolume(vid) != nil {
+		fid := readFid(vid, vars)
+		n := &storage.Needle{Offset: fid.Offset, Size: fid.Size, Cookie: fid.Cookie}
+		if _, err := s.store.Read(vid, n); err != nil {
+			util.Logger(req.Context()).Debug("read failed", "fid", fid.String(), "err", err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		noteFid(req, fid.String(), len(n.Data))
+		if n.HasMime() && len(n.Mime) > 0 {
+			w.Header().Set("Content-Type", string(n.Mime))
+		}
+		if n.HasName() && len(n.Name) > 0 {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", n.Name))
+		}
+		if n.HasLastModifiedDate() {
+			w.Header().Set("Last-Modified", time.Unix(int64(n.LastModified), 0).UTC().Format(http.TimeFormat))
+		}
+		if n.IsGzipped() {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(n.Data)))
 		w.Write(n.Data)
-		fmt.Println(len(n.Data))
 	} else {
 		http.Error(w, "vid not found", http.StatusBadRequest)
 	}
 }
 
+// readFid is the fid in the path of a read.
+func readFid(vid storage.VolumeId, vars map[string]string) *storage.FileId {
+	offset, _ := strconv.ParseUint(vars["offset"], 10, 64)
+	size, _ := strconv.ParseUint(vars["size"], 10, 32)
+	cookie, _ := strconv.ParseUint(vars["cookie"], 10, 32)
+	return storage.NewFileId(vid, offset, uint32(size), uint32(cookie))
+}
+
 func (s *Server) writeHandler(w http.ResponseWriter, req *http.Request) {
-	filename, data, mimetype, _, _, e := storage.ParseUpload(req)
+	vid, n, res, e := s.write(w, req)
 	if e != nil {
-		w.Write([]byte("write error"))
+		http.Error(w, e.Message, e.Status)
+		return
+	}
+	if n == nil {
+		return
+	}
+	noteFid(req, storage.NewFileId(vid, res.Offset, res.Size, res.Cookie).String(), len(n.Data))
+	w.Write([]byte(vid.String()))
+	content, _ := json.Marshal(res)
+	w.Write(content)
+}
+
+// write stores the upload of req in a volume led by this node. A nil
+// needle without an error means the request was forwarded to the leader
+// of the volume group, which has answered it.
+func (s *Server) write(w http.ResponseWriter, req *http.Request) (storage.VolumeId, *storage.Needle, *command.WriteRes, *apiError) {
+	vid, cookie := req.URL.Query().Get("vid"), uint32(0)
+	if fid := mux.Vars(req)["fid"]; fid != "" {
+		id, c, err := storage.ParseAssignedId(fid)
+		if err != nil {
+			return 0, nil, nil, newApiError(http.StatusBadRequest, "invalid_fid", err)
+		}
+		vid, cookie = id.String(), c
+		if s.writeKey != nil {
+			if e := checkToken(s.writeKey, req, id, c); e != nil {
+				return 0, nil, nil, e
+			}
+		}
+	} else if s.writeKey != nil {
+		return 0, nil, nil, newApiError(http.StatusUnauthorized, "token_required", fmt.Errorf("writes need a fid and a token from /dir/assign"))
+	}
+	ttl, err := storage.ReadTTL(req.URL.Query().Get("ttl"))
+	if err != nil {
+		return 0, nil, nil, newApiError(http.StatusBadRequest, "invalid_ttl", err)
+	}
+	v, rs, err := s.writableVolume(vid, ttl)
+	if err != nil {
+		return 0, nil, nil, newApiError(http.StatusServiceUnavailable, "no_writable_volume", err)
+	}
+	if !isLeader(rs) {
+		q := req.URL.Query()
+		q.Set("vid", v.Id.String())
+		req.URL.RawQuery = q.Encode()
+		if status, err := s.proxyToLeader(rs, w, req); err != nil {
+			return 0, nil, nil, newApiError(status, "leader_unavailable", err)
+		}
+		return v.Id, nil, nil, nil
+	}
+	filename, data, mimetype, gzipped, _, err := storage.ParseUpload(req)
+	if err != nil {
+		return 0, nil, nil, newApiError(http.StatusBadRequest, "invalid_upload", err)
+	}
+	if e := s.checkQuota(v.Collection, uint64(len(data))); e != nil {
+		return 0, nil, nil, e
 	}
 	size := len(data)
 	n := &storage.Needle{}
-	n.Cookie = rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+	n.Cookie = cookie
+	if n.Cookie == 0 {
+		n.Cookie = rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+	}
 	n.Data = data
 	n.DataSize = uint32(size)
 	n.Name = []byte(filename)
@@ -162,22 +430,23 @@ func (s *Server) writeHandler(w http.ResponseWriter, req *http.Request) {
 	n.SetHasMime()
 	n.SetHasName()
 	n.SetHasLastModifiedDate()
+	if gzipped {
+		n.SetGzipped()
+	}
+	n.SetTtl(ttl)
 	n.Checksum = storage.NewCRC(n.Data)
 
-	v := s.store.FreeVolume()
-
 	bytes, err := n.GobEncode()
 	if err != nil {
-		fmt.Println("needle encode error")
-	}
-	rv, err := s.raftServer.Do(command.NewWriteCommand(v.Id.String(), bytes))
-	if err == nil {
-		res := rv.(command.WriteRes)
-		w.Write([]byte(v.Id.String()))
-		content, _ := json.Marshal(res)
-		w.Write(content)
-		return
+		return 0, nil, nil, newApiError(http.StatusBadRequest, "invalid_upload", err)
+	}
+	c := command.NewWriteCommand(v.Id.String(), bytes)
+	c.Dedup = s.dedup
+	c.RequestId = util.RequestId(req.Context())
+	rv, err := rs.Do(c)
+	if err != nil {
+		return 0, nil, nil, newApiError(http.StatusInternalServerError, "write_failed", err)
 	}
-	leader := s.raftServer.Peers()[s.raftServer.Leader()].ConnectionString
-	w.Write([]byte(leader))
+	res := rv.(command.WriteRes)
+	return v.Id, n, &res, nil
 }
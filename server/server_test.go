@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"github.com/Masterlvng/MCDFS/command"
+	"github.com/Masterlvng/MCDFS/util"
+	"github.com/goraft/raft"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestServer is a node that is not started: its metadata group has
+// no peers and it serves no requests.
+func newTestServer(t *testing.T) *Server {
+	dir := t.TempDir()
+	s := New(dir, "localhost", 4001, []string{dir})
+	rs, err := raft.NewServer(s.name, dir, raft.NewHTTPTransporter("/raft", time.Second), s.context, s.context, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.raftServer = rs
+	return s
+}
+
+// startTestNode runs a node that is a cluster on its own, as runServer
+// does, and stops it at the end of the test.
+func startTestNode(t *testing.T) *Server {
+	s := startNode(t, "")
+	// The node knows it can take volumes after its first heartbeat.
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if isLeader(s.raftServer) && len(s.topology.Nodes()) > 0 {
+			return s
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("the node did not become the leader")
+	return nil
+}
+
+// startNode runs a node that joins the cluster led by leader, or starts
+// one when leader is empty, and waits for its metadata group. The setup
+// functions are applied to the node before it starts.
+func startNode(t *testing.T, leader string, setup ...func(*Server)) *Server {
+	command.Register()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	dir := t.TempDir()
+	s := New(dir, "127.0.0.1", port, []string{dir})
+	for _, f := range setup {
+		f(s)
+	}
+	go s.ListenAndServe(leader)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx, false)
+	})
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mutex.Lock()
+		started := s.httpServer != nil
+		s.mutex.Unlock()
+		if started && s.raftServer.Leader() != "" {
+			return s
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("the node did not join a cluster")
+	return nil
+}
+
+// waitForVolumes waits for the master to hear of the volumes of s, which
+// takes a heartbeat.
+func waitForVolumes(t *testing.T, s *Server) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, vid := range s.store.VolumeIds() {
+		for len(s.topology.Lookup(vid)) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("the master does not know volume %s", vid.String())
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+func TestPeerRoutesNeedTheClusterSecret(t *testing.T) {
+	withCredentials(t, "s3cret")
+	s := newTestServer(t)
+	s.installRoutes()
+	tests := []struct {
+		class  string
+		method string
+		path   string
+	}{
+		{"membership", "POST", "/join"},
+		{"membership", "POST", "/leave"},
+		{"membership", "POST", "/remove/node"},
+		{"read index", "GET", "/readindex"},
+		{"volume group", "POST", "/group/1/join"},
+		{"volume group", "POST", "/group/1/leave"},
+		{"volume group", "POST", "/group/1/remove/node"},
+		{"volume group", "GET", "/group/1/readindex"},
+		{"volume group", "POST", "/group/1/host"},
+		{"volume group", "POST", "/group/1/unhost"},
+		{"volume admin", "POST", "/admin/volume/1"},
+		{"volume admin", "POST", "/admin/volume/1/seal"},
+		{"volume admin", "POST", "/admin/volume/1/delete"},
+		{"volume admin", "POST", "/admin/volume/1/tier?to=dir"},
+		{"volume admin", "POST", "/admin/volume/1/untier"},
+		{"volume admin", "GET", "/admin/volume/1/data?from=0&to=0"},
+		{"erasure coding admin", "POST", "/admin/ec/encode/1"},
+		{"erasure coding admin", "POST", "/admin/ec/decode/1"},
+		{"erasure coding admin", "GET", "/admin/ec/info/1"},
+		{"erasure coding admin", "GET", "/admin/ec/shard/1/0"},
+		{"erasure coding admin", "POST", "/admin/ec/pull/1/0?from=localhost:4001"},
+		{"erasure coding admin", "POST", "/admin/ec/delete/1"},
+		{"master", "POST", "/dir/heartbeat"},
+		{"master", "POST", "/dir/filer/create"},
+		{"master", "POST", "/dir/filer/delete"},
+		{"master", "POST", "/dir/filer/rename"},
+		{"cluster admin", "POST", "/dir/grow?collection=photo"},
+		{"cluster admin", "POST", "/dir/ec/encode?volumeId=1"},
+		{"cluster admin", "POST", "/dir/ec/decode?volumeId=1"},
+		{"cluster admin", "POST", "/dir/tier?volumeId=1&to=dir"},
+		{"cluster admin", "POST", "/dir/untier?volumeId=1"},
+		{"cluster admin", "POST", "/dir/quota?collection=photo&maxBytes=1"},
+		{"cluster admin", "POST", "/dir/policy?collection=photo&replication=000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.class+" "+tt.method+" "+tt.path, func(t *testing.T) {
+			for _, secret := range []string{"", "guess"} {
+				req := httptest.NewRequest(tt.method, tt.path, nil)
+				if secret != "" {
+					req.Header.Set(util.SecretHeader, secret)
+				}
+				w := httptest.NewRecorder()
+				s.router.ServeHTTP(w, req)
+				if w.Code != http.StatusUnauthorized && w.Code != http.StatusForbidden {
+					t.Errorf("with secret %q: status = %d, want 401 or 403", secret, w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestPeerRoutesAnswerPeers(t *testing.T) {
+	withCredentials(t, "s3cret")
+	s := newTestServer(t)
+	s.installRoutes()
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/admin/ec/info/1", http.StatusNotFound},
+		{"GET", "/readindex", http.StatusServiceUnavailable},
+		{"POST", "/admin/ec/pull/1/0?from=169.254.169.254", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set(util.SecretHeader, "s3cret")
+			w := httptest.NewRecorder()
+			s.router.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestPublicRoutesStayOpen(t *testing.T) {
+	withCredentials(t, "s3cret")
+	s := newTestServer(t)
+	s.installRoutes()
+	for _, path := range []string{"/dir/quota", "/dir/policy", "/groups"} {
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden {
+			t.Errorf("GET %s: status = %d", path, w.Code)
+		}
+	}
+}
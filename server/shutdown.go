@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// track counts the client requests in flight for Shutdown and, once it
+// has begun, turns clients away so that they retry on other nodes. The
+// requests between nodes are still served: the node takes part in raft
+// until it stops. Only a request that proves it comes from a peer counts
+// as one, whatever its path, see fromPeer.
+func (s *Server) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		peer := fromPeer(req)
+		if peer && isInternal(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		s.mutex.Lock()
+		if s.draining {
+			s.mutex.Unlock()
+			if peer {
+				h.ServeHTTP(w, req)
+				return
+			}
+			reject(w, http.StatusServiceUnavailable, time.Second, fmt.Errorf("shutting down"))
+			return
+		}
+		s.inflight.Add(1)
+		s.mutex.Unlock()
+		defer s.inflight.Done()
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Shutdown stops the node in order: clients are turned away while the
+// requests in flight finish, the node leaves the cluster when leave is
+// set, the metadata group takes a snapshot, the raft groups stop, which
+// hands the leadership of the groups this node leads to a follower at its
+// next election, and the volumes are synced and closed. Only the wait for
+// the requests in flight ends with ctx; the rest always happens.
+func (s *Server) Shutdown(ctx context.Context, leave bool) error {
+	s.mutex.Lock()
+	s.draining = true
+	httpServer, s3Server, grpcServer := s.httpServer, s.s3Server, s.grpcServer
+	s.mutex.Unlock()
+
+	var errs []string
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		if grpcServer != nil {
+			grpcServer.GracefulStop()
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		errs = append(errs, "requests in flight: "+ctx.Err().Error())
+	}
+	if s3Server != nil {
+		s3Server.Close()
+	}
+	if leave {
+		if err := s.Leave(); err != nil {
+			errs = append(errs, "leave: "+err.Error())
+		}
+	}
+	if s.raftServer != nil && s.raftServer.Running() {
+		if err := s.raftServer.TakeSnapshot(); err != nil {
+			errs = append(errs, "snapshot: "+err.Error())
+		}
+	}
+	s.Stop()
+	if httpServer != nil {
+		httpServer.Close()
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
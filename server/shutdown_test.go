@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTrackExemptsOnlyPeers(t *testing.T) {
+	withCredentials(t, "s3cret")
+	s := &Server{draining: true}
+	h := s.track(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	tests := []struct {
+		name   string
+		path   string
+		secret string
+		want   int
+	}{
+		{"client", "/v1/write", "", http.StatusServiceUnavailable},
+		{"client on an internal path", "/raft/appendEntries", "", http.StatusServiceUnavailable},
+		{"client with a wrong secret", "/raft/appendEntries", "guess", http.StatusServiceUnavailable},
+		{"peer", "/v1/write", "s3cret", http.StatusOK},
+		{"peer on an internal path", "/raft/appendEntries", "s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, nil)
+			if tt.secret != "" {
+				req.Header.Set(util.SecretHeader, tt.secret)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a node")
+	}
+	s := startTestNode(t)
+	vid := storage.VolumeId(7)
+	allocate(t, s, vid, "")
+	waitForGroup(t, s, vid, 0)
+
+	// The upload is held in flight until Shutdown has begun.
+	started, release := make(chan struct{}), make(chan struct{})
+	upload := httptest.NewServer(s.track(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		s.v1WriteHandler(w, req)
+	})))
+	defer upload.Close()
+	uploaded := make(chan *http.Response, 1)
+	go func() {
+		ct, body := v1Upload("a.txt", []byte("in flight"))
+		resp, err := http.Post(upload.URL+"/v1/write?vid="+vid.String(), ct, body)
+		if err != nil {
+			t.Error(err)
+		}
+		uploaded <- resp
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx, false)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(fmt.Sprintf("http://%s/dir/status", s.publicUrl()))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusServiceUnavailable {
+				if resp.Header.Get("Retry-After") == "" {
+					t.Error("a request turned away while draining has no Retry-After")
+				}
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("a new request while draining was served: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown() = %v before the upload in flight finished", err)
+	default:
+	}
+
+	close(release)
+	resp := <-uploaded
+	if resp == nil {
+		t.FailNow()
+	}
+	var res V1WriteResult
+	json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("the upload in flight got %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown() = %v", err)
+	}
+	fid, _ := storage.ParseFileId(res.Fid)
+	n := &storage.Needle{Offset: fid.Offset, Size: fid.Size, Cookie: fid.Cookie}
+	if _, err := s.store.Read(vid, n); err == nil {
+		t.Error("the store can still be read after Shutdown")
+	}
+}
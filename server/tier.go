@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/storage"
+	"net/http"
+	"net/url"
+)
+
+// AddTier makes a remote tier available for sealed volumes of this node.
+func (s *Server) AddTier(t storage.RemoteTier) {
+	s.store.AddTier(t)
+}
+
+func (s *Server) tierHandler(w http.ResponseWriter, req *http.Request) {
+	vid, err := volumeIdVar(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	upload := req.FormValue("upload") != "false"
+	if err := s.store.TierVolume(vid, req.FormValue("to"), upload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) untierHandler(w http.ResponseWriter, req *http.Request) {
+	vid, err := volumeIdVar(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.store.UntierVolume(vid, req.FormValue("drop") == "true"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) volumeHosts(vid storage.VolumeId) []string {
+	var hosts []string
+	for _, l := range s.topology.Lookup(vid) {
+		if len(l.EcShards) == 0 {
+			hosts = append(hosts, l.Url)
+		}
+	}
+	return hosts
+}
+
+// dirTierHandler seals a volume through its group, uploads the data file
+// from the group leader and switches every replica to the remote copy.
+func (s *Server) dirTierHandler(w http.ResponseWriter, req *http.Request) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	vid, err := storage.NewVolumeId(req.FormValue("volumeId"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hosts := s.volumeHosts(vid)
+	if len(hosts) == 0 {
+		http.Error(w, "volume not found", http.StatusNotFound)
+		return
+	}
+	source, err := postForString(fmt.Sprintf("http://%s/admin/volume/%s/seal", hosts[0], vid.String()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	to := url.QueryEscape(req.FormValue("to"))
+	if err := postMembership(fmt.Sprintf("http://%s/admin/volume/%s/tier?to=%s", source, vid.String(), to), nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, host := range hosts {
+		if host == source {
+			continue
+		}
+		u := fmt.Sprintf("http://%s/admin/volume/%s/tier?to=%s&upload=false", host, vid.String(), to)
+		if err := postMembership(u, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func (s *Server) dirUntierHandler(w http.ResponseWriter, req *http.Request) {
+	if !isLeader(s.raftServer) {
+		s.forwardToLeader(s.raftServer, w, req)
+		return
+	}
+	vid, err := storage.NewVolumeId(req.FormValue("volumeId"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hosts := s.volumeHosts(vid)
+	if len(hosts) == 0 {
+		http.Error(w, "volume not found", http.StatusNotFound)
+		return
+	}
+	// The last replica brought back drops the remote copy.
+	for i, host := range hosts {
+		u := fmt.Sprintf("http://%s/admin/volume/%s/untier?drop=%t", host, vid.String(), i == len(hosts)-1)
+		if err := postMembership(u, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/Masterlvng/MCDFS/filer"
+	"golang.org/x/net/webdav"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// WebDAV serves the same tree as the S3 gateway: the top-level directories
+// are the collections (buckets) and files are filer entries under them.
+
+const davPrefix = "/dav"
+
+func (s *Server) davHandler() *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: &davFS{s: s},
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+type davFS struct {
+	s *Server
+}
+
+// filerPath maps a WebDAV name to the filer. Names starting with a dot at
+// the top level are kept for the gateway's own use.
+func (fs *davFS) filerPath(name string) (string, error) {
+	name = filer.Clean(name)
+	if strings.HasPrefix(name, "/.") {
+		return "", os.ErrNotExist
+	}
+	if name == "/" {
+		return s3BucketsDir, nil
+	}
+	return s3BucketsDir + name, nil
+}
+
+// collection returns the collection a filer path belongs to.
+func collectionOf(p string) string {
+	c := strings.TrimPrefix(p, s3BucketsDir+"/")
+	if i := strings.Index(c, "/"); i >= 0 {
+		c = c[:i]
+	}
+	return c
+}
+
+func davError(err error) error {
+	switch err {
+	case filer.ErrNotFound:
+		return os.ErrNotExist
+	case filer.ErrExists, filer.ErrIsDir, filer.ErrNotDir, filer.ErrNotEmpty:
+		return os.ErrExist
+	}
+	return err
+}
+
+func (fs *davFS) find(p string) (*filer.Entry, error) {
+	e, err := fs.s.context.Filer.Find(p)
+	if err == filer.ErrNotFound && p == s3BucketsDir {
+		return &filer.Entry{Path: p, IsDir: true}, nil
+	}
+	return e, davError(err)
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	p, err := fs.filerPath(name)
+	if err != nil {
+		return err
+	}
+	if _, err = fs.find(p); err == nil {
+		return os.ErrExist
+	}
+	if _, err = fs.find(path.Dir(p)); err != nil {
+		return err
+	}
+	if !fs.collectionName(p) {
+		return os.ErrPermission
+	}
+	return davError(fs.s.putEntry(&filer.Entry{Path: p, IsDir: true, Mtime: time.Now()}))
+}
+
+// collectionName reports whether p, when it is a top-level directory, is
+// named as the S3 gateway names buckets: a collection name holds no "_",
+// which separates it from the volume id in file names.
+func (fs *davFS) collectionName(p string) bool {
+	return path.Dir(p) != s3BucketsDir || s3BucketName.MatchString(path.Base(p))
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p, err := fs.filerPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		if p == s3BucketsDir || path.Dir(p) == s3BucketsDir {
+			return nil, os.ErrPermission // files live in collections
+		}
+		if e, err := fs.find(p); err == nil && e.IsDir {
+			return nil, os.ErrExist
+		}
+		return &davFile{fs: fs, ctx: ctx, entry: &filer.Entry{Path: p}, writing: true}, nil
+	}
+	e, err := fs.find(p)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{fs: fs, ctx: ctx, entry: e}, nil
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	p, err := fs.filerPath(name)
+	if err != nil {
+		return err
+	}
+	if p == s3BucketsDir {
+		return os.ErrPermission
+	}
+	return davError(fs.s.removeEntry(p, true))
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName string, newName string) error {
+	from, err := fs.filerPath(oldName)
+	if err != nil {
+		return err
+	}
+	to, err := fs.filerPath(newName)
+	if err != nil {
+		return err
+	}
+	if from == s3BucketsDir || to == s3BucketsDir {
+		return os.ErrPermission
+	}
+	// Only collections live at the top level.
+	if path.Dir(to) == s3BucketsDir {
+		e, err := fs.find(from)
+		if err != nil {
+			return err
+		}
+		if !e.IsDir || !fs.collectionName(to) {
+			return os.ErrPermission
+		}
+	}
+	return davError(fs.s.renameEntry(from, to))
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	p, err := fs.filerPath(name)
+	if err != nil {
+		return nil, err
+	}
+	e, err := fs.find(p)
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{e}, nil
+}
+
+type davFileInfo struct {
+	e *filer.Entry
+}
+
+func (fi davFileInfo) Name() string       { return fi.e.Name() }
+func (fi davFileInfo) Size() int64        { return fi.e.Size }
+func (fi davFileInfo) ModTime() time.Time { return fi.e.Mtime }
+func (fi davFileInfo) IsDir() bool        { return fi.e.IsDir }
+func (fi davFileInfo) Sys() interface{}   { return nil }
+
+func (fi davFileInfo) Mode() os.FileMode {
+	if fi.e.IsDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType and ETag spare the handler from reading files to answer
+// PROPFIND.
+func (fi davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.e.Mime == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.e.Mime, nil
+}
+
+func (fi davFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.e.ETag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.e.ETag + `"`, nil
+}
+
+// davFile reads the content of a file on first use, and buffers what is
+// written to it until Close stores it.
+type davFile struct {
+	fs      *davFS
+	ctx     context.Context
+	entry   *filer.Entry
+	writing bool
+	reader  *bytes.Reader
+	buf     bytes.Buffer
+	listed  bool
+}
+
+func (f *davFile) Close() error {
+	if !f.writing {
+		return nil
+	}
+	f.writing = false
+	p := f.entry.Path
+	e, err := f.fs.s.uploadEntry(f.ctx, p, f.buf.Bytes(), mime.TypeByExtension(path.Ext(p)), collectionOf(p), "")
+	if err != nil {
+		return err
+	}
+	if err = f.fs.s.putEntry(e); err != nil {
+		f.fs.s.deleteFids([]*filer.Entry{e})
+		return davError(err)
+	}
+	return nil
+}
+
+func (f *davFile) load() error {
+	if f.reader != nil {
+		return nil
+	}
+	if f.entry.IsDir {
+		return os.ErrInvalid
+	}
+	var buf bytes.Buffer
+	if err := f.fs.s.readEntry(f.ctx, f.entry, 0, f.entry.Size, &buf); err != nil {
+		return err
+	}
+	f.reader = bytes.NewReader(buf.Bytes())
+	return nil
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.writing {
+		return 0, os.ErrInvalid
+	}
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.reader.Read(p)
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	if f.writing {
+		if offset == 0 && whence == io.SeekCurrent {
+			return int64(f.buf.Len()), nil
+		}
+		return 0, os.ErrInvalid
+	}
+	// Seeking to the end is how the handler learns the size; no need to
+	// read the file for that.
+	if f.reader == nil && offset == 0 && whence == io.SeekEnd {
+		return f.entry.Size, nil
+	}
+	if f.reader == nil && offset == 0 && whence == io.SeekStart {
+		return 0, nil
+	}
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if !f.writing {
+		return 0, os.ErrInvalid
+	}
+	return f.buf.Write(p)
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.entry.IsDir {
+		return nil, os.ErrInvalid
+	}
+	if f.listed {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	f.listed = true
+	entries, err := f.fs.s.context.Filer.List(f.entry.Path, "", 0)
+	if err != nil && !(err == filer.ErrNotFound && f.entry.Path == s3BucketsDir) {
+		return nil, davError(err)
+	}
+	var infos []os.FileInfo
+	for _, e := range entries {
+		if f.entry.Path == s3BucketsDir && strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		infos = append(infos, davFileInfo{e})
+	}
+	return infos, nil
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return davFileInfo{f.entry}, nil
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebDAV(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a node")
+	}
+	s := startTestNode(t)
+	dav := httptest.NewServer(s.davHandler())
+	defer dav.Close()
+	do := func(method string, path string, body string, header map[string]string, status int) string {
+		req, err := http.NewRequest(method, dav.URL+davPrefix+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != status {
+			t.Fatalf("%s %s: status = %d, want %d: %s", method, path, resp.StatusCode, status, b)
+		}
+		return string(b)
+	}
+	move := func(from string, to string, status int) {
+		do("MOVE", from, "", map[string]string{"Destination": dav.URL + davPrefix + to}, status)
+	}
+	propfind := func(path string, depth string) string {
+		return do("PROPFIND", path, "", map[string]string{"Depth": depth}, http.StatusMultiStatus)
+	}
+
+	do("MKCOL", "/photos", "", nil, http.StatusCreated)
+	do("MKCOL", "/photos", "", nil, http.StatusMethodNotAllowed)
+	do("MKCOL", "/bad_name", "", nil, http.StatusMethodNotAllowed)
+	do("MKCOL", "/photos/2024", "", nil, http.StatusCreated)
+	do("MKCOL", "/none/dir", "", nil, http.StatusConflict)
+
+	do("PUT", "/photos/2024/a.txt", "first file", nil, http.StatusCreated)
+	do("PUT", "/top.txt", "no collection", nil, http.StatusNotFound)
+	waitForVolumes(t, s)
+	if got := do("GET", "/photos/2024/a.txt", "", nil, http.StatusOK); got != "first file" {
+		t.Errorf("GET = %q, want %q", got, "first file")
+	}
+	do("GET", "/photos/2024/none.txt", "", nil, http.StatusNotFound)
+
+	root := propfind("/", "1")
+	if !strings.Contains(root, "/dav/photos/") {
+		t.Errorf("PROPFIND / does not list the collection: %s", root)
+	}
+	dir := propfind("/photos/2024", "1")
+	if !strings.Contains(dir, "/dav/photos/2024/a.txt") || !strings.Contains(dir, "<D:getcontentlength>10</D:getcontentlength>") {
+		t.Errorf("PROPFIND /photos/2024 does not list the file: %s", dir)
+	}
+
+	move("/photos/2024/a.txt", "/photos/b.txt", http.StatusCreated)
+	do("GET", "/photos/2024/a.txt", "", nil, http.StatusNotFound)
+	if got := do("GET", "/photos/b.txt", "", nil, http.StatusOK); got != "first file" {
+		t.Errorf("GET after MOVE = %q, want %q", got, "first file")
+	}
+	// Only collections, with valid names, live at the top level.
+	move("/photos/b.txt", "/b.txt", http.StatusForbidden)
+	move("/photos/2024", "/bad_name", http.StatusForbidden)
+	move("/photos/2024", "/videos", http.StatusCreated)
+	propfind("/videos", "0")
+
+	do("DELETE", "/photos/b.txt", "", nil, http.StatusNoContent)
+	do("GET", "/photos/b.txt", "", nil, http.StatusNotFound)
+	do("DELETE", "/photos", "", nil, http.StatusNoContent)
+	do("PROPFIND", "/photos", "", map[string]string{"Depth": "0"}, http.StatusNotFound)
+	if root = propfind("/", "1"); strings.Contains(root, "/dav/photos/") || !strings.Contains(root, "/dav/videos/") {
+		t.Errorf("PROPFIND / after DELETE and MOVE: %s", root)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/Masterlvng/MCDFS/command"
+	"github.com/Masterlvng/MCDFS/config"
+	"github.com/Masterlvng/MCDFS/filer"
+	"github.com/Masterlvng/MCDFS/server"
+	"github.com/Masterlvng/MCDFS/storage"
+	"github.com/Masterlvng/MCDFS/util"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var cfg = config.Default()
+var configFile string
+var replace string
+
+// commaList is a flag of comma separated values.
+type commaList struct {
+	values *[]string
+}
+
+func (l commaList) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l commaList) Set(s string) error {
+	*l.values = strings.Split(s, ",")
+	return nil
+}
+
+var serverFlags = flag.NewFlagSet("server", flag.ExitOnError)
+
+func init() {
+	serverFlags.StringVar(&configFile, "config", "", "YAML file of settings; flags override it")
+	serverFlags.StringVar(&cfg.Host, "h", cfg.Host, "hostname")
+	serverFlags.IntVar(&cfg.Port, "p", cfg.Port, "port")
+	serverFlags.StringVar(&cfg.Join, "join", "", "host:port of leader to join")
+	serverFlags.StringVar(&replace, "replace", "", "name of a failed node to take over, requires -join")
+	serverFlags.BoolVar(&cfg.Leave, "leave", false, "leave the cluster on shutdown")
+	serverFlags.DurationVar(&cfg.ShutdownTimeout, "shutdowntimeout", cfg.ShutdownTimeout, "how long to wait for the requests in flight on shutdown")
+	serverFlags.StringVar(&cfg.DataCenter, "dc", "", "data center of this node")
+	serverFlags.StringVar(&cfg.Rack, "rack", "", "rack of this node")
+	serverFlags.BoolVar(&cfg.Dedup, "dedup", false, "store identical uploads once")
+	serverFlags.StringVar(&cfg.FilerStore, "filerstore", cfg.FilerStore, "store of the filer namespace: bolt or memory")
+	serverFlags.StringVar(&cfg.VolumeDir, "vl", "", "where to store volume")
+	serverFlags.StringVar(&cfg.Volumes, "volumes", cfg.Volumes, "comma separated ids of the volumes to create on start")
+	serverFlags.StringVar(&cfg.Collection, "collection", cfg.Collection, "collection of -volumes")
+	serverFlags.Int64Var(&cfg.VolumeSizeLimitMB, "volumesizelimitmb", 0, "MB from which volumes take no new writes, 0 for no limit")
+	serverFlags.DurationVar(&cfg.Raft.HeartbeatInterval, "heartbeat", cfg.Raft.HeartbeatInterval, "raft heartbeat interval")
+	serverFlags.DurationVar(&cfg.Raft.ElectionTimeout, "electiontimeout", cfg.Raft.ElectionTimeout, "raft election timeout")
+	serverFlags.DurationVar(&cfg.Raft.TransportTimeout, "transporttimeout", cfg.Raft.TransportTimeout, "timeout of raft requests")
+	serverFlags.StringVar(&cfg.Tier.Dir, "tierdir", "", "directory of the \"dir\" tier for sealed volumes")
+	serverFlags.StringVar(&cfg.Tier.S3Endpoint, "s3endpoint", "", "endpoint of the \"s3\" tier, keys are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	serverFlags.StringVar(&cfg.Tier.S3Bucket, "s3bucket", cfg.Tier.S3Bucket, "bucket of the \"s3\" tier")
+	serverFlags.StringVar(&cfg.Listen.S3, "s3gateway", "", "address to serve the S3 API on, e.g. :8333; keys are read from MCDFS_S3_ACCESS_KEY and MCDFS_S3_SECRET_KEY")
+	serverFlags.Var(commaList{&cfg.Private}, "private", "comma separated collections whose reads need a token or a presigned URL")
+	serverFlags.StringVar(&cfg.TLS.Cert, "tlscert", "", "certificate to serve HTTPS with and to present to the other nodes")
+	serverFlags.StringVar(&cfg.TLS.Key, "tlskey", "", "key of -tlscert")
+	serverFlags.StringVar(&cfg.TLS.CA, "tlsca", "", "CA that signs the certificates of the nodes, required from peers on /join and raft")
+	serverFlags.StringVar(&cfg.Listen.GRPC, "grpc", "", "address to serve the gRPC API on, e.g. :4101")
+	serverFlags.StringVar(&cfg.Tier.S3Region, "s3region", "", "region of the \"s3\" tier")
+	serverFlags.Float64Var(&cfg.Limits.Rate, "ratelimit", 0, "requests per second this node takes from all clients, 0 for no limit")
+	serverFlags.IntVar(&cfg.Limits.Burst, "rateburst", 0, "requests over -ratelimit taken in a burst")
+	serverFlags.Float64Var(&cfg.Limits.ClientRate, "clientratelimit", 0, "requests per second this node takes from each client address, 0 for no limit")
+	serverFlags.IntVar(&cfg.Limits.ClientBurst, "clientburst", 0, "requests over -clientratelimit taken in a burst")
+	serverFlags.IntVar(&cfg.Limits.MaxUploads, "maxuploads", 0, "uploads in flight at once, 0 for no limit")
+	serverFlags.Int64Var(&cfg.Limits.MaxUploadMB, "maxuploadmb", 0, "MB of a single upload, 0 for no limit")
+	serverFlags.Int64Var(&cfg.Limits.MaxInFlightMB, "maxinflightmb", 0, "MB of uploads in flight at once, 0 for no limit")
+	serverFlags.StringVar(&cfg.Log.Level, "loglevel", cfg.Log.Level, "log level: debug, info, warn or error")
+	serverFlags.BoolVar(&cfg.Log.JSON, "logjson", false, "log JSON records instead of text")
+	serverFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s server [arguments] [<data-path>] \n", os.Args[0])
+		serverFlags.PrintDefaults()
+	}
+}
+
+// loadConfig reads -config, if given, then parses args again so that the
+// flags override the file.
+func loadConfig(args []string) {
+	serverFlags.Parse(args)
+	if configFile != "" {
+		if err := cfg.Load(configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot load configuration: %s\n", err.Error())
+			os.Exit(1)
+		}
+		serverFlags.Parse(args)
+	}
+	if serverFlags.NArg() > 0 {
+		cfg.Dir = serverFlags.Arg(0)
+	}
+	if cfg.Dir == "" {
+		serverFlags.Usage()
+		os.Exit(2)
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	util.SetupLogging(os.Stderr, cfg.Log.Level, cfg.Log.JSON)
+}
+
+func runServer(args []string) {
+	loadConfig(args)
+	rand.Seed(time.Now().UnixNano())
+	command.Register()
+	server.SetClusterSecret(os.Getenv("MCDFS_CLUSTER_SECRET"))
+	if keys := os.Getenv("MCDFS_CLIENT_KEYS"); keys != "" {
+		server.SetClientKeys(strings.Split(keys, ","))
+	}
+	if (os.Getenv("MCDFS_WRITE_KEY") != "" || os.Getenv("MCDFS_READ_KEY") != "" || os.Getenv("MCDFS_URL_KEYS") != "") &&
+		os.Getenv("MCDFS_CLUSTER_SECRET") == "" && os.Getenv("MCDFS_CLIENT_KEYS") == "" && cfg.TLS.CA == "" {
+		fmt.Fprintln(os.Stderr, "MCDFS_WRITE_KEY, MCDFS_READ_KEY and MCDFS_URL_KEYS require MCDFS_CLIENT_KEYS, MCDFS_CLUSTER_SECRET or -tlsca to tell who gets tokens")
+		os.Exit(1)
+	}
+	if cfg.TLS.Cert != "" {
+		certs, err := util.NewCertReloader(cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.CA)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot load certificates: %s\n", err.Error())
+			os.Exit(1)
+		}
+		server.SetTLS(certs)
+	}
+	path := cfg.Dir
+	os.MkdirAll(path, 0744)
+	var dirname []string
+	dirname = append(dirname, cfg.VolumeDir)
+	var takeOver []storage.VolumeId
+	if replace != "" {
+		if cfg.Join == "" {
+			fmt.Fprintln(os.Stderr, "-replace requires -join")
+			os.Exit(1)
+		}
+		var err error
+		if takeOver, err = server.HostedGroups(cfg.Join, replace); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot list the volume groups of %s: %s\n", replace, err.Error())
+			os.Exit(1)
+		}
+		if err = server.RemoveNode(cfg.Join, replace); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot remove %s: %s\n", replace, err.Error())
+			os.Exit(1)
+		}
+	}
+	s := server.New(path, cfg.Host, cfg.Port, dirname)
+	s.TakeOver(takeOver)
+	if cfg.Volumes != "" {
+		s.AddVolumes(cfg.Volumes, cfg.Collection)
+	}
+	s.SetLocation(cfg.DataCenter, cfg.Rack)
+	s.SetDedup(cfg.Dedup)
+	s.SetRaftTimings(server.RaftTimings{
+		HeartbeatInterval: cfg.Raft.HeartbeatInterval,
+		ElectionTimeout:   cfg.Raft.ElectionTimeout,
+		TransportTimeout:  cfg.Raft.TransportTimeout,
+	})
+	s.SetVolumeSizeLimit(uint64(cfg.VolumeSizeLimitMB) << 20)
+	if len(cfg.Collections) > 0 {
+		policies := make(map[string]string)
+		for name, c := range cfg.Collections {
+			policies[name] = c.Replication
+		}
+		s.SetPolicies(policies)
+	}
+	s.SetWriteKey(os.Getenv("MCDFS_WRITE_KEY"))
+	if l := cfg.Limits; l != (config.Limits{}) {
+		if (l.Rate > 0 || l.ClientRate > 0) && os.Getenv("MCDFS_CLUSTER_SECRET") == "" && cfg.TLS.CA == "" {
+			slog.Warn("without MCDFS_CLUSTER_SECRET or -tlsca, the requests between nodes are rate limited too")
+		}
+		s.SetLimits(server.Limits{
+			Rate:             l.Rate,
+			Burst:            l.Burst,
+			ClientRate:       l.ClientRate,
+			ClientBurst:      l.ClientBurst,
+			MaxUploads:       l.MaxUploads,
+			MaxUploadBytes:   l.MaxUploadMB << 20,
+			MaxInFlightBytes: l.MaxInFlightMB << 20,
+		})
+	}
+	if keys := os.Getenv("MCDFS_URL_KEYS"); keys != "" {
+		ring, err := util.ParseKeyRing(keys)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		s.SetURLKeys(ring)
+	}
+	if len(cfg.Private) > 0 {
+		if os.Getenv("MCDFS_READ_KEY") == "" && os.Getenv("MCDFS_URL_KEYS") == "" {
+			fmt.Fprintln(os.Stderr, "-private requires MCDFS_READ_KEY or MCDFS_URL_KEYS")
+			os.Exit(1)
+		}
+		s.SetReadKey(os.Getenv("MCDFS_READ_KEY"), cfg.Private)
+	}
+	switch cfg.FilerStore {
+	case "bolt":
+		st, err := filer.NewBoltStore(filepath.Join(path, "filer.db"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot open filer store: %s\n", err.Error())
+			os.Exit(1)
+		}
+		s.SetFilerStore(st)
+	case "memory":
+		s.SetFilerStore(filer.NewMemoryStore())
+	}
+	if cfg.Tier.Dir != "" {
+		t, err := storage.NewDirTier("dir", cfg.Tier.Dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot use tier directory: %s\n", err.Error())
+			os.Exit(1)
+		}
+		s.AddTier(t)
+	}
+	if cfg.Tier.S3Endpoint != "" {
+		s.AddTier(storage.NewS3Tier("s3", cfg.Tier.S3Endpoint, cfg.Tier.S3Bucket,
+			os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), cfg.Tier.S3Region))
+	}
+	if cfg.Listen.S3 != "" {
+		keys := make(map[string]string)
+		if ak := os.Getenv("MCDFS_S3_ACCESS_KEY"); ak != "" {
+			keys[ak] = os.Getenv("MCDFS_S3_SECRET_KEY")
+		}
+		go func() {
+			if err := s.ServeS3(cfg.Listen.S3, keys); err != nil && err != http.ErrServerClosed {
+				slog.Error("cannot serve S3", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	if cfg.Listen.GRPC != "" {
+		go func() {
+			if err := s.ServeGRPC(cfg.Listen.GRPC); err != nil {
+				slog.Error("cannot serve gRPC", "err", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	// The first signal shuts down gracefully, a second one at once.
+	done := make(chan error)
+	go func() {
+		c := make(chan os.Signal, 2)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		go func() {
+			<-c
+			slog.Error("shutdown interrupted")
+			os.Exit(1)
+		}()
+		slog.Info("shutting down", "timeout", cfg.ShutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		done <- s.Shutdown(ctx, cfg.Leave)
+	}()
+	if err := s.ListenAndServe(cfg.Join); err != http.ErrServerClosed {
+		slog.Error("cannot serve", "err", err)
+		os.Exit(1)
+	}
+	if err := <-done; err != nil {
+		slog.Error("shutdown failed", "err", err)
+		os.Exit(1)
+	}
+	slog.Info("shut down")
+}
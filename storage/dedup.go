@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+func contentHash(n *Needle) string {
+	sum := sha256.Sum256(n.Data)
+	return hex.EncodeToString(sum[:])
+}
+
+// WriteDedup writes n for the command with the given nonce unless the
+// volume already holds the same bytes, in which case n takes the location
+// of the stored needle and a mark adds a reference to it. Only hits in
+// this volume count: the other volumes of the collection may be hosted by
+// some replicas and not by others, and every replica has to come to the
+// same answer.
+func (v *Volume) WriteDedup(n *Needle, nonce uint64) (size uint32, err error) {
+	if n.HasTtl() {
+		return v.WriteOnce(n, nonce)
+	}
+	if err = v.checkWritable(n); err != nil {
+		return
+	}
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	var done bool
+	if done, err = v.replayed(n, nonce); done || err != nil {
+		return uint32(len(n.Data)), err
+	}
+	if err = v.loadHashes(); err != nil {
+		return
+	}
+	offset, ok := v.lookupHash(contentHash(n))
+	if !ok {
+		return v.write(n, nonce)
+	}
+	stored := new(Needle)
+	if err = v.readHeader(stored, offset); err != nil {
+		return
+	}
+	stored.Offset = offset
+	if !v.holders[offset].holds(stored.Cookie, n.Cookie) {
+		if err = v.appendMark(markRef, &Needle{Offset: offset, Cookie: n.Cookie}, nonce); err != nil {
+			return
+		}
+		v.note(markRef, stored, n.Cookie)
+	}
+	v.remember(nonce, offset)
+	n.Offset, n.Size = stored.Offset, stored.Size
+	return uint32(len(n.Data)), nil
+}
+
+// Holders are the uploads holding a deduplicated needle: the first one,
+// with the cookie of the needle, until it is deleted, and the others,
+// each with its own cookie, so that every upload deletes its own hold and
+// only once.
+type Holders struct {
+	Cookie   uint32   // of the needle
+	Released bool     `json:",omitempty"` // the first upload was deleted
+	Refs     []uint32 `json:",omitempty"` // the cookies of the others
+	Gone     []uint32 `json:",omitempty"` // the cookies of the others deleted
+}
+
+func (h *Holders) hasRef(cookie uint32) bool {
+	return h != nil && contains(h.Refs, cookie)
+}
+
+func contains(cookies []uint32, cookie uint32) bool {
+	for _, c := range cookies {
+		if c == cookie {
+			return true
+		}
+	}
+	return false
+}
+
+// holds reports whether the upload with the cookie holds the needle, whose
+// own cookie is stored. A nil h holds only the first upload.
+func (h *Holders) holds(stored uint32, cookie uint32) bool {
+	if h == nil {
+		return cookie == stored
+	}
+	return h.hasRef(cookie) || cookie == h.Cookie && !h.Released
+}
+
+// released reports whether the upload with the cookie held the needle and
+// was deleted.
+func (h *Holders) released(cookie uint32) bool {
+	if h == nil || h.hasRef(cookie) {
+		return false
+	}
+	return h.Released && cookie == h.Cookie || contains(h.Gone, cookie)
+}
+
+// cookieFor returns the cookie the needle is stored with for a read with
+// the cookie of an upload, and false if that upload was deleted.
+func (h *Holders) cookieFor(cookie uint32) (uint32, bool) {
+	if h.hasRef(cookie) {
+		return h.Cookie, true
+	}
+	return cookie, !h.released(cookie)
+}
+
+// count returns how many uploads hold the needle.
+func (h *Holders) count() int {
+	if h == nil {
+		return 1
+	}
+	if h.Released {
+		return len(h.Refs)
+	}
+	return 1 + len(h.Refs)
+}
+
+func (h *Holders) add(cookie uint32) {
+	if !h.hasRef(cookie) {
+		h.Refs = append(h.Refs, cookie)
+	}
+}
+
+// remove drops the hold of the upload with the cookie: one of the others
+// if it is among them, the first one otherwise.
+func (h *Holders) remove(cookie uint32) {
+	for i, c := range h.Refs {
+		if c == cookie {
+			h.Refs = append(h.Refs[:i], h.Refs[i+1:]...)
+			h.Gone = append(h.Gone, cookie)
+			return
+		}
+	}
+	h.Released = true
+}
+
+// readHeld reads the needle n from r for the upload with the cookie of n,
+// which may hold a needle stored with another cookie.
+func readHeld(n *Needle, r io.Reader, stored uint32) (int, error) {
+	cookie := n.Cookie
+	size, err := n.Read(r, n.Size, stored)
+	n.Cookie = cookie
+	return size, err
+}
+
+// loadHashes indexes the needles of the data file by content hash on the
+// first deduplicated write; write keeps the index up to date from then
+// on. Every needle is indexed, the deleted ones too, so the first live
+// needle with some bytes is the same whenever the index was built.
+func (v *Volume) loadHashes() error {
+	if v.hashes != nil {
+		return nil
+	}
+	v.hashes = make(map[string][]uint64)
+	_, err := v.walk(true, func(n *Needle, offset uint64, body []byte) {
+		if n.Size > 0 {
+			n.readNeedleData(body[:n.Size])
+			v.indexHash(n, offset)
+		}
+	})
+	if err != nil {
+		v.hashes = nil
+	}
+	return err
+}
+
+func (v *Volume) indexHash(n *Needle, offset uint64) {
+	if v.hashes == nil || n.HasTtl() {
+		return
+	}
+	hash := contentHash(n)
+	v.hashes[hash] = append(v.hashes[hash], offset)
+}
+
+// lookupHash returns the first live needle with the hash, forgetting the
+// deleted ones before it.
+func (v *Volume) lookupHash(hash string) (uint64, bool) {
+	offsets := v.hashes[hash]
+	for len(offsets) > 0 && v.deleted[offsets[0]] {
+		offsets = offsets[1:]
+	}
+	if len(offsets) == 0 {
+		delete(v.hashes, hash)
+		return 0, false
+	}
+	v.hashes[hash] = offsets
+	return offsets[0], true
+}
+
+// WriteDedup writes n to the volume vid, see Volume.WriteDedup.
+func (s *Store) WriteDedup(vid VolumeId, n *Needle, nonce uint64) (uint32, error) {
+	v := s.GetVolume(vid)
+	if v == nil {
+		return 0, fmt.Errorf("not such volume")
+	}
+	return v.WriteDedup(n, nonce)
+}
+
+// Delete drops one reference to the needle and deletes it from its volume
+// once nothing refers to it. It returns the references left.
+func (s *Store) Delete(vid VolumeId, n *Needle, nonce uint64) (int, error) {
+	v := s.GetVolume(vid)
+	if v == nil {
+		return 0, fmt.Errorf("not such volume")
+	}
+	return v.Delete(n, nonce)
+}
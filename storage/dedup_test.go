@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"testing"
+)
+
+func newNeedle(cookie uint32, data string) *Needle {
+	return &Needle{Cookie: cookie, Data: []byte(data), Checksum: NewCRC([]byte(data))}
+}
+
+// op is a write or delete command applied to a volume, with its nonce.
+type op struct {
+	delete bool
+	data   string // what a write uploads
+	target int    // the write whose needle a delete drops
+	nonce  uint64
+}
+
+// apply runs the ops against v and returns the needle each write got and
+// the references each delete left.
+func apply(t *testing.T, v *Volume, ops []op) ([]*Needle, []int) {
+	var written []*Needle
+	var refs []int
+	for i, o := range ops {
+		if !o.delete {
+			n := newNeedle(uint32(1000+i), o.data)
+			if _, err := v.WriteDedup(n, o.nonce); err != nil {
+				t.Fatalf("op %d: WriteDedup() = %v", i, err)
+			}
+			written = append(written, n)
+			refs = append(refs, -1)
+			continue
+		}
+		w := written[o.target]
+		r, err := v.Delete(&Needle{Offset: w.Offset, Size: w.Size, Cookie: w.Cookie}, o.nonce)
+		if err != nil {
+			t.Fatalf("op %d: Delete() = %v", i, err)
+		}
+		written = append(written, nil)
+		refs = append(refs, r)
+	}
+	return written, refs
+}
+
+func TestDedupRefcounts(t *testing.T) {
+	tests := []struct {
+		name     string
+		ops      []op
+		wantRefs []int // after each delete, -1 for writes
+		same     [][2]int
+		live     []int // writes still readable at the end
+		gone     []int
+	}{
+		{
+			name:     "distinct bytes",
+			ops:      []op{{data: "a", nonce: 1}, {data: "b", nonce: 2}},
+			wantRefs: []int{-1, -1},
+			live:     []int{0, 1},
+		},
+		{
+			name:     "same bytes share a needle",
+			ops:      []op{{data: "a", nonce: 1}, {data: "a", nonce: 2}, {delete: true, target: 0, nonce: 3}},
+			wantRefs: []int{-1, -1, 1},
+			same:     [][2]int{{0, 1}},
+			live:     []int{1},
+		},
+		{
+			name: "last reference deletes",
+			ops: []op{{data: "a", nonce: 1}, {data: "a", nonce: 2},
+				{delete: true, target: 0, nonce: 3}, {delete: true, target: 1, nonce: 4}},
+			wantRefs: []int{-1, -1, 1, 0},
+			gone:     []int{0},
+		},
+		{
+			name: "bytes written again after a delete",
+			ops: []op{{data: "a", nonce: 1}, {delete: true, target: 0, nonce: 2},
+				{data: "a", nonce: 3}},
+			wantRefs: []int{-1, 0, -1},
+			gone:     []int{0},
+			live:     []int{2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			v, err := NewVolume(dir, "", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			written, refs := apply(t, v, tt.ops)
+			v.Close()
+			for i, want := range tt.wantRefs {
+				if refs[i] != want {
+					t.Errorf("op %d left %d references, want %d", i, refs[i], want)
+				}
+			}
+			for _, p := range tt.same {
+				if written[p[0]].Offset != written[p[1]].Offset {
+					t.Errorf("writes %d and %d were stored twice", p[0], p[1])
+				}
+			}
+
+			// The references outlive a restart.
+			if v, err = NewVolume(dir, "", 1); err != nil {
+				t.Fatal(err)
+			}
+			defer v.Close()
+			for _, i := range tt.live {
+				w := written[i]
+				if _, err := v.Read(&Needle{Offset: w.Offset, Size: w.Size, Cookie: w.Cookie}); err != nil {
+					t.Errorf("Read(write %d) = %v", i, err)
+				}
+			}
+			for _, i := range tt.gone {
+				w := written[i]
+				if _, err := v.Read(&Needle{Offset: w.Offset, Size: w.Size, Cookie: w.Cookie}); err != ErrNeedleDeleted {
+					t.Errorf("Read(write %d) = %v, want %v", i, err, ErrNeedleDeleted)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayIsIdempotent(t *testing.T) {
+	ops := []op{
+		{data: "a", nonce: 1},
+		{data: "b", nonce: 2},
+		{data: "a", nonce: 3},
+		{delete: true, target: 0, nonce: 4},
+		{delete: true, target: 1, nonce: 5},
+		{data: "b", nonce: 6},
+	}
+	dir := t.TempDir()
+	v, err := NewVolume(dir, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, refs := apply(t, v, ops)
+	size := v.Size()
+	count, dead := v.Deleted()
+	v.Close()
+
+	// A restart replays the whole raft log.
+	if v, err = NewVolume(dir, "", 1); err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	replayed, replayedRefs := apply(t, v, ops)
+	if v.Size() != size {
+		t.Errorf("replay grew the data file from %d to %d bytes", size, v.Size())
+	}
+	if c, d := v.Deleted(); c != count || d != dead {
+		t.Errorf("Deleted() = %d, %d after replay, want %d, %d", c, d, count, dead)
+	}
+	for i := range ops {
+		if ops[i].delete {
+			continue
+		}
+		if w, r := written[i], replayed[i]; w.Offset != r.Offset || w.Size != r.Size || w.Cookie != r.Cookie {
+			t.Errorf("write %d replayed to %d/%d/%d, want %d/%d/%d", i, r.Offset, r.Size, r.Cookie, w.Offset, w.Size, w.Cookie)
+		}
+	}
+	if got, want := replayedRefs[3], refs[3]; got != want {
+		t.Errorf("replayed delete left %d references, want %d", got, want)
+	}
+
+	// A new command still writes.
+	n := newNeedle(7, "c")
+	if _, err = v.WriteDedup(n, 7); err != nil {
+		t.Fatal(err)
+	}
+	if v.Size() == size {
+		t.Error("a new write after the replay was not stored")
+	}
+}
+
+func TestDeleteIsOncePerUpload(t *testing.T) {
+	dir := t.TempDir()
+	v, err := NewVolume(dir, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, _ := apply(t, v, []op{{data: "a", nonce: 1}, {data: "a", nonce: 2}})
+	first, second := written[0], written[1]
+	if second.Cookie == first.Cookie {
+		t.Fatal("the second upload got the cookie of the first")
+	}
+	del := func(w *Needle) (int, error) {
+		return v.Delete(&Needle{Offset: w.Offset, Size: w.Size, Cookie: w.Cookie}, 0)
+	}
+	read := func(w *Needle) error {
+		_, err := v.Read(&Needle{Offset: w.Offset, Size: w.Size, Cookie: w.Cookie})
+		return err
+	}
+	if r, err := del(second); err != nil || r != 1 {
+		t.Fatalf("Delete(second) = %d, %v, want 1, nil", r, err)
+	}
+	// Deleting the second upload again does not drop the first one's hold.
+	if _, err := del(second); err != ErrNeedleDeleted {
+		t.Errorf("second Delete(second) = %v, want %v", err, ErrNeedleDeleted)
+	}
+	v.Close()
+	if v, err = NewVolume(dir, "", 1); err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if err := read(second); err != ErrNeedleDeleted {
+		t.Errorf("Read(second) = %v, want %v", err, ErrNeedleDeleted)
+	}
+	if err := read(first); err != nil {
+		t.Errorf("Read(first) = %v", err)
+	}
+	if r, err := del(first); err != nil || r != 0 {
+		t.Errorf("Delete(first) = %d, %v, want 0, nil", r, err)
+	}
+}
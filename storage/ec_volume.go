@@ -0,0 +1,398 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/reedsolomon"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// A sealed volume can be converted into Reed-Solomon shards. The .dat file
+// is cut into DataShardsCount contiguous pieces of ShardSize bytes (the
+// last one zero padded) and ParityShardsCount parity shards are computed
+// over them. Shard files are named <volume>.ec00 .. <volume>.ec13 and the
+// layout is kept in <volume>.ecx.
+const (
+	DataShardsCount   = 10
+	ParityShardsCount = 4
+	TotalShardsCount  = DataShardsCount + ParityShardsCount
+	ecBlockSize       = 1024 * 1024
+)
+
+// ShardFetcher reads size bytes at offset of a shard held by another node.
+type ShardFetcher func(vid VolumeId, shard int, offset int64, size int) ([]byte, error)
+
+type EcInfo struct {
+	Collection  string
+	DatSize     int64
+	ShardSize   int64
+	Holders     map[uint64]*Holders `json:",omitempty"` // of the deduplicated needles, by offset
+	Files       uint32              `json:",omitempty"`
+	DeleteCount int                 `json:",omitempty"`
+	DeadBytes   uint64              `json:",omitempty"`
+}
+
+type EcVolume struct {
+	Id         VolumeId
+	dir        string
+	Collection string
+	info       EcInfo
+	shards     [TotalShardsCount]*os.File
+	encoder    reedsolomon.Encoder
+	fetch      ShardFetcher
+	accessLock sync.Mutex
+}
+
+func ecShardFileName(base string, shard int) string {
+	return fmt.Sprintf("%s.ec%02d", base, shard)
+}
+
+func newEncoder() (reedsolomon.Encoder, error) {
+	return reedsolomon.New(DataShardsCount, ParityShardsCount)
+}
+
+// EncodeShards writes the shards of a sealed volume next to its data file.
+func (v *Volume) EncodeShards() error {
+	if !v.readOnly {
+		return fmt.Errorf("volume %s is not sealed", v.Id.String())
+	}
+	if v.remote != nil {
+		return fmt.Errorf("volume %s is on tier %s", v.Id.String(), v.remote.Name())
+	}
+	encoder, err := newEncoder()
+	if err != nil {
+		return err
+	}
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	stat, err := v.dataFile.Stat()
+	if err != nil {
+		return err
+	}
+	info := EcInfo{
+		Collection:  v.Collection,
+		DatSize:     stat.Size(),
+		ShardSize:   (stat.Size() + DataShardsCount - 1) / DataShardsCount,
+		Holders:     v.holders,
+		Files:       v.counter,
+		DeleteCount: len(v.deleted),
+		DeadBytes:   v.deadBytes,
+	}
+	base := v.FileName()
+	var files [TotalShardsCount]*os.File
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for k := range files {
+		if files[k], err = os.Create(ecShardFileName(base, k)); err != nil {
+			return err
+		}
+	}
+	shards := make([][]byte, TotalShardsCount)
+	for pos := int64(0); pos < info.ShardSize; pos += ecBlockSize {
+		size := info.ShardSize - pos
+		if size > ecBlockSize {
+			size = ecBlockSize
+		}
+		for k := range shards {
+			shards[k] = make([]byte, size)
+		}
+		for k := 0; k < DataShardsCount; k++ {
+			if _, err = v.dataFile.ReadAt(shards[k], int64(k)*info.ShardSize+pos); err != nil && err != io.EOF {
+				return err
+			}
+		}
+		if err = encoder.Encode(shards); err != nil {
+			return err
+		}
+		for k, f := range files {
+			if _, err = f.Write(shards[k]); err != nil {
+				return err
+			}
+		}
+	}
+	return writeEcInfo(base, info)
+}
+
+func writeEcInfo(base string, info EcInfo) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(base+".ecx", content, 0644)
+}
+
+// LoadEcVolume opens the shards of a volume present in dirname.
+func LoadEcVolume(dirname string, collection string, id VolumeId) (*EcVolume, error) {
+	ev := &EcVolume{Id: id, dir: dirname, Collection: collection}
+	content, err := ioutil.ReadFile(ev.FileName() + ".ecx")
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &ev.info); err != nil {
+		return nil, err
+	}
+	if ev.encoder, err = newEncoder(); err != nil {
+		return nil, err
+	}
+	for k := range ev.shards {
+		if f, e := os.Open(ecShardFileName(ev.FileName(), k)); e == nil {
+			ev.shards[k] = f
+		}
+	}
+	return ev, nil
+}
+
+func (ev *EcVolume) FileName() string {
+	return volumeFileName(ev.dir, ev.Collection, ev.Id)
+}
+
+func (ev *EcVolume) Info() EcInfo {
+	return ev.info
+}
+
+func (ev *EcVolume) SetFetcher(fetch ShardFetcher) {
+	ev.accessLock.Lock()
+	defer ev.accessLock.Unlock()
+	ev.fetch = fetch
+}
+
+// ShardIds returns the shards stored on this node.
+func (ev *EcVolume) ShardIds() []int {
+	ev.accessLock.Lock()
+	defer ev.accessLock.Unlock()
+	var ids []int
+	for k, f := range ev.shards {
+		if f != nil {
+			ids = append(ids, k)
+		}
+	}
+	return ids
+}
+
+// ReadLocalShard reads from a shard stored on this node.
+func (ev *EcVolume) ReadLocalShard(shard int, offset int64, size int) ([]byte, error) {
+	ev.accessLock.Lock()
+	f := ev.shards[shard]
+	ev.accessLock.Unlock()
+	if f == nil {
+		return nil, fmt.Errorf("shard %d of volume %s not found", shard, ev.Id.String())
+	}
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// OpenLocalShard returns the shard file for streaming it to another node.
+func (ev *EcVolume) OpenLocalShard(shard int) (*os.File, error) {
+	return os.Open(ecShardFileName(ev.FileName(), shard))
+}
+
+// AddShard stores a shard copied from another node. The shard is only
+// added once it is whole and on disk.
+func (ev *EcVolume) AddShard(shard int, r io.Reader) error {
+	name := ecShardFileName(ev.FileName(), shard)
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && n != ev.info.ShardSize {
+		err = fmt.Errorf("shard %d of volume %s: got %d bytes, want %d", shard, ev.Id.String(), n, ev.info.ShardSize)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	ev.accessLock.Lock()
+	defer ev.accessLock.Unlock()
+	if ev.shards[shard] != nil {
+		ev.shards[shard].Close()
+	}
+	ev.shards[shard], err = os.Open(name)
+	return err
+}
+
+func (ev *EcVolume) readShard(shard int, offset int64, size int) ([]byte, error) {
+	if data, err := ev.ReadLocalShard(shard, offset, size); err == nil {
+		return data, nil
+	}
+	ev.accessLock.Lock()
+	fetch := ev.fetch
+	ev.accessLock.Unlock()
+	if fetch == nil {
+		return nil, fmt.Errorf("shard %d of volume %s not found", shard, ev.Id.String())
+	}
+	return fetch(ev.Id, shard, offset, size)
+}
+
+// readShardRange reads a range of a shard, rebuilding it from the other
+// shards when the shard itself cannot be read.
+func (ev *EcVolume) readShardRange(shard int, offset int64, size int) ([]byte, error) {
+	if data, err := ev.readShard(shard, offset, size); err == nil {
+		return data, nil
+	}
+	shards := make([][]byte, TotalShardsCount)
+	found := 0
+	for k := 0; k < TotalShardsCount && found < DataShardsCount; k++ {
+		if k == shard {
+			continue
+		}
+		if data, err := ev.readShard(k, offset, size); err == nil {
+			shards[k] = data
+			found++
+		}
+	}
+	if found < DataShardsCount {
+		return nil, fmt.Errorf("volume %s: only %d shards available", ev.Id.String(), found)
+	}
+	reconstruct := ev.encoder.ReconstructData
+	if shard >= DataShardsCount {
+		reconstruct = ev.encoder.Reconstruct
+	}
+	if err := reconstruct(shards); err != nil {
+		return nil, err
+	}
+	return shards[shard], nil
+}
+
+// ReadAt reads size bytes at offset of the original data file.
+func (ev *EcVolume) ReadAt(offset int64, size int) ([]byte, error) {
+	if offset+int64(size) > ev.info.DatSize {
+		return nil, fmt.Errorf("read beyond end of volume %s", ev.Id.String())
+	}
+	buf := make([]byte, 0, size)
+	for size > 0 {
+		shard := int(offset / ev.info.ShardSize)
+		pos := offset % ev.info.ShardSize
+		n := size
+		if rest := ev.info.ShardSize - pos; int64(n) > rest {
+			n = int(rest)
+		}
+		data, err := ev.readShardRange(shard, pos, n)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, data...)
+		offset += int64(n)
+		size -= n
+	}
+	return buf, nil
+}
+
+func (ev *EcVolume) Read(n *Needle) (int, error) {
+	cookie, ok := ev.info.Holders[n.Offset].cookieFor(n.Cookie)
+	if !ok {
+		return 0, ErrNeedleDeleted
+	}
+	data, err := ev.ReadAt(int64(n.Offset)*NeedlePaddingSize, int(NeedleHeaderSize+n.Size+NeedleChecksumSize))
+	if err != nil {
+		return 0, err
+	}
+	return readHeld(n, bytes.NewReader(data), cookie)
+}
+
+// Decode rebuilds the sealed data file from the shards.
+func (ev *EcVolume) Decode() error {
+	name := ev.FileName() + ".dat"
+	f, err := os.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(name + ".tmp")
+	for k := 0; k < DataShardsCount; k++ {
+		for pos := int64(0); pos < ev.info.ShardSize; pos += ecBlockSize {
+			start := int64(k)*ev.info.ShardSize + pos
+			if start >= ev.info.DatSize {
+				break
+			}
+			size := ev.info.ShardSize - pos
+			if size > ecBlockSize {
+				size = ecBlockSize
+			}
+			if rest := ev.info.DatSize - start; size > rest {
+				size = rest
+			}
+			data, err := ev.readShardRange(k, pos, int(size))
+			if err != nil {
+				f.Close()
+				return err
+			}
+			if _, err = f.WriteAt(data, start); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(name+".tmp", 0444); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// DeleteShard removes a local shard, e.g. after it was copied elsewhere.
+func (ev *EcVolume) DeleteShard(shard int) error {
+	ev.accessLock.Lock()
+	defer ev.accessLock.Unlock()
+	if ev.shards[shard] != nil {
+		ev.shards[shard].Close()
+		ev.shards[shard] = nil
+	}
+	return os.Remove(ecShardFileName(ev.FileName(), shard))
+}
+
+func (ev *EcVolume) Close() {
+	ev.accessLock.Lock()
+	defer ev.accessLock.Unlock()
+	for k, f := range ev.shards {
+		if f != nil {
+			f.Close()
+			ev.shards[k] = nil
+		}
+	}
+}
+
+// Destroy closes the volume and removes its local shards and layout file.
+func (ev *EcVolume) Destroy() error {
+	ev.Close()
+	for k := 0; k < TotalShardsCount; k++ {
+		os.Remove(ecShardFileName(ev.FileName(), k))
+	}
+	return os.Remove(ev.FileName() + ".ecx")
+}
+
+// NewEcVolume prepares an empty volume to receive shards from other nodes.
+func NewEcVolume(dirname string, id VolumeId, info EcInfo) (*EcVolume, error) {
+	ev := &EcVolume{Id: id, dir: dirname, Collection: info.Collection, info: info}
+	var err error
+	if ev.encoder, err = newEncoder(); err != nil {
+		return nil, err
+	}
+	return ev, writeEcInfo(ev.FileName(), info)
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// encodedVolume writes needles to a volume in dir, seals and encodes it,
+// and returns the needles and the bytes of the data file.
+func encodedVolume(t *testing.T, dir string) ([]*Needle, []byte) {
+	v, err := NewVolume(dir, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	needles := writeNeedles(t, v, 40)
+	if err = v.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.EncodeShards(); err != nil {
+		t.Fatal(err)
+	}
+	dat, err := ioutil.ReadFile(v.FileName() + ".dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return needles, dat
+}
+
+func TestEcReconstruction(t *testing.T) {
+	tests := []struct {
+		name    string
+		lost    []int // shards deleted from the node
+		remote  []int // lost shards another node still serves
+		wantErr bool
+	}{
+		{"every shard", nil, nil, false},
+		{"one data shard", []int{3}, nil, false},
+		{"one parity shard", []int{12}, nil, false},
+		{"as many shards as there are parity shards", []int{0, 4, 9, 13}, nil, false},
+		{"one shard too many", []int{0, 1, 2, 3, 4}, nil, true},
+		{"shards read from another node", []int{0, 1, 2, 3, 4, 5}, []int{1, 2}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, elsewhere := t.TempDir(), t.TempDir()
+			needles, dat := encodedVolume(t, dir)
+			ev, err := LoadEcVolume(dir, "", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ev.Close()
+			for _, k := range tt.remote {
+				data, err := ioutil.ReadFile(ecShardFileName(ev.FileName(), k))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = ioutil.WriteFile(ecShardFileName(volumeFileName(elsewhere, "", 1), k), data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, k := range tt.lost {
+				if err = ev.DeleteShard(k); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ev.SetFetcher(func(vid VolumeId, shard int, offset int64, size int) ([]byte, error) {
+				f, err := os.Open(ecShardFileName(volumeFileName(elsewhere, "", 1), shard))
+				if err != nil {
+					return nil, err
+				}
+				defer f.Close()
+				buf := make([]byte, size)
+				_, err = f.ReadAt(buf, offset)
+				return buf, err
+			})
+
+			// The needles on the shards left stay readable either way.
+			failed := 0
+			for i, w := range needles {
+				n := &Needle{Offset: w.Offset, Size: w.Size, Cookie: w.Cookie}
+				if _, err := ev.Read(n); err != nil {
+					if !tt.wantErr {
+						t.Fatalf("Read(needle %d) = %v", i, err)
+					}
+					failed++
+				} else if !bytes.Equal(n.Data, w.Data) {
+					t.Errorf("needle %d = %q, want %q", i, n.Data, w.Data)
+				}
+			}
+			if tt.wantErr && failed == 0 {
+				t.Errorf("every needle was read with %d shards lost", len(tt.lost))
+			}
+
+			os.Remove(ev.FileName() + ".dat")
+			err = ev.Decode()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode() = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			decoded, err := ioutil.ReadFile(ev.FileName() + ".dat")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, dat) {
+				t.Errorf("the decoded data file differs from the original: %d bytes, want %d", len(decoded), len(dat))
+			}
+		})
+	}
+}
+
+func TestEcAddShard(t *testing.T) {
+	dir := t.TempDir()
+	encodedVolume(t, dir)
+	ev, err := LoadEcVolume(dir, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ev.Close()
+	shard, err := ioutil.ReadFile(ecShardFileName(ev.FileName(), 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"whole shard", shard, false},
+		{"cut short", shard[:len(shard)-1], true},
+		{"too long", append(append([]byte{}, shard...), 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := t.TempDir()
+			replica, err := NewEcVolume(other, 1, ev.Info())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer replica.Close()
+			err = replica.AddShard(2, bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddShard() = %v, want error %v", err, tt.wantErr)
+			}
+			if got := replica.ShardIds(); (len(got) == 1) == tt.wantErr {
+				t.Errorf("ShardIds() = %v after AddShard() = %v", got, err)
+			}
+			if _, err := os.Stat(ecShardFileName(replica.FileName(), 2) + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("the partial shard was left behind")
+			}
+		})
+	}
+}
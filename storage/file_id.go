@@ -1,6 +1,7 @@
 package storage
 
 import (
+    "fmt"
     "strings"
     "strconv"
 )
@@ -27,3 +28,22 @@ func ParseFileId(fid string) (*FileId, error) {
 func (n *FileId) String() string {
     return n.VolumeId.String() + "," + strconv.FormatUint(n.Offset, 10) + "/" + strconv.FormatUint(uint64(n.Size), 10) + "/" + strconv.FormatUint(uint64(n.Cookie), 10)
 }
+
+// ParseAssignedId parses "vid,cookie" as handed out by the master before
+// the needle is written, when offset and size are not known yet.
+func ParseAssignedId(fid string) (VolumeId, uint32, error) {
+    a := strings.Split(fid, ",")
+    if len(a) != 2 {
+        return 0, 0, fmt.Errorf("Invalid assigned fid %s", fid)
+    }
+    volumeId, e := NewVolumeId(a[0])
+    if e != nil {
+        return 0, 0, e
+    }
+    cookie, e := strconv.ParseUint(a[1], 10, 32)
+    return volumeId, uint32(cookie), e
+}
+
+func AssignedId(vid VolumeId, cookie uint32) string {
+    return vid.String() + "," + strconv.FormatUint(uint64(cookie), 10)
+}
@@ -28,6 +28,7 @@ const (
 	FlagHasName             = 0x02
 	FlagHasMime             = 0x04
 	FlagHasLastModifiedDate = 0x08
+	FlagHasTtl              = 0x10
 	LastModifiedBytesLength = 5
 )
 
@@ -45,6 +46,7 @@ type Needle struct {
 	MimeSize     uint8
 	Mime         []byte
 	LastModified uint64
+	Ttl          TTL
 
 	Checksum CRC
 	Padding  []byte
@@ -63,6 +65,9 @@ func (n *Needle) GobEncode() ([]byte, error) {
 	encoder.Encode(n.Mime)
 	encoder.Encode(n.LastModified)
 	err := encoder.Encode(n.Checksum.Value())
+	if err == nil && n.HasTtl() {
+		err = encoder.Encode([]byte{n.Ttl.Count, n.Ttl.Unit})
+	}
 	return w.Bytes(), err
 }
 
@@ -80,7 +85,13 @@ func (n *Needle) GobDecode(buf []byte) error {
 	decoder.Decode(&n.Mime)
 	decoder.Decode(&n.LastModified)
 	decoder.Decode(&checksum)
-	if checksum == NewCRC(n.Data).Value() {
+	if n.HasTtl() {
+		var ttl []byte
+		if decoder.Decode(&ttl) == nil && len(ttl) == TtlBytesLength {
+			n.Ttl = ttlFromBytes(ttl)
+		}
+	}
+	if n.Checksum = NewCRC(n.Data); checksum == n.Checksum.Value() {
 		return nil
 	}
 	return fmt.Errorf("error")
@@ -118,6 +129,27 @@ func (n *Needle) SetHasLastModifiedDate() {
 	n.Flags = n.Flags | FlagHasLastModifiedDate
 }
 
+func (n *Needle) HasTtl() bool {
+	return n.Flags&FlagHasTtl > 0
+}
+
+func (n *Needle) SetTtl(ttl TTL) {
+	if ttl.IsEmpty() {
+		return
+	}
+	n.Ttl = ttl
+	n.Flags = n.Flags | FlagHasTtl
+}
+
+// IsExpired reports whether the needle's TTL, counted from its last
+// modified time in seconds, has passed.
+func (n *Needle) IsExpired(now time.Time) bool {
+	if !n.HasTtl() || n.Ttl.IsEmpty() || n.LastModified == 0 {
+		return false
+	}
+	return time.Unix(int64(n.LastModified), 0).Add(n.Ttl.Duration()).Before(now)
+}
+
 func (n *Needle) readNeedleHeader(bytes []byte) {
 	n.Cookie = util.BytesToUint32(bytes[0:4])
 	n.Offset = util.BytesToUint64(bytes[4:12])
@@ -150,6 +182,10 @@ func (n *Needle) readNeedleData(bytes []byte) {
 		n.LastModified = util.BytesToUint64(bytes[index : index+LastModifiedBytesLength])
 		index += LastModifiedBytesLength
 	}
+	if index < lenBytes && n.HasTtl() {
+		n.Ttl = ttlFromBytes(bytes[index : index+TtlBytesLength])
+		index += TtlBytesLength
+	}
 }
 
 //r是用seek设置过offset的，利用这个接口，可以校验offset/size/cookie是否匹配
@@ -209,6 +245,9 @@ func (n *Needle) Append(w io.Writer) (size uint32, err error) {
 		if n.HasLastModifiedDate() {
 			n.Size = n.Size + LastModifiedBytesLength
 		}
+		if n.HasTtl() {
+			n.Size = n.Size + TtlBytesLength
+		}
 	}
 	size = n.DataSize
 	util.Uint32toBytes(header[12:16], n.Size)
@@ -251,6 +290,12 @@ func (n *Needle) Append(w io.Writer) (size uint32, err error) {
 				return
 			}
 		}
+		if n.HasTtl() {
+			n.Ttl.toBytes(header[0:TtlBytesLength])
+			if _, err = w.Write(header[0:TtlBytesLength]); err != nil {
+				return
+			}
+		}
 		padding := NeedlePaddingSize - ((NeedleHeaderSize + n.Size + NeedleChecksumSize) % NeedlePaddingSize)
 		util.Uint32toBytes(header[0:NeedleChecksumSize], n.Checksum.Value())
 		_, err = w.Write(header[0 : NeedleChecksumSize+padding])
@@ -283,14 +328,11 @@ func (n *Needle) Read(r io.Reader, size uint32, cookie uint32) (ret int, err err
 		return
 	}
 	if ret != int(NeedleHeaderSize+size+NeedleChecksumSize) {
-		fmt.Printf("%d\n%d\n", ret, int(NeedleHeaderSize+size+NeedleChecksumSize))
-		return 0, fmt.Errorf("File Entry Not Found")
+		return 0, fmt.Errorf("File Entry Not Found. Read %d of %d bytes", ret, NeedleHeaderSize+size+NeedleChecksumSize)
 	}
 	n.readNeedleHeader(bytes)
 	if n.Size != size || n.Cookie != cookie {
-		fmt.Println(n.Offset)
-		fmt.Println(n.Cookie)
-		return 0, fmt.Errorf("File Entry Not Found cookie")
+		return 0, fmt.Errorf("File Entry Not Found cookie. Needle %d/%d Fid %d/%d", n.Size, n.Cookie, size, cookie)
 	}
 	n.readNeedleData(bytes[NeedleHeaderSize : NeedleHeaderSize+n.Size])
 	checksum := util.BytesToUint32(bytes[NeedleHeaderSize+n.Size : NeedleHeaderSize+n.Size+NeedleChecksumSize])
@@ -303,8 +345,14 @@ func (n *Needle) Read(r io.Reader, size uint32, cookie uint32) (ret int, err err
 }
 
 func ParseUpload(r *http.Request) (fileName string, data []byte, mimeType string, isGzipped bool, modifiedTime uint64, e error) {
-	form, _ := r.MultipartReader()
-	part, _ := form.NextPart()
+	form, e := r.MultipartReader()
+	if e != nil {
+		return
+	}
+	part, e := form.NextPart()
+	if e != nil {
+		return
+	}
 	fileName = part.FileName()
 	data, e = ioutil.ReadAll(part)
 	dotIndex := strings.LastIndex(fileName, ".")
@@ -356,7 +404,7 @@ func NewNeedle(r *http.Request) (n *Needle, e error) {
 		n.SetGzipped()
 	}
 	if n.LastModified == 0 {
-		n.LastModified = uint64(time.Now().UnixNano())
+		n.LastModified = uint64(time.Now().Unix())
 	}
 	n.SetHasLastModifiedDate()
 	n.Checksum = NewCRC(n.Data)
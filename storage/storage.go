@@ -1,37 +1,51 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type DiskLocation struct {
 	directory string
 	volumes   map[VolumeId]*Volume
+	ecVolumes map[VolumeId]*EcVolume
 }
 
 type Store struct {
 	locations []*DiskLocation
-    counter uint32
+	counter   uint32
+	fetcher   ShardFetcher
+	tiers     map[string]RemoteTier
+	mutex     sync.RWMutex
 }
 
 func NewStore(dirNames []string) (s *Store) {
-	s = &Store{}
+	s = &Store{tiers: make(map[string]RemoteTier)}
 	s.locations = make([]*DiskLocation, 0)
 	for i := 0; i < len(dirNames); i++ {
 		d := &DiskLocation{directory: dirNames[i]}
 		d.volumes = make(map[VolumeId]*Volume)
+		d.ecVolumes = make(map[VolumeId]*EcVolume)
 		d.loadExistVolumes()
 		s.locations = append(s.locations, d)
 	}
 	return
 }
 
-func (s *Store) AddVolume(volumeList string, collection string) error {
+func (s *Store) AddVolume(volumeList string, collection string, ttl TTL) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	for _, id_string := range strings.Split(volumeList, ",") {
 		id, _ := NewVolumeId(id_string)
-		s.addVolume(id, collection)
+		s.addVolume(id, collection, ttl)
 	}
 	return nil
 }
@@ -51,12 +65,12 @@ func (s *Store) findFreeLocation() *DiskLocation {
 	return s.locations[0]
 }
 
-func (s *Store) addVolume(vid VolumeId, collection string) error {
+func (s *Store) addVolume(vid VolumeId, collection string, ttl TTL) error {
 	if s.findVolume(vid) != nil {
 		return fmt.Errorf("Volume found")
 	}
 	if location := s.findFreeLocation(); location != nil {
-		if volume, err := NewVolume(location.directory, collection, vid); err == nil {
+		if volume, err := NewTtlVolume(location.directory, collection, vid, ttl); err == nil {
 			location.volumes[vid] = volume
 			return nil
 		}
@@ -69,17 +83,18 @@ func (l *DiskLocation) loadExistVolumes() {
 		for _, dir := range dirs {
 			name := dir.Name()
 			if !dir.IsDir() && strings.HasSuffix(name, ".dat") {
-				collection := ""
-				base := name[:len(name)-len(".dat")]
-				i := strings.Index(base, "_")
-				if i > 0 {
-					collection, base = base[:i], base[i+1:]
+				collection, vid, err := parseVolumeFileName(name, ".dat")
+				if err == nil && l.volumes[vid] == nil {
+					if v, e := NewVolume(l.directory, collection, vid); e == nil {
+						l.volumes[vid] = v
+					}
 				}
-				if vid, err := NewVolumeId(base); err == nil {
-					if l.volumes[vid] == nil {
-						if v, e := NewVolume(l.directory, collection, vid); e == nil {
-							l.volumes[vid] = v
-						}
+			}
+			if !dir.IsDir() && strings.HasSuffix(name, ".ecx") {
+				collection, vid, err := parseVolumeFileName(name, ".ecx")
+				if err == nil && l.ecVolumes[vid] == nil {
+					if ev, e := LoadEcVolume(l.directory, collection, vid); e == nil {
+						l.ecVolumes[vid] = ev
 					}
 				}
 			}
@@ -87,38 +102,364 @@ func (l *DiskLocation) loadExistVolumes() {
 	}
 }
 
+func parseVolumeFileName(name string, ext string) (collection string, vid VolumeId, err error) {
+	base := name[:len(name)-len(ext)]
+	i := strings.Index(base, "_")
+	if i > 0 {
+		collection, base = base[:i], base[i+1:]
+	}
+	vid, err = NewVolumeId(base)
+	return
+}
+
 func (s *Store) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	for _, location := range s.locations {
 		for _, volume := range location.volumes {
 			volume.Close()
 		}
+		for _, ev := range location.ecVolumes {
+			ev.Close()
+		}
 	}
 }
 
 func (s *Store) Write(vid VolumeId, n *Needle) (size uint32, err error) {
-	if v := s.findVolume(vid); v != nil {
+	if v := s.GetVolume(vid); v != nil {
 		size, err = v.Write(n)
 		return
 	}
 	return 0, fmt.Errorf("not such volume")
 }
 
+var (
+	ErrNeedleExpired = errors.New("needle expired")
+	ErrNeedleDeleted = errors.New("needle deleted")
+)
+
+// Read reads a needle from a volume or an erasure coded volume. Needles
+// whose TTL has passed are gone.
 func (s *Store) Read(vid VolumeId, n *Needle) (size int, err error) {
-	if v := s.findVolume(vid); v != nil {
+	if v := s.GetVolume(vid); v != nil {
 		size, err = v.Read(n)
-		return
+	} else if ev := s.GetEcVolume(vid); ev != nil {
+		size, err = ev.Read(n)
+	} else {
+		return 0, fmt.Errorf("not such volume")
 	}
-	return 0, fmt.Errorf("not such volume")
+	if err == nil && n.IsExpired(time.Now()) {
+		return 0, ErrNeedleExpired
+	}
+	return
+}
+
+// ExpiredVolumes returns the TTL volumes whose needles have all expired.
+func (s *Store) ExpiredVolumes() []VolumeId {
+	var vids []VolumeId
+	for _, vid := range s.VolumeIds() {
+		if v := s.GetVolume(vid); v != nil && v.Expired() {
+			vids = append(vids, vid)
+		}
+	}
+	return vids
 }
 
 func (s *Store) GetVolume(vid VolumeId) *Volume {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.findVolume(vid)
 }
 
 func (s *Store) HasVolume(vid VolumeId) bool {
-	v := s.findVolume(vid)
+	v := s.GetVolume(vid)
 	return v != nil
 }
+
+// DeleteVolume closes the volume and removes its data file, see
+// Volume.Destroy.
+func (s *Store) DeleteVolume(vid VolumeId) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, location := range s.locations {
+		if v, found := location.volumes[vid]; found {
+			delete(location.volumes, vid)
+			return v.Destroy()
+		}
+	}
+	return fmt.Errorf("not such volume")
+}
+
+func (s *Store) GetEcVolume(vid VolumeId) *EcVolume {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, location := range s.locations {
+		if ev, found := location.ecVolumes[vid]; found {
+			return ev
+		}
+	}
+	return nil
+}
+
+// AddTier makes a remote tier available and opens the local volumes whose
+// data file lives on it.
+func (s *Store) AddTier(t RemoteTier) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tiers[t.Name()] = t
+	for _, location := range s.locations {
+		location.loadTieredVolumes(t)
+	}
+}
+
+func (l *DiskLocation) loadTieredVolumes(t RemoteTier) {
+	dirs, err := ioutil.ReadDir(l.directory)
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		name := dir.Name()
+		if dir.IsDir() || !strings.HasSuffix(name, ".tier") {
+			continue
+		}
+		collection, vid, err := parseVolumeFileName(name, ".tier")
+		if err == nil && l.volumes[vid] == nil {
+			if v, e := loadTieredVolume(l.directory, collection, vid, t); e == nil {
+				l.volumes[vid] = v
+			}
+		}
+	}
+}
+
+// TierVolume moves the data file of a sealed volume to the named tier.
+func (s *Store) TierVolume(vid VolumeId, tier string, upload bool) error {
+	s.mutex.RLock()
+	t := s.tiers[tier]
+	v := s.findVolume(vid)
+	s.mutex.RUnlock()
+	if t == nil {
+		return fmt.Errorf("no tier %s", tier)
+	}
+	if v == nil {
+		return fmt.Errorf("not such volume")
+	}
+	return v.TierUp(t, upload)
+}
+
+// UntierVolume brings the data file of a tiered volume back to local disk,
+// see Volume.TierDown.
+func (s *Store) UntierVolume(vid VolumeId, drop bool) error {
+	v := s.GetVolume(vid)
+	if v == nil {
+		return fmt.Errorf("not such volume")
+	}
+	return v.TierDown(drop)
+}
+
+// SetShardFetcher sets how erasure coded volumes read shards held by
+// other nodes.
+func (s *Store) SetShardFetcher(fetch ShardFetcher) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fetcher = fetch
+	for _, location := range s.locations {
+		for _, ev := range location.ecVolumes {
+			ev.SetFetcher(fetch)
+		}
+	}
+}
+
+// EncodeVolume seals a volume and writes its erasure coded shards. The
+// volume keeps serving reads until it is deleted.
+func (s *Store) EncodeVolume(vid VolumeId) error {
+	// Sealing and encoding take long, so the store is only locked to
+	// find the volume and to add its shards.
+	s.mutex.Lock()
+	var v *Volume
+	var location *DiskLocation
+	for _, l := range s.locations {
+		if found, ok := l.volumes[vid]; ok {
+			v, location = found, l
+			break
+		}
+	}
+	s.mutex.Unlock()
+	if v == nil {
+		return fmt.Errorf("not such volume")
+	}
+	if err := v.Seal(); err != nil {
+		return err
+	}
+	if err := v.EncodeShards(); err != nil {
+		return err
+	}
+	ev, err := LoadEcVolume(location.directory, v.Collection, vid)
+	if err != nil {
+		return err
+	}
+	ev.SetFetcher(s.fetcher)
+	s.mutex.Lock()
+	location.ecVolumes[vid] = ev
+	s.mutex.Unlock()
+	return nil
+}
+
+// ReceiveEcShard stores a shard of an erasure coded volume copied from
+// another node.
+func (s *Store) ReceiveEcShard(vid VolumeId, info EcInfo, shard int, r io.Reader) error {
+	if shard < 0 || shard >= TotalShardsCount {
+		return fmt.Errorf("invalid shard %d", shard)
+	}
+	ev := s.GetEcVolume(vid)
+	if ev == nil {
+		s.mutex.Lock()
+		location := s.findFreeLocation()
+		var err error
+		if ev, err = NewEcVolume(location.directory, vid, info); err != nil {
+			s.mutex.Unlock()
+			return err
+		}
+		ev.SetFetcher(s.fetcher)
+		location.ecVolumes[vid] = ev
+		s.mutex.Unlock()
+	}
+	return ev.AddShard(shard, r)
+}
+
+// DeleteEcVolume removes the local shards of an erasure coded volume.
+func (s *Store) DeleteEcVolume(vid VolumeId) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, location := range s.locations {
+		if ev, found := location.ecVolumes[vid]; found {
+			delete(location.ecVolumes, vid)
+			return ev.Destroy()
+		}
+	}
+	return fmt.Errorf("not such volume")
+}
+
+// DeleteEcShards removes some local shards of an erasure coded volume,
+// and the volume itself once no shard is left.
+func (s *Store) DeleteEcShards(vid VolumeId, shards []int) error {
+	ev := s.GetEcVolume(vid)
+	if ev == nil {
+		return fmt.Errorf("not such volume")
+	}
+	for _, shard := range shards {
+		if shard < 0 || shard >= TotalShardsCount {
+			return fmt.Errorf("invalid shard %d", shard)
+		}
+		if err := ev.DeleteShard(shard); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(ev.ShardIds()) == 0 {
+		return s.DeleteEcVolume(vid)
+	}
+	return nil
+}
+
+// DecodeEcVolume rebuilds a sealed volume from the shards, fetching the
+// missing ones from other nodes, and drops the local shards.
+func (s *Store) DecodeEcVolume(vid VolumeId) error {
+	ev := s.GetEcVolume(vid)
+	if ev == nil {
+		return fmt.Errorf("not such volume")
+	}
+	if err := ev.Decode(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, location := range s.locations {
+		if location.ecVolumes[vid] != ev {
+			continue
+		}
+		v, err := NewVolume(location.directory, ev.Collection, vid)
+		if err != nil {
+			return err
+		}
+		location.volumes[vid] = v
+		delete(location.ecVolumes, vid)
+		return ev.Destroy()
+	}
+	return fmt.Errorf("not such volume")
+}
+
+// EcShards returns the shards held by this node for every erasure coded
+// volume.
+func (s *Store) EcShards() map[VolumeId][]int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	shards := make(map[VolumeId][]int)
+	for _, location := range s.locations {
+		for vid, ev := range location.ecVolumes {
+			shards[vid] = ev.ShardIds()
+		}
+	}
+	return shards
+}
+
+// EcVolumeInfos returns the erasure coded volumes this node holds shards
+// of, as they were when encoded: they take no writes or deletes since.
+func (s *Store) EcVolumeInfos() []VolumeInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var infos []VolumeInfo
+	for _, location := range s.locations {
+		for vid, ev := range location.ecVolumes {
+			info := ev.Info()
+			infos = append(infos, VolumeInfo{
+				Id:               vid,
+				Size:             uint64(info.DatSize),
+				Collection:       ev.Collection,
+				FileCount:        int(info.Files),
+				DeleteCount:      info.DeleteCount,
+				DeletedByteCount: info.DeadBytes,
+				ReadOnly:         true,
+			})
+		}
+	}
+	return infos
+}
+
+func (s *Store) VolumeInfos() []VolumeInfo {
+	var infos []VolumeInfo
+	for _, vid := range s.VolumeIds() {
+		v := s.GetVolume(vid)
+		if v == nil {
+			continue
+		}
+		info := VolumeInfo{
+			Id:         v.Id,
+			Collection: v.Collection,
+			FileCount:  int(v.Num()),
+			ReadOnly:   v.readOnly,
+			RemoteTier: v.Tier(),
+			Ttl:        v.Ttl.String(),
+		}
+		if size := v.Size(); size > 0 {
+			info.Size = uint64(size)
+		}
+		info.DeleteCount, info.DeletedByteCount = v.Deleted()
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+func (s *Store) VolumeIds() []VolumeId {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var vids []VolumeId
+	for _, location := range s.locations {
+		for vid := range location.volumes {
+			vids = append(vids, vid)
+		}
+	}
+	sort.Sort(VolumeIds(vids))
+	return vids
+}
 /*
 func (s *Store) FreeVolume() *Volume {
 	for _, v := range s.locations[0].volumes {
@@ -130,9 +471,10 @@ func (s *Store) FreeVolume() *Volume {
 }
 */
 func (s *Store) FreeVolume() *Volume {
-    var vid VolumeId
-    vid = (VolumeId)(s.counter % 3 + 1)
-    s.counter++
-    return s.locations[0].volumes[vid]
+	vids := s.VolumeIds()
+	if len(vids) == 0 {
+		return nil
+	}
+	n := atomic.AddUint32(&s.counter, 1) - 1
+	return s.GetVolume(vids[n%uint32(len(vids))])
 }
-
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RemoteTier keeps the data files of sealed volumes on cheaper storage.
+// Reads of a tiered volume are ranged reads against the tier.
+type RemoteTier interface {
+	Name() string
+	Upload(key string, r io.Reader, size int64) error
+	ReadAt(key string, p []byte, offset int64) (int, error)
+	Download(key string, w io.Writer) error
+	Delete(key string) error
+}
+
+// DirTier stores data files in a directory, typically a mount of slower
+// disks or a network filesystem.
+type DirTier struct {
+	name string
+	dir  string
+}
+
+func NewDirTier(name string, dir string) (*DirTier, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirTier{name: name, dir: dir}, nil
+}
+
+func (t *DirTier) Name() string {
+	return t.name
+}
+
+func (t *DirTier) path(key string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(key))
+}
+
+func (t *DirTier) Upload(key string, r io.Reader, size int64) error {
+	name := t.path(key)
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("short upload of %s: %d of %d bytes", key, n, size)
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func (t *DirTier) ReadAt(key string, p []byte, offset int64) (int, error) {
+	f, err := os.Open(t.path(key))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(p, offset)
+}
+
+func (t *DirTier) Download(key string, w io.Writer) error {
+	f, err := os.Open(t.path(key))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (t *DirTier) Delete(key string) error {
+	return os.Remove(t.path(key))
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/Masterlvng/MCDFS/util"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// s3TierTimeout bounds a ranged read or a delete against the tier, and
+// the wait for the response to an upload or a download, whose data files
+// take as long as they take.
+const s3TierTimeout = 30 * time.Second
+
+// S3Tier stores data files in a bucket of an S3-compatible object store,
+// addressed path-style so that it also works against MinIO-like servers.
+type S3Tier struct {
+	name        string
+	endpoint    string
+	bucket      string
+	credentials util.Credentials
+	client      *http.Client // for reads and deletes
+	transfers   *http.Client // for uploads and downloads
+}
+
+func NewS3Tier(name string, endpoint string, bucket string, accessKey string, secretKey string, region string) *S3Tier {
+	if region == "" {
+		region = "us-east-1"
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, ResponseHeaderTimeout: s3TierTimeout}
+	return &S3Tier{
+		name:     name,
+		endpoint: strings.TrimRight(endpoint, "/"),
+		bucket:   bucket,
+		credentials: util.Credentials{
+			AccessKey: accessKey,
+			SecretKey: secretKey,
+			Region:    region,
+			Service:   "s3",
+		},
+		client:    &http.Client{Transport: transport, Timeout: s3TierTimeout},
+		transfers: &http.Client{Transport: transport},
+	}
+}
+
+func (t *S3Tier) Name() string {
+	return t.name
+}
+
+func (t *S3Tier) do(client *http.Client, method string, key string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	url := t.endpoint + "/" + t.bucket + "/" + util.UriEncode(key, false)
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := util.EmptyPayloadHash
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = util.UnsignedPayload
+	}
+	util.SignV4(req, payloadHash, t.credentials, time.Now())
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s %s", method, key, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
+func (t *S3Tier) Upload(key string, r io.Reader, size int64) error {
+	resp, err := t.do(t.transfers, "PUT", key, r, size, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *S3Tier) ReadAt(key string, p []byte, offset int64) (int, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(p))-1))
+	resp, err := t.do(t.client, "GET", key, nil, 0, header)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.ReadFull(resp.Body, p)
+}
+
+func (t *S3Tier) Download(key string, w io.Writer) error {
+	resp, err := t.do(t.transfers, "GET", key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (t *S3Tier) Delete(key string) error {
+	resp, err := t.do(t.client, "DELETE", key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTierRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	tier, err := NewDirTier("cold", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVolume(dir, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, _ := apply(t, v, []op{{data: "a", nonce: 1}, {data: "a", nonce: 2}, {data: "b", nonce: 3}})
+	if _, err = v.Delete(written[2], 4); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	remote := filepath.Join(tier.dir, filepath.Base(v.FileName())+".dat")
+	files := v.Num()
+
+	check := func(stage string, v *Volume) {
+		for _, w := range written[:2] {
+			if _, err := v.Read(&Needle{Offset: w.Offset, Size: w.Size, Cookie: w.Cookie}); err != nil {
+				t.Errorf("%s: Read(cookie %d) = %v", stage, w.Cookie, err)
+			}
+		}
+		w := written[2]
+		if _, err := v.Read(&Needle{Offset: w.Offset, Size: w.Size, Cookie: w.Cookie}); err != ErrNeedleDeleted {
+			t.Errorf("%s: Read(deleted) = %v, want %v", stage, err, ErrNeedleDeleted)
+		}
+		if count, _ := v.Deleted(); count != 1 {
+			t.Errorf("%s: Deleted() = %d, want 1", stage, count)
+		}
+		if v.Num() != files {
+			t.Errorf("%s: Num() = %d, want %d", stage, v.Num(), files)
+		}
+	}
+
+	if err = v.TierUp(tier, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(v.FileName() + ".dat"); !os.IsNotExist(err) {
+		t.Errorf("the local data file is still there: %v", err)
+	}
+	if v.Tier() != "cold" {
+		t.Errorf("Tier() = %q, want cold", v.Tier())
+	}
+	check("tiered", v)
+	v.Close()
+
+	// A restart reads the tier info back.
+	if v, err = loadTieredVolume(dir, "", 1, tier); err != nil {
+		t.Fatal(err)
+	}
+	check("reloaded", v)
+
+	// Another replica brings its copy back first and leaves the remote
+	// one in place.
+	if err = v.TierDown(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(remote); err != nil {
+		t.Errorf("the remote copy is gone after TierDown(false): %v", err)
+	}
+	check("untiered", v)
+
+	if err = v.TierUp(tier, false); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.TierDown(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(remote); !os.IsNotExist(err) {
+		t.Errorf("the remote copy is still there after TierDown(true): %v", err)
+	}
+	if _, err = os.Stat(v.FileName() + ".tier"); !os.IsNotExist(err) {
+		t.Errorf("the tier info is still there: %v", err)
+	}
+	check("dropped", v)
+}
+
+func TestDestroyTieredVolume(t *testing.T) {
+	dir := t.TempDir()
+	tier, err := NewDirTier("cold", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVolume(dir, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeNeedles(t, v, 2)
+	if err = v.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.TierUp(tier, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join(tier.dir, filepath.Base(v.FileName())+".dat"), v.FileName() + ".tier"} {
+		if _, err = os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s is still there: %v", name, err)
+		}
+	}
+}
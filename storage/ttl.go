@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// TTL is how long a needle lives after it was written, e.g. "3d". It is
+// stored in two bytes: a count and a unit.
+type TTL struct {
+	Count byte
+	Unit  byte
+}
+
+const TtlBytesLength = 2
+
+var EmptyTTL = TTL{}
+
+var ttlUnits = map[byte]time.Duration{
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+	'M': 30 * 24 * time.Hour,
+	'y': 365 * 24 * time.Hour,
+}
+
+// ReadTTL parses "<count><unit>" with unit one of m, h, d, w, M, y; a bare
+// count is in minutes.
+func ReadTTL(s string) (TTL, error) {
+	if s == "" {
+		return EmptyTTL, nil
+	}
+	unit := s[len(s)-1]
+	count := s[:len(s)-1]
+	if unit >= '0' && unit <= '9' {
+		unit, count = 'm', s
+	}
+	if _, ok := ttlUnits[unit]; !ok {
+		return EmptyTTL, fmt.Errorf("invalid ttl unit in %q", s)
+	}
+	n, err := strconv.ParseUint(count, 10, 8)
+	if err != nil || n == 0 {
+		return EmptyTTL, fmt.Errorf("invalid ttl count in %q", s)
+	}
+	return TTL{Count: byte(n), Unit: unit}, nil
+}
+
+func (t TTL) IsEmpty() bool {
+	return t.Count == 0
+}
+
+func (t TTL) Duration() time.Duration {
+	return time.Duration(t.Count) * ttlUnits[t.Unit]
+}
+
+func (t TTL) String() string {
+	if t.IsEmpty() {
+		return ""
+	}
+	return strconv.Itoa(int(t.Count)) + string(t.Unit)
+}
+
+func (t TTL) toBytes(b []byte) {
+	b[0], b[1] = t.Count, t.Unit
+}
+
+func ttlFromBytes(b []byte) TTL {
+	t := TTL{Count: b[0], Unit: b[1]}
+	if _, ok := ttlUnits[t.Unit]; !ok {
+		return EmptyTTL
+	}
+	return t
+}
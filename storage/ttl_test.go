@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadTTL(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    TTL
+		wantErr bool
+	}{
+		{"", EmptyTTL, false},
+		{"5", TTL{5, 'm'}, false},
+		{"3m", TTL{3, 'm'}, false},
+		{"12h", TTL{12, 'h'}, false},
+		{"7d", TTL{7, 'd'}, false},
+		{"2w", TTL{2, 'w'}, false},
+		{"6M", TTL{6, 'M'}, false},
+		{"1y", TTL{1, 'y'}, false},
+		{"255d", TTL{255, 'd'}, false},
+		{"256d", EmptyTTL, true},
+		{"0d", EmptyTTL, true},
+		{"d", EmptyTTL, true},
+		{"3s", EmptyTTL, true},
+		{"-1d", EmptyTTL, true},
+		{"1.5h", EmptyTTL, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ReadTTL(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadTTL() = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ReadTTL() = %+v, want %+v", got, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			// What String prints parses back, and so do the stored bytes.
+			if again, err := ReadTTL(got.String()); err != nil || again != got {
+				t.Errorf("ReadTTL(%q) = %+v, %v", got.String(), again, err)
+			}
+			b := make([]byte, TtlBytesLength)
+			got.toBytes(b)
+			if back := ttlFromBytes(b); back != got && !got.IsEmpty() {
+				t.Errorf("ttlFromBytes() = %+v, want %+v", back, got)
+			}
+		})
+	}
+}
+
+func TestTTLDuration(t *testing.T) {
+	tests := []struct {
+		ttl  string
+		want time.Duration
+	}{
+		{"", 0},
+		{"90", 90 * time.Minute},
+		{"2h", 2 * time.Hour},
+		{"3d", 72 * time.Hour},
+		{"1w", 7 * 24 * time.Hour},
+		{"1M", 30 * 24 * time.Hour},
+		{"2y", 2 * 365 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		ttl, err := ReadTTL(tt.ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ttl.Duration(); got != tt.want {
+			t.Errorf("ReadTTL(%q).Duration() = %v, want %v", tt.ttl, got, tt.want)
+		}
+	}
+}
+
+func TestTtlFromBytesRejectsUnknownUnits(t *testing.T) {
+	if got := ttlFromBytes([]byte{3, 'x'}); got != EmptyTTL {
+		t.Errorf("ttlFromBytes() = %+v, want no ttl", got)
+	}
+}
+
+func TestNeedleIsExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		ttl     string
+		written time.Time
+		expired bool
+	}{
+		{"no ttl", "", now.Add(-1000 * time.Hour), false},
+		{"within the ttl", "1h", now.Add(-30 * time.Minute), false},
+		{"past the ttl", "1h", now.Add(-90 * time.Minute), true},
+		{"days", "2d", now.Add(-47 * time.Hour), false},
+		{"no write time", "1h", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, err := ReadTTL(tt.ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := &Needle{}
+			n.SetTtl(ttl)
+			if !tt.written.IsZero() {
+				n.LastModified = uint64(tt.written.Unix())
+			}
+			if got := n.IsExpired(now); got != tt.expired {
+				t.Errorf("IsExpired() = %v, want %v", got, tt.expired)
+			}
+		})
+	}
+}
+
+func TestTtlVolume(t *testing.T) {
+	ttl, _ := ReadTTL("1h")
+	tests := []struct {
+		name    string
+		ttl     TTL
+		idle    time.Duration // since the last write
+		wantErr bool
+		expired bool
+	}{
+		{"needle with the volume ttl", ttl, 0, false, false},
+		{"needle without a ttl", EmptyTTL, 0, true, false},
+		{"needle with another ttl", TTL{2, 'h'}, 0, true, false},
+		{"idle past the ttl", ttl, 2 * time.Hour, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			v, err := NewTtlVolume(dir, "", 1, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := newNeedle(1, "data")
+			n.SetTtl(tt.ttl)
+			n.LastModified = uint64(time.Now().Unix())
+			if _, err = v.Write(n); (err != nil) != tt.wantErr {
+				t.Fatalf("Write() = %v, want error %v", err, tt.wantErr)
+			}
+			v.Close()
+			if tt.idle > 0 {
+				then := time.Now().Add(-tt.idle)
+				if err = os.Chtimes(v.FileName()+".dat", then, then); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The ttl is kept with the volume and the needle.
+			if v, err = NewVolume(dir, "", 1); err != nil {
+				t.Fatal(err)
+			}
+			defer v.Close()
+			if v.Ttl != ttl {
+				t.Errorf("reloaded volume ttl = %q, want %q", v.Ttl.String(), ttl.String())
+			}
+			if got := v.Expired(); got != tt.expired {
+				t.Errorf("Expired() = %v, want %v", got, tt.expired)
+			}
+			if tt.wantErr {
+				return
+			}
+			read := &Needle{Offset: n.Offset, Size: n.Size, Cookie: n.Cookie}
+			if _, err = v.Read(read); err != nil {
+				t.Fatal(err)
+			}
+			if read.Ttl != ttl {
+				t.Errorf("needle ttl = %q, want %q", read.Ttl.String(), ttl.String())
+			}
+		})
+	}
+}
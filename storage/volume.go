@@ -1,12 +1,32 @@
 package storage
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/Masterlvng/MCDFS/util"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"sync"
+	"time"
+)
+
+// Records of size zero in a data file mark what happened to the needle at
+// their offset, on behalf of the upload with their cookie. What follows
+// their header is sixteen bytes long: their kind, then the nonce of the
+// command that appended them, so that a command replayed from the raft log
+// is recognised.
+const markSize = NeedleHeaderSize + 2*NeedlePaddingSize
+
+const (
+	markWrite  byte = iota + 1 // the command wrote the needle
+	markDelete                 // the command deleted the needle
+	markRef                    // a deduplicated upload refers to the needle
+	markUnref                  // an upload referring to the needle was deleted
 )
 
 type Volume struct {
@@ -16,20 +36,43 @@ type Volume struct {
 	dataFile   *os.File
 	counter    uint32
 	readOnly   bool
+	Ttl        TTL
+	remote     RemoteTier
+	tierInfo   TierInfo
+	deleted    map[uint64]bool
+	deadBytes  uint64
+	holders    map[uint64]*Holders // the uploads holding deduplicated needles, by offset
+	applied    []map[uint64]uint64 // command nonce to the offset of the needle it touched, by checkpoint
+	starts     []int64             // where the checkpoints of applied start, see Checkpoint
+	hashes     map[string][]uint64 // content hash to needle offsets, see WriteDedup
 	accessLock sync.Mutex
 }
 
+// TierInfo is kept in <volume>.tier when the data file of a sealed volume
+// lives on a remote tier.
+type TierInfo struct {
+	Tier      string
+	Key       string
+	Size      int64
+	Files     uint32              `json:",omitempty"`
+	Deleted   []uint64            `json:",omitempty"` // offsets of the deleted needles
+	DeadBytes uint64              `json:",omitempty"`
+	Holders   map[uint64]*Holders `json:",omitempty"`
+}
+
 func (v *Volume) SetMemberForTest(dir string, file *os.File) {
 	v.dir, v.dataFile = dir, file
 }
 
 func (v *Volume) FileName() (fileName string) {
-	if v.Collection == "" {
-		fileName = path.Join(v.dir, v.Id.String())
-	} else {
-		fileName = path.Join(v.dir, v.Collection+"_"+v.Id.String())
+	return volumeFileName(v.dir, v.Collection, v.Id)
+}
+
+func volumeFileName(dir string, collection string, id VolumeId) string {
+	if collection == "" {
+		return path.Join(dir, id.String())
 	}
-	return
+	return path.Join(dir, collection+"_"+id.String())
 }
 
 //读取或者创建文件
@@ -57,6 +100,9 @@ func (v *Volume) load() error {
 func (v *Volume) Size() int64 {
 	v.accessLock.Lock()
 	defer v.accessLock.Unlock()
+	if v.remote != nil {
+		return v.tierInfo.Size
+	}
 	stat, e := v.dataFile.Stat()
 	if e == nil {
 		return stat.Size()
@@ -67,7 +113,12 @@ func (v *Volume) Size() int64 {
 func (v *Volume) Close() {
 	v.accessLock.Lock()
 	defer v.accessLock.Unlock()
-	v.dataFile.Close()
+	if v.dataFile != nil {
+		if !v.readOnly {
+			v.dataFile.Sync()
+		}
+		v.dataFile.Close()
+	}
 }
 
 func (v *Volume) isFileUnchanged(n *Needle) bool {
@@ -89,12 +140,37 @@ func (v *Volume) isFileUnchanged(n *Needle) bool {
 }
 
 func (v *Volume) Write(n *Needle) (size uint32, err error) {
-	if v.readOnly {
-		err = fmt.Errorf("read-only", v.dataFile)
+	return v.WriteOnce(n, 0)
+}
+
+// WriteOnce writes n for the command with the given nonce. A command
+// applied already, as when a raft log is replayed after a restart, gets
+// back the needle it wrote the first time instead of writing a copy. A
+// zero nonce is never recognised.
+func (v *Volume) WriteOnce(n *Needle, nonce uint64) (size uint32, err error) {
+	if err = v.checkWritable(n); err != nil {
 		return
 	}
 	v.accessLock.Lock()
 	defer v.accessLock.Unlock()
+	return v.write(n, nonce)
+}
+
+func (v *Volume) checkWritable(n *Needle) error {
+	if v.readOnly {
+		return fmt.Errorf("%s is read-only", v.FileName())
+	}
+	if n.Ttl != v.Ttl {
+		return fmt.Errorf("volume %s only takes needles with ttl %q", v.Id.String(), v.Ttl.String())
+	}
+	return nil
+}
+
+func (v *Volume) write(n *Needle, nonce uint64) (size uint32, err error) {
+	var done bool
+	if done, err = v.replayed(n, nonce); done || err != nil {
+		return uint32(len(n.Data)), err
+	}
 	if v.isFileUnchanged(n) {
 		size = n.Size
 		return
@@ -112,40 +188,360 @@ func (v *Volume) Write(n *Needle) (size uint32, err error) {
 	}
 
 	n.Offset = uint64(offset / NeedlePaddingSize)
-	if size, err = n.Append(v.dataFile); err != nil {
+	if size, err = n.Append(v.dataFile); err == nil && nonce != 0 {
+		err = v.appendMark(markWrite, n, nonce)
+	}
+	if err != nil {
 		if e := v.dataFile.Truncate(offset); e != nil {
 			err = fmt.Errorf("cannot truncate")
 		}
 		return
 	}
+	v.remember(nonce, n.Offset)
+	v.indexHash(n, n.Offset)
 	v.counter++
 	return
 }
 
-func (v *Volume) delete(n *Needle) (uint32, error) {
+// replayed fills n with the needle the command with the nonce wrote or
+// referred to, if the command was applied already. The cookie of n stays
+// that of the upload if it refers to the needle.
+func (v *Volume) replayed(n *Needle, nonce uint64) (bool, error) {
+	if nonce == 0 {
+		return false, nil
+	}
+	for _, applied := range v.applied {
+		if offset, ok := applied[nonce]; ok {
+			cookie := n.Cookie
+			if err := v.readHeader(n, offset); err != nil {
+				return true, err
+			}
+			if v.holders[offset].hasRef(cookie) {
+				n.Cookie = cookie
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// remember records that the command with the nonce touched the needle at
+// offset.
+func (v *Volume) remember(nonce uint64, offset uint64) {
+	if nonce != 0 {
+		v.applied[len(v.applied)-1][nonce] = offset
+	}
+}
+
+// readHeader fills the cookie, offset and size of n from the needle at
+// offset.
+func (v *Volume) readHeader(n *Needle, offset uint64) error {
+	header := make([]byte, NeedleHeaderSize)
+	if _, err := v.dataFile.ReadAt(header, int64(offset)*NeedlePaddingSize); err != nil {
+		return err
+	}
+	n.readNeedleHeader(header)
+	return nil
+}
+
+// appendMark appends a mark of the given kind for the needle at the
+// offset of n, on behalf of the upload with the cookie of n and of the
+// command with the nonce.
+func (v *Volume) appendMark(kind byte, n *Needle, nonce uint64) error {
+	offset, err := v.dataFile.Seek(0, 2)
+	if err != nil {
+		return err
+	}
+	if offset%NeedlePaddingSize != 0 {
+		offset = offset + (NeedlePaddingSize - offset%NeedlePaddingSize)
+	}
+	mark := make([]byte, markSize)
+	util.Uint32toBytes(mark[0:4], n.Cookie)
+	util.Uint64toBytes(mark[4:12], n.Offset)
+	mark[NeedleHeaderSize] = kind
+	util.Uint64toBytes(mark[NeedleHeaderSize+NeedlePaddingSize:], nonce)
+	_, err = v.dataFile.WriteAt(mark, offset)
+	return err
+}
+
+// note applies a mark of the given kind, on behalf of the upload with the
+// cookie, to the stored needle.
+func (v *Volume) note(kind byte, stored *Needle, cookie uint32) {
+	offset := stored.Offset
+	switch kind {
+	case markDelete:
+		if !v.deleted[offset] {
+			v.deleted[offset] = true
+			v.deadBytes += uint64(stored.Size)
+		}
+		delete(v.holders, offset)
+	case markRef:
+		h := v.holders[offset]
+		if h == nil {
+			h = &Holders{Cookie: stored.Cookie}
+			v.holders[offset] = h
+		}
+		h.add(cookie)
+	case markUnref:
+		if h := v.holders[offset]; h != nil {
+			h.remove(cookie)
+		}
+	}
+}
+
+// Delete drops the hold of the upload with the cookie of n on the needle
+// for the command with the given nonce, and appends a mark that deletes
+// the needle once no deduplicated upload holds it any more. Reads with
+// that cookie fail from then on, and so does a second delete. It returns
+// the uploads left holding the needle.
+func (v *Volume) Delete(n *Needle, nonce uint64) (int, error) {
 	if v.readOnly {
-		return 0, fmt.Errorf("%s is read-only")
+		return 0, fmt.Errorf("%s is read-only", v.FileName())
 	}
 	v.accessLock.Lock()
 	defer v.accessLock.Unlock()
-	size := n.Size
-	if _, err := v.dataFile.Seek(0, 2); err != nil {
-		return size, err
+	if done, err := v.replayed(new(Needle), nonce); done || err != nil {
+		return v.references(n.Offset), err
+	}
+	if v.deleted[n.Offset] {
+		return 0, ErrNeedleDeleted
 	}
-	n.Data = make([]byte, 0)
-	_, err := n.Append(v.dataFile)
-	return size, err
+	stored := new(Needle)
+	if err := v.readHeader(stored, n.Offset); err != nil {
+		return 0, err
+	}
+	stored.Offset = n.Offset
+	if stored.Size != n.Size {
+		return 0, fmt.Errorf("File Entry Not Found. Needle %d Memory %d", stored.Size, n.Size)
+	}
+	h := v.holders[n.Offset]
+	if !h.holds(stored.Cookie, n.Cookie) {
+		if h.released(n.Cookie) {
+			return 0, ErrNeedleDeleted
+		}
+		return 0, fmt.Errorf("File Entry Not Found cookie")
+	}
+	kind := markDelete
+	if h.count() > 1 {
+		kind = markUnref
+	}
+	if err := v.appendMark(kind, n, nonce); err != nil {
+		return 0, err
+	}
+	v.note(kind, stored, n.Cookie)
+	v.remember(nonce, n.Offset)
+	return v.references(n.Offset), nil
+}
 
+// references returns how many uploads hold the needle at offset.
+func (v *Volume) references(offset uint64) int {
+	if v.deleted[offset] {
+		return 0
+	}
+	if h := v.holders[offset]; h != nil {
+		return h.count()
+	}
+	return 1
 }
 
-func (v *Volume) Read(n *Needle) (int, error) {
+// Deleted returns how many needles were deleted and their size.
+func (v *Volume) Deleted() (int, uint64) {
 	v.accessLock.Lock()
 	defer v.accessLock.Unlock()
+	return len(v.deleted), v.deadBytes
+}
+
+func (v *Volume) Read(n *Needle) (int, error) {
+	v.accessLock.Lock()
+	if v.deleted[n.Offset] {
+		v.accessLock.Unlock()
+		return -1, ErrNeedleDeleted
+	}
+	cookie, ok := v.holders[n.Offset].cookieFor(n.Cookie)
+	if !ok {
+		v.accessLock.Unlock()
+		return -1, ErrNeedleDeleted
+	}
+
+	if v.remote != nil {
+		// The remote copy never changes, so it is read without holding
+		// up the other reads of the volume.
+		remote, key := v.remote, v.tierInfo.Key
+		v.accessLock.Unlock()
+		buf := make([]byte, NeedleHeaderSize+n.Size+NeedleChecksumSize)
+		if _, err := remote.ReadAt(key, buf, int64(n.Offset)*NeedlePaddingSize); err != nil {
+			return -1, err
+		}
+		return readHeld(n, bytes.NewReader(buf), cookie)
+	}
 
+	defer v.accessLock.Unlock()
 	if _, err := v.dataFile.Seek(int64(n.Offset)*NeedlePaddingSize, 0); err != nil {
 		return -1, err
 	}
-	return n.Read(v.dataFile, n.Size, n.Cookie)
+	return readHeld(n, v.dataFile, cookie)
+}
+
+func (v *Volume) ReadOnly() bool {
+	return v.readOnly
+}
+
+// Seal makes the volume read-only for good: the data file is synced and
+// loses its write permission, which load() honours on restart.
+func (v *Volume) Seal() error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.remote != nil {
+		return nil
+	}
+	if err := v.dataFile.Sync(); err != nil {
+		return err
+	}
+	if err := os.Chmod(v.FileName()+".dat", 0444); err != nil {
+		return err
+	}
+	v.readOnly = true
+	return nil
+}
+
+// Destroy closes the volume and removes its data file. The replicas of a
+// tiered volume share its copy on the remote tier, which goes too: a
+// volume is only destroyed when it is dropped from every replica.
+func (v *Volume) Destroy() error {
+	v.Close()
+	os.Remove(v.FileName() + ".ttl")
+	os.Remove(v.FileName() + ".cpt")
+	if v.remote != nil {
+		if err := v.remote.Delete(v.tierInfo.Key); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Remove(v.FileName() + ".tier")
+	}
+	return os.Remove(v.FileName() + ".dat")
+}
+
+func (v *Volume) Tier() string {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.remote == nil {
+		return ""
+	}
+	return v.remote.Name()
+}
+
+// TierUp moves the data file of a sealed volume to t. When upload is false
+// another replica has already uploaded the same file and the volume only
+// switches to reading it.
+func (v *Volume) TierUp(t RemoteTier, upload bool) error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if !v.readOnly {
+		return fmt.Errorf("volume %s is not sealed", v.Id.String())
+	}
+	if v.remote != nil {
+		return fmt.Errorf("volume %s is already on tier %s", v.Id.String(), v.remote.Name())
+	}
+	stat, err := v.dataFile.Stat()
+	if err != nil {
+		return err
+	}
+	info := TierInfo{
+		Tier: t.Name(),
+		Key:  filepath.Base(v.FileName()) + ".dat",
+		Size: stat.Size(),
+	}
+	// A tiered volume is not scanned on load, so its files and deleted
+	// needles are kept with the tier info.
+	info.Files = v.counter
+	for offset := range v.deleted {
+		info.Deleted = append(info.Deleted, offset)
+	}
+	info.DeadBytes = v.deadBytes
+	info.Holders = v.holders
+	if upload {
+		if err = t.Upload(info.Key, io.NewSectionReader(v.dataFile, 0, info.Size), info.Size); err != nil {
+			return err
+		}
+	}
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(v.FileName()+".tier", content, 0644); err != nil {
+		return err
+	}
+	v.dataFile.Close()
+	v.dataFile = nil
+	v.remote, v.tierInfo = t, info
+	return os.Remove(v.FileName() + ".dat")
+}
+
+// TierDown brings the data file of a tiered volume back to local disk.
+// With drop, the copy on the remote tier is deleted then: the last
+// replica brought back drops it, the others still read it until then.
+func (v *Volume) TierDown(drop bool) error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.remote == nil {
+		return nil
+	}
+	name := v.FileName() + ".dat"
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(name + ".tmp")
+	err = v.remote.Download(v.tierInfo.Key, f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(name+".tmp", 0444); err != nil {
+		return err
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	if v.dataFile, err = os.Open(name); err != nil {
+		return err
+	}
+	remote := v.remote
+	v.remote = nil
+	if err = os.Remove(v.FileName() + ".tier"); err != nil || !drop {
+		return err
+	}
+	return remote.Delete(v.tierInfo.Key)
+}
+
+// loadTieredVolume opens a volume whose data file is on t.
+func loadTieredVolume(dirname string, collection string, id VolumeId, t RemoteTier) (*Volume, error) {
+	v := &Volume{dir: dirname, Collection: collection, Id: id, readOnly: true, remote: t}
+	content, err := ioutil.ReadFile(v.FileName() + ".tier")
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &v.tierInfo); err != nil {
+		return nil, err
+	}
+	if v.tierInfo.Tier != t.Name() {
+		return nil, fmt.Errorf("volume %s is on tier %s", id.String(), v.tierInfo.Tier)
+	}
+	v.deleted = make(map[uint64]bool)
+	for _, offset := range v.tierInfo.Deleted {
+		v.deleted[offset] = true
+	}
+	v.counter = v.tierInfo.Files
+	v.deadBytes = v.tierInfo.DeadBytes
+	v.holders = v.tierInfo.Holders
+	if v.holders == nil {
+		v.holders = make(map[uint64]*Holders)
+	}
+	return v, nil
 }
 
 func (v *Volume) Num() uint32 {
@@ -157,6 +553,265 @@ func (v *Volume) Num() uint32 {
 
 func NewVolume(dirname string, collection string, id VolumeId) (v *Volume, e error) {
 	v = &Volume{dir: dirname, Collection: collection, Id: id}
+	v.clearMarks()
 	v.load()
+	v.Ttl = loadVolumeTtl(v.FileName())
+	if v.dataFile != nil {
+		e = v.loadMarks()
+	}
 	return
 }
+
+// clearMarks forgets what loadMarks rebuilds.
+func (v *Volume) clearMarks() {
+	v.counter = 0
+	v.deleted = make(map[uint64]bool)
+	v.deadBytes = 0
+	v.holders = make(map[uint64]*Holders)
+	v.applied = []map[uint64]uint64{make(map[uint64]uint64)}
+	v.starts = []int64{0}
+	v.hashes = nil
+}
+
+// DataSection returns the bytes of the data file from from to to, which
+// a checkpoint synced, for another replica to catch up with.
+func (v *Volume) DataSection(from int64, to int64) (io.Reader, error) {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.remote != nil {
+		return nil, fmt.Errorf("volume %s is on tier %s", v.Id.String(), v.remote.Name())
+	}
+	stat, err := v.dataFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if from < 0 || from > to || to > stat.Size() {
+		return nil, fmt.Errorf("volume %s has %d bytes, not %d to %d", v.Id.String(), stat.Size(), from, to)
+	}
+	return io.NewSectionReader(v.dataFile, from, to-from), nil
+}
+
+// AppendData appends the data section r of another replica to the data
+// file, which ends at from, and loads the marks again.
+func (v *Volume) AppendData(r io.Reader, from int64) error {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.readOnly {
+		return fmt.Errorf("%s is read-only", v.FileName())
+	}
+	stat, err := v.dataFile.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() != from {
+		return fmt.Errorf("volume %s has %d bytes, not %d", v.Id.String(), stat.Size(), from)
+	}
+	if _, err = v.dataFile.Seek(from, 0); err == nil {
+		_, err = io.Copy(v.dataFile, r)
+	}
+	if err == nil {
+		err = v.dataFile.Sync()
+	}
+	if err != nil {
+		v.dataFile.Truncate(from)
+		return err
+	}
+	v.clearMarks()
+	return v.loadMarks()
+}
+
+// walk calls visit with every record of the data file, in order: the
+// needle header, its offset in units of NeedlePaddingSize and what follows
+// the header, which for needles is only read with bodies and skipped
+// otherwise. A record cut short by a crash ends the walk, which returns
+// where the complete records end.
+func (v *Volume) walk(bodies bool, visit func(n *Needle, offset uint64, body []byte)) (int64, error) {
+	stat, err := v.dataFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := stat.Size()
+	sr := io.NewSectionReader(v.dataFile, 0, size)
+	r := bufio.NewReader(sr)
+	header := make([]byte, NeedleHeaderSize)
+	mark := make([]byte, markSize-NeedleHeaderSize)
+	var pos int64
+	for {
+		if _, err = io.ReadFull(r, header); err != nil {
+			break
+		}
+		n := new(Needle)
+		n.readNeedleHeader(header)
+		length := int64(len(mark))
+		if n.Size > 0 {
+			length = n.DiskSize() - NeedleHeaderSize
+		}
+		end := pos + NeedleHeaderSize + length
+		if end > size {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+		var body []byte
+		if n.Size == 0 {
+			body = mark
+		} else if bodies {
+			body = make([]byte, length)
+		}
+		if body != nil {
+			if _, err = io.ReadFull(r, body); err != nil {
+				break
+			}
+		} else if length <= int64(r.Buffered()) {
+			r.Discard(int(length))
+		} else {
+			if _, err = sr.Seek(end, io.SeekStart); err != nil {
+				break
+			}
+			r.Reset(sr)
+		}
+		visit(n, uint64(pos/NeedlePaddingSize), body)
+		pos = end
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return pos, nil
+	}
+	return pos, err
+}
+
+// loadMarks rebuilds the deleted needles, their holders and the applied
+// commands from the marks in the data file, and cuts off a record a crash
+// left half written so that the next one does not land behind it. Only
+// the commands since the oldest checkpoint kept are remembered.
+func (v *Volume) loadMarks() error {
+	if err := v.loadCheckpoints(); err != nil {
+		return err
+	}
+	stored := make(map[uint64]*Needle)
+	end, err := v.walk(false, func(n *Needle, offset uint64, body []byte) {
+		if n.Size > 0 {
+			stored[offset] = &Needle{Offset: offset, Size: n.Size, Cookie: n.Cookie}
+			v.counter++
+			return
+		}
+		s := stored[n.Offset]
+		if s == nil {
+			s = &Needle{Offset: n.Offset}
+		}
+		v.note(body[0], s, n.Cookie)
+		nonce := util.BytesToUint64(body[NeedlePaddingSize:])
+		if pos := int64(offset) * NeedlePaddingSize; nonce != 0 && pos >= v.starts[0] {
+			k := len(v.starts) - 1
+			for v.starts[k] > pos {
+				k--
+			}
+			v.applied[k][nonce] = n.Offset
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if stat, err := v.dataFile.Stat(); err == nil && stat.Size() > end && !v.readOnly {
+		return v.dataFile.Truncate(end)
+	}
+	return nil
+}
+
+// keptCheckpoints is how many checkpoints back the volume remembers the
+// commands it applied. The raft group of the volume snapshots at a
+// checkpoint, and until that snapshot is saved a restart replays the log
+// from the one before, which covers the commands since the checkpoint
+// before that.
+const keptCheckpoints = 3
+
+// Checkpoint syncs the data file and returns its size, for the raft group
+// of the volume to snapshot. The commands applied before the oldest of the
+// last keptCheckpoints checkpoints are forgotten, so that a replay of them
+// would write again. The checkpoints are kept in <volume>.cpt.
+func (v *Volume) Checkpoint() (int64, error) {
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.remote != nil {
+		return v.tierInfo.Size, nil
+	}
+	if !v.readOnly {
+		if err := v.dataFile.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	stat, err := v.dataFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	v.starts = append(v.starts, stat.Size())
+	v.applied = append(v.applied, make(map[uint64]uint64))
+	if k := len(v.starts) - keptCheckpoints; k > 0 {
+		v.starts, v.applied = v.starts[k:], v.applied[k:]
+	}
+	content, err := json.Marshal(v.starts)
+	if err != nil {
+		return 0, err
+	}
+	if err = ioutil.WriteFile(v.FileName()+".cpt.tmp", content, 0644); err != nil {
+		return 0, err
+	}
+	return stat.Size(), os.Rename(v.FileName()+".cpt.tmp", v.FileName()+".cpt")
+}
+
+func (v *Volume) loadCheckpoints() error {
+	content, err := ioutil.ReadFile(v.FileName() + ".cpt")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var starts []int64
+	if err = json.Unmarshal(content, &starts); err != nil || len(starts) == 0 {
+		return fmt.Errorf("bad checkpoints of volume %s: %v", v.Id.String(), err)
+	}
+	v.starts = starts
+	v.applied = make([]map[uint64]uint64, len(starts))
+	for k := range v.applied {
+		v.applied[k] = make(map[uint64]uint64)
+	}
+	return nil
+}
+
+// A volume created with a TTL only takes needles with that TTL, so the
+// whole volume can be dropped once its last write has expired. The TTL is
+// kept in <volume>.ttl.
+func NewTtlVolume(dirname string, collection string, id VolumeId, ttl TTL) (v *Volume, e error) {
+	if v, e = NewVolume(dirname, collection, id); e != nil || ttl.IsEmpty() {
+		return
+	}
+	v.Ttl = ttl
+	e = ioutil.WriteFile(v.FileName()+".ttl", []byte(ttl.String()), 0644)
+	return
+}
+
+func loadVolumeTtl(fileName string) TTL {
+	b, err := ioutil.ReadFile(fileName + ".ttl")
+	if err != nil {
+		return EmptyTTL
+	}
+	ttl, _ := ReadTTL(string(bytes.TrimSpace(b)))
+	return ttl
+}
+
+// Expired reports whether the volume has a TTL and nothing was written to
+// it for longer than that.
+func (v *Volume) Expired() bool {
+	if v.Ttl.IsEmpty() {
+		return false
+	}
+	v.accessLock.Lock()
+	defer v.accessLock.Unlock()
+	if v.dataFile == nil {
+		return false
+	}
+	stat, err := v.dataFile.Stat()
+	if err != nil {
+		return false
+	}
+	return time.Since(stat.ModTime()) > v.Ttl.Duration()
+}
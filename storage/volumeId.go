@@ -18,3 +18,9 @@ func (vid *VolumeId) String() string {
 func (vid *VolumeId) Next() VolumeId {
 	return VolumeId(uint32(*vid) + 1)
 }
+
+type VolumeIds []VolumeId
+
+func (ids VolumeIds) Len() int           { return len(ids) }
+func (ids VolumeIds) Less(i, j int) bool { return ids[i] < ids[j] }
+func (ids VolumeIds) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
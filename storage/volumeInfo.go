@@ -8,4 +8,6 @@ type VolumeInfo struct {
     DeleteCount int
     DeletedByteCount uint64
     ReadOnly bool
+    RemoteTier string
+    Ttl string
 }
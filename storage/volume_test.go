@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func writeNeedles(t *testing.T, v *Volume, count int) []*Needle {
+	var needles []*Needle
+	for i := 0; i < count; i++ {
+		data := []byte(fmt.Sprintf("needle %d", i))
+		n := &Needle{Cookie: uint32(100 + i), Data: data, Checksum: NewCRC(data)}
+		if _, err := v.Write(n); err != nil {
+			t.Fatal(err)
+		}
+		needles = append(needles, n)
+	}
+	return needles
+}
+
+func TestVolumeReloadKeepsDeletes(t *testing.T) {
+	tests := []struct {
+		name    string
+		deletes []int
+		garbage int // bytes of a record cut short by a crash
+	}{
+		{"no deletes", nil, 0},
+		{"one delete", []int{1}, 0},
+		{"every needle", []int{0, 1, 2}, 0},
+		{"torn tail", []int{2}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			v, err := NewVolume(dir, "", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			needles := writeNeedles(t, v, 3)
+			var dead uint64
+			for _, i := range tt.deletes {
+				if _, err = v.Delete(needles[i], 0); err != nil {
+					t.Fatal(err)
+				}
+				dead += uint64(needles[i].Size)
+			}
+			v.Close()
+			if tt.garbage > 0 {
+				f, err := os.OpenFile(v.FileName()+".dat", os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Write(make([]byte, tt.garbage))
+				f.Close()
+			}
+
+			v, err = NewVolume(dir, "", 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer v.Close()
+			if count, size := v.Deleted(); count != len(tt.deletes) || size != dead {
+				t.Errorf("Deleted() = %d, %d, want %d, %d", count, size, len(tt.deletes), dead)
+			}
+			if v.Num() != 3 {
+				t.Errorf("Num() = %d, want 3", v.Num())
+			}
+			deleted := make(map[int]bool)
+			for _, i := range tt.deletes {
+				deleted[i] = true
+			}
+			for i, n := range needles {
+				_, err := v.Read(&Needle{Offset: n.Offset, Size: n.Size, Cookie: n.Cookie})
+				if deleted[i] && err != ErrNeedleDeleted {
+					t.Errorf("Read(needle %d) = %v, want %v", i, err, ErrNeedleDeleted)
+				}
+				if !deleted[i] && err != nil {
+					t.Errorf("Read(needle %d) = %v", i, err)
+				}
+			}
+			if len(tt.deletes) > 0 {
+				if _, err = v.Delete(needles[tt.deletes[0]], 0); err != ErrNeedleDeleted {
+					t.Errorf("second Delete() = %v, want %v", err, ErrNeedleDeleted)
+				}
+			}
+		})
+	}
+}
+
+func TestVolumeReloadSkipsLargeNeedles(t *testing.T) {
+	dir := t.TempDir()
+	v, err := NewVolume(dir, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bodies longer than the read buffer are skipped by seeking past them.
+	data := bytes.Repeat([]byte("x"), 100*1024)
+	large := &Needle{Cookie: 1, Data: data, Checksum: NewCRC(data)}
+	if _, err = v.Write(large); err != nil {
+		t.Fatal(err)
+	}
+	small := writeNeedles(t, v, 2)
+	if _, err = v.Delete(small[0], 0); err != nil {
+		t.Fatal(err)
+	}
+	v.Close()
+
+	if v, err = NewVolume(dir, "", 1); err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if v.Num() != 3 {
+		t.Errorf("Num() = %d, want 3", v.Num())
+	}
+	if count, size := v.Deleted(); count != 1 || size != uint64(small[0].Size) {
+		t.Errorf("Deleted() = %d, %d, want 1, %d", count, size, small[0].Size)
+	}
+	if _, err = v.Read(&Needle{Offset: large.Offset, Size: large.Size, Cookie: large.Cookie}); err != nil {
+		t.Errorf("Read(large) = %v", err)
+	}
+}
+
+func TestCheckpointForgetsOldCommands(t *testing.T) {
+	dir := t.TempDir()
+	v, err := NewVolume(dir, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for nonce := uint64(1); nonce <= keptCheckpoints; nonce++ {
+		if _, err = v.WriteOnce(newNeedle(uint32(nonce), fmt.Sprint(nonce)), nonce); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = v.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(v.applied) != keptCheckpoints {
+		t.Errorf("%d checkpoints of applied commands kept, want %d", len(v.applied), keptCheckpoints)
+	}
+	// The commands since the oldest checkpoint kept are still recognised,
+	// after a restart too.
+	replay := func() {
+		size := v.Size()
+		for nonce := uint64(2); nonce <= keptCheckpoints; nonce++ {
+			if _, err = v.WriteOnce(newNeedle(uint32(nonce), fmt.Sprint(nonce)), nonce); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if v.Size() != size {
+			t.Error("a replayed command wrote again")
+		}
+	}
+	replay()
+	v.Close()
+	if v, err = NewVolume(dir, "", 1); err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	replay()
+
+	// The one before is forgotten.
+	size := v.Size()
+	if _, err = v.WriteOnce(newNeedle(1, "1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if v.Size() == size {
+		t.Error("a command before the oldest checkpoint was still recognised")
+	}
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JSON Web Tokens signed with HMAC-SHA256, granting access to one fid.
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+)
+
+type Claims struct {
+	Fid string `json:"fid"` // "vid,cookie"
+	Exp int64  `json:"exp"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func jwtSignature(key []byte, signed string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignToken returns a token for fid that expires after ttl.
+func SignToken(key []byte, fid string, ttl time.Duration) string {
+	payload, _ := json.Marshal(&Claims{Fid: fid, Exp: time.Now().Add(ttl).Unix()})
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + jwtSignature(key, signed)
+}
+
+// VerifyToken checks the signature and the expiry of token and returns
+// its claims.
+func VerifyToken(key []byte, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(jwtSignature(key, parts[0]+"."+parts[1]))) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	c := &Claims{}
+	if err = json.Unmarshal(payload, c); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() > c.Exp {
+		return nil, ErrExpiredToken
+	}
+	return c, nil
+}
+
+// RequestToken returns the bearer token of the Authorization header of
+// req, or its "jwt" parameter.
+func RequestToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return req.URL.Query().Get("jwt")
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Logs go through log/slog. Every HTTP request gets an id, which travels
+// between nodes in RequestIdHeader and within a node in the context of
+// the request.
+
+const RequestIdHeader = "X-Request-Id"
+
+// SetupLogging makes the default logger write records of level ("debug",
+// "info", "warn" or "error") and above to w, as JSON or as text.
+func SetupLogging(w io.Writer, level string, json bool) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	if json {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, opts)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, opts)))
+	}
+	return nil
+}
+
+// ValidLogLevel reports whether SetupLogging takes level.
+func ValidLogLevel(level string) bool {
+	var l slog.Level
+	return l.UnmarshalText([]byte(level)) == nil
+}
+
+func NewRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type requestIdKey struct{}
+
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestId returns the id of the request ctx belongs to, if any.
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// Logger returns the default logger, adding the request id of ctx to its
+// records.
+func Logger(ctx context.Context) *slog.Logger {
+	return RequestLogger(RequestId(ctx))
+}
+
+// RequestLogger is Logger for a request id carried by other means, such
+// as a raft command.
+func RequestLogger(id string) *slog.Logger {
+	if id == "" {
+		return slog.Default()
+	}
+	return slog.Default().With("request", id)
+}
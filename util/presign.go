@@ -0,0 +1,80 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Presigned URLs carry an expiry and an HMAC of the fid and the expiry,
+// made with one of a ring of named keys. URLs are signed with the first
+// key and accepted with any of them, so a key is rotated by putting a new
+// one first and dropping the old one once its URLs have expired.
+
+var (
+	ErrBadSignature     = errors.New("signature does not match")
+	ErrSignatureExpired = errors.New("URL expired")
+)
+
+type URLKey struct {
+	Id     string
+	Secret []byte
+}
+
+type KeyRing []URLKey
+
+// ParseKeyRing parses "id:secret,id:secret".
+func ParseKeyRing(s string) (KeyRing, error) {
+	var r KeyRing
+	for _, kv := range strings.Split(s, ",") {
+		i := strings.Index(kv, ":")
+		if i <= 0 || i == len(kv)-1 {
+			return nil, fmt.Errorf("invalid URL key %q, want id:secret", kv)
+		}
+		r = append(r, URLKey{Id: kv[:i], Secret: []byte(kv[i+1:])})
+	}
+	return r, nil
+}
+
+func urlSignature(secret []byte, fid string, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(fid + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the query parameters that open fid until expires.
+func (r KeyRing) Sign(fid string, expires time.Time) url.Values {
+	e := strconv.FormatInt(expires.Unix(), 10)
+	return url.Values{
+		"expires": {e},
+		"kid":     {r[0].Id},
+		"sig":     {urlSignature(r[0].Secret, fid, e)},
+	}
+}
+
+// Verify checks the parameters Sign added to q for fid.
+func (r KeyRing) Verify(fid string, q url.Values) error {
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	for _, k := range r {
+		if k.Id != q.Get("kid") {
+			continue
+		}
+		if !hmac.Equal([]byte(q.Get("sig")), []byte(urlSignature(k.Secret, fid, q.Get("expires")))) {
+			return ErrBadSignature
+		}
+		if time.Now().Unix() > expires {
+			return ErrSignatureExpired
+		}
+		return nil
+	}
+	return ErrBadSignature
+}
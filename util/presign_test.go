@@ -0,0 +1,71 @@
+package util
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestKeyRingVerify(t *testing.T) {
+	old := KeyRing{{Id: "k1", Secret: []byte("one")}}
+	rotated := KeyRing{{Id: "k2", Secret: []byte("two")}, {Id: "k1", Secret: []byte("one")}}
+	dropped := KeyRing{{Id: "k2", Secret: []byte("two")}}
+	later := time.Now().Add(time.Hour)
+	tampered := rotated.Sign("3,1/2/3", later)
+	tampered.Set("expires", "9999999999")
+	tests := []struct {
+		name  string
+		ring  KeyRing
+		fid   string
+		query url.Values
+		want  error
+	}{
+		{"signed with the first key", rotated, "3,1/2/3", rotated.Sign("3,1/2/3", later), nil},
+		{"signed before the rotation", rotated, "3,1/2/3", old.Sign("3,1/2/3", later), nil},
+		{"old key dropped", dropped, "3,1/2/3", old.Sign("3,1/2/3", later), ErrBadSignature},
+		{"expired", rotated, "3,1/2/3", rotated.Sign("3,1/2/3", time.Now().Add(-time.Second)), ErrSignatureExpired},
+		{"other fid", rotated, "3,1/2/4", rotated.Sign("3,1/2/3", later), ErrBadSignature},
+		{"expiry moved", rotated, "3,1/2/3", tampered, ErrBadSignature},
+		{"unsigned", rotated, "3,1/2/3", url.Values{}, ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.ring.Verify(tt.fid, tt.query); err != tt.want {
+				t.Errorf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKeyRing(t *testing.T) {
+	tests := []struct {
+		in    string
+		ids   []string
+		valid bool
+	}{
+		{"k1:secret", []string{"k1"}, true},
+		{"k2:two,k1:one", []string{"k2", "k1"}, true},
+		{"k1:a:b", []string{"k1"}, true},
+		{"", nil, false},
+		{"k1", nil, false},
+		{":secret", nil, false},
+		{"k1:", nil, false},
+		{"k1:one,", nil, false},
+	}
+	for _, tt := range tests {
+		r, err := ParseKeyRing(tt.in)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseKeyRing(%q) = %v, want valid %v", tt.in, err, tt.valid)
+			continue
+		}
+		if len(r) != len(tt.ids) {
+			t.Errorf("ParseKeyRing(%q) has %d keys, want %d", tt.in, len(r), len(tt.ids))
+			continue
+		}
+		for i, id := range tt.ids {
+			if r[i].Id != id {
+				t.Errorf("ParseKeyRing(%q)[%d] = %s, want %s", tt.in, i, r[i].Id, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package util
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// SecretHeader carries the shared secret of a cluster on the requests
+// between its nodes.
+const SecretHeader = "X-Mcdfs-Secret"
+
+// SecretTransport adds Secret to the requests it sends through Base, or
+// through http.DefaultTransport when Base is nil.
+type SecretTransport struct {
+	Secret string
+	Base   http.RoundTripper
+}
+
+func (t *SecretTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.Secret == "" {
+		return base.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set(SecretHeader, t.Secret)
+	return base.RoundTrip(r)
+}
+
+// HasSecret reports whether req presents secret. Every request does when
+// secret is empty.
+func HasSecret(req *http.Request, secret string) bool {
+	if secret == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(req.Header.Get(SecretHeader)), []byte(secret)) == 1
+}
+
+// ClientKeyHeader carries the key of a client of a cluster.
+const ClientKeyHeader = "X-Mcdfs-Key"
+
+// HasClientKey reports whether req presents one of keys.
+func HasClientKey(req *http.Request, keys []string) bool {
+	key := req.Header.Get(ClientKeyHeader)
+	if key == "" {
+		return false
+	}
+	found := false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
@@ -0,0 +1,153 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, used to talk to S3-compatible object stores and
+// to authenticate S3 clients.
+
+const (
+	SigV4Algorithm    = "AWS4-HMAC-SHA256"
+	SigV4TimeFormat   = "20060102T150405Z"
+	SigV4DateFormat   = "20060102"
+	UnsignedPayload   = "UNSIGNED-PAYLOAD"
+	EmptyPayloadHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzContentSha256  = "X-Amz-Content-Sha256"
+	amzDate           = "X-Amz-Date"
+	authorizationName = "Authorization"
+)
+
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+	Region    string
+	Service   string
+}
+
+func (c Credentials) Scope(date string) string {
+	return date + "/" + c.Region + "/" + c.Service + "/aws4_request"
+}
+
+// SignV4 signs req with the host and x-amz-* headers.
+func SignV4(req *http.Request, payloadHash string, c Credentials, t time.Time) {
+	now := t.UTC().Format(SigV4TimeFormat)
+	req.Header.Set(amzDate, now)
+	req.Header.Set(amzContentSha256, payloadHash)
+	signed := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			signed = append(signed, lower)
+		}
+	}
+	sort.Strings(signed)
+	signature := SignatureV4(req, signed, payloadHash, c, now)
+	req.Header.Set(authorizationName, fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		SigV4Algorithm, c.AccessKey, c.Scope(now[:8]), strings.Join(signed, ";"), signature))
+}
+
+// SignatureV4 computes the signature of req over the given headers at
+// amzTime (in SigV4TimeFormat).
+func SignatureV4(req *http.Request, signedHeaders []string, payloadHash string, c Credentials, amzTime string) string {
+	canonical := CanonicalRequest(req, signedHeaders, payloadHash)
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{
+		SigV4Algorithm,
+		amzTime,
+		c.Scope(amzTime[:8]),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+	return hex.EncodeToString(hmacSha256(SigningKey(c, amzTime[:8]), stringToSign))
+}
+
+// SigningKey derives the key signatures of date (in SigV4DateFormat) are
+// made with.
+func SigningKey(c Credentials, date string) []byte {
+	key := hmacSha256([]byte("AWS4"+c.SecretKey), date)
+	key = hmacSha256(key, c.Region)
+	key = hmacSha256(key, c.Service)
+	return hmacSha256(key, "aws4_request")
+}
+
+// ChunkSignatureV4 signs a chunk of an aws-chunked payload, chained to the
+// signature of the previous chunk (the seed signature for the first one).
+func ChunkSignatureV4(c Credentials, amzTime string, previous string, chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	stringToSign := strings.Join([]string{
+		SigV4Algorithm + "-PAYLOAD",
+		amzTime,
+		c.Scope(amzTime[:8]),
+		previous,
+		EmptyPayloadHash,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+	return hex.EncodeToString(hmacSha256(SigningKey(c, amzTime[:8]), stringToSign))
+}
+
+func CanonicalRequest(req *http.Request, signedHeaders []string, payloadHash string) string {
+	var headers []string
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+		headers = append(headers, name+":"+strings.Join(strings.Fields(value), " ")+"\n")
+	}
+	return strings.Join([]string{
+		req.Method,
+		UriEncode(req.URL.Path, false),
+		canonicalQuery(req),
+		strings.Join(headers, ""),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func canonicalQuery(req *http.Request) string {
+	var pairs []string
+	for key, values := range req.URL.Query() {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, UriEncode(key, true)+"="+UriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// UriEncode escapes everything but the unreserved characters, and slashes
+// unless encodeSlash is set.
+func UriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,159 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often a CertReloader looks for new files.
+const certCheckInterval = 10 * time.Second
+
+// CertReloader holds a certificate and an optional CA loaded from PEM
+// files, and loads them again when the files change, so certificates can
+// be renewed without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTime  time.Time
+	checked  time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string, caFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.load(); err != nil {
+		return nil, err
+	}
+	r.modTime, r.checked = modTime, time.Now()
+	return r, nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile, r.caFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *CertReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate in %s", r.caFile)
+		}
+	}
+	r.cert, r.pool = &cert, pool
+	return nil
+}
+
+// current returns the certificate and the CA, first loading them again if
+// the files changed. A failed reload keeps the previous ones.
+func (r *CertReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		if modTime, err := r.latestModTime(); err == nil && modTime.After(r.modTime) {
+			if err = r.load(); err != nil {
+				slog.Error("cannot reload certificate, keeping the previous one", "cert", r.certFile, "err", err)
+			} else {
+				r.modTime = modTime
+			}
+		}
+	}
+	return r.cert, r.pool
+}
+
+// HasCA reports whether peers must present certificates signed by a CA.
+func (r *CertReloader) HasCA() bool {
+	return r.caFile != ""
+}
+
+// ServerConfig serves the certificate and, with a CA, verifies the client
+// certificates that are presented. The port is shared by clients, which
+// may connect without one, and nodes, so a handler for nodes only must
+// check that the connection has a verified chain: a certificate the CA
+// did not sign fails the handshake, but no certificate leaves the chains
+// empty.
+func (r *CertReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			c := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*cert}}
+			if pool != nil {
+				c.ClientCAs = pool
+				c.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return c, nil
+		},
+	}
+}
+
+// ClientConfig presents the certificate to servers and, with a CA,
+// verifies them against it instead of the system roots.
+func (r *CertReloader) ClientConfig() *tls.Config {
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+	if r.caFile == "" {
+		return c
+	}
+	// The CA may change, so the chain is verified here rather than
+	// against a fixed RootCAs.
+	c.InsecureSkipVerify = true
+	c.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("tls: no server certificate")
+		}
+		_, pool := r.current()
+		opts := x509.VerifyOptions{Roots: pool, DNSName: cs.ServerName, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	return c
+}
@@ -0,0 +1,200 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for 127.0.0.1 signed by ca, its key and the
+// CA to dir, and returns their file names.
+func (ca *testCA) issue(t *testing.T, dir string, serial int64) (string, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile, caFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"), filepath.Join(dir, "ca.crt")
+	write := func(name string, content []byte) {
+		if err := ioutil.WriteFile(name, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	write(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	write(caFile, ca.pem)
+	return certFile, keyFile, caFile
+}
+
+func newTestReloader(t *testing.T, ca *testCA, serial int64) *CertReloader {
+	certFile, keyFile, caFile := ca.issue(t, t.TempDir(), serial)
+	r, err := NewCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// startTLSServer answers 401 to the connections without a verified chain.
+func startTLSServer(t *testing.T, r *CertReloader) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.VerifiedChains) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	srv.TLS = r.ServerConfig()
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, other := newTestCA(t, "cluster"), newTestCA(t, "other")
+	srv := startTLSServer(t, newTestReloader(t, ca, 2))
+	tests := []struct {
+		name      string
+		config    *tls.Config
+		handshake bool
+		verified  bool
+	}{
+		{"certificate signed by the CA", newTestReloader(t, ca, 3).ClientConfig(), true, true},
+		{"certificate of another CA", newTestReloader(t, other, 3).ClientConfig(), false, false},
+		{"no certificate", &tls.Config{RootCAs: x509PoolOf(ca.cert)}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: tt.config}}
+			resp, err := c.Get(srv.URL)
+			if !tt.handshake {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("the handshake succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if verified := resp.StatusCode == http.StatusOK; verified != tt.verified {
+				t.Errorf("verified chain = %v, want %v", verified, tt.verified)
+			}
+		})
+	}
+}
+
+func TestClientRejectsUntrustedServer(t *testing.T) {
+	ca, other := newTestCA(t, "cluster"), newTestCA(t, "other")
+	srv := startTLSServer(t, newTestReloader(t, other, 2))
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: newTestReloader(t, ca, 3).ClientConfig()}}
+	if resp, err := c.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("connected to a server the CA did not sign")
+	}
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	ca := newTestCA(t, "cluster")
+	dir := t.TempDir()
+	certFile, keyFile, caFile := ca.issue(t, dir, 2)
+	r, err := NewCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := r.current()
+
+	// The renewed files replace the old ones in place.
+	ca.issue(t, dir, 3)
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{certFile, keyFile} {
+		if err = os.Chtimes(name, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cert, _ := r.current(); cert != before {
+		t.Error("the files were loaded again before the check interval")
+	}
+	r.checked = time.Time{}
+	after, _ := r.current()
+	leaf, err := x509.ParseCertificate(after.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.SerialNumber.Int64() != 3 {
+		t.Errorf("serving certificate %d after the reload, want 3", leaf.SerialNumber.Int64())
+	}
+
+	// A broken file keeps the previous certificate.
+	if err = ioutil.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	r.checked = time.Time{}
+	if cert, _ := r.current(); cert != after {
+		t.Error("a broken certificate file replaced the certificate")
+	}
+}
+
+func x509PoolOf(cert *x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool
+}